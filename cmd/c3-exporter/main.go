@@ -9,11 +9,13 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
 
 	"github.com/circonus/c3-exporter/internal/config"
+	"github.com/circonus/c3-exporter/internal/logger"
 	"github.com/circonus/c3-exporter/internal/release"
 	"github.com/circonus/c3-exporter/internal/server"
 	"github.com/rs/zerolog"
@@ -24,8 +26,11 @@ import (
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
-	cfgFile := flag.String("config", "c3-exporter.yaml", "c3 exporter configuration file")
+	cfgFile := flag.String("config", "c3-exporter.yaml", "c3 exporter configuration file ('-' for stdin or an http(s) url)")
+	strictConfig := flag.Bool("strict-config", false, "treat unknown config keys as errors")
+	checkConfig := flag.Bool("check-config", false, "validate the config, print a summary and exit")
 	debug := flag.Bool("debug", false, "sets log level to debug")
+	logVersion := flag.Bool("log-version", false, "add version and commit to every log line")
 	version := flag.Bool("version", false, "show version and exit")
 	flag.Parse()
 
@@ -38,20 +43,30 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *logVersion {
+		log.Logger = logger.WithVersion(log.Logger, release.Version, release.Commit)
+	}
+
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	if *debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 		log.Debug().Msg("debug enabled")
 	}
 
-	cfg, err := config.Load(*cfgFile)
+	if *checkConfig {
+		os.Exit(checkConfigFile(*cfgFile, *strictConfig))
+	}
+
+	cfg, err := config.Load(*cfgFile, *strictConfig)
 	if err != nil {
 		log.Fatal().Err(err).Msg("loading config")
 	}
 	cfg.Debug = *debug
 
+	logger.SetFieldNames(cfg.Log.Fields.Message, cfg.Log.Fields.Level, cfg.Log.Fields.Time)
+
 	signalCh := make(chan os.Signal, 10)
-	signal.Notify(signalCh, os.Interrupt, unix.SIGTERM, unix.SIGHUP, unix.SIGPIPE, unix.SIGTRAP)
+	signal.Notify(signalCh, os.Interrupt, unix.SIGTERM, unix.SIGHUP, unix.SIGUSR1, unix.SIGPIPE, unix.SIGTRAP)
 
 	svr, err := server.New(cfg)
 	if err != nil {
@@ -61,6 +76,9 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	go handleSignals(ctx, signalCh, svr)
+	if cfg.Server.WatchConfig {
+		go svr.WatchConfig(ctx, *cfgFile, cfg.Server.WatchConfigDebounce)
+	}
 
 	log.Info().
 		Str("name", release.NAME).
@@ -75,6 +93,29 @@ func main() {
 	}
 }
 
+// checkConfigFile loads (and so validates) the config w/o starting the server
+// or contacting circonus, printing a summary, and returns the exit code.
+func checkConfigFile(file string, strict bool) int {
+	cfg, err := config.Load(file, strict)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config %s: %s\n", file, err)
+		return 1
+	}
+
+	tls := "off"
+	if cfg.Server.CertFile != "" && cfg.Server.KeyFile != "" {
+		tls = "on"
+	}
+	fmt.Printf("config %s: ok\n", file)
+	fmt.Printf("  listen:      %s (tls %s)\n", cfg.Server.Address, tls)
+	fmt.Printf("  destination: %s (tls %t)\n", net.JoinHostPort(cfg.Destination.Host, cfg.Destination.Port), cfg.Destination.EnableTLS)
+	if cfg.Destination.Failover != nil {
+		fmt.Printf("  failover:    %s (tls %t)\n", net.JoinHostPort(cfg.Destination.Failover.Host, cfg.Destination.Failover.Port), cfg.Destination.Failover.EnableTLS)
+	}
+	fmt.Printf("  circonus:    %s (flush %s)\n", cfg.Circonus.APIURL, cfg.Circonus.FlushInterval)
+	return 0
+}
+
 func handleSignals(ctx context.Context, signalCh chan os.Signal, s *server.Server) {
 	const stacktraceBufSize = 1024 * 1024
 
@@ -91,7 +132,11 @@ func handleSignals(ctx context.Context, signalCh chan os.Signal, s *server.Serve
 					log.Error().Err(err).Msg("stopping server")
 				}
 				return
-			case unix.SIGPIPE, unix.SIGHUP:
+			case unix.SIGHUP:
+				s.Reload()
+			case unix.SIGUSR1:
+				s.ReloadAccounts()
+			case unix.SIGPIPE:
 				// Noop
 			case unix.SIGTRAP:
 				stacklen := runtime.Stack(buf, true)
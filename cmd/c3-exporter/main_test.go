@@ -0,0 +1,47 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckConfigFile(t *testing.T) {
+	const valid = `version: 1
+destination:
+  host: localhost
+  port: "9200"
+circonus:
+  api_key: c3e-test-token
+`
+	tests := []struct {
+		name   string
+		doc    string
+		strict bool
+		want   int
+	}{
+		{"valid", valid, false, 0},
+		{"valid strict", valid, true, 0},
+		{"unknown key", valid + "unknown: 1\n", false, 0},
+		{"unknown key strict", valid + "unknown: 1\n", true, 1},
+		{"invalid yaml", valid + "destination: [\n", false, 1},
+		{"invalid setting", valid + "server:\n  handler_timeouts:\n    _bulk: 1s\n", false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "c3-exporter.yaml")
+			if err := os.WriteFile(file, []byte(tt.doc), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if got := checkConfigFile(file, tt.strict); got != tt.want {
+				t.Errorf("exit code %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
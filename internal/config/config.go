@@ -6,77 +6,407 @@
 package config
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
 )
 
+const configFetchTimeout = 30 * time.Second
+
+var validBrokerCID = regexp.MustCompile(`^/broker/[0-9]+$`)
+
+// defaultPathTagRules collapse uuids and numbers (e.g. rolling index
+// suffixes) in paths used as metric tags.
+var defaultPathTagRules = []PathTagRule{
+	{Pattern: `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`, Replacement: "{uuid}"},
+	{Pattern: `[0-9]{2,}`, Replacement: "{n}"},
+}
+
 type Config struct {
+	Version     int         `yaml:"version"`
 	Server      Server      `yaml:"server"`
 	Destination Destination `yaml:"destination"`
 	Circonus    Circonus    `yaml:"circonus"`
+	Metrics     Metrics     `yaml:"metrics"`
+	Log         Log         `yaml:"log"`
 	Debug       bool
 }
 
+// Metrics holds additional destinations for the exporter's own metrics,
+// which are always sent to circonus.
+type Metrics struct {
+	OTLP OTLP `yaml:"otlp"`
+}
+
+// OTLP pushes the exporter's metrics, with each flush, to an OpenTelemetry
+// collector (OTLP/HTTP, protobuf encoded).
+type OTLP struct {
+	Headers  map[string]string `yaml:"headers"`  // e.g. authorization
+	Endpoint string            `yaml:"endpoint"` // e.g. http://localhost:4318, empty disables
+}
+
+// Log holds settings for the exporter's own (json) logs.
+type Log struct {
+	Fields LogFields `yaml:"fields"`
+}
+
+// LogFields rename the standard log fields, e.g. to fit an existing schema,
+// empty keeps the default (message, level, time).
+type LogFields struct {
+	Message string `yaml:"message"`
+	Level   string `yaml:"level"`
+	Time    string `yaml:"time"`
+}
+
 type Destination struct {
-	TLSConfig  *tls.Config
-	Host       string `yaml:"host"`
-	Port       string `yaml:"port"`
-	CAFile     string `yaml:"ca_file"`
-	SkipVerify bool   `yaml:"tls_skip_verify"`
-	EnableTLS  bool   `yaml:"enable_tls"`
+	TLSConfig           *tls.Config   `yaml:"-"`
+	Host                string        `yaml:"host"`
+	Port                string        `yaml:"port"`
+	Name                string        `yaml:"name"` // destination metric tag, default host
+	CAFile              string        `yaml:"ca_file"`
+	NoRetryStatus       []int         `yaml:"no_retry_status"` // status codes which are passed through w/o retrying
+	Failover            *Endpoint     `yaml:"failover"`        // used when the destination fails after retries
+	Shadow              *Endpoint     `yaml:"shadow"`          // receives a copy of _bulk writes, best-effort
+	ForceClose          *bool         `yaml:"force_close"`     // true, close upstream connections after each request
+	CompatHeaders       CompatHeaders `yaml:"compat_headers"`
+	AllowedHosts        []string      `yaml:"allowed_hosts"` // hosts, ips or cidrs which may be forwarded to
+	ProxyURL            string        `yaml:"proxy_url"`     // proxy for destination requests, overrides env
+	UseEnvProxy         *bool         `yaml:"use_env_proxy"` // true, use HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+	PreserveHost        bool          `yaml:"preserve_host"` // forward the client's Host rather than the destination host
+	RetryRate           float64       `yaml:"retry_rate"`    // retries per second, across all requests, 0 is unlimited
+	RetryBurst          int           `yaml:"retry_burst"`   // retries allowed at once, default retry_rate (rounded up)
+	RetryBudgetDuration string        `yaml:"retry_budget"`  // max total wait between retries per request, empty is unlimited
+	RetryBudget         time.Duration `yaml:"-"`
+	AllowedHostnames    []string      `yaml:"-"`
+	AllowedNets         []*net.IPNet  `yaml:"-"`
+	TLSSessionCacheSize int           `yaml:"tls_session_cache_size"` // 64, per destination/failover
+	SkipVerify          bool          `yaml:"tls_skip_verify"`
+	EnableTLS           bool          `yaml:"enable_tls"`
+	// path prefix, by account, for forwarded requests (path based multi-tenant destinations)
+	TenantPrefixes map[string]string `yaml:"tenant_prefixes"`
+	// retrying of _bulk requests and of other requests, separately
+	BulkRetry Retry `yaml:"bulk_retry"`
+	Retry     Retry `yaml:"retry"`
+	// lower the gzip level used for forwarded bodies when cpu is busy
+	AdaptiveCompression bool `yaml:"adaptive_compression"`
+	// query parameters (e.g. pipeline) set on forwarded _bulk requests
+	QueryParams map[string]string `yaml:"query_params"`
+	// compression of forwarded bodies, gzip|zstd|none
+	CompressionAlgo string `yaml:"compression_algo"`
+	// bodies smaller than this are forwarded uncompressed, 0 compresses all
+	CompressMinBytes int `yaml:"compress_min_bytes"`
+	// paths whose bodies are compressed (empty, all) and paths whose bodies
+	// are not, exact or prefix when ending in '/'
+	CompressPaths   []string `yaml:"compress_paths"`
+	NoCompressPaths []string `yaml:"no_compress_paths"`
+	// classes of request errors retried (refused, reset, timeout, dns, tls,
+	// other), by default all but tls
+	RetryErrors []string `yaml:"retry_errors"`
+	// level of per-attempt retry logs, debug|info, outcomes are logged at info
+	RetryLogLevel string `yaml:"retry_log_level"`
+	// sign forwarded requests w/AWS SigV4 (managed OpenSearch)
+	AWSSigV4 *AWSSigV4 `yaml:"aws_sigv4"`
+	// set X-Forwarded-Proto and X-Forwarded-Host on forwarded requests
+	AddForwardedHeaders bool `yaml:"add_forwarded_headers"`
+	// set X-Client-Cert-Subject, X-Client-Cert-Issuer and
+	// X-Client-Cert-Fingerprint, from the verified client certificate
+	// (server.client_ca_file), on forwarded requests
+	ForwardClientCert bool `yaml:"forward_client_cert"`
+	// separate node pools for reads (GET/HEAD, searches) and writes (_bulk,
+	// other PUT/POST/DELETE), otherwise the destination is used for both
+	ReadDestination  *Endpoint `yaml:"read_destination"`
+	WriteDestination *Endpoint `yaml:"write_destination"`
+}
+
+// Retry configures retrying failed requests to the destination, waiting
+// between wait_min and wait_max (exponential backoff) between attempts.
+type Retry struct {
+	Max             *int          `yaml:"max"`      // 7, retries after the first attempt
+	WaitMinDuration string        `yaml:"wait_min"` // 2 seconds
+	WaitMaxDuration string        `yaml:"wait_max"` // 10 seconds
+	WaitMin         time.Duration `yaml:"-"`
+	WaitMax         time.Duration `yaml:"-"`
+}
+
+// CompatHeaders are set on forwarded requests and on responses to clients,
+// for clients which expect e.g. X-Elastic-Product or a compatibility Accept.
+type CompatHeaders struct {
+	Request  map[string]string `yaml:"request"`
+	Response map[string]string `yaml:"response"`
+}
+
+// AWSSigV4 configures signing forwarded requests for AWS managed OpenSearch.
+// Credentials are read from the environment (AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN) or set in the config (static).
+type AWSSigV4 struct {
+	Region          string `yaml:"region"`            // AWS_REGION when empty
+	Service         string `yaml:"service"`           // es (default) or aoss (serverless)
+	Credentials     string `yaml:"credentials"`       // env|static
+	AccessKeyID     string `yaml:"access_key_id"`     // static credentials
+	SecretAccessKey string `yaml:"secret_access_key"` // static credentials
+	SessionToken    string `yaml:"session_token"`     // static credentials, optional
+}
+
+// Endpoint is an additional upstream, with the same connection settings as
+// the destination.
+type Endpoint struct {
+	TLSConfig  *tls.Config `yaml:"-"`
+	Host       string      `yaml:"host"`
+	Port       string      `yaml:"port"`
+	Name       string      `yaml:"name"`
+	CAFile     string      `yaml:"ca_file"`
+	SkipVerify bool        `yaml:"tls_skip_verify"`
+	EnableTLS  bool        `yaml:"enable_tls"`
 }
 
 type Server struct {
 	Address           string `yaml:"listen_address"`      // :19200
+	AdminAddress      string `yaml:"admin_address"`       // empty means no admin listener
 	CertFile          string `yaml:"cert_file"`           // empty means no tls
 	KeyFile           string `yaml:"key_file"`            // empty means no tls
+	ClientCAFile      string `yaml:"client_ca_file"`      // require client certs signed by these CAs (tls only)
+	ClientCertAccount bool   `yaml:"client_cert_account"` // account from the client cert subject rather than basic auth
 	ReadTimeout       string `yaml:"read_timeout"`        // 60 second
 	WriteTimeout      string `yaml:"write_timeout"`       // 60 second
 	IdleTimeout       string `yaml:"idle_timeout"`        // 30 seconds
 	ReadHeaderTimeout string `yaml:"read_header_timeout"` // 5 seconds
 	HandlerTimeout    string `yaml:"handler_timeout"`     // 30 seconds
+	HealthFormat      string `yaml:"health_format"`       // plain|json
+	EmptyBody         string `yaml:"empty_body"`          // forward|reject, POST/PUT w/o a body
+	AccessLogFormat   string `yaml:"access_log_format"`   // json|combined, format of per-request logs
+	DebugBodies       int    `yaml:"debug_bodies"`        // bytes of req/resp bodies to log w/debug, 0 disables
+	StatsEndpoint     bool   `yaml:"stats_endpoint"`      // serve /stats (requires basic auth)
+	ValidateBulk      bool   `yaml:"validate_bulk"`       // reject malformed _bulk ndjson w/400 rather than forwarding it
+	ForwardTrailers   bool   `yaml:"forward_trailers"`    // relay destination response trailers to clients
+	ResponseGzip      bool   `yaml:"response_gzip"`       // gzip responses to clients accepting it
+	RequestIDHeader   string `yaml:"request_id_header"`   // inbound header (e.g. X-Request-ID) used as req_id when present
+	BulkDocs          bool   `yaml:"bulk_docs"`           // count _bulk action lines (bulk_docs metric)
+	MaxHeaderBytes    int    `yaml:"max_header_bytes"`    // 1048576
+	MaxConnsPerIP     int    `yaml:"max_conns_per_ip"`    // concurrent requests per client ip, 0 is unlimited
+	ListenBacklog     int    `yaml:"listen_backlog"`      // pending connection queue length, 0 is the system default
+	ReusePort         bool   `yaml:"reuseport"`           // SO_REUSEPORT, multiple processes listening on one port
+	DisableKeepAlives bool   `yaml:"disable_keepalives"`  // close client connections after each response
+	CopyBufferSize    int    `yaml:"copy_buffer_size"`    // 32768, buffer used to copy request/response bodies
+	BufferResponses   int    `yaml:"buffer_responses"`    // responses up to this size are buffered rather than streamed, 0 streams all
+	Spool             Spool  `yaml:"spool"`
+	Async             Async  `yaml:"async"`
+	Cache             Cache  `yaml:"cache"`
+	Idempotency       Cache  `yaml:"idempotency"`
+	// requests slower than this are logged as warnings, others at debug,
+	// empty logs all requests at info
+	SlowRequestThreshold string        `yaml:"slow_request_threshold"`
+	SlowRequest          time.Duration `yaml:"-"`
+	// PUTs to these paths (exact, or prefix when ending in '/') get a
+	// synthetic success and are not forwarded, for pre-provisioned clusters
+	StubProvisioningPaths []string `yaml:"stub_provisioning_paths"`
+	// routes (exact, or prefix when ending in '/') not served, requests for
+	// them (and paths under them) get a 404
+	DisabledRoutes []string `yaml:"disabled_routes"`
+	// paths (exact, or prefix when ending in '/') served w/o requiring basic
+	// auth (as auth_mode optional), and paths requiring it which otherwise
+	// would not (e.g. /health)
+	PublicPaths    []string `yaml:"public_paths"`
+	ProtectedPaths []string `yaml:"protected_paths"`
+	// rules applied, in order, to request paths used as metric tags
+	PathTagRules []PathTagRule `yaml:"path_tag_rules"`
+	// headers removed from responses before they are returned to clients
+	StripResponseHeaders []string `yaml:"strip_response_headers"`
+	// transformations applied to successful responses, by path, before they
+	// are returned to clients
+	ResponseTransforms []ResponseTransform `yaml:"response_transforms"`
+	// destination response status codes replaced (from: to) in responses to clients
+	StatusRemap map[int]int `yaml:"status_remap"`
+	// timeouts by route (e.g. /_bulk), overriding handler_timeout
+	HandlerTimeouts map[string]string        `yaml:"handler_timeouts"`
+	RouteTimeouts   map[string]time.Duration `yaml:"-"`
+	// proxies (ips or cidrs) whose X-Forwarded-For/X-Real-IP headers are honored
+	TrustedProxies []string     `yaml:"trusted_proxies"`
+	TrustedNets    []*net.IPNet `yaml:"-"`
+	// file listing the accounts (one per line) allowed to send requests,
+	// re-read when it changes, empty allows all accounts
+	AllowedAccountsFile           string        `yaml:"allowed_accounts_file"`
+	AllowedAccountsReloadDuration string        `yaml:"allowed_accounts_reload"` // 30s, how often the file is checked for changes
+	AllowedAccountsReload         time.Duration `yaml:"-"`
+	// requests w/o basic auth: require (401), optional (circonus
+	// default_account) or anonymous (all requests are the default account's,
+	// credentials are ignored)
+	AuthMode      string `yaml:"auth_mode"`
+	AuthChallenge *bool  `yaml:"auth_challenge"` // true, 401s include WWW-Authenticate (browser prompt)
+	// watch the config file, re-reading the tls files (as on SIGHUP) once it
+	// has changed and then been unchanged for watch_config_debounce (config
+	// file only, other settings are not reloaded)
+	WatchConfig                 bool          `yaml:"watch_config"`
+	WatchConfigDebounceDuration string        `yaml:"watch_config_debounce"` // 5s
+	WatchConfigDebounce         time.Duration `yaml:"-"`
+	// requests (other than /health) handled concurrently, further requests
+	// wait for a slot, at most write_timeout (503), 0 is unlimited
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests"`
+	// tags, sent by clients in a header, added to the metrics of a request
+	RequestTags RequestTags `yaml:"request_tags"`
+	// warn when the server certificate (cert_file) expires within this
+	// window, 0 disables the warning
+	CertExpiryWarningDuration string        `yaml:"cert_expiry_warning"` // 720h (30 days)
+	CertExpiryWarning         time.Duration `yaml:"-"`
+}
+
+// RequestTags lets clients attribute requests by sending tags in a header,
+// e.g. "X-C3E-Tags: env:prod,team:search". Only tags in the listed
+// categories are added, bounding cardinality, none disables request tags.
+type RequestTags struct {
+	Header     string   `yaml:"header"` // X-C3E-Tags
+	Categories []string `yaml:"categories"`
+}
+
+// PathTagRule replaces matches of pattern (a regular expression) in a
+// request path used as a metric tag.
+type PathTagRule struct {
+	Regexp      *regexp.Regexp `yaml:"-"`
+	Pattern     string         `yaml:"pattern"`
+	Replacement string         `yaml:"replacement"`
+}
+
+// ResponseTransform transforms the json responses to requests for path
+// (exact, or prefix when ending in '/'), removing strip_fields, dotted paths
+// into the response (e.g. hits.hits._source.events), arrays are descended
+// into.
+type ResponseTransform struct {
+	Path        string   `yaml:"path"`
+	StripFields []string `yaml:"strip_fields"`
+}
+
+// Async accepts bulk requests into a bounded queue, responding 202, while
+// workers forward them to the destination.
+type Async struct {
+	Workers   int  `yaml:"workers"`    // 4
+	QueueSize int  `yaml:"queue_size"` // 1000
+	Enabled   bool `yaml:"enabled"`
+}
+
+// Cache holds responses in memory, per account, for a short time. As cache,
+// successful GET responses (e.g. cluster settings, templates), as
+// idempotency, bulk responses by Idempotency-Key.
+type Cache struct {
+	TTLDuration string        `yaml:"ttl"` // 10 seconds (cache), 5 minutes (idempotency)
+	TTL         time.Duration `yaml:"-"`
+	MaxEntries  int           `yaml:"max_entries"` // 1000 (cache), 10000 (idempotency)
+	Enabled     bool          `yaml:"enabled"`
+}
+
+// Spool persists bulk requests which could not be forwarded, to be re-sent
+// in the background.
+type Spool struct {
+	Dir           string        `yaml:"dir"`
+	RetryDuration string        `yaml:"retry_interval"` // 30 seconds
+	RetryInterval time.Duration `yaml:"-"`
+	MaxSize       int64         `yaml:"max_size"` // bytes, 0 is unlimited
+	Enabled       bool          `yaml:"enabled"`
 }
 
 type Circonus struct {
-	APIKey        string `yaml:"api_key"`
-	APIURL        string `yaml:"api_url"`
-	CheckTarget   string `yaml:"check_target"`
-	FlushDuration string `yaml:"flush_interval"`
-	FlushInterval time.Duration
+	SubmitTLSConfig  *tls.Config    `yaml:"-"`
+	APIKey           string         `yaml:"api_key"`
+	APIURL           string         `yaml:"api_url"`
+	CheckTarget      string         `yaml:"check_target"`
+	FlushDuration    string         `yaml:"flush_interval"`
+	SubmissionURL    string         `yaml:"submission_url"`     // explicit submission url, bypasses check/broker selection
+	SubmissionCAFile string         `yaml:"submission_ca_file"` // ca cert for an https submission url
+	BrokerCID        string         `yaml:"broker_cid"`         // broker to use when the check is created
+	DefaultAccount   string         `yaml:"default_account"`    // account (and ingest_acct tag) of requests w/o a username, "anonymous"
+	FlushInterval    time.Duration  `yaml:"-"`
+	FlushConcurrency int            `yaml:"flush_concurrency"` // 1, checks flushed concurrently
+	Preflight        bool           `yaml:"preflight"`         // verify check exists before serving
+	RuntimeMetrics   bool           `yaml:"runtime_metrics"`   // record go runtime metrics
+	AccountMetrics   AccountMetrics `yaml:"account_metrics"`
+	// flushes taking longer (e.g. a hung broker) are aborted, 30s
+	FlushTimeoutDuration string        `yaml:"flush_timeout"`
+	FlushTimeout         time.Duration `yaml:"-"`
+	// tags (category: value) added to all metrics and the check, values
+	// may reference env vars (e.g. ${POD_NAME}), when unset the pod,
+	// namespace and node are read from the kubernetes downward api env vars
+	StaticTags map[string]string `yaml:"static_tags"`
+}
+
+// downwardAPITags are the default static tags, by env var, set in
+// kubernetes pods via the downward api.
+var downwardAPITags = []struct{ env, category string }{
+	{env: "POD_NAME", category: "pod"},
+	{env: "POD_NAMESPACE", category: "namespace"},
+	{env: "NODE_NAME", category: "node"},
+}
+
+// AccountMetrics limits which accounts have per-account (ingest_acct)
+// metrics recorded, to those listed or, for a request, of at least
+// min_bytes. When neither is set, all accounts do.
+type AccountMetrics struct {
+	Accounts []string `yaml:"accounts"`
+	MinBytes int64    `yaml:"min_bytes"`
 }
 
 func cfgFromEnv() Config {
 	envPrefix := "C3E_"
 
 	cfg := Config{
+		Version: CurrentVersion,
 		Server: Server{
 			Address:           os.Getenv(envPrefix + "SVR_ADDRESS"),
+			AdminAddress:      os.Getenv(envPrefix + "SVR_ADMIN_ADDRESS"),
 			CertFile:          os.Getenv(envPrefix + "SVR_CERT_FILE"),
 			KeyFile:           os.Getenv(envPrefix + "SVR_KEY_FILE"),
+			ClientCAFile:      os.Getenv(envPrefix + "SVR_CLIENT_CA_FILE"),
 			ReadTimeout:       os.Getenv(envPrefix + "SVR_READ_TIMEOUT"),
 			WriteTimeout:      os.Getenv(envPrefix + "SVR_WRITE_TIMEOUT"),
 			IdleTimeout:       os.Getenv(envPrefix + "SVR_IDLE_TIMEOUT"),
 			ReadHeaderTimeout: os.Getenv(envPrefix + "SVR_READ_HEADER_TIMEOUT"),
 			HandlerTimeout:    os.Getenv(envPrefix + "SVR_HANDLER_TIMEOUT"),
+			HealthFormat:      os.Getenv(envPrefix + "SVR_HEALTH_FORMAT"),
+			EmptyBody:         os.Getenv(envPrefix + "SVR_EMPTY_BODY"),
+			AccessLogFormat:   os.Getenv(envPrefix + "SVR_ACCESS_LOG_FORMAT"),
+			RequestIDHeader:   os.Getenv(envPrefix + "SVR_REQUEST_ID_HEADER"),
 		},
 		Destination: Destination{
 			Host:   os.Getenv(envPrefix + "DEST_HOST"),
 			Port:   os.Getenv(envPrefix + "DEST_PORT"),
+			Name:   os.Getenv(envPrefix + "DEST_NAME"),
 			CAFile: os.Getenv(envPrefix + "DEST_CA_FILE"),
 		},
 		Circonus: Circonus{
-			CheckTarget:   os.Getenv(envPrefix + "CIRC_CHECK_TARGET"),
-			APIKey:        os.Getenv(envPrefix + "CIRC_API_KEY"),
-			APIURL:        os.Getenv(envPrefix + "CIRC_API_URL"),
-			FlushDuration: os.Getenv(envPrefix + "CIRC_FLUSH_INTERVAL"),
+			CheckTarget:      os.Getenv(envPrefix + "CIRC_CHECK_TARGET"),
+			APIKey:           os.Getenv(envPrefix + "CIRC_API_KEY"),
+			APIURL:           os.Getenv(envPrefix + "CIRC_API_URL"),
+			FlushDuration:    os.Getenv(envPrefix + "CIRC_FLUSH_INTERVAL"),
+			SubmissionURL:    os.Getenv(envPrefix + "CIRC_SUBMISSION_URL"),
+			SubmissionCAFile: os.Getenv(envPrefix + "CIRC_SUBMISSION_CA_FILE"),
+			BrokerCID:        os.Getenv(envPrefix + "CIRC_BROKER_CID"),
+			DefaultAccount:   os.Getenv(envPrefix + "CIRC_DEFAULT_ACCOUNT"),
+		},
+		Metrics: Metrics{
+			OTLP: OTLP{
+				Endpoint: os.Getenv(envPrefix + "METRICS_OTLP_ENDPOINT"),
+				Headers:  mapFromEnv(envPrefix + "METRICS_OTLP_HEADERS"),
+			},
+		},
+		Log: Log{
+			Fields: LogFields{
+				Message: os.Getenv(envPrefix + "LOG_MESSAGE_FIELD"),
+				Level:   os.Getenv(envPrefix + "LOG_LEVEL_FIELD"),
+				Time:    os.Getenv(envPrefix + "LOG_TIME_FIELD"),
+			},
 		},
 	}
 
@@ -103,105 +433,1644 @@ func cfgFromEnv() Config {
 		}
 	}
 
-	if val, ok := os.LookupEnv(envPrefix + "DEBUG"); ok {
+	if val, ok := os.LookupEnv(envPrefix + "DEST_RETRY_ERRORS"); ok {
+		for _, class := range strings.Split(val, ",") {
+			if class = strings.TrimSpace(class); class != "" {
+				cfg.Destination.RetryErrors = append(cfg.Destination.RetryErrors, class)
+			}
+		}
+	}
+
+	cfg.Destination.Failover = endpointFromEnv(envPrefix + "DEST_FAILOVER_")
+	cfg.Destination.Shadow = endpointFromEnv(envPrefix + "DEST_SHADOW_")
+	cfg.Destination.ReadDestination = endpointFromEnv(envPrefix + "DEST_READ_")
+	cfg.Destination.WriteDestination = endpointFromEnv(envPrefix + "DEST_WRITE_")
+
+	if region := os.Getenv(envPrefix + "DEST_AWS_SIGV4_REGION"); region != "" {
+		cfg.Destination.AWSSigV4 = &AWSSigV4{
+			Region:          region,
+			Service:         os.Getenv(envPrefix + "DEST_AWS_SIGV4_SERVICE"),
+			Credentials:     os.Getenv(envPrefix + "DEST_AWS_SIGV4_CREDENTIALS"),
+			AccessKeyID:     os.Getenv(envPrefix + "DEST_AWS_SIGV4_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv(envPrefix + "DEST_AWS_SIGV4_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv(envPrefix + "DEST_AWS_SIGV4_SESSION_TOKEN"),
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "DEST_TLS_SESSION_CACHE_SIZE"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sDEST_TLS_SESSION_CACHE_SIZE", envPrefix)
+			} else {
+				cfg.Destination.TLSSessionCacheSize = setting
+			}
+		}
+	}
+
+	cfg.Destination.CompatHeaders.Request = mapFromEnv(envPrefix + "DEST_COMPAT_REQUEST_HEADERS")
+	cfg.Destination.CompatHeaders.Response = mapFromEnv(envPrefix + "DEST_COMPAT_RESPONSE_HEADERS")
+	cfg.Destination.TenantPrefixes = mapFromEnv(envPrefix + "DEST_TENANT_PREFIXES")
+	cfg.Destination.QueryParams = mapFromEnv(envPrefix + "DEST_QUERY_PARAMS")
+	cfg.Destination.CompressionAlgo = os.Getenv(envPrefix + "DEST_COMPRESSION_ALGO")
+	cfg.Destination.RetryLogLevel = os.Getenv(envPrefix + "DEST_RETRY_LOG_LEVEL")
+	cfg.Circonus.FlushTimeoutDuration = os.Getenv(envPrefix + "CIRC_FLUSH_TIMEOUT")
+	cfg.Circonus.StaticTags = mapFromEnv(envPrefix + "CIRC_STATIC_TAGS")
+
+	if val, ok := os.LookupEnv(envPrefix + "DEST_COMPRESS_PATHS"); ok {
+		for _, path := range strings.Split(val, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				cfg.Destination.CompressPaths = append(cfg.Destination.CompressPaths, path)
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "DEST_NO_COMPRESS_PATHS"); ok {
+		for _, path := range strings.Split(val, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				cfg.Destination.NoCompressPaths = append(cfg.Destination.NoCompressPaths, path)
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "DEST_COMPRESS_MIN_BYTES"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sDEST_COMPRESS_MIN_BYTES", envPrefix)
+			} else {
+				cfg.Destination.CompressMinBytes = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "DEST_ALLOWED_HOSTS"); ok {
+		for _, host := range strings.Split(val, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				cfg.Destination.AllowedHosts = append(cfg.Destination.AllowedHosts, host)
+			}
+		}
+	}
+
+	cfg.Destination.ProxyURL = os.Getenv(envPrefix + "DEST_PROXY_URL")
+	if val, ok := os.LookupEnv(envPrefix + "DEST_USE_ENV_PROXY"); ok {
 		if val != "" {
 			setting, err := strconv.ParseBool(val)
 			if err != nil {
-				log.Warn().Err(err).Str("value", val).Msgf("parsing %sDEBUG", envPrefix)
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sDEST_USE_ENV_PROXY", envPrefix)
 			} else {
-				cfg.Debug = setting
+				cfg.Destination.UseEnvProxy = &setting
 			}
 		}
 	}
 
-	return cfg
-}
+	if val, ok := os.LookupEnv(envPrefix + "DEST_PRESERVE_HOST"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sDEST_PRESERVE_HOST", envPrefix)
+			} else {
+				cfg.Destination.PreserveHost = setting
+			}
+		}
+	}
 
-func Load(file string) (*Config, error) {
-	if file == "" {
-		return nil, fmt.Errorf("invalid config file path (empty)")
+	if val, ok := os.LookupEnv(envPrefix + "DEST_RETRY_RATE"); ok {
+		if val != "" {
+			setting, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sDEST_RETRY_RATE", envPrefix)
+			} else {
+				cfg.Destination.RetryRate = setting
+			}
+		}
 	}
 
-	var cfg Config
-	data, err := os.ReadFile(file)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			log.Warn().Err(err).Msg("config not found, trying environment")
-			cfg = cfgFromEnv()
-		} else {
-			return nil, err
+	if val, ok := os.LookupEnv(envPrefix + "DEST_RETRY_BURST"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sDEST_RETRY_BURST", envPrefix)
+			} else {
+				cfg.Destination.RetryBurst = setting
+			}
 		}
-	} else {
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			return nil, err
+	}
+
+	cfg.Destination.RetryBudgetDuration = os.Getenv(envPrefix + "DEST_RETRY_BUDGET")
+
+	cfg.Destination.Retry = retryFromEnv(envPrefix + "DEST_RETRY_")
+	cfg.Destination.BulkRetry = retryFromEnv(envPrefix + "DEST_BULK_RETRY_")
+
+	if val, ok := os.LookupEnv(envPrefix + "DEST_ADAPTIVE_COMPRESSION"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sDEST_ADAPTIVE_COMPRESSION", envPrefix)
+			} else {
+				cfg.Destination.AdaptiveCompression = setting
+			}
 		}
 	}
 
-	if cfg.Destination.Host == "" {
-		return nil, fmt.Errorf("invalid config, destination host is required")
+	if val, ok := os.LookupEnv(envPrefix + "DEST_ADD_FORWARDED_HEADERS"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sDEST_ADD_FORWARDED_HEADERS", envPrefix)
+			} else {
+				cfg.Destination.AddForwardedHeaders = setting
+			}
+		}
 	}
-	if cfg.Circonus.APIKey == "" {
-		return nil, fmt.Errorf("invalid config, circonus api key is required")
+
+	if val, ok := os.LookupEnv(envPrefix + "DEST_FORWARD_CLIENT_CERT"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sDEST_FORWARD_CLIENT_CERT", envPrefix)
+			} else {
+				cfg.Destination.ForwardClientCert = setting
+			}
+		}
 	}
 
-	// backfill defaults
+	if val, ok := os.LookupEnv(envPrefix + "DEST_FORCE_CLOSE"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sDEST_FORCE_CLOSE", envPrefix)
+			} else {
+				cfg.Destination.ForceClose = &setting
+			}
+		}
+	}
 
-	if cfg.Circonus.APIURL == "" {
-		cfg.Circonus.APIURL = "https://api.circonus.com/"
+	if val, ok := os.LookupEnv(envPrefix + "DEST_NO_RETRY_STATUS"); ok {
+		for _, code := range strings.Split(val, ",") {
+			code = strings.TrimSpace(code)
+			if code == "" {
+				continue
+			}
+			setting, err := strconv.Atoi(code)
+			if err != nil {
+				log.Warn().Err(err).Str("value", code).Msgf("parsing %sDEST_NO_RETRY_STATUS", envPrefix)
+				continue
+			}
+			cfg.Destination.NoRetryStatus = append(cfg.Destination.NoRetryStatus, setting)
+		}
 	}
 
-	if cfg.Circonus.FlushDuration == "" {
-		cfg.Circonus.FlushDuration = "60s"
+	if val, ok := os.LookupEnv(envPrefix + "SVR_STUB_PROVISIONING_PATHS"); ok {
+		for _, path := range strings.Split(val, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				cfg.Server.StubProvisioningPaths = append(cfg.Server.StubProvisioningPaths, path)
+			}
+		}
 	}
-	dur, err := time.ParseDuration(cfg.Circonus.FlushDuration)
-	if err != nil {
-		return nil, err
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_DISABLED_ROUTES"); ok {
+		for _, route := range strings.Split(val, ",") {
+			if route = strings.TrimSpace(route); route != "" {
+				cfg.Server.DisabledRoutes = append(cfg.Server.DisabledRoutes, route)
+			}
+		}
 	}
-	cfg.Circonus.FlushInterval = dur
 
-	if cfg.Server.Address == "" {
-		cfg.Server.Address = ":9200"
+	if val, ok := os.LookupEnv(envPrefix + "SVR_PUBLIC_PATHS"); ok {
+		for _, path := range strings.Split(val, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				cfg.Server.PublicPaths = append(cfg.Server.PublicPaths, path)
+			}
+		}
 	}
 
-	if cfg.Server.ReadTimeout == "" {
-		cfg.Server.ReadTimeout = "60s"
+	if val, ok := os.LookupEnv(envPrefix + "SVR_PROTECTED_PATHS"); ok {
+		for _, path := range strings.Split(val, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				cfg.Server.ProtectedPaths = append(cfg.Server.ProtectedPaths, path)
+			}
+		}
 	}
 
-	if cfg.Server.WriteTimeout == "" {
-		cfg.Server.WriteTimeout = "60s"
+	if val, ok := os.LookupEnv(envPrefix + "SVR_STRIP_RESPONSE_HEADERS"); ok {
+		for _, header := range strings.Split(val, ",") {
+			if header = strings.TrimSpace(header); header != "" {
+				cfg.Server.StripResponseHeaders = append(cfg.Server.StripResponseHeaders, header)
+			}
+		}
 	}
 
-	if cfg.Server.IdleTimeout == "" {
-		cfg.Server.IdleTimeout = "30s"
+	cfg.Server.HandlerTimeouts = mapFromEnv(envPrefix + "SVR_HANDLER_TIMEOUTS")
+
+	for from, to := range mapFromEnv(envPrefix + "SVR_STATUS_REMAP") {
+		fromCode, err := strconv.Atoi(from)
+		if err != nil {
+			log.Warn().Err(err).Str("value", from).Msgf("parsing %sSVR_STATUS_REMAP", envPrefix)
+			continue
+		}
+		toCode, err := strconv.Atoi(to)
+		if err != nil {
+			log.Warn().Err(err).Str("value", to).Msgf("parsing %sSVR_STATUS_REMAP", envPrefix)
+			continue
+		}
+		if cfg.Server.StatusRemap == nil {
+			cfg.Server.StatusRemap = make(map[int]int)
+		}
+		cfg.Server.StatusRemap[fromCode] = toCode
 	}
 
-	if cfg.Server.ReadHeaderTimeout == "" {
-		cfg.Server.ReadHeaderTimeout = "5s"
+	if val, ok := os.LookupEnv(envPrefix + "SVR_TRUSTED_PROXIES"); ok {
+		for _, proxy := range strings.Split(val, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				cfg.Server.TrustedProxies = append(cfg.Server.TrustedProxies, proxy)
+			}
+		}
 	}
 
-	if cfg.Server.HandlerTimeout == "" {
-		cfg.Server.HandlerTimeout = "30s"
+	if val, ok := os.LookupEnv(envPrefix + "SVR_COPY_BUFFER_SIZE"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_COPY_BUFFER_SIZE", envPrefix)
+			} else {
+				cfg.Server.CopyBufferSize = setting
+			}
+		}
 	}
 
-	// create destination TLS Config
-	if cfg.Destination.EnableTLS {
-		var err error
-		tc := &tls.Config{
-			MinVersion: tls.VersionTLS12, //nolint:gosec // G402 -- AWS doesn't support TLS13
+	if val, ok := os.LookupEnv(envPrefix + "SVR_BUFFER_RESPONSES"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_BUFFER_RESPONSES", envPrefix)
+			} else {
+				cfg.Server.BufferResponses = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_MAX_HEADER_BYTES"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_MAX_HEADER_BYTES", envPrefix)
+			} else {
+				cfg.Server.MaxHeaderBytes = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_LISTEN_BACKLOG"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_LISTEN_BACKLOG", envPrefix)
+			} else {
+				cfg.Server.ListenBacklog = setting
+			}
 		}
-		if cfg.Destination.CAFile != "" {
-			tc, err = loadCAFile(cfg.Destination.CAFile)
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_REUSEPORT"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
 			if err != nil {
-				log.Fatal().Err(err).Str("ca_file", cfg.Destination.CAFile).Msg("loading destination ca file")
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_REUSEPORT", envPrefix)
+			} else {
+				cfg.Server.ReusePort = setting
 			}
 		}
-		if cfg.Destination.SkipVerify {
-			tc.InsecureSkipVerify = true
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_DISABLE_KEEPALIVES"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_DISABLE_KEEPALIVES", envPrefix)
+			} else {
+				cfg.Server.DisableKeepAlives = setting
+			}
 		}
-		cfg.Destination.TLSConfig = tc
 	}
 
-	return &cfg, nil
+	if val, ok := os.LookupEnv(envPrefix + "SVR_MAX_CONCURRENT_REQUESTS"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_MAX_CONCURRENT_REQUESTS", envPrefix)
+			} else {
+				cfg.Server.MaxConcurrentRequests = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_MAX_CONNS_PER_IP"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_MAX_CONNS_PER_IP", envPrefix)
+			} else {
+				cfg.Server.MaxConnsPerIP = setting
+			}
+		}
+	}
+
+	cfg.Server.SlowRequestThreshold = os.Getenv(envPrefix + "SVR_SLOW_REQUEST_THRESHOLD")
+	cfg.Server.CertExpiryWarningDuration = os.Getenv(envPrefix + "SVR_CERT_EXPIRY_WARNING")
+	cfg.Server.AllowedAccountsFile = os.Getenv(envPrefix + "SVR_ALLOWED_ACCOUNTS_FILE")
+	cfg.Server.AllowedAccountsReloadDuration = os.Getenv(envPrefix + "SVR_ALLOWED_ACCOUNTS_RELOAD")
+	cfg.Server.AuthMode = os.Getenv(envPrefix + "SVR_AUTH_MODE")
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_AUTH_CHALLENGE"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_AUTH_CHALLENGE", envPrefix)
+			} else {
+				cfg.Server.AuthChallenge = &setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_DEBUG_BODIES"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_DEBUG_BODIES", envPrefix)
+			} else {
+				cfg.Server.DebugBodies = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_CLIENT_CERT_ACCOUNT"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_CLIENT_CERT_ACCOUNT", envPrefix)
+			} else {
+				cfg.Server.ClientCertAccount = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_FORWARD_TRAILERS"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_FORWARD_TRAILERS", envPrefix)
+			} else {
+				cfg.Server.ForwardTrailers = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_RESPONSE_GZIP"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_RESPONSE_GZIP", envPrefix)
+			} else {
+				cfg.Server.ResponseGzip = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_BULK_DOCS"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_BULK_DOCS", envPrefix)
+			} else {
+				cfg.Server.BulkDocs = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_VALIDATE_BULK"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_VALIDATE_BULK", envPrefix)
+			} else {
+				cfg.Server.ValidateBulk = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_STATS_ENDPOINT"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_STATS_ENDPOINT", envPrefix)
+			} else {
+				cfg.Server.StatsEndpoint = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_SPOOL_ENABLED"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_SPOOL_ENABLED", envPrefix)
+			} else {
+				cfg.Server.Spool.Enabled = setting
+			}
+		}
+	}
+	cfg.Server.Spool.Dir = os.Getenv(envPrefix + "SVR_SPOOL_DIR")
+	cfg.Server.Spool.RetryDuration = os.Getenv(envPrefix + "SVR_SPOOL_RETRY_INTERVAL")
+	if val, ok := os.LookupEnv(envPrefix + "SVR_SPOOL_MAX_SIZE"); ok {
+		if val != "" {
+			setting, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_SPOOL_MAX_SIZE", envPrefix)
+			} else {
+				cfg.Server.Spool.MaxSize = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_ASYNC_ENABLED"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_ASYNC_ENABLED", envPrefix)
+			} else {
+				cfg.Server.Async.Enabled = setting
+			}
+		}
+	}
+	cfg.Server.RequestTags.Header = os.Getenv(envPrefix + "SVR_REQUEST_TAGS_HEADER")
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_REQUEST_TAGS_CATEGORIES"); ok {
+		for _, category := range strings.Split(val, ",") {
+			if category = strings.TrimSpace(category); category != "" {
+				cfg.Server.RequestTags.Categories = append(cfg.Server.RequestTags.Categories, category)
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_ASYNC_WORKERS"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_ASYNC_WORKERS", envPrefix)
+			} else {
+				cfg.Server.Async.Workers = setting
+			}
+		}
+	}
+	if val, ok := os.LookupEnv(envPrefix + "SVR_ASYNC_QUEUE_SIZE"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_ASYNC_QUEUE_SIZE", envPrefix)
+			} else {
+				cfg.Server.Async.QueueSize = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_CACHE_ENABLED"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_CACHE_ENABLED", envPrefix)
+			} else {
+				cfg.Server.Cache.Enabled = setting
+			}
+		}
+	}
+	cfg.Server.Cache.TTLDuration = os.Getenv(envPrefix + "SVR_CACHE_TTL")
+	if val, ok := os.LookupEnv(envPrefix + "SVR_CACHE_MAX_ENTRIES"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_CACHE_MAX_ENTRIES", envPrefix)
+			} else {
+				cfg.Server.Cache.MaxEntries = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "SVR_IDEMPOTENCY_ENABLED"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_IDEMPOTENCY_ENABLED", envPrefix)
+			} else {
+				cfg.Server.Idempotency.Enabled = setting
+			}
+		}
+	}
+	cfg.Server.Idempotency.TTLDuration = os.Getenv(envPrefix + "SVR_IDEMPOTENCY_TTL")
+	if val, ok := os.LookupEnv(envPrefix + "SVR_IDEMPOTENCY_MAX_ENTRIES"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sSVR_IDEMPOTENCY_MAX_ENTRIES", envPrefix)
+			} else {
+				cfg.Server.Idempotency.MaxEntries = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "CIRC_FLUSH_CONCURRENCY"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sCIRC_FLUSH_CONCURRENCY", envPrefix)
+			} else {
+				cfg.Circonus.FlushConcurrency = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "CIRC_PREFLIGHT"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sCIRC_PREFLIGHT", envPrefix)
+			} else {
+				cfg.Circonus.Preflight = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "CIRC_RUNTIME_METRICS"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sCIRC_RUNTIME_METRICS", envPrefix)
+			} else {
+				cfg.Circonus.RuntimeMetrics = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "CIRC_ACCOUNT_METRICS_ACCOUNTS"); ok {
+		for _, acct := range strings.Split(val, ",") {
+			if acct = strings.TrimSpace(acct); acct != "" {
+				cfg.Circonus.AccountMetrics.Accounts = append(cfg.Circonus.AccountMetrics.Accounts, acct)
+			}
+		}
+	}
+	if val, ok := os.LookupEnv(envPrefix + "CIRC_ACCOUNT_METRICS_MIN_BYTES"); ok {
+		if val != "" {
+			setting, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sCIRC_ACCOUNT_METRICS_MIN_BYTES", envPrefix)
+			} else {
+				cfg.Circonus.AccountMetrics.MinBytes = setting
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv(envPrefix + "DEBUG"); ok {
+		if val != "" {
+			setting, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sDEBUG", envPrefix)
+			} else {
+				cfg.Debug = setting
+			}
+		}
+	}
+
+	return cfg
+}
+
+// retryFromEnv returns the retry settings from the environment variables
+// with prefix (MAX, WAIT_MIN, WAIT_MAX).
+func retryFromEnv(prefix string) Retry {
+	retry := Retry{
+		WaitMinDuration: os.Getenv(prefix + "WAIT_MIN"),
+		WaitMaxDuration: os.Getenv(prefix + "WAIT_MAX"),
+	}
+	if val, ok := os.LookupEnv(prefix + "MAX"); ok {
+		if val != "" {
+			setting, err := strconv.Atoi(val)
+			if err != nil {
+				log.Warn().Err(err).Str("value", val).Msgf("parsing %sMAX", prefix)
+			} else {
+				retry.Max = &setting
+			}
+		}
+	}
+	return retry
+}
+
+// endpointFromEnv returns the endpoint configured by the env vars with
+// prefix (e.g. C3E_DEST_FAILOVER_), nil when no host is set.
+func endpointFromEnv(prefix string) *Endpoint {
+	host := os.Getenv(prefix + "HOST")
+	if host == "" {
+		return nil
+	}
+	ep := &Endpoint{
+		Host:   host,
+		Port:   os.Getenv(prefix + "PORT"),
+		Name:   os.Getenv(prefix + "NAME"),
+		CAFile: os.Getenv(prefix + "CA_FILE"),
+	}
+	if val := os.Getenv(prefix + "ENABLE_TLS"); val != "" {
+		setting, err := strconv.ParseBool(val)
+		if err != nil {
+			log.Warn().Err(err).Str("value", val).Msgf("parsing %sENABLE_TLS", prefix)
+		} else {
+			ep.EnableTLS = setting
+		}
+	}
+	if val := os.Getenv(prefix + "TLS_SKIP_VERIFY"); val != "" {
+		setting, err := strconv.ParseBool(val)
+		if err != nil {
+			log.Warn().Err(err).Str("value", val).Msgf("parsing %sTLS_SKIP_VERIFY", prefix)
+		} else {
+			ep.SkipVerify = setting
+		}
+	}
+	return ep
+}
+
+// mapFromEnv parses a comma separated list of name=value pairs (e.g. headers).
+func mapFromEnv(name string) map[string]string {
+	val := os.Getenv(name)
+	if val == "" {
+		return nil
+	}
+
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(val, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Warn().Str("value", pair).Msgf("parsing %s, expected name=value", name)
+			continue
+		}
+		pairs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return pairs
+}
+
+// Load reads, validates and backfills defaults for the configuration. When
+// strict is true, the config is decoded strictly and unknown keys are errors
+// rather than warnings.
+func Load(file string, strict bool) (*Config, error) {
+	if file == "" {
+		return nil, fmt.Errorf("invalid config file path (empty)")
+	}
+
+	var cfg Config
+	data, err := readConfig(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Warn().Err(err).Msg("config not found, trying environment")
+			cfg = cfgFromEnv()
+		} else {
+			return nil, err
+		}
+	} else {
+		if strict {
+			// unknown (e.g. misspelled) keys are errors, the decoder
+			// reports the offending field and line
+			dec := yaml.NewDecoder(bytes.NewReader(data))
+			dec.KnownFields(true)
+			if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("invalid config (strict): %w", err)
+			}
+		} else {
+			if err := yaml.Unmarshal(data, &cfg); err != nil {
+				return nil, err
+			}
+
+			unknown, deprecated, err := checkKeys(data)
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range deprecated {
+				log.Warn().Str("key", key).Str("replacement", deprecatedKeys[key]).Msg("deprecated config key, ignored")
+			}
+			for _, key := range unknown {
+				log.Warn().Str("key", key).Msg("unknown config key, ignored")
+			}
+		}
+
+		if cfg.Version == 0 {
+			log.Warn().Int("current_version", CurrentVersion).Msg("config has no version, assuming current -- add 'version' to config")
+			cfg.Version = CurrentVersion
+		}
+	}
+
+	if err := checkVersion(cfg.Version); err != nil {
+		return nil, err
+	}
+
+	if cfg.Destination.Host == "" {
+		return nil, fmt.Errorf("invalid config, destination host is required")
+	}
+	if cfg.Circonus.APIKey == "" {
+		return nil, fmt.Errorf("invalid config, circonus api key is required")
+	}
+
+	// backfill defaults
+
+	if cfg.Circonus.APIURL == "" {
+		cfg.Circonus.APIURL = "https://api.circonus.com/"
+	}
+
+	if cfg.Circonus.FlushDuration == "" {
+		cfg.Circonus.FlushDuration = "60s"
+	}
+	dur, err := time.ParseDuration(cfg.Circonus.FlushDuration)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Circonus.FlushInterval = dur
+
+	if cfg.Circonus.FlushTimeoutDuration == "" {
+		cfg.Circonus.FlushTimeoutDuration = "30s"
+	}
+	flushTimeout, err := time.ParseDuration(cfg.Circonus.FlushTimeoutDuration)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config, circonus flush_timeout: %w", err)
+	}
+	if flushTimeout <= 0 {
+		return nil, fmt.Errorf("invalid config, circonus flush_timeout must be > 0")
+	}
+	cfg.Circonus.FlushTimeout = flushTimeout
+
+	cfg.Circonus.DefaultAccount = strings.ToLower(strings.TrimSpace(cfg.Circonus.DefaultAccount))
+	if cfg.Circonus.DefaultAccount == "" {
+		cfg.Circonus.DefaultAccount = "anonymous"
+	}
+
+	if cfg.Circonus.FlushConcurrency == 0 {
+		cfg.Circonus.FlushConcurrency = 1
+	}
+	if cfg.Circonus.FlushConcurrency < 0 {
+		return nil, fmt.Errorf("invalid config, circonus flush_concurrency must be > 0")
+	}
+
+	if cfg.Metrics.OTLP.Endpoint != "" {
+		u, err := url.Parse(cfg.Metrics.OTLP.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, metrics otlp endpoint: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid config, metrics otlp endpoint must be an http(s) url (%s)", cfg.Metrics.OTLP.Endpoint)
+		}
+		// the collector's default path for metrics, when only host:port is given
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/metrics"
+			cfg.Metrics.OTLP.Endpoint = u.String()
+		}
+	}
+
+	if cfg.Circonus.SubmissionURL != "" {
+		if cfg.Circonus.BrokerCID != "" {
+			return nil, fmt.Errorf("invalid config, circonus submission_url and broker_cid are mutually exclusive")
+		}
+		u, err := url.Parse(cfg.Circonus.SubmissionURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, circonus submission_url: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid config, circonus submission_url must be an http(s) url (%s)", cfg.Circonus.SubmissionURL)
+		}
+		if u.Scheme == "https" {
+			tc := &tls.Config{
+				MinVersion: tls.VersionTLS12,
+			}
+			if cfg.Circonus.SubmissionCAFile != "" {
+				tc, err = loadCAFile(cfg.Circonus.SubmissionCAFile)
+				if err != nil {
+					return nil, fmt.Errorf("loading circonus submission ca file: %w", err)
+				}
+				tc.MinVersion = tls.VersionTLS12
+			}
+			cfg.Circonus.SubmitTLSConfig = tc
+		}
+	}
+
+	if cfg.Circonus.AccountMetrics.MinBytes < 0 {
+		return nil, fmt.Errorf("invalid config, circonus account_metrics min_bytes must be >= 0")
+	}
+
+	if cfg.Circonus.StaticTags == nil {
+		cfg.Circonus.StaticTags = make(map[string]string)
+		for _, t := range downwardAPITags {
+			if val := os.Getenv(t.env); val != "" {
+				cfg.Circonus.StaticTags[t.category] = val
+			}
+		}
+	}
+	for category, val := range cfg.Circonus.StaticTags {
+		if category == "" || strings.ContainsAny(category, ":,") {
+			return nil, fmt.Errorf("invalid config, circonus static_tags invalid category (%s)", category)
+		}
+		val = os.ExpandEnv(val)
+		if val == "" {
+			// e.g. an env var not set, an empty tag is of no use
+			delete(cfg.Circonus.StaticTags, category)
+			continue
+		}
+		cfg.Circonus.StaticTags[category] = val
+	}
+
+	if cfg.Circonus.BrokerCID != "" && !validBrokerCID.MatchString(cfg.Circonus.BrokerCID) {
+		return nil, fmt.Errorf("invalid config, circonus broker_cid must be in the form /broker/<id> (%s)", cfg.Circonus.BrokerCID)
+	}
+
+	if cfg.Server.Address == "" {
+		cfg.Server.Address = ":9200"
+	}
+
+	if cfg.Server.ReadTimeout == "" {
+		cfg.Server.ReadTimeout = "60s"
+	}
+
+	if cfg.Server.WriteTimeout == "" {
+		cfg.Server.WriteTimeout = "60s"
+	}
+
+	if cfg.Server.IdleTimeout == "" {
+		cfg.Server.IdleTimeout = "30s"
+	}
+
+	if cfg.Server.ReadHeaderTimeout == "" {
+		cfg.Server.ReadHeaderTimeout = "5s"
+	}
+
+	if cfg.Server.HandlerTimeout == "" {
+		cfg.Server.HandlerTimeout = "30s"
+	}
+
+	if cfg.Server.MaxHeaderBytes == 0 {
+		cfg.Server.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	if cfg.Server.MaxHeaderBytes < 0 {
+		return nil, fmt.Errorf("invalid config, server max_header_bytes must be > 0")
+	}
+
+	if cfg.Server.ListenBacklog < 0 {
+		return nil, fmt.Errorf("invalid config, server listen_backlog must be >= 0")
+	}
+
+	if cfg.Server.MaxConnsPerIP < 0 {
+		return nil, fmt.Errorf("invalid config, server max_conns_per_ip must be >= 0")
+	}
+
+	if cfg.Server.MaxConcurrentRequests < 0 {
+		return nil, fmt.Errorf("invalid config, server max_concurrent_requests must be >= 0")
+	}
+
+	if cfg.Server.CopyBufferSize == 0 {
+		cfg.Server.CopyBufferSize = 32 * 1024
+	}
+	if cfg.Server.CopyBufferSize < 0 {
+		return nil, fmt.Errorf("invalid config, server copy_buffer_size must be > 0")
+	}
+
+	if cfg.Server.RequestTags.Header == "" {
+		cfg.Server.RequestTags.Header = "X-C3E-Tags"
+	}
+	tagCategories := make(map[string]bool)
+	for _, category := range cfg.Server.RequestTags.Categories {
+		switch category {
+		case "":
+			return nil, fmt.Errorf("invalid config, server request_tags invalid category (empty)")
+		case "path", "destination", "units", "ingest_acct", "method":
+			// the exporter's own tags can not be set by clients
+			return nil, fmt.Errorf("invalid config, server request_tags reserved category (%s)", category)
+		}
+		if strings.ContainsAny(category, ":,") {
+			return nil, fmt.Errorf("invalid config, server request_tags invalid category (%s)", category)
+		}
+		if tagCategories[category] {
+			return nil, fmt.Errorf("invalid config, server request_tags duplicate category (%s)", category)
+		}
+		tagCategories[category] = true
+	}
+
+	if cfg.Server.BufferResponses < 0 {
+		return nil, fmt.Errorf("invalid config, server buffer_responses must be >= 0")
+	}
+
+	if cfg.Server.CertExpiryWarningDuration == "" {
+		cfg.Server.CertExpiryWarningDuration = "720h"
+	}
+	{
+		dur, err := time.ParseDuration(cfg.Server.CertExpiryWarningDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, server cert_expiry_warning: %w", err)
+		}
+		if dur < 0 {
+			return nil, fmt.Errorf("invalid config, server cert_expiry_warning must be >= 0")
+		}
+		cfg.Server.CertExpiryWarning = dur
+	}
+
+	if cfg.Server.SlowRequestThreshold != "" {
+		dur, err := time.ParseDuration(cfg.Server.SlowRequestThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, server slow_request_threshold: %w", err)
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("invalid config, server slow_request_threshold must be > 0")
+		}
+		cfg.Server.SlowRequest = dur
+	}
+
+	if cfg.Server.AllowedAccountsFile != "" {
+		if cfg.Server.AllowedAccountsReloadDuration == "" {
+			cfg.Server.AllowedAccountsReloadDuration = "30s"
+		}
+		dur, err := time.ParseDuration(cfg.Server.AllowedAccountsReloadDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, server allowed_accounts_reload: %w", err)
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("invalid config, server allowed_accounts_reload must be > 0")
+		}
+		cfg.Server.AllowedAccountsReload = dur
+	}
+
+	if cfg.Server.WatchConfig {
+		if cfg.Server.WatchConfigDebounceDuration == "" {
+			cfg.Server.WatchConfigDebounceDuration = "5s"
+		}
+		dur, err := time.ParseDuration(cfg.Server.WatchConfigDebounceDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, server watch_config_debounce: %w", err)
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("invalid config, server watch_config_debounce must be > 0")
+		}
+		cfg.Server.WatchConfigDebounce = dur
+	}
+
+	for _, headers := range []map[string]string{cfg.Destination.CompatHeaders.Request, cfg.Destination.CompatHeaders.Response} {
+		for name := range headers {
+			if name == "" {
+				return nil, fmt.Errorf("invalid config, destination compat_headers invalid header (empty)")
+			}
+		}
+	}
+
+	for name := range cfg.Destination.QueryParams {
+		if name == "" {
+			return nil, fmt.Errorf("invalid config, destination query_params invalid parameter (empty)")
+		}
+	}
+
+	if cfg.Destination.UseEnvProxy == nil {
+		useEnvProxy := true
+		cfg.Destination.UseEnvProxy = &useEnvProxy
+	}
+	if cfg.Destination.ProxyURL != "" {
+		u, err := url.Parse(cfg.Destination.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, destination proxy_url: %w", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid config, destination proxy_url must be a url (%s)", cfg.Destination.ProxyURL)
+		}
+	}
+
+	if cfg.Destination.ForceClose == nil {
+		forceClose := true
+		cfg.Destination.ForceClose = &forceClose
+	}
+
+	switch cfg.Server.AuthMode {
+	case "":
+		cfg.Server.AuthMode = "require"
+	case "require", "optional", "anonymous":
+	default:
+		return nil, fmt.Errorf("invalid config, server auth_mode must be require, optional or anonymous (%s)", cfg.Server.AuthMode)
+	}
+
+	if cfg.Server.AuthChallenge == nil {
+		authChallenge := true
+		cfg.Server.AuthChallenge = &authChallenge
+	}
+
+	for _, code := range cfg.Destination.NoRetryStatus {
+		if code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid config, destination no_retry_status invalid status code (%d)", code)
+		}
+	}
+
+	switch cfg.Destination.CompressionAlgo {
+	case "":
+		cfg.Destination.CompressionAlgo = "gzip"
+	case "gzip", "zstd", "none":
+	default:
+		return nil, fmt.Errorf("invalid config, destination compression_algo must be gzip, zstd or none (%s)", cfg.Destination.CompressionAlgo)
+	}
+
+	if sig := cfg.Destination.AWSSigV4; sig != nil {
+		if sig.Region == "" {
+			sig.Region = os.Getenv("AWS_REGION")
+		}
+		if sig.Region == "" {
+			return nil, fmt.Errorf("invalid config, destination aws_sigv4 region is required")
+		}
+		if sig.Service == "" {
+			sig.Service = "es"
+		}
+		switch sig.Credentials {
+		case "":
+			sig.Credentials = "env"
+		case "env":
+		case "static":
+			if sig.AccessKeyID == "" || sig.SecretAccessKey == "" {
+				return nil, fmt.Errorf("invalid config, destination aws_sigv4 static credentials require access_key_id and secret_access_key")
+			}
+		default:
+			return nil, fmt.Errorf("invalid config, destination aws_sigv4 credentials must be env or static (%s)", sig.Credentials)
+		}
+	}
+
+	if cfg.Destination.CompressMinBytes < 0 {
+		return nil, fmt.Errorf("invalid config, destination compress_min_bytes must be >= 0")
+	}
+
+	for _, path := range cfg.Destination.CompressPaths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid config, destination compress_paths must start with '/' (%s)", path)
+		}
+	}
+	for _, path := range cfg.Destination.NoCompressPaths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid config, destination no_compress_paths must start with '/' (%s)", path)
+		}
+	}
+
+	if cfg.Destination.RetryErrors == nil {
+		cfg.Destination.RetryErrors = []string{"refused", "reset", "timeout", "dns", "other"}
+	}
+	for _, class := range cfg.Destination.RetryErrors {
+		switch class {
+		case "refused", "reset", "timeout", "dns", "tls", "other":
+		default:
+			return nil, fmt.Errorf("invalid config, destination retry_errors must be refused, reset, timeout, dns, tls or other (%s)", class)
+		}
+	}
+
+	switch cfg.Destination.RetryLogLevel {
+	case "":
+		cfg.Destination.RetryLogLevel = "debug"
+	case "debug", "info":
+	default:
+		return nil, fmt.Errorf("invalid config, destination retry_log_level must be debug or info (%s)", cfg.Destination.RetryLogLevel)
+	}
+
+	switch cfg.Server.HealthFormat {
+	case "":
+		cfg.Server.HealthFormat = "plain"
+	case "plain", "json":
+	default:
+		return nil, fmt.Errorf("invalid config, server health_format must be plain or json (%s)", cfg.Server.HealthFormat)
+	}
+
+	switch cfg.Server.EmptyBody {
+	case "":
+		cfg.Server.EmptyBody = "forward"
+	case "forward", "reject":
+	default:
+		return nil, fmt.Errorf("invalid config, server empty_body must be forward or reject (%s)", cfg.Server.EmptyBody)
+	}
+
+	switch cfg.Server.AccessLogFormat {
+	case "":
+		cfg.Server.AccessLogFormat = "json"
+	case "json", "combined":
+	default:
+		return nil, fmt.Errorf("invalid config, server access_log_format must be json or combined (%s)", cfg.Server.AccessLogFormat)
+	}
+
+	if cfg.Server.Spool.Enabled {
+		if cfg.Server.Spool.Dir == "" {
+			return nil, fmt.Errorf("invalid config, server spool dir is required when spool is enabled")
+		}
+		if cfg.Server.Spool.MaxSize < 0 {
+			return nil, fmt.Errorf("invalid config, server spool max_size must be >= 0")
+		}
+		if cfg.Server.Spool.RetryDuration == "" {
+			cfg.Server.Spool.RetryDuration = "30s"
+		}
+		dur, err := time.ParseDuration(cfg.Server.Spool.RetryDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, server spool retry_interval: %w", err)
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("invalid config, server spool retry_interval must be > 0")
+		}
+		cfg.Server.Spool.RetryInterval = dur
+	}
+
+	if cfg.Server.Async.Enabled {
+		if cfg.Server.Async.Workers == 0 {
+			cfg.Server.Async.Workers = 4
+		}
+		if cfg.Server.Async.QueueSize == 0 {
+			cfg.Server.Async.QueueSize = 1000
+		}
+		if cfg.Server.Async.Workers < 0 || cfg.Server.Async.QueueSize < 0 {
+			return nil, fmt.Errorf("invalid config, server async workers and queue_size must be > 0")
+		}
+	}
+
+	if cfg.Server.PathTagRules == nil {
+		cfg.Server.PathTagRules = append([]PathTagRule{}, defaultPathTagRules...)
+	}
+	for i, rule := range cfg.Server.PathTagRules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, server path_tag_rules pattern (%s): %w", rule.Pattern, err)
+		}
+		cfg.Server.PathTagRules[i].Regexp = re
+	}
+
+	for _, path := range cfg.Server.StubProvisioningPaths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid config, server stub_provisioning_paths must start with '/' (%s)", path)
+		}
+	}
+
+	disabled := make(map[string]bool)
+	for _, route := range cfg.Server.DisabledRoutes {
+		if !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("invalid config, server disabled_routes must start with '/' (%s)", route)
+		}
+		if disabled[route] {
+			return nil, fmt.Errorf("invalid config, server disabled_routes duplicate route (%s)", route)
+		}
+		disabled[route] = true
+	}
+
+	public := make(map[string]bool)
+	for _, path := range cfg.Server.PublicPaths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid config, server public_paths must start with '/' (%s)", path)
+		}
+		public[path] = true
+	}
+	for _, path := range cfg.Server.ProtectedPaths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid config, server protected_paths must start with '/' (%s)", path)
+		}
+		if public[path] {
+			return nil, fmt.Errorf("invalid config, server path both public and protected (%s)", path)
+		}
+	}
+
+	for _, t := range cfg.Server.ResponseTransforms {
+		if !strings.HasPrefix(t.Path, "/") {
+			return nil, fmt.Errorf("invalid config, server response_transforms path must start with '/' (%s)", t.Path)
+		}
+		if len(t.StripFields) == 0 {
+			return nil, fmt.Errorf("invalid config, server response_transforms (%s) no strip_fields", t.Path)
+		}
+		for _, field := range t.StripFields {
+			if field == "" || strings.HasPrefix(field, ".") || strings.HasSuffix(field, ".") || strings.Contains(field, "..") {
+				return nil, fmt.Errorf("invalid config, server response_transforms (%s) invalid strip_fields field (%s)", t.Path, field)
+			}
+		}
+	}
+
+	for i, header := range cfg.Server.StripResponseHeaders {
+		if header == "" {
+			return nil, fmt.Errorf("invalid config, server strip_response_headers invalid header (empty)")
+		}
+		cfg.Server.StripResponseHeaders[i] = http.CanonicalHeaderKey(header)
+	}
+
+	for route, timeout := range cfg.Server.HandlerTimeouts {
+		if !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("invalid config, server handler_timeouts route must start with '/' (%s)", route)
+		}
+		dur, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, server handler_timeouts %s: %w", route, err)
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("invalid config, server handler_timeouts %s must be > 0", route)
+		}
+		if cfg.Server.RouteTimeouts == nil {
+			cfg.Server.RouteTimeouts = make(map[string]time.Duration)
+		}
+		cfg.Server.RouteTimeouts[route] = dur
+	}
+
+	for from, to := range cfg.Server.StatusRemap {
+		if from < 100 || from > 599 || to < 100 || to > 599 {
+			return nil, fmt.Errorf("invalid config, server status_remap invalid status code (%d: %d)", from, to)
+		}
+	}
+
+	for _, proxy := range cfg.Server.TrustedProxies {
+		ipNet, err := parseNet(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, server trusted_proxies: %w", err)
+		}
+		cfg.Server.TrustedNets = append(cfg.Server.TrustedNets, ipNet)
+	}
+
+	for _, host := range cfg.Destination.AllowedHosts {
+		if ipNet, err := parseNet(host); err == nil {
+			cfg.Destination.AllowedNets = append(cfg.Destination.AllowedNets, ipNet)
+			continue
+		}
+		if host == "" || strings.ContainsAny(host, "/: ") {
+			return nil, fmt.Errorf("invalid config, destination allowed_hosts invalid host (%s)", host)
+		}
+		cfg.Destination.AllowedHostnames = append(cfg.Destination.AllowedHostnames, strings.ToLower(host))
+	}
+
+	if cfg.Server.Cache.Enabled {
+		if cfg.Server.Cache.TTLDuration == "" {
+			cfg.Server.Cache.TTLDuration = "10s"
+		}
+		dur, err := time.ParseDuration(cfg.Server.Cache.TTLDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, server cache ttl: %w", err)
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("invalid config, server cache ttl must be > 0")
+		}
+		cfg.Server.Cache.TTL = dur
+		if cfg.Server.Cache.MaxEntries == 0 {
+			cfg.Server.Cache.MaxEntries = 1000
+		}
+		if cfg.Server.Cache.MaxEntries < 0 {
+			return nil, fmt.Errorf("invalid config, server cache max_entries must be > 0")
+		}
+	}
+
+	if cfg.Server.Idempotency.Enabled {
+		if cfg.Server.Idempotency.TTLDuration == "" {
+			cfg.Server.Idempotency.TTLDuration = "5m"
+		}
+		dur, err := time.ParseDuration(cfg.Server.Idempotency.TTLDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, server idempotency ttl: %w", err)
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("invalid config, server idempotency ttl must be > 0")
+		}
+		cfg.Server.Idempotency.TTL = dur
+		if cfg.Server.Idempotency.MaxEntries == 0 {
+			cfg.Server.Idempotency.MaxEntries = 10000
+		}
+		if cfg.Server.Idempotency.MaxEntries < 0 {
+			return nil, fmt.Errorf("invalid config, server idempotency max_entries must be > 0")
+		}
+	}
+
+	if cfg.Server.DebugBodies < 0 {
+		return nil, fmt.Errorf("invalid config, server debug_bodies must be >= 0")
+	}
+
+	if cfg.Server.ClientCAFile != "" && (cfg.Server.CertFile == "" || cfg.Server.KeyFile == "") {
+		return nil, fmt.Errorf("invalid config, server client_ca_file requires cert_file and key_file")
+	}
+	if cfg.Server.ClientCertAccount && cfg.Server.ClientCAFile == "" {
+		return nil, fmt.Errorf("invalid config, server client_cert_account requires client_ca_file")
+	}
+
+	logFields := make(map[string]bool)
+	for _, name := range []string{cfg.Log.Fields.Message, cfg.Log.Fields.Level, cfg.Log.Fields.Time} {
+		if name == "" {
+			continue
+		}
+		if logFields[name] {
+			return nil, fmt.Errorf("invalid config, log fields must be distinct (%s)", name)
+		}
+		logFields[name] = true
+	}
+
+	for account, prefix := range cfg.Destination.TenantPrefixes {
+		prefix = "/" + strings.Trim(prefix, "/")
+		if prefix == "/" {
+			return nil, fmt.Errorf("invalid config, destination tenant_prefixes prefix for %s is empty", account)
+		}
+		cfg.Destination.TenantPrefixes[account] = prefix
+	}
+
+	if cfg.Destination.RetryRate < 0 {
+		return nil, fmt.Errorf("invalid config, destination retry_rate must be >= 0")
+	}
+	if cfg.Destination.RetryBurst < 0 {
+		return nil, fmt.Errorf("invalid config, destination retry_burst must be >= 0")
+	}
+
+	if cfg.Destination.RetryBudgetDuration != "" {
+		dur, err := time.ParseDuration(cfg.Destination.RetryBudgetDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config, destination retry_budget: %w", err)
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("invalid config, destination retry_budget must be > 0")
+		}
+		cfg.Destination.RetryBudget = dur
+	}
+
+	if err := loadRetry(&cfg.Destination.Retry, "retry"); err != nil {
+		return nil, err
+	}
+	if err := loadRetry(&cfg.Destination.BulkRetry, "bulk_retry"); err != nil {
+		return nil, err
+	}
+
+	if cfg.Destination.TLSSessionCacheSize == 0 {
+		cfg.Destination.TLSSessionCacheSize = 64
+	}
+	if cfg.Destination.TLSSessionCacheSize < 0 {
+		return nil, fmt.Errorf("invalid config, destination tls_session_cache_size must be > 0")
+	}
+
+	if fo := cfg.Destination.Failover; fo != nil && fo.Host == "" {
+		return nil, fmt.Errorf("invalid config, destination failover host is required")
+	}
+	if sh := cfg.Destination.Shadow; sh != nil && sh.Host == "" {
+		return nil, fmt.Errorf("invalid config, destination shadow host is required")
+	}
+	if rd := cfg.Destination.ReadDestination; rd != nil && rd.Host == "" {
+		return nil, fmt.Errorf("invalid config, destination read_destination host is required")
+	}
+	if wd := cfg.Destination.WriteDestination; wd != nil && wd.Host == "" {
+		return nil, fmt.Errorf("invalid config, destination write_destination host is required")
+	}
+
+	if err := checkAllowedHosts(&cfg.Destination); err != nil {
+		return nil, err
+	}
+
+	// names distinguish the destinations in metrics (destination tag)
+	if cfg.Destination.Name == "" {
+		cfg.Destination.Name = cfg.Destination.Host
+	}
+	if fo := cfg.Destination.Failover; fo != nil && fo.Name == "" {
+		fo.Name = fo.Host
+	}
+	if sh := cfg.Destination.Shadow; sh != nil && sh.Name == "" {
+		sh.Name = sh.Host
+	}
+	if rd := cfg.Destination.ReadDestination; rd != nil && rd.Name == "" {
+		rd.Name = rd.Host
+	}
+	if wd := cfg.Destination.WriteDestination; wd != nil && wd.Name == "" {
+		wd.Name = wd.Host
+	}
+
+	// create destination TLS Config
+	destTLS, failoverTLS, err := cfg.Destination.NewTLSConfigs()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Destination.TLSConfig = destTLS
+	if fo := cfg.Destination.Failover; fo != nil {
+		fo.TLSConfig = failoverTLS
+	}
+	for name, ep := range map[string]*Endpoint{
+		"shadow":            cfg.Destination.Shadow,
+		"read_destination":  cfg.Destination.ReadDestination,
+		"write_destination": cfg.Destination.WriteDestination,
+	} {
+		if ep == nil {
+			continue
+		}
+		tc, err := ep.NewTLSConfig(cfg.Destination.TLSSessionCacheSize)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: %w", name, err)
+		}
+		ep.TLSConfig = tc
+	}
+
+	return &cfg, nil
+}
+
+// checkAllowedHosts verifies that the destination and the failover, shadow,
+// read and write destination hosts are in allowed_hosts, rather than each
+// request failing once running. A host name which is not listed must resolve
+// to addresses in the allowed ips and cidrs, one which cannot be resolved now
+// is checked when connecting.
+func checkAllowedHosts(dest *Destination) error {
+	if len(dest.AllowedHosts) == 0 {
+		return nil
+	}
+
+	hosts := map[string]string{"destination": dest.Host}
+	for name, ep := range map[string]*Endpoint{
+		"failover":          dest.Failover,
+		"shadow":            dest.Shadow,
+		"read_destination":  dest.ReadDestination,
+		"write_destination": dest.WriteDestination,
+	} {
+		if ep != nil {
+			hosts["destination "+name] = ep.Host
+		}
+	}
+
+	for name, host := range hosts {
+		host = strings.ToLower(host)
+		if slices.Contains(dest.AllowedHostnames, host) {
+			continue
+		}
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else if len(dest.AllowedNets) > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			cancel()
+			if err != nil {
+				log.Warn().Err(err).Str("host", host).Msgf("%s host not resolved, allowed_hosts checked when connecting", name)
+				continue
+			}
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+		}
+		if len(ips) == 0 || !slices.ContainsFunc(ips, func(ip net.IP) bool { return ipAllowed(dest.AllowedNets, ip) }) {
+			return fmt.Errorf("invalid config, %s host (%s) not in destination allowed_hosts", name, host)
+		}
+	}
+
+	return nil
+}
+
+// ipAllowed returns true if ip is in one of the allowed networks.
+func ipAllowed(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRetry backfills the defaults and parses the waits of retry settings.
+func loadRetry(retry *Retry, name string) error {
+	if retry.Max == nil {
+		retryMax := 7
+		retry.Max = &retryMax
+	}
+	if *retry.Max < 0 {
+		return fmt.Errorf("invalid config, destination %s max must be >= 0", name)
+	}
+	if retry.WaitMinDuration == "" {
+		retry.WaitMinDuration = "2s"
+	}
+	if retry.WaitMaxDuration == "" {
+		retry.WaitMaxDuration = "10s"
+	}
+	waitMin, err := time.ParseDuration(retry.WaitMinDuration)
+	if err != nil {
+		return fmt.Errorf("invalid config, destination %s wait_min: %w", name, err)
+	}
+	waitMax, err := time.ParseDuration(retry.WaitMaxDuration)
+	if err != nil {
+		return fmt.Errorf("invalid config, destination %s wait_max: %w", name, err)
+	}
+	if waitMin <= 0 || waitMax < waitMin {
+		return fmt.Errorf("invalid config, destination %s waits must be > 0 and wait_min <= wait_max", name)
+	}
+	retry.WaitMin = waitMin
+	retry.WaitMax = waitMax
+	return nil
+}
+
+// NewTLSConfigs creates the tls configs for the destination and failover
+// (nil when tls is not enabled), ca files are (re)read each time it is called.
+func (d *Destination) NewTLSConfigs() (*tls.Config, *tls.Config, error) {
+	var destTLS, failoverTLS *tls.Config
+
+	if d.EnableTLS {
+		tc, err := newTLSConfig(d.CAFile, d.SkipVerify)
+		if err != nil {
+			return nil, nil, fmt.Errorf("destination: %w", err)
+		}
+		tc.ClientSessionCache = tls.NewLRUClientSessionCache(d.TLSSessionCacheSize)
+		destTLS = tc
+	}
+
+	if fo := d.Failover; fo != nil && fo.EnableTLS {
+		tc, err := newTLSConfig(fo.CAFile, fo.SkipVerify)
+		if err != nil {
+			return nil, nil, fmt.Errorf("destination failover: %w", err)
+		}
+		tc.ClientSessionCache = tls.NewLRUClientSessionCache(d.TLSSessionCacheSize)
+		failoverTLS = tc
+	}
+
+	return destTLS, failoverTLS, nil
+}
+
+// NewTLSConfig creates the tls config for the endpoint (nil when tls is not
+// enabled), the ca file is (re)read each time it is called.
+func (e *Endpoint) NewTLSConfig(sessionCacheSize int) (*tls.Config, error) {
+	if !e.EnableTLS {
+		return nil, nil
+	}
+	tc, err := newTLSConfig(e.CAFile, e.SkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	tc.ClientSessionCache = tls.NewLRUClientSessionCache(sessionCacheSize)
+	return tc, nil
+}
+
+// parseNet parses an ip or cidr, an ip is treated as a single address network.
+func parseNet(addr string) (*net.IPNet, error) {
+	if !strings.Contains(addr, "/") {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip (%s)", addr)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return nil, err
+	}
+	return ipNet, nil
+}
+
+// readConfig returns the raw config from stdin ("-"), an http(s) url, or a file.
+func readConfig(file string) ([]byte, error) {
+	switch {
+	case file == "-":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("reading config from stdin: %w", err)
+		}
+		return data, nil
+	case strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://"):
+		return fetchConfig(file)
+	default:
+		return os.ReadFile(file)
+	}
+}
+
+func fetchConfig(cfgURL string) ([]byte, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+			},
+		},
+		Timeout: configFetchTimeout,
+	}
+
+	resp, err := client.Get(cfgURL) //nolint:noctx
+	if err != nil {
+		return nil, fmt.Errorf("fetching config: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching config: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading config response: %w", err)
+	}
+
+	return data, nil
+}
+
+// newTLSConfig creates the client tls config used to connect to a destination.
+func newTLSConfig(caFile string, skipVerify bool) (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12, //nolint:gosec // G402 -- AWS doesn't support TLS13
+	}
+	if caFile != "" {
+		var err error
+		tc, err = loadCAFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading ca file (%s): %w", caFile, err)
+		}
+	}
+	if skipVerify {
+		tc.InsecureSkipVerify = true
+	}
+	return tc, nil
 }
 
 func loadCAFile(fn string) (*tls.Config, error) {
@@ -0,0 +1,261 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package config
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// loadYAML loads a config from doc, the minimum required settings are
+// prepended (a later, e.g. destination, section must repeat them).
+func loadYAML(t *testing.T, doc string, strict bool) (*Config, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(doc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return Load(file, strict)
+}
+
+const minimalYAML = `version: 1
+destination:
+  host: localhost
+circonus:
+  api_key: key
+`
+
+func TestLoadSubmissionURL(t *testing.T) {
+	cfg, err := loadYAML(t, `version: 1
+destination:
+  host: localhost
+circonus:
+  api_key: key
+  submission_url: "http://127.0.0.1:2609/module/httptrap/uuid/secret"
+`, true)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if cfg.Circonus.SubmissionURL != "http://127.0.0.1:2609/module/httptrap/uuid/secret" {
+		t.Errorf("submission url %q", cfg.Circonus.SubmissionURL)
+	}
+	if cfg.Circonus.SubmitTLSConfig != nil {
+		t.Error("tls config set for an http submission url")
+	}
+
+	cfg, err = loadYAML(t, `version: 1
+destination:
+  host: localhost
+circonus:
+  api_key: key
+  submission_url: "https://broker:43191/module/httptrap/uuid/secret"
+`, true)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if cfg.Circonus.SubmitTLSConfig == nil {
+		t.Error("no tls config for an https submission url")
+	}
+
+	for name, circonus := range map[string]string{
+		"not a url":  `  submission_url: "broker:43191"`,
+		"scheme":     `  submission_url: "ftp://broker/module/httptrap/uuid/secret"`,
+		"broker cid": "  submission_url: \"http://broker/module/httptrap/uuid/secret\"\n  broker_cid: /broker/1",
+	} {
+		if _, err := loadYAML(t, minimalYAML+circonus+"\n", true); err == nil {
+			t.Errorf("%s: invalid submission url accepted", name)
+		} else if !strings.Contains(err.Error(), "submission_url") {
+			t.Errorf("%s: error does not name the setting: %s", name, err)
+		}
+	}
+}
+
+func TestLoadAllowedHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		dest    string
+		invalid string // host reported, empty if the config is valid
+	}{
+		{name: "by name", dest: "  host: es.internal\n  allowed_hosts: [\"ES.internal\"]\n"},
+		{name: "ip in cidr", dest: "  host: 10.1.2.3\n  allowed_hosts: [\"10.0.0.0/8\"]\n"},
+		{name: "name resolves to allowed ip", dest: "  host: localhost\n  allowed_hosts: [\"127.0.0.0/8\"]\n"},
+		{name: "no allowed_hosts", dest: "  host: anywhere.example\n"},
+		{name: "destination not allowed", dest: "  host: 10.1.2.3\n  allowed_hosts: [\"es.internal\"]\n", invalid: "10.1.2.3"},
+		{name: "name not allowed", dest: "  host: other.example\n  allowed_hosts: [\"es.internal\"]\n", invalid: "other.example"},
+		{name: "name resolves elsewhere", dest: "  host: localhost\n  allowed_hosts: [\"10.0.0.0/8\"]\n", invalid: "localhost"},
+		{
+			name:    "failover not allowed",
+			dest:    "  host: es.internal\n  allowed_hosts: [\"es.internal\"]\n  failover:\n    host: 10.9.9.9\n",
+			invalid: "failover host (10.9.9.9)",
+		},
+		{
+			name:    "shadow not allowed",
+			dest:    "  host: es.internal\n  allowed_hosts: [\"es.internal\"]\n  shadow:\n    host: shadow.internal\n",
+			invalid: "shadow host (shadow.internal)",
+		},
+		{
+			name:    "write destination not allowed",
+			dest:    "  host: es.internal\n  allowed_hosts: [\"es.internal\", \"10.0.0.0/8\"]\n  write_destination:\n    host: 192.168.1.1\n",
+			invalid: "write_destination host (192.168.1.1)",
+		},
+		{
+			name: "read destination allowed",
+			dest: "  host: es.internal\n  allowed_hosts: [\"es.internal\", \"10.0.0.0/8\"]\n  read_destination:\n    host: 10.0.0.5\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadYAML(t, "version: 1\ndestination:\n"+tt.dest+"circonus:\n  api_key: key\n", true)
+			switch {
+			case tt.invalid == "" && err != nil:
+				t.Errorf("load: %s", err)
+			case tt.invalid != "" && err == nil:
+				t.Errorf("loaded, want %s not allowed", tt.invalid)
+			case tt.invalid != "" && (!strings.Contains(err.Error(), tt.invalid) || !strings.Contains(err.Error(), "allowed_hosts")):
+				t.Errorf("error %q, want %s not in allowed_hosts", err, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestLoadSpoolRetryInterval(t *testing.T) {
+	tests := []struct {
+		interval string
+		want     time.Duration // 0 if the config is invalid
+	}{
+		{interval: "", want: 30 * time.Second},
+		{interval: "10s", want: 10 * time.Second},
+		{interval: "0s"},
+		{interval: "-1s"},
+	}
+	for _, tt := range tests {
+		doc := minimalYAML + "server:\n  spool:\n    enabled: true\n    dir: " + t.TempDir() + "\n"
+		if tt.interval != "" {
+			doc += "    retry_interval: \"" + tt.interval + "\"\n"
+		}
+		cfg, err := loadYAML(t, doc, true)
+		switch {
+		case tt.want == 0 && err == nil:
+			t.Errorf("retry_interval %q accepted", tt.interval)
+		case tt.want == 0 && !strings.Contains(err.Error(), "retry_interval"):
+			t.Errorf("retry_interval %q: error does not name the setting: %s", tt.interval, err)
+		case tt.want != 0 && err != nil:
+			t.Errorf("retry_interval %q: %s", tt.interval, err)
+		case tt.want != 0 && cfg.Server.Spool.RetryInterval != tt.want:
+			t.Errorf("retry_interval %q is %s, want %s", tt.interval, cfg.Server.Spool.RetryInterval, tt.want)
+		}
+	}
+}
+
+func TestLoadStdin(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "stdin")
+	if err := os.WriteFile(file, []byte(minimalYAML), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	orig := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = orig }()
+
+	cfg, err := Load("-", true)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if cfg.Destination.Host != "localhost" || cfg.Circonus.APIKey != "key" {
+		t.Errorf("config not read from stdin: %+v", cfg)
+	}
+}
+
+func TestLoadURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/c3-exporter.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(minimalYAML))
+	}))
+	defer srv.Close()
+
+	cfg, err := Load(srv.URL+"/c3-exporter.yaml", true)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if cfg.Destination.Host != "localhost" || cfg.Circonus.APIKey != "key" {
+		t.Errorf("config not read from the url: %+v", cfg)
+	}
+
+	// unlike a missing file, a failed fetch does not fall back to the environment
+	if _, err := Load(srv.URL+"/missing.yaml", true); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("fetching a missing config: %v, want the response status", err)
+	}
+}
+
+func TestLoadUnknownKeys(t *testing.T) {
+	var logs bytes.Buffer
+	orig := log.Logger
+	log.Logger = zerolog.New(&logs)
+	defer func() { log.Logger = orig }()
+
+	doc := minimalYAML + "  flush_intervall: 10s\n"
+	cfg, err := loadYAML(t, doc, false)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if cfg.Circonus.APIKey != "key" {
+		t.Errorf("config not loaded: %+v", cfg.Circonus)
+	}
+	if !strings.Contains(logs.String(), "unknown config key") || !strings.Contains(logs.String(), "circonus.flush_intervall") {
+		t.Errorf("unknown key not warned about:\n%s", logs.String())
+	}
+
+	if _, err := loadYAML(t, doc, true); err == nil {
+		t.Error("unknown key accepted in strict mode")
+	}
+
+	logs.Reset()
+	if _, err := loadYAML(t, strings.TrimPrefix(minimalYAML, "version: 1\n"), false); err != nil {
+		t.Fatalf("load w/o a version: %s", err)
+	}
+	if !strings.Contains(logs.String(), "config has no version") {
+		t.Errorf("missing version not warned about:\n%s", logs.String())
+	}
+	if _, err := loadYAML(t, strings.Replace(minimalYAML, "version: 1", "version: 99", 1), false); err == nil {
+		t.Error("unknown version accepted")
+	}
+}
+
+func TestLoadStrictMisspelledKey(t *testing.T) {
+	_, err := loadYAML(t, `version: 1
+destination:
+  host: localhost
+  bulk_retry:
+    max_retries: 3
+circonus:
+  api_key: key
+`, true)
+	if err == nil {
+		t.Fatal("misspelled key accepted")
+	}
+	// the error names the key and the line it is on
+	for _, want := range []string{"strict", "max_retries", "line 5"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
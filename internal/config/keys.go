@@ -0,0 +1,104 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// CurrentVersion is the config schema version written by this release.
+	CurrentVersion = 1
+)
+
+// knownVersions are the config schema versions this release can load.
+var knownVersions = map[int]bool{
+	CurrentVersion: true,
+}
+
+// deprecatedKeys maps keys no longer used, as dotted paths, to their
+// replacement. None yet, keys are added here when one is renamed.
+var deprecatedKeys = map[string]string{}
+
+// checkKeys walks the yaml document and returns the keys which do not map to
+// a field in the Config, as dotted paths, and the deprecated keys found.
+func checkKeys(data []byte) ([]string, []string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil, nil
+	}
+
+	var unknown, deprecated []string
+	walkKeys(doc.Content[0], reflect.TypeOf(Config{}), "", &unknown, &deprecated)
+
+	return unknown, deprecated, nil
+}
+
+func walkKeys(node *yaml.Node, t reflect.Type, prefix string, unknown, deprecated *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if node.Kind != yaml.MappingNode || t.Kind() != reflect.Struct {
+		return
+	}
+
+	fields := yamlFields(t)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		if _, ok := deprecatedKeys[path]; ok {
+			*deprecated = append(*deprecated, path)
+			continue
+		}
+		ft, ok := fields[key]
+		if !ok {
+			*unknown = append(*unknown, path)
+			continue
+		}
+		walkKeys(node.Content[i+1], ft, path, unknown, deprecated)
+	}
+}
+
+// yamlFields returns the yaml key names for the fields of a struct, following
+// the yaml.v3 convention of using the lowercased field name when untagged.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := strings.ToLower(f.Name)
+		if tag, ok := f.Tag.Lookup("yaml"); ok {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func checkVersion(version int) error {
+	if !knownVersions[version] {
+		return fmt.Errorf("invalid config, unknown version (%d)", version)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckKeys(t *testing.T) {
+	deprecatedKeys["destination.old_name"] = "destination.name"
+	t.Cleanup(func() { delete(deprecatedKeys, "destination.old_name") })
+
+	unknown, deprecated, err := checkKeys([]byte(`version: 1
+debug: true
+destination:
+  host: localhost
+  old_name: dest
+  hostname: typo
+  bulk_retry:
+    max: 2
+    maximum: 3
+circonus:
+  api_key: key
+extra: 1
+`))
+	if err != nil {
+		t.Fatalf("checking keys: %s", err)
+	}
+	if got := strings.Join(unknown, ","); got != "destination.hostname,destination.bulk_retry.maximum,extra" {
+		t.Errorf("unknown keys %v", unknown)
+	}
+	if got := strings.Join(deprecated, ","); got != "destination.old_name" {
+		t.Errorf("deprecated keys %v", deprecated)
+	}
+
+	if unknown, deprecated, err := checkKeys(nil); err != nil || unknown != nil || deprecated != nil {
+		t.Errorf("empty document: %v %v %v", unknown, deprecated, err)
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	if err := checkVersion(CurrentVersion); err != nil {
+		t.Errorf("current version: %s", err)
+	}
+	if err := checkVersion(CurrentVersion + 1); err == nil || !strings.Contains(err.Error(), "unknown version") {
+		t.Errorf("future version: %v", err)
+	}
+}
@@ -46,3 +46,22 @@ func (lw LogWrapper) Warnf(fmt string, v ...interface{}) {
 func (lw LogWrapper) Errorf(fmt string, v ...interface{}) {
 	lw.Log.Error().Msgf(fmt, v...)
 }
+
+// SetFieldNames renames the standard fields of all subsequent log lines,
+// empty names are left unchanged.
+func SetFieldNames(message, level, timestamp string) {
+	if message != "" {
+		zerolog.MessageFieldName = message
+	}
+	if level != "" {
+		zerolog.LevelFieldName = level
+	}
+	if timestamp != "" {
+		zerolog.TimestampFieldName = timestamp
+	}
+}
+
+// WithVersion adds the version and commit fields to every line logged with l.
+func WithVersion(l zerolog.Logger, version, commit string) zerolog.Logger {
+	return l.With().Str("version", version).Str("commit", commit).Logger()
+}
@@ -0,0 +1,78 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestSetFieldNames(t *testing.T) {
+	message, level, timestamp := zerolog.MessageFieldName, zerolog.LevelFieldName, zerolog.TimestampFieldName
+	defer func() {
+		zerolog.MessageFieldName, zerolog.LevelFieldName, zerolog.TimestampFieldName = message, level, timestamp
+	}()
+
+	tests := []struct {
+		name                       string
+		message, level, timestamp  string
+		wantMessage, wantLevel     string
+		wantTimestamp, notExpected string
+	}{
+		{"renamed", "msg", "severity", "ts", "msg", "severity", "ts", "message"},
+		{"empty unchanged", "", "", "", "msg", "severity", "ts", "level"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetFieldNames(tt.message, tt.level, tt.timestamp)
+
+			var buf bytes.Buffer
+			l := zerolog.New(&buf).With().Timestamp().Logger()
+			l.Info().Msg("hello")
+
+			var fields map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+				t.Fatalf("log line not json: %s\n%s", err, buf.String())
+			}
+			if fields[tt.wantMessage] != "hello" {
+				t.Errorf("message field %q missing: %s", tt.wantMessage, buf.String())
+			}
+			if fields[tt.wantLevel] != "info" {
+				t.Errorf("level field %q missing: %s", tt.wantLevel, buf.String())
+			}
+			if _, ok := fields[tt.wantTimestamp]; !ok {
+				t.Errorf("timestamp field %q missing: %s", tt.wantTimestamp, buf.String())
+			}
+			if _, ok := fields[tt.notExpected]; ok {
+				t.Errorf("default field %q present: %s", tt.notExpected, buf.String())
+			}
+		})
+	}
+}
+
+func TestWithVersion(t *testing.T) {
+	var buf bytes.Buffer
+	l := WithVersion(zerolog.New(&buf), "1.2.3", "abc123")
+	l.Info().Str("path", "/_bulk").Msg("request")
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatalf("log line not json: %s\n%s", err, buf.String())
+	}
+	if fields["version"] != "1.2.3" {
+		t.Errorf("version %v, want 1.2.3", fields["version"])
+	}
+	if fields["commit"] != "abc123" {
+		t.Errorf("commit %v, want abc123", fields["commit"])
+	}
+	if fields["path"] != "/_bulk" {
+		t.Errorf("path %v, want the event's own fields kept", fields["path"])
+	}
+}
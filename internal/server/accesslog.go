@@ -0,0 +1,129 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// combinedTimeFormat is the time format of the combined log format.
+const combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLog writes a line, in the combined (apache/nginx) log format, for
+// each request (access_log_format combined). The per-request json logs of
+// the handlers are then logged at debug.
+func (s *Server) accessLog(next http.Handler) http.Handler {
+	if s.cfg.Server.AccessLogFormat != "combined" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessLogKey, true)))
+		_, _ = io.WriteString(os.Stderr, combinedLogLine(r, limitIP(r, s.cfg.Server.TrustedNets), rec.statusCode(), rec.size, start))
+	})
+}
+
+// accessLogged returns true if the request is logged by accessLog.
+func accessLogged(r *http.Request) bool {
+	logged, _ := r.Context().Value(accessLogKey).(bool)
+	return logged
+}
+
+// combinedLogLine formats a request in the combined log format:
+// remote - user [time] "method uri proto" status size "referer" "user-agent"
+func combinedLogLine(r *http.Request, remote string, status int, size int64, start time.Time) string {
+	user, _, ok := r.BasicAuth()
+	if !ok || user == "" {
+		user = "-"
+	}
+	bytesSent := "-"
+	if size > 0 {
+		bytesSent = strconv.FormatInt(size, 10)
+	}
+
+	var b strings.Builder
+	b.WriteString(logField(remote))
+	b.WriteString(" - ")
+	b.WriteString(logField(user))
+	b.WriteString(" [")
+	b.WriteString(start.Format(combinedTimeFormat))
+	b.WriteString("] ")
+	b.WriteString(strconv.Quote(r.Method + " " + r.URL.RequestURI() + " " + r.Proto))
+	b.WriteString(" ")
+	b.WriteString(strconv.Itoa(status))
+	b.WriteString(" ")
+	b.WriteString(bytesSent)
+	b.WriteString(" ")
+	b.WriteString(strconv.Quote(headerField(r.Referer())))
+	b.WriteString(" ")
+	b.WriteString(strconv.Quote(headerField(r.UserAgent())))
+	b.WriteString("\n")
+	return b.String()
+}
+
+// logField returns an unquoted field, spaces would split it.
+func logField(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return strings.Map(func(c rune) rune {
+		if c <= ' ' || c == 0x7f {
+			return '_'
+		}
+		return c
+	}, v)
+}
+
+func headerField(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// statusRecorder records the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// statusCode is the status sent, 200 when the handler wrote nothing.
+func (w *statusRecorder) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
@@ -0,0 +1,79 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCombinedLogLine(t *testing.T) {
+	start := time.Date(2024, time.March, 5, 14, 7, 9, 0, time.FixedZone("", -5*3600))
+	tests := []struct {
+		name   string
+		req    func() *http.Request
+		remote string
+		status int
+		size   int64
+		want   string
+	}{
+		{
+			name: "bulk",
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodPost, "/_bulk?refresh=false", nil)
+				r.SetBasicAuth(testAccount, testToken)
+				r.Header.Set("User-Agent", "Data Prepper/2.6")
+				return r
+			},
+			remote: "198.51.100.1",
+			status: http.StatusOK,
+			size:   42,
+			want:   `198.51.100.1 - acct [05/Mar/2024:14:07:09 -0500] "POST /_bulk?refresh=false HTTP/1.1" 200 42 "-" "Data Prepper/2.6"` + "\n",
+		},
+		{
+			name: "unauthorized, no body",
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/logs/_search", nil)
+				r.Header.Set("Referer", "http://dashboards/app")
+				return r
+			},
+			remote: "",
+			status: http.StatusUnauthorized,
+			want:   `- - - [05/Mar/2024:14:07:09 -0500] "GET /logs/_search HTTP/1.1" 401 - "http://dashboards/app" "-"` + "\n",
+		},
+		{
+			name: "spaces in the username",
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodHead, "/", nil)
+				r.SetBasicAuth("a b", testToken)
+				return r
+			},
+			remote: "203.0.113.7",
+			status: http.StatusOK,
+			want:   `203.0.113.7 - a_b [05/Mar/2024:14:07:09 -0500] "HEAD / HTTP/1.1" 200 - "-" "-"` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := combinedLogLine(tt.req(), tt.remote, tt.status, tt.size, start); got != tt.want {
+			t.Errorf("%s:\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStatusRecorder(t *testing.T) {
+	rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+	if rec.statusCode() != http.StatusOK {
+		t.Errorf("status %d w/o a response, want 200", rec.statusCode())
+	}
+	rec.WriteHeader(http.StatusCreated)
+	rec.WriteHeader(http.StatusInternalServerError)
+	_, _ = rec.Write([]byte("created"))
+	if rec.statusCode() != http.StatusCreated || rec.size != 7 {
+		t.Errorf("status %d, size %d, want 201 and 7", rec.statusCode(), rec.size)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// allowedAccounts is the set of accounts, read from a file, which may send
+// requests. The file is re-read when it changes, w/o affecting anything
+// else. A nil set allows all accounts.
+type allowedAccounts struct {
+	modTime  time.Time
+	accounts map[string]bool
+	file     string
+	mu       sync.RWMutex
+}
+
+func newAllowedAccounts(file string) (*allowedAccounts, error) {
+	a := &allowedAccounts{file: file}
+	if _, err := a.reload(true); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// allowed returns true if the account may send requests.
+func (a *allowedAccounts) allowed(account string) bool {
+	if a == nil {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.accounts[account]
+}
+
+// reload re-reads the file if it has been modified since it was last read
+// (or force is set), returning true if it was. On an error the current
+// accounts are kept.
+func (a *allowedAccounts) reload(force bool) (bool, error) {
+	fi, err := os.Stat(a.file)
+	if err != nil {
+		return false, fmt.Errorf("allowed accounts file: %w", err)
+	}
+
+	a.mu.RLock()
+	unchanged := fi.ModTime().Equal(a.modTime)
+	a.mu.RUnlock()
+	if unchanged && !force {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(a.file)
+	if err != nil {
+		return false, fmt.Errorf("allowed accounts file: %w", err)
+	}
+
+	// one account per line, blank lines and '#' comments are ignored
+	accounts := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			accounts[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("allowed accounts file: %w", err)
+	}
+
+	a.mu.Lock()
+	a.accounts = accounts
+	a.modTime = fi.ModTime()
+	a.mu.Unlock()
+
+	return true, nil
+}
+
+// watch checks the file for changes every interval until ctx is done.
+func (a *allowedAccounts) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.logReload(false)
+		}
+	}
+}
+
+func (a *allowedAccounts) logReload(force bool) {
+	reloaded, err := a.reload(force)
+	if err != nil {
+		log.Error().Err(err).Msg("reloading allowed accounts, continuing with current accounts")
+		return
+	}
+	if reloaded {
+		a.mu.RLock()
+		n := len(a.accounts)
+		a.mu.RUnlock()
+		log.Info().Str("file", a.file).Int("accounts", n).Msg("reloaded allowed accounts")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAllowedAccountsReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "accounts")
+	write := func(data string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// a distinct modification time, writes within the file system's
+		// timestamp granularity would otherwise not be seen as a change
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("acct-a\n# comment\n  acct-b  # trailing comment\n\n", start)
+
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, `server:
+  allowed_accounts_file: `+file+`
+  allowed_accounts_reload: 10ms
+`))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ts.allowed.watch(ctx, ts.cfg.Server.AllowedAccountsReload)
+
+	status := func(account string) int {
+		t.Helper()
+		req := ts.request(t, http.MethodGet, "/logs/_search", "")
+		req.SetBasicAuth(account, testToken)
+		resp, _ := ts.do(t, req)
+		return resp.StatusCode
+	}
+	for account, want := range map[string]int{"acct-a": http.StatusOK, "acct-b": http.StatusOK, "acct-c": http.StatusForbidden} {
+		if got := status(account); got != want {
+			t.Errorf("%s: status %d, want %d", account, got, want)
+		}
+	}
+
+	// acct-b removed, acct-c added
+	write("acct-a\nacct-c\n", start.Add(time.Minute))
+	want := map[string]int{"acct-a": http.StatusOK, "acct-b": http.StatusForbidden, "acct-c": http.StatusOK}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := map[string]int{}
+		reloaded := true
+		for account, wantStatus := range want {
+			got[account] = status(account)
+			reloaded = reloaded && got[account] == wantStatus
+		}
+		if reloaded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after reload statuses %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := counterValue(ts.metrics, "account_denied", pathTags(ts.paths.tag("/logs/_search"))); n == 0 {
+		t.Error("account_denied not counted")
+	}
+
+	// an unreadable file keeps the current accounts
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	ts.allowed.logReload(true)
+	if got := status("acct-c"); got != http.StatusOK {
+		t.Errorf("after the file was removed: status %d, want the accounts kept", got)
+	}
+}
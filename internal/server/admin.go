@@ -0,0 +1,154 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof" //nolint:gosec // G108 -- only registered on the (optional) admin listener
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/circonus/c3-exporter/internal/release"
+	"gopkg.in/yaml.v3"
+)
+
+// newAdminServer creates the http server for the operational endpoints,
+// it is only used when an admin address is configured.
+func (s *Server) newAdminServer(readTimeout, writeTimeout, idleTimeout, readHeaderTimeout time.Duration) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/health", healthHandler{started: s.started, stats: s.stats, format: s.cfg.Server.HealthFormat})
+	mux.Handle("/version", versionHandler{})
+	mux.Handle("/config", configHandler{s: s})
+	mux.Handle("/metrics", metricsHandler{s: s})
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return &http.Server{
+		Addr:              s.cfg.Server.AdminAddress,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		Handler:           mux,
+	}
+}
+
+type versionHandler struct{}
+
+func (versionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"name":       release.NAME,
+		"version":    release.Version,
+		"branch":     release.Branch,
+		"commit":     release.Commit,
+		"build_date": release.BuildDate,
+		"build_tag":  release.BuildTag,
+	})
+}
+
+type metricsHandler struct {
+	s *Server
+}
+
+type metricsResponse struct {
+	Stats       statsResponse   `json:"stats"`
+	LastFlushed *flushedMetrics `json:"last_flushed,omitempty"`
+}
+
+// ServeHTTP responds with the stats (as /stats) and the metrics sent with the
+// last flush, if any.
+func (h metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(metricsResponse{
+		Stats:       h.s.stats.response(h.s.started),
+		LastFlushed: h.s.stats.lastMetrics.Load(),
+	})
+}
+
+type configHandler struct {
+	s *Server
+}
+
+// ServeHTTP responds with the running configuration, secrets redacted. Header
+// values (e.g. an authorization header for the collector or destination) are
+// all redacted, as are passwords in urls and the secret of the submission url.
+func (h configHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := *h.s.cfg
+	if cfg.Circonus.APIKey != "" {
+		cfg.Circonus.APIKey = "<redacted>"
+	}
+	cfg.Metrics.OTLP.Headers = redactValues(cfg.Metrics.OTLP.Headers)
+	cfg.Metrics.OTLP.Endpoint = redactURL(cfg.Metrics.OTLP.Endpoint)
+	cfg.Destination.CompatHeaders.Request = redactValues(cfg.Destination.CompatHeaders.Request)
+	cfg.Destination.CompatHeaders.Response = redactValues(cfg.Destination.CompatHeaders.Response)
+	cfg.Destination.ProxyURL = redactURL(cfg.Destination.ProxyURL)
+	cfg.Circonus.SubmissionURL = redactSubmissionURL(cfg.Circonus.SubmissionURL)
+	if sig := cfg.Destination.AWSSigV4; sig != nil && (sig.SecretAccessKey != "" || sig.SessionToken != "") {
+		redacted := *sig
+		redacted.SecretAccessKey = "<redacted>"
+		redacted.SessionToken = "<redacted>"
+		cfg.Destination.AWSSigV4 = &redacted
+	}
+
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		h.s.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+	_, _ = w.Write(data)
+}
+
+// redactValues returns a copy of m with every value redacted, the config's
+// maps are shared so are not modified.
+func redactValues(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return m
+	}
+	redacted := make(map[string]string, len(m))
+	for k := range m {
+		redacted[k] = "<redacted>"
+	}
+	return redacted
+}
+
+// redactURL returns rawURL with the password of its user info, if any,
+// redacted.
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// redactSubmissionURL returns redactURL(rawURL) with, for an httptrap url
+// (.../module/httptrap/<check uuid>/<secret>), the secret redacted.
+func redactSubmissionURL(rawURL string) string {
+	redacted := redactURL(rawURL)
+	u, err := url.Parse(redacted)
+	if err != nil {
+		return redacted
+	}
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, segment := range segments {
+		if segment == "httptrap" && i+2 < len(segments) && segments[i+2] != "" {
+			segments[i+2] = "<redacted>"
+			return strings.Replace(redacted, u.EscapedPath(), strings.Join(segments, "/"), 1)
+		}
+	}
+	return redacted
+}
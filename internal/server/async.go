@@ -0,0 +1,167 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/circonus-labs/go-trapmetrics"
+	"github.com/circonus/c3-exporter/internal/spool"
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/rs/zerolog/log"
+)
+
+// asyncQueue forwards bulk requests in the background so that the latency
+// of the destination is not passed on to clients.
+type asyncQueue struct {
+	s       *Server
+	jobs    chan asyncJob
+	wg      sync.WaitGroup
+	workers int
+	mu      sync.RWMutex
+	closed  bool
+}
+
+type asyncJob struct {
+	reqID string
+	body  []byte
+	entry spool.Entry
+}
+
+func newAsyncQueue(s *Server, workers, size int) *asyncQueue {
+	return &asyncQueue{
+		s:       s,
+		jobs:    make(chan asyncJob, size),
+		workers: workers,
+	}
+}
+
+// enqueue adds a job w/o blocking, returns false if the queue is full (or closed).
+func (q *asyncQueue) enqueue(job asyncJob) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return false
+	}
+
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// depth returns the number of jobs waiting for a worker.
+func (q *asyncQueue) depth() int {
+	return len(q.jobs)
+}
+
+func (q *asyncQueue) start(ctx context.Context) {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.worker(ctx)
+	}
+}
+
+// stop closes the queue and waits for the workers to forward the jobs
+// remaining or for the context to be done.
+func (q *asyncQueue) stop(ctx context.Context) {
+	q.mu.Lock()
+	q.closed = true
+	close(q.jobs)
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn().Int("queued", q.depth()).Msg("async queue not drained")
+	}
+}
+
+func (q *asyncQueue) worker(ctx context.Context) {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		q.forward(ctx, job)
+	}
+}
+
+// forward sends the job to the destination, a job which cannot be sent is
+// spooled (if enabled) otherwise it is dropped.
+func (q *asyncQueue) forward(ctx context.Context, job asyncJob) {
+	s := q.s
+	pathTag := s.paths.tag(job.entry.Path)
+	tags := trapmetrics.Tags{{Category: "path", Value: pathTag}}
+	reqLogger := log.With().
+		Str("req_id", job.reqID).
+		Str("path", job.entry.Path).
+		Str("method", job.entry.Method).
+		Logger()
+
+	ctx, cancel := context.WithTimeout(ctx, backgroundTimeout)
+	defer cancel()
+
+	req, err := s.entryRequest(ctx, &job.entry, job.body)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("creating async destination request")
+		_ = s.metrics.CounterIncrement("async_failed", tags)
+		return
+	}
+	rreq, err := retryablehttp.FromRequest(req)
+	if err != nil {
+		reqLogger.Error().Err(err).Msg("creating async destination request")
+		_ = s.metrics.CounterIncrement("async_failed", tags)
+		return
+	}
+
+	client, closeIdle := s.clients.forEndpoint(s.cfg.Destination.WriteDestination)
+	defer closeIdle()
+
+	retryClient := newRetryClient(client, s.cfg.Destination.BulkRetry, reqLogger, "async", s.cfg.Debug)
+	retryClient.CheckRetry = checkRetry(s.cfg.Destination.NoRetryStatus, s.clients.retryErrors, s.clients.budget, s.metrics, pathTag, reqLogger, s.cfg.Destination.RetryLogLevel)
+	limitRetryTime(retryClient, s.cfg.Destination.RetryBudget, reqLogger)
+
+	resp, err := retryClient.Do(rreq)
+	if err == nil {
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			reqLogger.Warn().Int("status_code", resp.StatusCode).Str("status", resp.Status).Msg("async request rejected by destination")
+			_ = s.metrics.CounterIncrement("async_rejected", tags)
+			recordRejected(s.metrics, pathTag, resp)
+			return
+		}
+		reqLogger.Debug().Int("gz_size", len(job.body)).Msg("async request forwarded")
+		_ = s.metrics.CounterIncrement("async_sent", tags)
+		return
+	}
+
+	checkTLSError(s.metrics, reqLogger, pathTag, err)
+	s.stats.upstreamErrors.Add(1)
+
+	if s.spool != nil {
+		spoolErr := s.spool.Store(job.entry, job.body)
+		if spoolErr == nil {
+			reqLogger.Warn().Err(err).Msg("async destination request failed, spooled")
+			_ = s.metrics.CounterIncrement("spooled", tags)
+			return
+		}
+		reqLogger.Error().Err(spoolErr).Msg("spooling async request")
+	}
+
+	reqLogger.Error().Err(err).Msg("async destination request failed, dropping")
+	_ = s.metrics.CounterIncrement("async_failed", tags)
+}
@@ -0,0 +1,81 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBulkAsync(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	cfg := testConfig(t, up.Server, `
+server:
+  async:
+    enabled: true
+    workers: 1
+    queue_size: 1
+`)
+	ts := newTestServer(t, cfg)
+
+	doc := `{"index":{}}` + "\n" + `{"message":"queued"}` + "\n"
+	req, err := http.NewRequest(http.MethodPost, ts.url+"/_bulk", chunked(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(testAccount, testToken)
+	resp, body := ts.do(t, req)
+	if resp.StatusCode != http.StatusAccepted || string(body) != `{"queued":true}` {
+		t.Fatalf("response %d %s, want 202 queued", resp.StatusCode, body)
+	}
+	if up.received() != 0 {
+		t.Error("queued request forwarded before a worker started")
+	}
+	if ts.async.depth() != 1 {
+		t.Errorf("queue depth %d, want 1", ts.async.depth())
+	}
+	// the bytes read, a chunked request has no content length
+	if n := counterValue(ts.metrics, "log_size", sizeTags("/_bulk", cfg.Destination.Name)); n != int64(len(doc)) {
+		t.Errorf("log_size %d, want %d", n, len(doc))
+	}
+
+	// queue full
+	resp, body = ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc))
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("full queue: response %d %s, want 503", resp.StatusCode, body)
+	}
+	if n := counterValue(ts.metrics, "async_queue_full", pathTags("/_bulk")); n != 1 {
+		t.Errorf("async_queue_full %d, want 1", n)
+	}
+
+	// the worker forwards the queued request, stop waits for it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ts.async.start(ctx)
+	ts.async.stop(ctx)
+
+	if up.received() != 1 {
+		t.Fatalf("upstream received %d requests, want 1", up.received())
+	}
+	fwd, got := up.last(t)
+	if got != doc {
+		t.Errorf("forwarded body %q, want %q", got, doc)
+	}
+	if user, pass, _ := fwd.BasicAuth(); user != testAccount || pass != testToken {
+		t.Errorf("forwarded as %q/%q, want the client's credentials", user, pass)
+	}
+	if n := counterValue(ts.metrics, "async_sent", pathTags("/_bulk")); n != 1 {
+		t.Errorf("async_sent %d, want 1", n)
+	}
+
+	// closed
+	resp, _ = ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc))
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("stopped queue: response %d, want 503", resp.StatusCode)
+	}
+}
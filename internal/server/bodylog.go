@@ -0,0 +1,110 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// secretFields matches json string values of keys which commonly hold
+// credentials, so they can be masked before a body is logged.
+var secretFields = regexp.MustCompile(`(?i)("(?:password|passwd|secret|token|api_key|apikey|access_key|secret_key)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// bodyCapture retains, at most, the first limit bytes written to it and
+// silently discards the rest. It is used with io.TeeReader so that the
+// bodies being forwarded are never buffered beyond the limit for logging.
+type bodyCapture struct {
+	buf   bytes.Buffer
+	limit int
+	total int64
+}
+
+func newBodyCapture(limit int) *bodyCapture {
+	if limit <= 0 {
+		return nil
+	}
+	return &bodyCapture{limit: limit}
+}
+
+func (bc *bodyCapture) Write(p []byte) (int, error) {
+	bc.total += int64(len(p))
+	if remain := bc.limit - bc.buf.Len(); remain > 0 {
+		if len(p) > remain {
+			bc.buf.Write(p[:remain])
+		} else {
+			bc.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// log emits the captured (and redacted) body at debug level.
+func (bc *bodyCapture) log(l zerolog.Logger, msg string) {
+	if bc == nil {
+		return
+	}
+	l.Debug().
+		Int64("size", bc.total).
+		Bool("truncated", bc.total > int64(bc.buf.Len())).
+		Str("data", redactBody(bc.buf.Bytes())).
+		Msg(msg)
+}
+
+func redactBody(data []byte) string {
+	return string(secretFields.ReplaceAll(data, []byte(`$1"<redacted>"`)))
+}
+
+// secretHeaders hold credentials, their values are masked when logged.
+var secretHeaders = map[string]bool{
+	"Authorization":         true,
+	"Proxy-Authorization":   true,
+	"X-Circonus-Auth-Token": true,
+	"X-Amz-Security-Token":  true,
+	"Cookie":                true,
+}
+
+// logHeaders emits, at debug level, the headers of a request forwarded to
+// the destination, credentials redacted. The scheme of an Authorization
+// header (e.g. Basic) is kept.
+func logHeaders(l zerolog.Logger, msg string, h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := zerolog.Dict()
+	for _, name := range names {
+		value := strings.Join(h.Values(name), ", ")
+		if secretHeaders[http.CanonicalHeaderKey(name)] {
+			value = redactHeader(value)
+		}
+		headers.Str(name, value)
+	}
+	l.Debug().Dict("headers", headers).Msg(msg)
+}
+
+func redactHeader(value string) string {
+	if scheme, _, ok := strings.Cut(value, " "); ok {
+		return scheme + " <redacted>"
+	}
+	return "<redacted>"
+}
+
+// tee returns a reader which copies what is read from r into the capture,
+// or r itself when body logging is disabled.
+func (bc *bodyCapture) tee(r io.Reader) io.Reader {
+	if bc == nil {
+		return r
+	}
+	return io.TeeReader(r, bc)
+}
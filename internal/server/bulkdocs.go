@@ -0,0 +1,86 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+
+	"github.com/circonus-labs/go-trapmetrics"
+)
+
+// maxActionPrefix is the start of a line kept to tell a delete action (which
+// has no source line) from the others.
+const maxActionPrefix = 32
+
+// bulkDocCounter counts, as the body is written to it, the action lines of a
+// _bulk body, i.e. the documents indexed, created, updated or deleted. Lines
+// are not parsed, only the start of each action line is looked at, so it is
+// cheap enough for large bodies. Malformed bodies are counted as best it can.
+type bulkDocCounter struct {
+	prefix     []byte
+	docs       uint64
+	wantSource bool
+}
+
+func (c *bulkDocCounter) Write(p []byte) (int, error) {
+	data := p
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			c.keep(data)
+			break
+		}
+		c.keep(data[:i])
+		c.line()
+		data = data[i+1:]
+	}
+	return len(p), nil
+}
+
+// count returns the number of documents, including a final line w/o a
+// trailing newline.
+func (c *bulkDocCounter) count() uint64 {
+	if c == nil {
+		return 0
+	}
+	if len(c.prefix) > 0 {
+		c.line()
+	}
+	return c.docs
+}
+
+func (c *bulkDocCounter) keep(data []byte) {
+	if n := maxActionPrefix - len(c.prefix); n > 0 {
+		if len(data) > n {
+			data = data[:n]
+		}
+		c.prefix = append(c.prefix, data...)
+	}
+}
+
+func (c *bulkDocCounter) line() {
+	line := bytes.TrimSpace(c.prefix)
+	c.prefix = c.prefix[:0]
+	if len(line) == 0 {
+		return
+	}
+	if c.wantSource {
+		c.wantSource = false
+		return
+	}
+	c.docs++
+	action := bytes.TrimLeft(bytes.TrimPrefix(line, []byte("{")), " \t")
+	c.wantSource = !bytes.HasPrefix(action, []byte(`"delete"`))
+}
+
+// recordBulkDocs records the documents of a forwarded (or queued) request in
+// the bulk_docs counter, nothing if counting is not enabled (nil counter).
+func recordBulkDocs(tm *trapmetrics.TrapMetrics, path string, c *bulkDocCounter) {
+	if c == nil {
+		return
+	}
+	_ = tm.CounterIncrementByValue("bulk_docs", trapmetrics.Tags{{Category: "path", Value: path}}, c.count())
+}
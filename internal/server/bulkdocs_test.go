@@ -0,0 +1,64 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBulkDocCounter(t *testing.T) {
+	long := `{"index":{"_index":"` + strings.Repeat("x", 2*maxActionPrefix) + `"}}`
+	tests := []struct {
+		name string
+		body string
+		want uint64
+	}{
+		{"index", `{"index":{}}` + "\n" + `{"message":"a"}` + "\n" + `{"create":{}}` + "\n" + `{"message":"b"}` + "\n", 2},
+		{"delete has no source", `{"delete":{"_id":"1"}}` + "\n" + `{"index":{}}` + "\n" + `{"delete":{}}` + "\n" + `{ "index":{}}` + "\n{}\n", 3},
+		{"source like an action", `{"index":{}}` + "\n" + `{"delete":"field"}` + "\n", 1},
+		{"no trailing newline", `{"index":{}}` + "\n" + `{"message":"a"}` + "\n" + `{"delete":{}}`, 2},
+		{"blank lines", "\n" + `{"index":{}}` + "\n\n" + `{}` + "\n\n", 1},
+		{"long action line", long + "\n{}\n" + long + "\n{}\n", 2},
+		{"empty", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// written whole, and a byte at a time (lines split across writes)
+			for _, size := range []int{len(tt.body) + 1, 1} {
+				c := &bulkDocCounter{}
+				for body := tt.body; body != ""; {
+					n := size
+					if n > len(body) {
+						n = len(body)
+					}
+					_, _ = c.Write([]byte(body[:n]))
+					body = body[n:]
+				}
+				if got := c.count(); got != tt.want {
+					t.Errorf("writes of %d: %d docs, want %d", size, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBulkDocsMetric(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, "server:\n  bulk_docs: true\n"))
+
+	body := strings.Repeat(`{"index":{}}`+"\n"+`{"message":"a"}`+"\n", 5) + `{"delete":{"_id":"1"}}` + "\n"
+	for i := 0; i < 2; i++ {
+		if resp, respBody := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", body)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("response %d %s", resp.StatusCode, respBody)
+		}
+	}
+	if n := counterValue(ts.metrics, "bulk_docs", pathTags(ts.paths.tag("/_bulk"))); n != 12 {
+		t.Errorf("bulk_docs %d, want 12 (6 per request)", n)
+	}
+}
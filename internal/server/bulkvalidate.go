@@ -0,0 +1,97 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// bulkValidator checks, as the body is written to it, that a _bulk body is
+// well formed ndjson: action lines (a single index, create, update or delete
+// object) each followed, except for delete, by a source line. The first
+// problem found is returned by close, later writes are ignored.
+type bulkValidator struct {
+	err        error
+	partial    []byte
+	line       int
+	wantSource bool
+}
+
+func (v *bulkValidator) Write(p []byte) (int, error) {
+	if v.err != nil {
+		return len(p), nil
+	}
+	data := p
+	for len(data) > 0 && v.err == nil {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			v.partial = append(v.partial, data...)
+			break
+		}
+		if len(v.partial) > 0 {
+			v.partial = append(v.partial, data[:i]...)
+			v.check(v.partial)
+			v.partial = v.partial[:0]
+		} else {
+			v.check(data[:i])
+		}
+		data = data[i+1:]
+	}
+	return len(p), nil
+}
+
+// close checks a final line w/o a trailing newline and that the body did not
+// end expecting a source line.
+func (v *bulkValidator) close() error {
+	if v == nil {
+		return nil
+	}
+	if v.err == nil && len(v.partial) > 0 {
+		v.check(v.partial)
+	}
+	if v.err == nil && v.wantSource {
+		v.err = fmt.Errorf("line %d: action w/o a source line", v.line)
+	}
+	return v.err
+}
+
+func (v *bulkValidator) check(line []byte) {
+	v.line++
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+
+	if v.wantSource {
+		if !json.Valid(line) || line[0] != '{' {
+			v.err = fmt.Errorf("line %d: source is not a json object", v.line)
+			return
+		}
+		v.wantSource = false
+		return
+	}
+
+	var action map[string]json.RawMessage
+	if err := json.Unmarshal(line, &action); err != nil {
+		v.err = fmt.Errorf("line %d: action is not a json object", v.line)
+		return
+	}
+	if len(action) != 1 {
+		v.err = fmt.Errorf("line %d: action must have a single key", v.line)
+		return
+	}
+	for name := range action {
+		switch name {
+		case "index", "create", "update":
+			v.wantSource = true
+		case "delete":
+		default:
+			v.err = fmt.Errorf("line %d: unknown action (%s)", v.line, name)
+		}
+	}
+}
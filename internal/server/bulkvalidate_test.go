@@ -0,0 +1,76 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBulkValidator(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"index", `{"index":{"_index":"logs"}}` + "\n" + `{"message":"a"}` + "\n", ""},
+		{"all actions", `{"create":{}}` + "\n{}\n" + `{"update":{"_id":"1"}}` + "\n" + `{"doc":{}}` + "\n" + `{"delete":{"_id":"2"}}` + "\n", ""},
+		{"no trailing newline", `{"index":{}}` + "\n" + `{"message":"a"}`, ""},
+		{"blank lines", "\n" + `{"index":{}}` + "\n\n" + `{"message":"a"}` + "\n\n", ""},
+		{"missing source", `{"index":{}}` + "\n", "line 1: action w/o a source line"},
+		{"source not an object", `{"index":{}}` + "\n" + `["a"]` + "\n", "line 2: source is not a json object"},
+		{"action not json", `index` + "\n{}\n", "line 1: action is not a json object"},
+		{"two actions", `{"index":{},"delete":{}}` + "\n{}\n", "line 1: action must have a single key"},
+		{"unknown action", `{"upsert":{}}` + "\n{}\n", "line 1: unknown action (upsert)"},
+		{"first error kept", `{"index":{}}` + "\n" + `x` + "\n" + `{"bad":{}}` + "\n", "line 2: source is not a json object"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// written whole, and a byte at a time (lines split across writes)
+			for _, size := range []int{len(tt.body), 1} {
+				v := &bulkValidator{}
+				for body := tt.body; body != ""; {
+					n := size
+					if n > len(body) {
+						n = len(body)
+					}
+					_, _ = v.Write([]byte(body[:n]))
+					body = body[n:]
+				}
+				err := v.close()
+				if tt.wantErr == "" && err != nil {
+					t.Errorf("writes of %d: %s, want valid", size, err)
+				}
+				if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+					t.Errorf("writes of %d: %v, want %s", size, err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateBulkRejects(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, "server:\n  validate_bulk: true\n"))
+
+	resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n"+`{"message":"a"}`+"\n"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("valid body: response %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n"+`not json`+"\n"))
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "line 2") {
+		t.Errorf("invalid body: response %d %s, want 400 naming the line", resp.StatusCode, body)
+	}
+	if up.received() != 1 {
+		t.Errorf("upstream received %d requests, want only the valid one", up.received())
+	}
+	if n := counterValue(ts.metrics, "invalid_bulk", pathTags(ts.paths.tag("/_bulk"))); n != 1 {
+		t.Errorf("invalid_bulk %d, want 1", n)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// responseCache is a small in-memory LRU of responses, successful GETs or
+// bulk responses by idempotency key, entries expire after ttl.
+type responseCache struct {
+	entries    map[string]*list.Element
+	order      *list.List
+	ttl        time.Duration
+	maxEntries int
+	mu         sync.Mutex
+}
+
+type cachedResponse struct {
+	expires     time.Time
+	key         string
+	contentType string
+	body        []byte
+	status      int
+}
+
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+	}
+}
+
+// cacheKey returns the key for a request, the credentials are part of the
+// key (hashed) so a response is only served to the same account.
+func cacheKey(username, password, uri string) string {
+	sum := sha256.Sum256([]byte(username + ":" + password))
+	return hex.EncodeToString(sum[:]) + " " + uri
+}
+
+func (c *responseCache) get(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cachedResponse) //nolint:forcetypeassert
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+
+	return entry, true
+}
+
+func (c *responseCache) set(key string, status int, contentType string, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cachedResponse{
+		expires:     time.Now().Add(c.ttl),
+		key:         key,
+		contentType: contentType,
+		body:        body,
+		status:      status,
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key) //nolint:forcetypeassert
+	}
+}
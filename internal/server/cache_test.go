@@ -0,0 +1,92 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	c := newResponseCache(50*time.Millisecond, 2)
+	key := cacheKey(testAccount, testToken, "/_template/logs")
+
+	if _, ok := c.get(key); ok {
+		t.Fatal("hit on an empty cache")
+	}
+	c.set(key, http.StatusOK, "application/json", []byte(`{"logs":{}}`))
+	entry, ok := c.get(key)
+	if !ok || string(entry.body) != `{"logs":{}}` || entry.contentType != "application/json" {
+		t.Fatalf("cached entry %+v, %v", entry, ok)
+	}
+
+	// other credentials do not share entries
+	if _, ok := c.get(cacheKey(testAccount, "other", "/_template/logs")); ok {
+		t.Error("hit with other credentials")
+	}
+
+	// the least recently used entry is evicted
+	c.set(cacheKey(testAccount, testToken, "/a"), http.StatusOK, "", nil)
+	c.get(key)
+	c.set(cacheKey(testAccount, testToken, "/b"), http.StatusOK, "", nil)
+	if _, ok := c.get(cacheKey(testAccount, testToken, "/a")); ok {
+		t.Error("least recently used entry not evicted")
+	}
+	if _, ok := c.get(key); !ok {
+		t.Error("recently used entry evicted")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.get(key); ok {
+		t.Error("hit on an expired entry")
+	}
+	if _, ok := c.entries[key]; ok {
+		t.Error("expired entry not removed")
+	}
+}
+
+func TestGetCached(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"cluster_name":"logs"}`))
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, "server:\n  cache:\n    enabled: true\n    ttl: 200ms\n"))
+
+	get := func() {
+		t.Helper()
+		resp, body := ts.do(t, ts.request(t, http.MethodGet, "/_cluster/settings", ""))
+		if resp.StatusCode != http.StatusOK || string(body) != `{"cluster_name":"logs"}` {
+			t.Fatalf("response %d %s", resp.StatusCode, body)
+		}
+	}
+
+	get() // miss
+	get() // hit
+	if up.received() != 1 {
+		t.Errorf("upstream received %d requests, want 1", up.received())
+	}
+	tags := pathTags("/_cluster/settings")
+	if hit, miss := counterValue(ts.metrics, "cache_hit", tags), counterValue(ts.metrics, "cache_miss", tags); hit != 1 || miss != 1 {
+		t.Errorf("cache_hit %d, cache_miss %d, want 1 and 1", hit, miss)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	get() // expired
+	if up.received() != 2 {
+		t.Errorf("upstream received %d requests after expiry, want 2", up.received())
+	}
+
+	// only GETs are cached
+	for i := 0; i < 2; i++ {
+		if resp, body := ts.do(t, ts.request(t, http.MethodPut, "/_template/logs", "{}")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("put: response %d %s", resp.StatusCode, body)
+		}
+	}
+	if up.received() != 4 {
+		t.Errorf("upstream received %d requests, want 4", up.received())
+	}
+}
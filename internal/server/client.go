@@ -0,0 +1,444 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/circonus-labs/go-trapmetrics"
+	"github.com/circonus/c3-exporter/internal/config"
+	"github.com/rs/zerolog"
+)
+
+var errDestinationNotAllowed = errors.New("destination not allowed")
+
+// destGuard restricts the addresses which may be connected to when
+// forwarding, to hosts by name or, once resolved, to ips in allowed networks.
+type destGuard struct {
+	hosts map[string]bool
+	nets  []*net.IPNet
+}
+
+func newDestGuard(cfg *config.Destination) *destGuard {
+	if len(cfg.AllowedHosts) == 0 {
+		return nil
+	}
+	g := &destGuard{
+		hosts: make(map[string]bool),
+		nets:  cfg.AllowedNets,
+	}
+	for _, host := range cfg.AllowedHostnames {
+		g.hosts[host] = true
+	}
+	return g
+}
+
+// allowedIP returns true if ip is in one of the allowed networks.
+func (g *destGuard) allowedIP(ip net.IP) bool {
+	for _, n := range g.nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost returns an error if host may not be forwarded to: it is not
+// allowed by name and neither it, nor an address it resolves to, is in the
+// allowed networks.
+func (g *destGuard) checkHost(ctx context.Context, host string) error {
+	host = strings.ToLower(host)
+	if g.hosts[host] {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if g.allowedIP(ip) {
+			return nil
+		}
+		return fmt.Errorf("%w (%s)", errDestinationNotAllowed, host)
+	}
+	if len(g.nets) > 0 {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("resolving destination: %w", err)
+		}
+		for _, addr := range addrs {
+			if g.allowedIP(addr.IP) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w (%s)", errDestinationNotAllowed, host)
+}
+
+// proxiedKey marks the context of a request sent through a proxy, whose
+// destination has already been checked (see guardTransport).
+type proxiedKey struct{}
+
+// dialContext returns a dial func which only connects to allowed hosts, the
+// ip actually connected to is checked so a name cannot resolve elsewhere.
+// Connections to a proxy are not checked, the destination of the request is.
+func (g *destGuard) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	guarded := *dialer
+	guarded.Control = func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if g.allowedIP(net.ParseIP(host)) {
+			return nil
+		}
+		return fmt.Errorf("%w (%s)", errDestinationNotAllowed, address)
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if proxied, _ := ctx.Value(proxiedKey{}).(bool); proxied {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		if host, _, err := net.SplitHostPort(addr); err == nil && g.hosts[strings.ToLower(host)] {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return guarded.DialContext(ctx, network, addr)
+	}
+}
+
+// guardTransport checks the destination of requests sent through a proxy,
+// which are otherwise only checked when dialing, i.e. the proxy's address.
+type guardTransport struct {
+	next  http.RoundTripper
+	guard *destGuard
+	proxy func(*http.Request) (*url.URL, error)
+}
+
+func (t guardTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	proxyURL, err := t.proxy(r)
+	if err != nil || proxyURL == nil {
+		// not proxied, or the transport fails the same way
+		return t.next.RoundTrip(r)
+	}
+	if err := t.guard.checkHost(r.Context(), r.URL.Hostname()); err != nil {
+		if r.Body != nil {
+			_ = r.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(r.WithContext(context.WithValue(r.Context(), proxiedKey{}, true)))
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport.
+func (t guardTransport) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// destClients provides the clients used to forward requests to the
+// destination, failover and read/write destinations. With force_close, each
+// request gets a new client w/o keepalives, otherwise the clients are shared
+// so connections are reused. The tls configs and shared clients are swapped
+// atomically when reloaded.
+type destClients struct {
+	dest        atomic.Pointer[http.Client]
+	failover    atomic.Pointer[http.Client]
+	destTLS     atomic.Pointer[tls.Config]
+	failoverTLS atomic.Pointer[tls.Config]
+	endpoints   map[*config.Endpoint]*endpointClient
+	cfg         *config.Destination
+	guard       *destGuard
+	budget      *retryBudget
+	retryErrors errorClasses
+	signer      *sigV4Signer
+	proxy       func(*http.Request) (*url.URL, error)
+	forceClose  bool
+}
+
+func newDestClients(dest *config.Destination) *destClients {
+	c := &destClients{
+		cfg:         dest,
+		guard:       newDestGuard(dest),
+		budget:      newRetryBudget(dest.RetryRate, dest.RetryBurst),
+		retryErrors: newErrorClasses(dest.RetryErrors),
+		signer:      newSigV4Signer(dest.AWSSigV4),
+		proxy:       destProxy(dest),
+		forceClose:  dest.ForceClose == nil || *dest.ForceClose,
+	}
+	var failoverTLS *tls.Config
+	if dest.Failover != nil {
+		failoverTLS = dest.Failover.TLSConfig
+	}
+	c.endpoints = make(map[*config.Endpoint]*endpointClient)
+	for _, ep := range []*config.Endpoint{dest.ReadDestination, dest.WriteDestination} {
+		if ep != nil {
+			c.endpoints[ep] = &endpointClient{}
+		}
+	}
+	c.swap(dest.TLSConfig, failoverTLS, endpointTLSConfigs(dest))
+	return c
+}
+
+// endpointClient is the tls config and, when connections are reused, shared
+// client of a read or write destination.
+type endpointClient struct {
+	client atomic.Pointer[http.Client]
+	tls    atomic.Pointer[tls.Config]
+}
+
+// endpointTLSConfigs returns the tls configs, as loaded, of the read and
+// write destinations.
+func endpointTLSConfigs(dest *config.Destination) map[*config.Endpoint]*tls.Config {
+	configs := make(map[*config.Endpoint]*tls.Config)
+	for _, ep := range []*config.Endpoint{dest.ReadDestination, dest.WriteDestination} {
+		if ep != nil {
+			configs[ep] = ep.TLSConfig
+		}
+	}
+	return configs
+}
+
+// swap stores the tls configs and, when connections are reused, replaces
+// the shared clients. Requests in flight complete on the client they started
+// with, only its idle connections are closed.
+func (c *destClients) swap(destTLS, failoverTLS *tls.Config, endpointTLS map[*config.Endpoint]*tls.Config) {
+	c.destTLS.Store(destTLS)
+	c.failoverTLS.Store(failoverTLS)
+	for ep, ec := range c.endpoints {
+		ec.tls.Store(endpointTLS[ep])
+	}
+	if c.forceClose {
+		return
+	}
+	if old := c.dest.Swap(c.newClient(destTLS, true)); old != nil {
+		old.CloseIdleConnections()
+	}
+	if c.cfg.Failover != nil {
+		if old := c.failover.Swap(c.newClient(failoverTLS, true)); old != nil {
+			old.CloseIdleConnections()
+		}
+	}
+	for ep, ec := range c.endpoints {
+		if old := ec.client.Swap(c.newClient(endpointTLS[ep], true)); old != nil {
+			old.CloseIdleConnections()
+		}
+	}
+}
+
+// reloadTLS re-reads the destination, failover and read/write destination ca
+// files, the current configs remain in use if any cannot be loaded.
+func (c *destClients) reloadTLS() error {
+	destTLS, failoverTLS, err := c.cfg.NewTLSConfigs()
+	if err != nil {
+		return err
+	}
+	endpointTLS := make(map[*config.Endpoint]*tls.Config, len(c.endpoints))
+	for ep := range c.endpoints {
+		tc, err := ep.NewTLSConfig(c.cfg.TLSSessionCacheSize)
+		if err != nil {
+			return fmt.Errorf("destination %s: %w", ep.Name, err)
+		}
+		endpointTLS[ep] = tc
+	}
+	c.swap(destTLS, failoverTLS, endpointTLS)
+	return nil
+}
+
+// tlsEnabled returns true if the destination, failover or a read/write
+// destination uses tls, i.e. there are ca files to reload.
+func (c *destClients) tlsEnabled() bool {
+	if c.cfg.EnableTLS || (c.cfg.Failover != nil && c.cfg.Failover.EnableTLS) {
+		return true
+	}
+	for ep := range c.endpoints {
+		if ep.EnableTLS {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the client for the destination (or failover) and a func to
+// call once the request is complete.
+func (c *destClients) get(failover bool) (*http.Client, func()) {
+	if c.forceClose {
+		tlsConfig := c.destTLS.Load()
+		if failover {
+			tlsConfig = c.failoverTLS.Load()
+		}
+		client := c.newClient(tlsConfig, false)
+		return client, client.CloseIdleConnections
+	}
+
+	if failover {
+		return c.failover.Load(), func() {}
+	}
+	return c.dest.Load(), func() {}
+}
+
+// forEndpoint returns the client for a read or write destination, or when
+// nil the destination, and a func to call once the request is complete.
+func (c *destClients) forEndpoint(ep *config.Endpoint) (*http.Client, func()) {
+	ec := c.endpoints[ep]
+	if ec == nil {
+		return c.get(false)
+	}
+	if c.forceClose {
+		client := c.newClient(ec.tls.Load(), false)
+		return client, client.CloseIdleConnections
+	}
+	return ec.client.Load(), func() {}
+}
+
+// newClient creates a destination client, signing requests when aws_sigv4 is
+// configured.
+func (c *destClients) newClient(tlsConfig *tls.Config, keepAlive bool) *http.Client {
+	client := newDestClient(tlsConfig, keepAlive, c.guard, c.proxy)
+	client.Transport = c.signer.transport(client.Transport)
+	return client
+}
+
+// destProxy returns the proxy func for the destination transports, the
+// configured proxy_url, the environment (HTTP_PROXY etc.) or none (nil).
+func destProxy(dest *config.Destination) func(*http.Request) (*url.URL, error) {
+	switch {
+	case dest.ProxyURL != "":
+		u, err := url.Parse(dest.ProxyURL)
+		if err != nil {
+			// validated when the config is loaded
+			return nil
+		}
+		return http.ProxyURL(u)
+	case dest.UseEnvProxy == nil || *dest.UseEnvProxy:
+		return http.ProxyFromEnvironment
+	default:
+		return nil
+	}
+}
+
+// newDestClient creates a client used to forward requests, tls is used
+// when a tls config is provided and connections are restricted when a
+// guard is provided.
+func newDestClient(tlsConfig *tls.Config, keepAlive bool, guard *destGuard, proxy func(*http.Request) (*url.URL, error)) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:       10 * time.Second,
+		KeepAlive:     3 * time.Second,
+		FallbackDelay: -1 * time.Millisecond,
+	}
+	transport := &http.Transport{
+		Proxy:               proxy,
+		DialContext:         dialer.DialContext,
+		DisableKeepAlives:   true,
+		DisableCompression:  false,
+		MaxIdleConns:        1,
+		MaxIdleConnsPerHost: 0,
+	}
+	if guard != nil {
+		transport.DialContext = guard.dialContext(dialer)
+	}
+	if keepAlive {
+		transport.DisableKeepAlives = false
+		transport.MaxIdleConns = 100
+		transport.MaxIdleConnsPerHost = 100
+		transport.IdleConnTimeout = 90 * time.Second
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig.Clone()
+		transport.TLSHandshakeTimeout = 10 * time.Second
+	}
+
+	var rt http.RoundTripper = transport
+	if guard != nil && proxy != nil {
+		rt = guardTransport{next: transport, guard: guard, proxy: proxy}
+	}
+
+	// no client timeout, the request context's deadline (see upstreamContext,
+	// backgroundTimeout) bounds the attempts, retries and failover
+	return &http.Client{
+		Transport: rt,
+	}
+}
+
+// checkTLSError logs and records (tls_handshake_errors) a forwarding error
+// caused by a failed tls handshake or certificate verification, so that it
+// can be told apart from e.g. connection refused.
+func checkTLSError(tm *trapmetrics.TrapMetrics, l zerolog.Logger, path string, err error) {
+	if !isTLSError(err) {
+		return
+	}
+	l.Error().Err(err).Msg("destination tls handshake failed, check destination tls settings (ca_file, enable_tls)")
+	_ = tm.CounterIncrement("tls_handshake_errors", trapmetrics.Tags{{Category: "path", Value: path}})
+}
+
+func isTLSError(err error) bool {
+	var (
+		unknownAuthErr x509.UnknownAuthorityError
+		hostnameErr    x509.HostnameError
+		invalidErr     x509.CertificateInvalidError
+		recordErr      tls.RecordHeaderError
+	)
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &unknownAuthErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &invalidErr),
+		errors.As(err, &recordErr):
+		return true
+	}
+
+	// handshake failures and alerts from the server are not exported types,
+	// net/http replaces the record header error for a plain http server
+	msg := err.Error()
+	return strings.Contains(msg, "tls: ") || strings.Contains(msg, "server gave HTTP response to HTTPS client")
+}
+
+// upstreamAddr is the remote address of the last connection used by a
+// request to the destination, e.g. the backend of a round-robin dns name
+// (or the proxy, when requests are proxied).
+type upstreamAddr struct {
+	addr atomic.Pointer[string]
+}
+
+func (a *upstreamAddr) set(addr string) {
+	a.addr.Store(&addr)
+}
+
+// String returns the address, empty if no connection was made.
+func (a *upstreamAddr) String() string {
+	if p := a.addr.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// traceConns returns ctx with a trace recording, for each connection used by
+// a request to the destination (including retries), whether it was reused
+// (conn_reused) or newly established (conn_new) and, when addr is not nil,
+// its remote address.
+func traceConns(ctx context.Context, tm *trapmetrics.TrapMetrics, pathTag string, addr *upstreamAddr) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			name := "conn_new"
+			if info.Reused {
+				name = "conn_reused"
+			}
+			_ = tm.CounterIncrement(name, trapmetrics.Tags{{Category: "path", Value: pathTag}})
+			if addr != nil && info.Conn != nil {
+				addr.set(info.Conn.RemoteAddr().String())
+			}
+		},
+	})
+}
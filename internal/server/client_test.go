@@ -0,0 +1,379 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDestGuardCheckHost(t *testing.T) {
+	g := &destGuard{hosts: map[string]bool{"es.internal": true}, nets: []*net.IPNet{mustCIDR(t, "127.0.0.0/8")}}
+
+	for host, allowed := range map[string]bool{
+		"es.internal": true,
+		"ES.Internal": true,
+		"127.0.0.1":   true,
+		"localhost":   true, // resolves to an allowed address
+		"10.1.2.3":    false,
+		"other.host":  false,
+	} {
+		err := g.checkHost(context.Background(), host)
+		if allowed && err != nil {
+			t.Errorf("%s not allowed: %s", host, err)
+		}
+		if !allowed && err == nil {
+			t.Errorf("%s allowed", host)
+		}
+	}
+	if err := g.checkHost(context.Background(), "10.1.2.3"); !errors.Is(err, errDestinationNotAllowed) {
+		t.Errorf("disallowed ip error %v, want errDestinationNotAllowed", err)
+	}
+}
+
+func TestBulkDestinationNotAllowed(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	cfg := testConfig(t, up.Server, `
+destination:
+  allowed_hosts: ["127.0.0.1"]
+`)
+	ts := newTestServer(t, cfg)
+
+	resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n"+`{"a":1}`+"\n"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("allowed destination: response %d %s", resp.StatusCode, body)
+	}
+
+	// the guard refuses to connect to an address which is not allowed (e.g.
+	// a host name resolving elsewhere)
+	ts.clients.guard.nets = []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}
+	resp, body = ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n"+`{"a":1}`+"\n"))
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("disallowed destination: response %d %s, want 502", resp.StatusCode, body)
+	}
+	if up.received() != 1 {
+		t.Errorf("upstream received %d requests, want 1", up.received())
+	}
+}
+
+func TestDestClientProxyChecksDestination(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.Host)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	// the proxy (127.0.0.1) is not in allowed_hosts, the destinations are
+	// checked rather than the proxy
+	g := &destGuard{hosts: map[string]bool{"es.internal": true}, nets: []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}}
+	client := newDestClient(nil, false, g, http.ProxyURL(proxyURL))
+
+	for _, dest := range []string{"http://es.internal:9200/_bulk", "http://10.1.2.3:9200/_bulk"} {
+		resp, err := client.Get(dest)
+		if err != nil {
+			t.Errorf("%s: %s", dest, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+	if strings.Join(proxied, ",") != "es.internal:9200,10.1.2.3:9200" {
+		t.Errorf("proxied %v", proxied)
+	}
+
+	_, err := client.Get("http://192.168.1.1:9200/_bulk")
+	if !errors.Is(err, errDestinationNotAllowed) {
+		t.Errorf("disallowed destination through the proxy: %v, want errDestinationNotAllowed", err)
+	}
+	if len(proxied) != 2 {
+		t.Errorf("disallowed destination sent to the proxy")
+	}
+}
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestForceClose(t *testing.T) {
+	for _, forceClose := range []bool{true, false} {
+		t.Run(fmt.Sprintf("force_close %v", forceClose), func(t *testing.T) {
+			up := newTestUpstream(t, nil)
+			ts := newTestServer(t, testConfig(t, up.Server, fmt.Sprintf("destination:\n  force_close: %v\n", forceClose)))
+
+			doc := `{"index":{}}` + "\n{}\n"
+			var remotes []string
+			for i := 0; i < 2; i++ {
+				if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc)); resp.StatusCode != http.StatusOK {
+					t.Fatalf("response %d %s", resp.StatusCode, body)
+				}
+				r, _ := up.last(t)
+				if r.Close != forceClose {
+					t.Errorf("request %d: connection close %v, want %v", i, r.Close, forceClose)
+				}
+				remotes = append(remotes, r.RemoteAddr)
+			}
+			// w/o force_close the connection is kept alive and reused
+			if reused := remotes[0] == remotes[1]; reused == forceClose {
+				t.Errorf("connections %v, reused %v", remotes, reused)
+			}
+		})
+	}
+}
+
+func TestConnReuseMetrics(t *testing.T) {
+	tests := []struct {
+		forceClose          bool
+		wantNew, wantReused int64
+	}{
+		{true, 2, 0},
+		{false, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("force_close %v", tt.forceClose), func(t *testing.T) {
+			up := newTestUpstream(t, nil)
+			ts := newTestServer(t, testConfig(t, up.Server, fmt.Sprintf("destination:\n  force_close: %v\n", tt.forceClose)))
+
+			for i := 0; i < 2; i++ {
+				if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n")); resp.StatusCode != http.StatusOK {
+					t.Fatalf("response %d %s", resp.StatusCode, body)
+				}
+			}
+			tags := pathTags(ts.paths.tag("/_bulk"))
+			if n := counterValue(ts.metrics, "conn_new", tags); n != tt.wantNew {
+				t.Errorf("conn_new %d, want %d", n, tt.wantNew)
+			}
+			if n := counterValue(ts.metrics, "conn_reused", tags); n != tt.wantReused {
+				t.Errorf("conn_reused %d, want %d", n, tt.wantReused)
+			}
+		})
+	}
+}
+
+// newTLSUpstream starts a tls destination stub, recording whether each
+// request's connection resumed a tls session, and returns the path of its ca
+// (certificate) file.
+func newTLSUpstream(t *testing.T) (*httptest.Server, string, func() []bool) {
+	t.Helper()
+	var (
+		resumed []bool
+		mu      sync.Mutex
+	)
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		resumed = append(resumed, r.TLS.DidResume)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(up.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: up.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return up, caFile, func() []bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]bool(nil), resumed...)
+	}
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	up, caFile, resumed := newTLSUpstream(t)
+	// with force_close (the default), each request is a new connection
+	ts := newTestServer(t, testConfig(t, up, "destination:\n  enable_tls: true\n  ca_file: "+caFile+"\n"))
+
+	doc := `{"index":{}}` + "\n{}\n"
+	for i := 0; i < 2; i++ {
+		if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("response %d %s", resp.StatusCode, body)
+		}
+	}
+	if got := resumed(); len(got) != 2 || got[0] || !got[1] {
+		t.Errorf("sessions resumed %v, want [false true]", got)
+	}
+}
+
+func TestTLSHandshakeErrors(t *testing.T) {
+	up, caFile, _ := newTLSUpstream(t)
+	u, err := url.Parse(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, dest := range map[string]string{
+		// signed by a ca which is not trusted
+		"unknown authority": "  host: 127.0.0.1\n",
+		// the certificate is not for localhost
+		"name mismatch": "  host: localhost\n  ca_file: " + caFile + "\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			logs := captureLog(t)
+			ts := newTestServer(t, testConfig(t, nil, "destination:\n"+dest+"  port: \""+u.Port()+"\"\n  enable_tls: true\n"))
+
+			resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"))
+			if resp.StatusCode == http.StatusOK {
+				t.Fatalf("response %d %s, want an error", resp.StatusCode, body)
+			}
+			if n := counterValue(ts.metrics, "tls_handshake_errors", pathTags("/_bulk")); n != 1 {
+				t.Errorf("tls_handshake_errors %d, want 1", n)
+			}
+			if !strings.Contains(logs.String(), "destination tls handshake failed") {
+				t.Errorf("handshake failure not logged:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestDestProxy(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://es.internal:9200/_bulk", nil)
+
+	cfg := testConfig(t, nil, "destination:\n  host: es.internal\n  use_env_proxy: false\n")
+	if proxy := destProxy(&cfg.Destination); proxy != nil {
+		t.Error("proxy func w/ use_env_proxy disabled")
+	}
+	transport := newDestClient(nil, false, nil, destProxy(&cfg.Destination)).Transport.(*http.Transport)
+	if transport.Proxy != nil {
+		t.Error("transport uses a proxy w/ use_env_proxy disabled")
+	}
+
+	cfg = testConfig(t, nil, "destination:\n  host: es.internal\n")
+	if proxy := destProxy(&cfg.Destination); proxy == nil {
+		t.Error("environment not used by default")
+	}
+
+	// proxy_url takes precedence over the environment setting
+	cfg = testConfig(t, nil, "destination:\n  host: es.internal\n  use_env_proxy: false\n  proxy_url: \"http://proxy:3128\"\n")
+	proxy := destProxy(&cfg.Destination)
+	if proxy == nil {
+		t.Fatal("no proxy func w/ proxy_url")
+	}
+	if u, err := proxy(req); err != nil || u.String() != "http://proxy:3128" {
+		t.Errorf("proxy %v (%v), want http://proxy:3128", u, err)
+	}
+}
+
+func TestReloadDestinationCA(t *testing.T) {
+	up, upCA, _ := newTLSUpstream(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, selfSignedCert(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, testConfig(t, up, "destination:\n  enable_tls: true\n  force_close: false\n  ca_file: "+caFile+"\n"))
+	doc := `{"index":{}}` + "\n{}\n"
+
+	// the upstream's certificate is not signed by the ca
+	if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc)); resp.StatusCode == http.StatusOK {
+		t.Fatalf("response %d %s, want the certificate rejected", resp.StatusCode, body)
+	}
+
+	ca, err := os.ReadFile(upCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ts.Reload()
+	if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("after reload: response %d %s", resp.StatusCode, body)
+	}
+
+	// an unreadable ca file leaves the current config in use
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ts.Reload()
+	if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc)); resp.StatusCode != http.StatusOK {
+		t.Errorf("after a failed reload: response %d %s", resp.StatusCode, body)
+	}
+}
+
+// selfSignedCert returns a (pem encoded) self-signed certificate.
+func selfSignedCert(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestUpstreamAddrLogged(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, ""))
+	logs := captureLog(t)
+
+	for _, req := range []*http.Request{
+		ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"),
+		ts.request(t, http.MethodGet, "/logs/_search", ""),
+	} {
+		if resp, body := ts.do(t, req); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: response %d %s", req.URL.Path, resp.StatusCode, body)
+		}
+	}
+
+	processed := 0
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry struct {
+			Message      string `json:"message"`
+			URL          string `json:"url"`
+			UpstreamAddr string `json:"upstream_addr"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("decoding log entry: %s\n%s", err, line)
+		}
+		if entry.Message != "request processed" {
+			continue
+		}
+		processed++
+		if entry.UpstreamAddr != up.Listener.Addr().String() {
+			t.Errorf("%s: upstream_addr %q, want %q", entry.URL, entry.UpstreamAddr, up.Listener.Addr())
+		}
+	}
+	if processed != 2 {
+		t.Errorf("%d requests logged, want 2:\n%s", processed, logs)
+	}
+}
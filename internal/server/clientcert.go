@@ -0,0 +1,74 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// clientCertTLSConfig returns the listener tls config requiring clients to
+// present a certificate signed by one of the CAs in caFile.
+func clientCertTLSConfig(caFile string) (*tls.Config, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client ca file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in client ca file (%s)", caFile)
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}, nil
+}
+
+// clientCertAccount returns the account identified by the verified client
+// certificate of r, the subject common name or, when the certificate has none,
+// its first DNS (then email) subject alternative name.
+func clientCertAccount(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName, true
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0], true
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0], true
+	}
+	return "", false
+}
+
+// clientCertHeaders are the headers identifying the client certificate on
+// forwarded requests (forward_client_cert).
+var clientCertHeaders = []string{"X-Client-Cert-Subject", "X-Client-Cert-Issuer", "X-Client-Cert-Fingerprint"}
+
+// setClientCertHeaders sets the subject, issuer and (sha256) fingerprint of
+// the verified client certificate of r on h. Headers of that name sent by the
+// client are removed, so they can not be spoofed.
+func setClientCertHeaders(h http.Header, r *http.Request) {
+	for _, name := range clientCertHeaders {
+		h.Del(name)
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(cert.Raw)
+	h.Set("X-Client-Cert-Subject", cert.Subject.String())
+	h.Set("X-Client-Cert-Issuer", cert.Issuer.String())
+	h.Set("X-Client-Cert-Fingerprint", hex.EncodeToString(sum[:]))
+}
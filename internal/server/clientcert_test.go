@@ -0,0 +1,223 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key, issued by parent (nil is self
+// signed).
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	issuer, signer := tmpl, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// files writes the certificate and key (pem) to dir, returning their paths.
+func (c *testCert) files(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// newTestServerCert creates a ca and a server certificate (for localhost)
+// issued by it, returning the ca and the paths of the ca, certificate and key
+// files.
+func newTestServerCert(t *testing.T) (*testCert, string, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	caFile, _ := ca.files(t, dir, "ca")
+	serverCert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "exporter"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	certFile, keyFile := serverCert.files(t, dir, "server")
+	return ca, caFile, certFile, keyFile
+}
+
+// clientTLSConfig is the config of a client trusting the ca, presenting
+// certs. The server name is sent (sni) so the exporter's certificate is
+// served rather than the certificate httptest adds to the listener.
+func (c *testCert) clientTLSConfig(certs ...tls.Certificate) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(c.cert)
+	return &tls.Config{
+		Certificates: certs,
+		RootCAs:      roots,
+		ServerName:   "localhost",
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+func TestClientCertAccount(t *testing.T) {
+	tests := []struct {
+		name  string
+		cert  *x509.Certificate
+		want  string
+		found bool
+	}{
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "acct-cn"}, DNSNames: []string{"dns.example"}}, "acct-cn", true},
+		{"dns san", &x509.Certificate{DNSNames: []string{"dns.example"}, EmailAddresses: []string{"a@example.com"}}, "dns.example", true},
+		{"email san", &x509.Certificate{EmailAddresses: []string{"a@example.com"}}, "a@example.com", true},
+		{"no identity", &x509.Certificate{}, "", false},
+		{"no certificate", nil, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.cert != nil {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert}}}
+			}
+			got, ok := clientCertAccount(r)
+			if got != tt.want || ok != tt.found {
+				t.Errorf("account %q %v, want %q %v", got, ok, tt.want, tt.found)
+			}
+		})
+	}
+}
+
+func TestClientCertAccountForwarded(t *testing.T) {
+	ca, caFile, certFile, keyFile := newTestServerCert(t)
+
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, `server:
+  cert_file: `+certFile+`
+  key_file: `+keyFile+`
+  client_ca_file: `+caFile+`
+  client_cert_account: true
+`))
+
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: ca.clientTLSConfig(certs...)}}
+	}
+
+	for _, cn := range []string{"acct-a", "acct-b"} {
+		clientCert := newTestCert(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: cn},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca)
+		// the password is passed along, the username is the certificate's
+		req := ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n")
+		req.SetBasicAuth("ignored", testToken)
+		resp, body := doRequest(t, client(clientCert.tlsCertificate()), req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: response %d %s", cn, resp.StatusCode, body)
+		}
+		r, _ := up.last(t)
+		if user, pass, _ := r.BasicAuth(); user != cn || pass != testToken {
+			t.Errorf("%s: forwarded as %q/%q, want %q/%q", cn, user, pass, cn, testToken)
+		}
+	}
+
+	// w/o a client certificate the handshake fails
+	if resp, err := client().Do(ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n")); err == nil {
+		resp.Body.Close()
+		t.Errorf("request w/o a client certificate: response %d", resp.StatusCode)
+	}
+}
+
+func TestForwardClientCert(t *testing.T) {
+	ca, caFile, certFile, keyFile := newTestServerCert(t)
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, `destination:
+  forward_client_cert: true
+server:
+  cert_file: `+certFile+`
+  key_file: `+keyFile+`
+  client_ca_file: `+caFile+`
+`))
+
+	clientCert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "shipper-1", Organization: []string{"logs"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: ca.clientTLSConfig(clientCert.tlsCertificate())}}
+	sum := sha256.Sum256(clientCert.cert.Raw)
+	want := map[string]string{
+		"X-Client-Cert-Subject":     "CN=shipper-1,O=logs",
+		"X-Client-Cert-Issuer":      "CN=test ca",
+		"X-Client-Cert-Fingerprint": hex.EncodeToString(sum[:]),
+	}
+
+	for _, req := range []*http.Request{
+		ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"),
+		ts.request(t, http.MethodGet, "/logs/_search", ""),
+	} {
+		// set by the client, replaced
+		req.Header.Set("X-Client-Cert-Subject", "CN=spoofed")
+		resp, body := doRequest(t, client, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: response %d %s", req.URL.Path, resp.StatusCode, body)
+		}
+		r, _ := up.last(t)
+		for name, value := range want {
+			if got := r.Header.Values(name); len(got) != 1 || got[0] != value {
+				t.Errorf("%s: %s %q, want %q", req.URL.Path, name, got, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the address of the client which made the request.
+//
+// With no trusted proxies, X-Forwarded-For is used as-is, falling back to the
+// remote address. Otherwise, forwarding headers are only honored when the
+// request comes from a trusted proxy: the X-Forwarded-For list is walked
+// from the right, skipping trusted proxies, and the first untrusted address
+// is the client. X-Real-IP is used when there is no X-Forwarded-For.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	if len(trusted) == 0 {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return xff
+		}
+		return r.RemoteAddr
+	}
+
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !isTrusted(peer, trusted) {
+		return peer
+	}
+
+	var hops []string
+	for _, xff := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(xff, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		if xrip := strings.TrimSpace(r.Header.Get("X-Real-IP")); xrip != "" {
+			return xrip
+		}
+		return peer
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isTrusted(hops[i], trusted) {
+			return hops[i]
+		}
+	}
+
+	// every hop is a trusted proxy, the left-most is as close to the client as it gets
+	return hops[0]
+}
+
+// forwardedProto returns the scheme (http or https) the client used. Behind a
+// trusted proxy, its X-Forwarded-Proto is used.
+func forwardedProto(r *http.Request, trusted []*net.IPNet) string {
+	if fromTrustedProxy(r, trusted) {
+		if proto := firstHop(r.Header.Get("X-Forwarded-Proto")); proto != "" {
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedHost returns the host the client requested. Behind a trusted
+// proxy, its X-Forwarded-Host is used.
+func forwardedHost(r *http.Request, trusted []*net.IPNet) string {
+	if fromTrustedProxy(r, trusted) {
+		if host := firstHop(r.Header.Get("X-Forwarded-Host")); host != "" {
+			return host
+		}
+	}
+	return r.Host
+}
+
+func fromTrustedProxy(r *http.Request, trusted []*net.IPNet) bool {
+	if len(trusted) == 0 {
+		return false
+	}
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	return isTrusted(peer, trusted)
+}
+
+// firstHop is the value set by the proxy closest to the client.
+func firstHop(value string) string {
+	first, _, _ := strings.Cut(value, ",")
+	return strings.TrimSpace(first)
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
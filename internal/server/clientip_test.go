@@ -0,0 +1,103 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []*net.IPNet{mustCIDR(t, "10.0.0.0/8"), mustCIDR(t, "192.168.1.0/24")}
+	tests := []struct {
+		name    string
+		remote  string
+		xff     []string
+		xrip    string
+		trusted []*net.IPNet
+		want    string
+	}{
+		{name: "no proxies, remote", remote: "203.0.113.7:5000", want: "203.0.113.7:5000"},
+		{name: "no proxies, xff as-is", remote: "10.0.0.1:5000", xff: []string{"198.51.100.1, 10.0.0.2"}, want: "198.51.100.1, 10.0.0.2"},
+		{name: "untrusted peer ignores xff", remote: "203.0.113.7:5000", xff: []string{"198.51.100.1"}, trusted: trusted, want: "203.0.113.7"},
+		{name: "one hop", remote: "10.0.0.1:5000", xff: []string{"198.51.100.1"}, trusted: trusted, want: "198.51.100.1"},
+		{name: "multi-hop", remote: "10.0.0.1:5000", xff: []string{"198.51.100.1, 192.168.1.5, 10.1.2.3"}, trusted: trusted, want: "198.51.100.1"},
+		{name: "spoofed left hop", remote: "10.0.0.1:5000", xff: []string{"1.2.3.4, 198.51.100.1, 10.1.2.3"}, trusted: trusted, want: "198.51.100.1"},
+		{name: "multiple headers", remote: "10.0.0.1:5000", xff: []string{"198.51.100.1", "192.168.1.5"}, trusted: trusted, want: "198.51.100.1"},
+		{name: "all trusted", remote: "10.0.0.1:5000", xff: []string{"192.168.1.5, 10.1.2.3"}, trusted: trusted, want: "192.168.1.5"},
+		{name: "x-real-ip", remote: "10.0.0.1:5000", xrip: "198.51.100.9", trusted: trusted, want: "198.51.100.9"},
+		{name: "trusted w/o headers", remote: "10.0.0.1:5000", trusted: trusted, want: "10.0.0.1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remote
+			for _, xff := range tc.xff {
+				r.Header.Add("X-Forwarded-For", xff)
+			}
+			if tc.xrip != "" {
+				r.Header.Set("X-Real-IP", tc.xrip)
+			}
+			if got := clientIP(r, tc.trusted); got != tc.want {
+				t.Errorf("client ip %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestForwardedProtoHost(t *testing.T) {
+	trusted := []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}
+	r := httptest.NewRequest(http.MethodGet, "http://exporter:9200/", nil)
+	r.Header.Set("X-Forwarded-Proto", "https, http")
+	r.Header.Set("X-Forwarded-Host", "logs.example.com, lb")
+
+	r.RemoteAddr = "10.0.0.1:5000"
+	if proto, host := forwardedProto(r, trusted), forwardedHost(r, trusted); proto != "https" || host != "logs.example.com" {
+		t.Errorf("trusted proxy: %s %s, want https logs.example.com", proto, host)
+	}
+	r.RemoteAddr = "203.0.113.7:5000"
+	if proto, host := forwardedProto(r, trusted), forwardedHost(r, trusted); proto != "http" || host != "exporter:9200" {
+		t.Errorf("untrusted peer: %s %s, want http exporter:9200", proto, host)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	ca, _, certFile, keyFile := newTestServerCert(t)
+	tests := []struct {
+		name   string
+		yaml   string
+		client *http.Client
+		proto  string
+	}{
+		{name: "plain", yaml: "destination:\n  add_forwarded_headers: true\n", client: http.DefaultClient, proto: "http"},
+		{
+			name:   "tls",
+			yaml:   "destination:\n  add_forwarded_headers: true\nserver:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n",
+			client: &http.Client{Transport: &http.Transport{TLSClientConfig: ca.clientTLSConfig()}},
+			proto:  "https",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := newTestUpstream(t, nil)
+			ts := newTestServer(t, testConfig(t, up.Server, tt.yaml))
+			req := ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n")
+			resp, body := doRequest(t, tt.client, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("response %d %s", resp.StatusCode, body)
+			}
+			r, _ := up.last(t)
+			if got := r.Header.Get("X-Forwarded-Proto"); got != tt.proto {
+				t.Errorf("X-Forwarded-Proto %q, want %q", got, tt.proto)
+			}
+			if got := r.Header.Get("X-Forwarded-Host"); got != req.URL.Host {
+				t.Errorf("X-Forwarded-Host %q, want %q", got, req.URL.Host)
+			}
+		})
+	}
+}
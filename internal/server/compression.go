@@ -0,0 +1,234 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/circonus-labs/go-trapmetrics"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// process cpu utilization (of GOMAXPROCS) above which requests are
+	// compressed with BestSpeed, and below which the default level is used
+	compressionBusyCPU = 0.75
+	compressionIdleCPU = 0.5
+)
+
+// bodyCompressor compresses request bodies forwarded to the destination with
+// the configured algorithm (gzip, zstd or none).
+type bodyCompressor struct {
+	tuner    *compressionTuner // gzip level, nil uses the default
+	algo     string
+	minBytes int64    // smaller bodies are not compressed
+	paths    []string // only bodies for these paths are compressed, empty all
+	noPaths  []string // bodies for these paths are not compressed
+}
+
+// forPath returns the compressor for a request to path, bodies for paths not
+// in compress_paths (when set) or in no_compress_paths are forwarded
+// uncompressed.
+func (c bodyCompressor) forPath(path string) bodyCompressor {
+	if (len(c.paths) > 0 && !matchPath(c.paths, path)) || matchPath(c.noPaths, path) {
+		c.algo = "none"
+	}
+	return c
+}
+
+// forSize returns the compressor for a body of size bytes, bodies smaller
+// than compress_min_bytes are forwarded uncompressed. Bodies of unknown size
+// (-1) are compressed.
+func (c bodyCompressor) forSize(size int64) bodyCompressor {
+	if size >= 0 && size < c.minBytes {
+		c.algo = "none"
+	}
+	return c
+}
+
+// writer returns a writer compressing to w, the compressed body is complete
+// once the writer is closed.
+func (c bodyCompressor) writer(w io.Writer) io.WriteCloser {
+	switch c.algo {
+	case "zstd":
+		enc, _ := zstdEncoders.Get().(*zstd.Encoder)
+		enc.Reset(w)
+		return zstdWriter{enc}
+	case "none":
+		return nopWriteCloser{w}
+	}
+	return c.tuner.writer(w)
+}
+
+// encoding returns the content encoding of compressed bodies.
+func (c bodyCompressor) encoding() string {
+	switch c.algo {
+	case "zstd":
+		return "zstd"
+	case "none":
+		return "identity"
+	}
+	return "gzip"
+}
+
+// setContentEncoding sets the Content-Encoding header for a non-empty body
+// with encoding, identity (uncompressed) bodies have none.
+func setContentEncoding(h http.Header, encoding string, size int) {
+	if size > 0 && encoding != "identity" {
+		h.Set("Content-Encoding", encoding)
+	}
+}
+
+// encoders are reused, each holds sizable buffers
+var zstdEncoders = sync.Pool{
+	New: func() interface{} {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	},
+}
+
+type zstdWriter struct {
+	*zstd.Encoder
+}
+
+func (z zstdWriter) Close() error {
+	err := z.Encoder.Close()
+	zstdEncoders.Put(z.Encoder)
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressionTuner adjusts the gzip level used for new requests to the load,
+// BestSpeed when the process is busy and the default level otherwise. A nil
+// tuner always uses the default level.
+type compressionTuner struct {
+	lastSample time.Time
+	lastCPU    time.Duration
+	level      atomic.Int64
+}
+
+func newCompressionTuner() *compressionTuner {
+	t := &compressionTuner{}
+	t.level.Store(gzip.DefaultCompression)
+	return t
+}
+
+// writer returns a gzip writer using the current level.
+func (t *compressionTuner) writer(w io.Writer) *gzip.Writer {
+	level := gzip.DefaultCompression
+	if t != nil {
+		level = int(t.level.Load())
+	}
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return gzip.NewWriter(w)
+	}
+	return gz
+}
+
+// compressBody copies src to the compressing writer gz and closes it, a
+// failure of either is counted (compression_errors) and returned.
+func compressBody(tm *trapmetrics.TrapMetrics, pathTag string, cb *copyBuffers, gz io.WriteCloser, src io.Reader) (int64, error) {
+	n, err := cb.copy(gz, src)
+	if err != nil {
+		_ = tm.CounterIncrement("compression_errors", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+		return n, fmt.Errorf("compressing body: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		_ = tm.CounterIncrement("compression_errors", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+		return n, fmt.Errorf("closing compressed buffer: %w", err)
+	}
+	return n, nil
+}
+
+// requestBody returns the body of r, decompressed when the client sent it gzip
+// encoded (recorded in the inbound_gzip metric).
+func requestBody(r *http.Request, tm *trapmetrics.TrapMetrics, pathTag string) (io.Reader, error) {
+	if !strings.EqualFold(strings.TrimSpace(r.Header.Get("Content-Encoding")), "gzip") {
+		return r.Body, nil
+	}
+	_ = tm.CounterIncrement("inbound_gzip", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return r.Body, nil // empty body
+		}
+		return nil, fmt.Errorf("decompressing body: %w", err)
+	}
+	return gz, nil
+}
+
+// adjust sets the level for a cpu utilization (0-1), between the busy and
+// idle thresholds the level is left as-is so it does not flap.
+func (t *compressionTuner) adjust(cpu float64) {
+	level := t.level.Load()
+	switch {
+	case cpu >= compressionBusyCPU:
+		level = gzip.BestSpeed
+	case cpu < compressionIdleCPU:
+		level = gzip.DefaultCompression
+	}
+	if prev := t.level.Swap(level); prev != level {
+		log.Info().Float64("cpu", cpu).Int64("level", level).Msg("gzip compression level changed")
+	}
+}
+
+// run samples the process cpu utilization every interval, adjusting the
+// level, until ctx is done.
+func (t *compressionTuner) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if cpu, ok := t.sample(); ok {
+				t.adjust(cpu)
+			}
+		}
+	}
+}
+
+// sample returns the process cpu utilization since the last sample.
+func (t *compressionTuner) sample() (float64, bool) {
+	var ru unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &ru); err != nil {
+		log.Warn().Err(err).Msg("sampling cpu usage")
+		return 0, false
+	}
+	now := time.Now()
+	used := time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+
+	prevSample, prevCPU := t.lastSample, t.lastCPU
+	t.lastSample, t.lastCPU = now, used
+	if prevSample.IsZero() {
+		return 0, false
+	}
+
+	elapsed := now.Sub(prevSample) * time.Duration(runtime.GOMAXPROCS(0))
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return float64(used-prevCPU) / float64(elapsed), true
+}
@@ -0,0 +1,277 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/circonus/c3-exporter/internal/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressionTunerAdjust(t *testing.T) {
+	tuner := newCompressionTuner()
+
+	// the level only changes crossing a threshold, between them it is kept
+	tests := []struct {
+		cpu  float64
+		want int64
+	}{
+		{0.2, gzip.DefaultCompression},
+		{0.9, gzip.BestSpeed},
+		{0.6, gzip.BestSpeed},
+		{0.3, gzip.DefaultCompression},
+		{0.6, gzip.DefaultCompression},
+		{0.75, gzip.BestSpeed},
+	}
+
+	for i, tt := range tests {
+		tuner.adjust(tt.cpu)
+		if got := tuner.level.Load(); got != tt.want {
+			t.Errorf("%d: cpu %.2f level %d, want %d", i, tt.cpu, got, tt.want)
+		}
+	}
+}
+
+func TestCompressionTunerWriter(t *testing.T) {
+	// the gzip header's extra flags (xfl) are 4 for BestSpeed, 0 for others
+	xfl := func(tuner *compressionTuner) byte {
+		t.Helper()
+		var buf bytes.Buffer
+		gz := tuner.writer(&buf)
+		_, _ = gz.Write([]byte(`{"message":"x"}`))
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()[8]
+	}
+
+	tuner := newCompressionTuner()
+	if got := xfl(tuner); got != 0 {
+		t.Errorf("idle: xfl %d, want 0 (default level)", got)
+	}
+	tuner.adjust(1)
+	if got := xfl(tuner); got != 4 {
+		t.Errorf("busy: xfl %d, want 4 (best speed)", got)
+	}
+	if got := xfl(nil); got != 0 {
+		t.Errorf("nil tuner: xfl %d, want 0 (default level)", got)
+	}
+}
+
+func TestInboundGzip(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, ""))
+
+	doc := `{"index":{}}` + "\n" + `{"message":"gzipped"}` + "\n"
+	for _, encoding := range []string{"gzip", ""} {
+		var body bytes.Buffer
+		if encoding == "gzip" {
+			gz := gzip.NewWriter(&body)
+			_, _ = gz.Write([]byte(doc))
+			_ = gz.Close()
+		} else {
+			body.WriteString(doc)
+		}
+		req := ts.request(t, http.MethodPost, "/_bulk", body.String())
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		resp, respBody := ts.do(t, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("encoding %q: response %d %s", encoding, resp.StatusCode, respBody)
+		}
+		if _, got := up.last(t); got != doc {
+			t.Errorf("encoding %q: forwarded body %q, want %q", encoding, got, doc)
+		}
+	}
+
+	// only the gzip encoded request is counted
+	if n := counterValue(ts.metrics, "inbound_gzip", pathTags(ts.paths.tag("/_bulk"))); n != 1 {
+		t.Errorf("inbound_gzip %d, want 1", n)
+	}
+}
+
+func TestCompressionAlgo(t *testing.T) {
+	doc := `{"index":{}}` + "\n" + `{"message":"compressed"}` + "\n"
+
+	tests := []struct {
+		algo, wantEncoding string
+		decode             func([]byte) ([]byte, error)
+	}{
+		{"gzip", "gzip", nil}, // decompressed by the upstream stub
+		{"zstd", "zstd", func(b []byte) ([]byte, error) {
+			dec, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+			defer dec.Close()
+			return dec.DecodeAll(b, nil)
+		}},
+		{"none", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algo, func(t *testing.T) {
+			up := newTestUpstream(t, nil)
+			ts := newTestServer(t, testConfig(t, up.Server, "destination:\n  compression_algo: "+tt.algo+"\n"))
+
+			resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("response %d %s", resp.StatusCode, body)
+			}
+			r, got := up.last(t)
+			if enc := r.Header.Get("Content-Encoding"); enc != tt.wantEncoding {
+				t.Errorf("content encoding %q, want %q", enc, tt.wantEncoding)
+			}
+			if tt.decode != nil {
+				data, err := tt.decode([]byte(got))
+				if err != nil {
+					t.Fatalf("decoding body: %s", err)
+				}
+				got = string(data)
+			}
+			if got != doc {
+				t.Errorf("forwarded body %q, want %q", got, doc)
+			}
+		})
+	}
+}
+
+// failingWriter is a compressing writer whose writes or close fail.
+type failingWriter struct {
+	writeErr, closeErr error
+}
+
+func (f failingWriter) Write(p []byte) (int, error) {
+	if f.writeErr != nil {
+		return 0, f.writeErr
+	}
+	return len(p), nil
+}
+
+func (f failingWriter) Close() error { return f.closeErr }
+
+func TestCompressBodyErrors(t *testing.T) {
+	broker := newTestBroker(t)
+	tm, _, err := initMetrics(config.Circonus{APIKey: testToken, APIURL: broker.URL, SubmissionURL: broker.submissionURL()})
+	if err != nil {
+		t.Fatalf("init metrics: %s", err)
+	}
+
+	failed := errors.New("no space left")
+	tests := []struct {
+		name    string
+		gz      failingWriter
+		wantErr string
+	}{
+		{"ok", failingWriter{}, ""},
+		{"write", failingWriter{writeErr: failed}, "compressing body: no space left"},
+		{"close", failingWriter{closeErr: failed}, "closing compressed buffer: no space left"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/" + tt.name
+			_, err := compressBody(tm, path, newCopyBuffers(32*1024), tt.gz, strings.NewReader("body"))
+			var want int64
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("error %s, want none", err)
+			case tt.wantErr != "":
+				want = 1
+				if err == nil || err.Error() != tt.wantErr || !errors.Is(err, failed) {
+					t.Errorf("error %v, want %s", err, tt.wantErr)
+				}
+			}
+			if n := counterValue(tm, "compression_errors", pathTags(path)); n != want {
+				t.Errorf("compression_errors %d, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestCompressMinBytes(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, "destination:\n  compress_min_bytes: 100\n"))
+
+	small := `{"index":{}}` + "\n{}\n"
+	large := strings.Repeat(`{"index":{}}`+"\n"+`{"message":"over the threshold"}`+"\n", 5)
+	tests := []struct {
+		name         string
+		body         string
+		chunked      bool
+		wantEncoding string
+	}{
+		{"under", small, false, ""},
+		{"over", large, false, "gzip"},
+		{"unknown size", small, true, "gzip"},
+	}
+
+	for _, tt := range tests {
+		req := ts.request(t, http.MethodPost, "/_bulk", "")
+		req.Body = io.NopCloser(strings.NewReader(tt.body))
+		if !tt.chunked {
+			req.ContentLength = int64(len(tt.body))
+		}
+		resp, body := ts.do(t, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: response %d %s", tt.name, resp.StatusCode, body)
+		}
+		r, got := up.last(t)
+		if enc := r.Header.Get("Content-Encoding"); enc != tt.wantEncoding {
+			t.Errorf("%s: content encoding %q, want %q", tt.name, enc, tt.wantEncoding)
+		}
+		if got != tt.body {
+			t.Errorf("%s: forwarded body %q, want %q", tt.name, got, tt.body)
+		}
+	}
+}
+
+func TestCompressPaths(t *testing.T) {
+	doc := `{"index":{}}` + "\n{}\n"
+	tests := []struct {
+		name string
+		yaml string
+		want map[string]string // content encoding by path
+	}{
+		{
+			name: "no_compress_paths",
+			yaml: "destination:\n  no_compress_paths: [/otel-v1-apm-span/]\n",
+			want: map[string]string{"/_bulk": "gzip", "/otel-v1-apm-span/_bulk": ""},
+		},
+		{
+			name: "compress_paths",
+			yaml: "destination:\n  compress_paths: [/_bulk]\n",
+			want: map[string]string{"/_bulk": "gzip", "/otel-v1-apm-span/_bulk": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := newTestUpstream(t, nil)
+			ts := newTestServer(t, testConfig(t, up.Server, tt.yaml))
+			for path, want := range tt.want {
+				resp, body := ts.do(t, ts.request(t, http.MethodPost, path, doc))
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("%s: response %d %s", path, resp.StatusCode, body)
+				}
+				r, got := up.last(t)
+				if enc := r.Header.Get("Content-Encoding"); enc != want {
+					t.Errorf("%s: content encoding %q, want %q", path, enc, want)
+				}
+				if got != doc {
+					t.Errorf("%s: forwarded body %q, want %q", path, got, doc)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// configWatchInterval is how often the config file is checked for changes.
+var configWatchInterval = time.Second
+
+// fileStamp identifies a version of a file w/o reading it.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(file string) (fileStamp, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+func (f fileStamp) equal(o fileStamp) bool {
+	return f.modTime.Equal(o.modTime) && f.size == o.size
+}
+
+// WatchConfig checks the config file for changes until ctx is done, for
+// environments which can not send SIGHUP (e.g. a remounted ConfigMap). Once
+// the file has changed, and then not changed for debounce (so a file being
+// rewritten is not reloaded mid-write), the tls files are re-read as on
+// SIGHUP. The config itself is not re-read, other changes need a restart.
+// Config read from stdin or a url is not watched.
+func (s *Server) WatchConfig(ctx context.Context, file string, debounce time.Duration) {
+	if file == "-" || strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://") {
+		log.Warn().Str("file", file).Msg("config not read from a file, not watching for changes")
+		return
+	}
+
+	last, err := statFile(file)
+	if err != nil {
+		log.Warn().Err(err).Str("file", file).Msg("watching config")
+	}
+	var changed time.Time // when a change not yet reloaded was last seen
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stamp, err := statFile(file)
+			if err != nil {
+				// e.g. replaced (removed and recreated), checked again
+				log.Debug().Err(err).Str("file", file).Msg("watching config")
+				continue
+			}
+			if !stamp.equal(last) {
+				last = stamp
+				changed = time.Now()
+				continue
+			}
+			if !changed.IsZero() && time.Since(changed) >= debounce {
+				changed = time.Time{}
+				log.Info().Str("file", file).Msg("config changed, reloading tls files")
+				s.Reload()
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchConfig(t *testing.T) {
+	orig := configWatchInterval
+	configWatchInterval = 10 * time.Millisecond
+	t.Cleanup(func() { configWatchInterval = orig })
+
+	up, upCA, _ := newTLSUpstream(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, selfSignedCert(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(file, []byte("destination:\n  ca_file: "+caFile+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, testConfig(t, up, "destination:\n  enable_tls: true\n  force_close: false\n  ca_file: "+caFile+"\n"))
+	logs := captureLog(t)
+	doc := `{"index":{}}` + "\n{}\n"
+
+	// the upstream's certificate is not signed by the ca
+	if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc)); resp.StatusCode == http.StatusOK {
+		t.Fatalf("response %d %s, want the certificate rejected", resp.StatusCode, body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watched := make(chan struct{})
+	defer func() {
+		cancel()
+		<-watched
+	}()
+	const debounce = 300 * time.Millisecond
+	go func() {
+		defer close(watched)
+		ts.WatchConfig(ctx, file, debounce)
+	}()
+	reloads := func() int { return strings.Count(logs.String(), "config changed, reloading tls files") }
+
+	// e.g. a remounted ConfigMap and Secret, the ca file changes w/o SIGHUP
+	time.Sleep(50 * time.Millisecond)
+	ca, err := os.ReadFile(upCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("destination:\n  ca_file: "+caFile+"\n  enable_tls: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	changed := time.Now()
+
+	// not reloaded until the file is unchanged for the debounce
+	time.Sleep(debounce / 2)
+	if n := reloads(); n != 0 {
+		t.Fatalf("%d reloads within the debounce window", n)
+	}
+	deadline := changed.Add(debounce + 2*time.Second)
+	for reloads() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("not reloaded %s after the change:\n%s", time.Since(changed), logs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(changed); elapsed < debounce {
+		t.Errorf("reloaded %s after the change, before the %s debounce", elapsed, debounce)
+	}
+	if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc)); resp.StatusCode != http.StatusOK {
+		t.Errorf("after the reload: response %d %s", resp.StatusCode, body)
+	}
+
+	// once reloaded, an unchanged file is not reloaded again
+	time.Sleep(debounce + 100*time.Millisecond)
+	if n := reloads(); n != 1 {
+		t.Errorf("%d reloads, want 1", n)
+	}
+}
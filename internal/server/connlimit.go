@@ -0,0 +1,136 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/circonus-labs/go-trapmetrics"
+	"github.com/rs/zerolog/log"
+)
+
+// clientLimiter bounds the requests in flight from any one client ip.
+type clientLimiter struct {
+	active map[string]int
+	max    int
+	mu     sync.Mutex
+}
+
+func newClientLimiter(limit int) *clientLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &clientLimiter{
+		active: make(map[string]int),
+		max:    limit,
+	}
+}
+
+// acquire returns false if the client is already at the limit.
+func (l *clientLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] >= l.max {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+func (l *clientLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] <= 1 {
+		delete(l.active, ip)
+		return
+	}
+	l.active[ip]--
+}
+
+// limitClients rejects, with 503, requests from a client which already has
+// server.max_conns_per_ip requests in flight (client_limited metric). Behind
+// trusted proxies the client is taken from the forwarding headers, otherwise
+// from the connection (forwarding headers are not trusted to avoid the
+// limit). /health is not limited.
+func (s *Server) limitClients(next http.Handler) http.Handler {
+	if s.limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := limitIP(r, s.cfg.Server.TrustedNets)
+		if !s.limiter.acquire(ip) {
+			_ = s.metrics.CounterIncrement("client_limited", trapmetrics.Tags{{Category: "path", Value: s.paths.tag(r.URL.Path)}})
+			log.Warn().Str("remote", ip).Str("path", r.URL.Path).Msg("too many concurrent requests from client, rejecting")
+			writeError(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.limiter.release(ip)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitIP is the client ip requests are limited by.
+func limitIP(r *http.Request, trusted []*net.IPNet) string {
+	if len(trusted) > 0 {
+		return clientIP(r, trusted)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// limitRequests bounds the requests handled concurrently to
+// server.max_concurrent_requests, further requests wait for a slot. The time
+// waited is recorded, by path, in the queue_wait_ms histogram and the request
+// log, telling local saturation from a slow destination. Requests waiting
+// longer than the write timeout are rejected with 503 (queue_timeout
+// metric). /health is not limited.
+func (s *Server) limitRequests(next http.Handler) http.Handler {
+	if s.slots == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tags := trapmetrics.Tags{{Category: "path", Value: s.paths.tag(r.URL.Path)}}
+		start := time.Now()
+		var timeout <-chan time.Time // w/o a write timeout, wait for the client
+		if s.writeTimeout > 0 {
+			timer := time.NewTimer(s.writeTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case s.slots <- struct{}{}:
+		case <-r.Context().Done():
+			return
+		case <-timeout:
+			_ = s.metrics.CounterIncrement("queue_timeout", tags)
+			log.Warn().Str("path", r.URL.Path).Str("wait", time.Since(start).String()).Msg("no request slot available, rejecting")
+			writeError(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-s.slots }()
+
+		wait := time.Since(start)
+		_ = s.metrics.HistogramRecordValue("queue_wait_ms", tags, float64(wait)/float64(time.Millisecond))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), queueWaitKey, wait)))
+	})
+}
@@ -0,0 +1,151 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientLimiter(t *testing.T) {
+	if l := newClientLimiter(0); l != nil {
+		t.Error("limiter w/o a limit")
+	}
+
+	l := newClientLimiter(2)
+	if !l.acquire("10.0.0.1") || !l.acquire("10.0.0.1") {
+		t.Fatal("requests under the limit rejected")
+	}
+	if l.acquire("10.0.0.1") {
+		t.Error("request over the limit accepted")
+	}
+	if !l.acquire("10.0.0.2") {
+		t.Error("other client limited")
+	}
+	l.release("10.0.0.1")
+	if !l.acquire("10.0.0.1") {
+		t.Error("request rejected after a release")
+	}
+	l.release("10.0.0.1")
+	l.release("10.0.0.1")
+	l.release("10.0.0.2")
+	if len(l.active) != 0 {
+		t.Errorf("clients %v left after all were released", l.active)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock() // the destination is not left blocked on a failure
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_bulk" {
+			arrived <- struct{}{}
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, "server:\n  max_conns_per_ip: 1\n"))
+
+	// a request in flight, held by the destination
+	first := ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n")
+	done := make(chan int, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(first)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-arrived
+
+	// the client's next request is over the limit, /health is not limited
+	resp, body := ts.do(t, ts.request(t, http.MethodGet, "/logs/_search", ""))
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("request over the limit: response %d %s, want 503", resp.StatusCode, body)
+	}
+	if n := counterValue(ts.metrics, "client_limited", pathTags(ts.paths.tag("/logs/_search"))); n != 1 {
+		t.Errorf("client_limited %d, want 1", n)
+	}
+	if resp, body := ts.do(t, ts.request(t, http.MethodGet, "/health", "")); resp.StatusCode != http.StatusOK {
+		t.Errorf("/health: response %d %s", resp.StatusCode, body)
+	}
+
+	unblock()
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("request in flight: response %d", status)
+	}
+
+	// under the limit again
+	if resp, body := ts.do(t, ts.request(t, http.MethodGet, "/logs/_search", "")); resp.StatusCode != http.StatusOK {
+		t.Errorf("after the request completed: response %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock()
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_bulk" {
+			arrived <- struct{}{}
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, "server:\n  max_concurrent_requests: 1\n"))
+
+	send := func(req *http.Request, done chan<- int) {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}
+
+	// the only slot is held by a request the destination holds
+	firstDone := make(chan int, 1)
+	go send(ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"), firstDone)
+	<-arrived
+
+	// the next request waits for the slot
+	secondDone := make(chan int, 1)
+	go send(ts.request(t, http.MethodGet, "/logs/_search", ""), secondDone)
+	const held = 100 * time.Millisecond
+	time.Sleep(held)
+	if n := up.received(); n != 1 {
+		t.Errorf("destination received %d requests while the slot was held, want 1", n)
+	}
+	unblock()
+	for _, done := range []chan int{firstDone, secondDone} {
+		if status := <-done; status != http.StatusOK {
+			t.Errorf("response %d, want 200", status)
+		}
+	}
+
+	h := histogram(ts.metrics, "queue_wait_ms", pathTags(ts.paths.tag("/logs/_search")))
+	if h == nil || h.Count() != 1 {
+		t.Fatalf("queue_wait_ms not recorded for the waiting request: %v", h)
+	}
+	if h.Max() <= 0 {
+		t.Errorf("queue_wait_ms %vms, want > 0", h.Max())
+	}
+	if h := histogram(ts.metrics, "queue_wait_ms", pathTags("/_bulk")); h == nil || h.Count() != 1 {
+		t.Errorf("queue_wait_ms not recorded for the first request: %v", h)
+	}
+}
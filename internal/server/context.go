@@ -10,4 +10,10 @@ type contextKey string
 const (
 	basicAuthUser = contextKey("basicAuthUser")
 	basicAuthPass = contextKey("basicAuthPass")
+	// request counts of the connection a request was read from
+	connRequestsKey = contextKey("connRequests")
+	// set on requests logged in the combined format
+	accessLogKey = contextKey("accessLog")
+	// time a request waited for a slot (max_concurrent_requests)
+	queueWaitKey = contextKey("queueWait")
 )
@@ -0,0 +1,39 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBuffers pools the buffers used to copy request and response bodies,
+// larger buffers mean fewer reads/writes (syscalls) for large bodies.
+type copyBuffers struct {
+	pool sync.Pool
+}
+
+func newCopyBuffers(size int) *copyBuffers {
+	c := &copyBuffers{}
+	c.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return c
+}
+
+// copy copies src to dst using a pooled buffer, a nil copyBuffers uses
+// io.Copy.
+func (c *copyBuffers) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if c == nil {
+		return io.Copy(dst, src)
+	}
+	buf, _ := c.pool.Get().(*[]byte)
+	defer c.pool.Put(buf)
+	// hide ReaderFrom/WriterTo (e.g. http.ResponseWriter), which would
+	// otherwise be used in place of the buffer
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
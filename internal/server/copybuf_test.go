@@ -0,0 +1,71 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// countingWriter counts writes, each a syscall when writing to a connection.
+type countingWriter struct {
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func TestCopyBuffers(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 100*1024)
+	for _, cb := range []*copyBuffers{nil, newCopyBuffers(64 * 1024)} {
+		var dst bytes.Buffer
+		n, err := cb.copy(&dst, bytes.NewReader(body))
+		if err != nil || n != int64(len(body)) || !bytes.Equal(dst.Bytes(), body) {
+			t.Errorf("copied %d (%v), want %d", n, err, len(body))
+		}
+	}
+
+	// the pooled buffer is used, even for writers with ReadFrom
+	w := &countingWriter{}
+	if _, err := newCopyBuffers(64*1024).copy(w, struct{ io.Reader }{bytes.NewReader(body)}); err != nil {
+		t.Fatal(err)
+	}
+	if w.writes != 2 {
+		t.Errorf("%d writes, want 2 of the 64KiB buffer", w.writes)
+	}
+}
+
+// BenchmarkCopyLargeBody copies an 8MiB body (e.g. a large _search response),
+// reporting the writes (syscalls) per copy for io.Copy's 32KiB buffer and
+// pooled buffers of copy_buffer_size.
+func BenchmarkCopyLargeBody(b *testing.B) {
+	body := bytes.Repeat([]byte(`{"_source":{"message":"x"}}`), 8*1024*1024/27)
+
+	for _, size := range []int{0, 32 * 1024, 256 * 1024, 1024 * 1024} {
+		name := "io.Copy"
+		var cb *copyBuffers
+		if size > 0 {
+			name = fmt.Sprintf("%dKiB", size/1024)
+			cb = newCopyBuffers(size)
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			w := &countingWriter{}
+			for i := 0; i < b.N; i++ {
+				// a network body, w/o WriterTo
+				src := struct{ io.Reader }{bytes.NewReader(body)}
+				if _, err := cb.copy(w, src); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// deadlineMargin is left between the upstream deadline and the handler
+// deadline, so a request which times out upstream is answered (504) by the
+// handler rather than by the timeout handler.
+const deadlineMargin = 100 * time.Millisecond
+
+// backgroundTimeout bounds requests sent outside of a client request (spooled
+// and queued bodies), which have no handler deadline.
+const backgroundTimeout = 60 * time.Second
+
+// upstreamTimeout bounds the requests forwarded for a client request when
+// there is neither a handler timeout nor a write_timeout, so a stalled
+// upstream does not hold the request (and its connections) indefinitely.
+const upstreamTimeout = 60 * time.Second
+
+// upstreamContext returns the context for the requests forwarded for r, w/a
+// single deadline: the handler timeout (on r's context, set by the timeout
+// handler) or the server write_timeout, after which a response can no longer
+// be written, whichever is sooner, less a margin. Attempts, retry waits and
+// failover all end at it, rather than e.g. continuing after the handler has
+// returned. With neither, they end after upstreamTimeout.
+func upstreamContext(r *http.Request, writeTimeout time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := r.Context().Deadline()
+	if writeTimeout > 0 {
+		if wd := time.Now().Add(writeTimeout); !ok || wd.Before(deadline) {
+			deadline, ok = wd, true
+		}
+	}
+	if !ok {
+		return context.WithTimeout(r.Context(), upstreamTimeout)
+	}
+	return context.WithDeadline(r.Context(), deadline.Add(-deadlineMargin))
+}
+
+// upstreamTimedOut returns true if a forwarded request failed because the
+// upstream deadline (see upstreamContext) passed.
+func upstreamTimedOut(ctx context.Context, err error) bool {
+	return err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
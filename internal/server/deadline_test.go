@@ -0,0 +1,83 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamContext(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/_bulk", nil)
+
+	// a write_timeout over the old 60s client timeout is not capped
+	ctx, cancel := upstreamContext(r, 90*time.Second)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatal("no deadline")
+	}
+	if d := time.Until(deadline); d < 89*time.Second || d > 90*time.Second {
+		t.Errorf("deadline in %s, want ~90s less the margin", d)
+	}
+
+	// w/o a write_timeout or handler deadline, the fallback bounds them
+	ctx, cancel = upstreamContext(r, 0)
+	defer cancel()
+	deadline, ok = ctx.Deadline()
+	if !ok {
+		t.Fatal("no deadline w/o a write_timeout or handler deadline")
+	}
+	if d := time.Until(deadline); d < upstreamTimeout-time.Second || d > upstreamTimeout {
+		t.Errorf("deadline in %s, want ~%s", d, upstreamTimeout)
+	}
+
+	if c := newDestClient(nil, false, nil, nil); c.Timeout != 0 {
+		t.Errorf("destination client timeout %s, the request deadline governs", c.Timeout)
+	}
+}
+
+func TestBulkUpstreamTimeout(t *testing.T) {
+	release := make(chan struct{})
+	cancelled := make(chan struct{}, 1)
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-release:
+		}
+	})
+	defer close(release)
+	cfg := testConfig(t, up.Server, `
+server:
+  write_timeout: "500ms"
+destination:
+  bulk_retry:
+    max: 3
+    wait_min: "1ms"
+    wait_max: "1ms"
+`)
+	ts := newTestServer(t, cfg)
+
+	start := time.Now()
+	resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n"+`{"a":1}`+"\n"))
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("response %d %s, want 504", resp.StatusCode, body)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("answered after %s, want at the write_timeout", d)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Error("upstream request not cancelled at the deadline")
+	}
+	if n := counterValue(ts.metrics, "upstream_timeout", pathTags("/_bulk")); n != 1 {
+		t.Errorf("upstream_timeout %d, want 1", n)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// errorResponse is the OpenSearch error envelope, errors generated by the
+// exporter itself use it so client libraries can parse them.
+type errorResponse struct {
+	Error  errorCause `json:"error"`
+	Status int        `json:"status"`
+}
+
+type errorCause struct {
+	RootCause []errorCause `json:"root_cause,omitempty"`
+	Type      string       `json:"type"`
+	Reason    string       `json:"reason"`
+}
+
+// writeError replies with an OpenSearch style json error, it is the json
+// analog of http.Error and takes the same arguments.
+func writeError(w http.ResponseWriter, reason string, code int) {
+	cause := errorCause{Type: errorType(code), Reason: reason}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", "application/json; charset=UTF-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(errorResponse{
+		Error: errorCause{
+			RootCause: []errorCause{cause},
+			Type:      cause.Type,
+			Reason:    cause.Reason,
+		},
+		Status: code,
+	})
+}
+
+// errorType maps a status code to an OpenSearch exception type.
+func errorType(code int) string {
+	switch code {
+	case http.StatusBadRequest:
+		return "illegal_argument_exception"
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "security_exception"
+	case http.StatusNotFound:
+		return "resource_not_found_exception"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed_exception"
+	case http.StatusServiceUnavailable:
+		return "rejected_execution_exception"
+	default:
+		return "exporter_exception"
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Encoding", "gzip")
+	writeError(rec, "invalid gzip request body", http.StatusBadRequest)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json; charset=UTF-8" {
+		t.Errorf("content type %q", ct)
+	}
+	if ce := rec.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("content encoding %q kept", ce)
+	}
+
+	// the OpenSearch error shape, as parsed by client libraries
+	var resp struct {
+		Error struct {
+			RootCause []struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"root_cause"`
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+		Status int `json:"status"`
+	}
+	dec := json.NewDecoder(rec.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatalf("decoding error: %s", err)
+	}
+	if resp.Status != 400 || resp.Error.Type != "illegal_argument_exception" || resp.Error.Reason != "invalid gzip request body" {
+		t.Errorf("error %+v", resp)
+	}
+	if len(resp.Error.RootCause) != 1 || resp.Error.RootCause[0].Type != resp.Error.Type || resp.Error.RootCause[0].Reason != resp.Error.Reason {
+		t.Errorf("root cause %+v", resp.Error.RootCause)
+	}
+}
+
+func TestErrorResponseFromServer(t *testing.T) {
+	ts := newTestServer(t, testConfig(t, nil, "destination:\n  host: localhost\n"))
+
+	req := ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n")
+	req.Header.Del("Authorization")
+	resp, body := ts.do(t, req)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("response %d %s, want 401", resp.StatusCode, body)
+	}
+	var e errorResponse
+	if err := json.Unmarshal(body, &e); err != nil {
+		t.Fatalf("decoding error: %s\n%s", err, body)
+	}
+	if e.Status != http.StatusUnauthorized || e.Error.Type != "security_exception" || len(e.Error.RootCause) != 1 {
+		t.Errorf("error %+v", e)
+	}
+}
@@ -7,29 +7,34 @@ package server
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/circonus-labs/go-trapmetrics"
 	"github.com/circonus/c3-exporter/internal/config"
 	"github.com/circonus/c3-exporter/internal/logger"
 	"github.com/circonus/c3-exporter/internal/release"
+	"github.com/circonus/c3-exporter/internal/spool"
 	"github.com/google/uuid"
 	"github.com/hashicorp/go-retryablehttp"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 func (s *Server) serverError(w http.ResponseWriter, err error) {
 	stack := string(debug.Stack())
 	log.Error().Err(err).Str("stack", stack).Msg("server error")
-	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
 type genericHandler struct {
@@ -42,215 +47,452 @@ func (h genericHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.s.genericRequest(w, r)
 	default:
 		log.Warn().Str("method", r.Method).Str("uri", r.RequestURI).Msg("request received")
-		http.Error(w, "not found", http.StatusNotFound)
+		_ = h.s.metrics.CounterIncrement("method_not_allowed", methodTags(h.s.paths, r))
+		writeError(w, "not found", http.StatusNotFound)
 	}
 }
 
-type healthHandler struct{}
+// disabledRouteHandler responds 404 to requests for disabled routes
+// (disabled_routes), recording route_disabled.
+type disabledRouteHandler struct {
+	s *Server
+}
+
+func (h disabledRouteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_ = h.s.metrics.CounterIncrement("route_disabled", methodTags(h.s.paths, r))
+	writeError(w, "not found", http.StatusNotFound)
+}
+
+// methodNotAllowed records method_not_allowed and responds 405.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, tm *trapmetrics.TrapMetrics, paths pathTagger) {
+	_ = tm.CounterIncrement("method_not_allowed", methodTags(paths, r))
+	writeError(w, "method not supported", http.StatusMethodNotAllowed)
+}
+
+type healthHandler struct {
+	started time.Time
+	stats   *serverStats
+	format  string
+}
+
+type healthResponse struct {
+	Status         string      `json:"status"`
+	Uptime         string      `json:"uptime"`
+	UptimeSeconds  float64     `json:"uptime_seconds"`
+	Flushes        uint64      `json:"flushes"`
+	FlushFailures  uint64      `json:"flush_failures"`
+	LastFlushError *flushError `json:"last_flush_error,omitempty"`
+}
 
-func (healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	_, _ = w.Write([]byte("OK"))
+func (h healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.format != "json" {
+		_, _ = w.Write([]byte("OK"))
+		return
+	}
+
+	uptime := time.Since(h.started)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(healthResponse{
+		Status:         "ok",
+		Uptime:         uptime.Round(time.Second).String(),
+		UptimeSeconds:  uptime.Seconds(),
+		Flushes:        h.stats.flushes.Load(),
+		FlushFailures:  h.stats.flushFailures.Load(),
+		LastFlushError: h.stats.lastFlushError.Load(),
+	})
 }
 
 type bulkHandler struct {
-	metrics   *trapmetrics.TrapMetrics
-	dataToken string
-	dest      config.Destination
-	debug     bool
+	metrics        *trapmetrics.TrapMetrics
+	spool          *spool.Spooler
+	async          *asyncQueue
+	shadow         *shadowForwarder
+	dataToken      string
+	defaultAccount string
+	dest           config.Destination
+	clients        *destClients
+	idempotency    *responseCache
+	statusRemap    map[int]int
+	retry          config.Retry
+	compressor     bodyCompressor
+	copyBuffers    *copyBuffers
+	stripHeaders   []string
+	stats          *serverStats
+	rejectEmpty    bool
+	validateBulk   bool
+	trailers       bool
+	requestID      string
+	bulkDocs       bool
+	paths          pathTagger
+	accounts       accountMetrics
+	requestTags    requestTagger
+	trustedProxies []*net.IPNet
+	slowRequest    time.Duration
+	writeTimeout   time.Duration
+	debugBodies    int
+	debug          bool
 }
 
 func (h bulkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, h.metrics, h.paths)
 		return
 	}
 
-	// extract basic auth credentials
-	// we're not going to verify them, but they must be present so they can be
-	// passed upstream and ultimately to OpenSearch.
-	username, password, ok := r.BasicAuth()
+	// credentials, extracted by verifyBasicAuth (from basic auth, or the
+	// client certificate)
+	username, ok := r.Context().Value(basicAuthUser).(string)
 	if !ok {
 		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	password, _ := r.Context().Value(basicAuthPass).(string)
 
-	reqID := uuid.New()
-	reqLogger := log.With().Str("req_id", reqID.String()).Logger()
+	reqID := requestID(r, h.requestID)
+	reqLogger := log.With().Str("req_id", reqID).Logger()
 	handleStart := time.Now()
-
-	remote := r.Header.Get("X-Forwarded-For")
-	if remote == "" {
-		remote = r.RemoteAddr
+	pathTag := h.paths.tag(r.URL.Path)
+	reqTags := h.requestTags.tags(r, h.metrics, pathTag)
+
+	remote := clientIP(r, h.trustedProxies)
+
+	// a repeat of a request already answered (e.g. a client retrying after
+	// a network error) is answered with the same response, not forwarded
+	var idemKey string
+	if h.idempotency != nil && r.Header.Get("Idempotency-Key") != "" {
+		idemKey = cacheKey(username, password, r.URL.Path+" "+r.Header.Get("Idempotency-Key"))
+		if entry, ok := h.idempotency.get(idemKey); ok {
+			_, _ = io.Copy(io.Discard, r.Body)
+			_ = h.metrics.CounterIncrement("idempotent_replay", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+			if entry.contentType != "" {
+				w.Header().Set("Content-Type", entry.contentType)
+			}
+			setHeaders(w.Header(), h.dest.CompatHeaders.Response)
+			stripHeaders(w.Header(), h.stripHeaders)
+			w.WriteHeader(remapStatus(h.statusRemap, entry.status))
+			_, _ = w.Write(entry.body)
+			recordRespBytes(h.metrics, pathTag, int64(len(entry.body)))
+
+			handleDur := time.Since(handleStart)
+			requestEvent(r, reqLogger, h.slowRequest, handleDur).
+				Str("remote", remote).
+				Str("proto", r.Proto).
+				Str("idempotency_key", r.Header.Get("Idempotency-Key")).
+				Str("handle_dur", handleDur.String()).
+				Int("resp_size", len(entry.body)).
+				Msg("duplicate request, not forwarded")
+			return
+		}
 	}
 
 	method := r.Method
+	reqBody := newBodyCapture(h.debugBodies)
 	var buf bytes.Buffer
-	gz := gzip.NewWriter(&buf)
+	// the size of bodies sent w/o a content encoding is known up front
+	bodySize := r.ContentLength
+	if r.Header.Get("Content-Encoding") != "" {
+		bodySize = -1
+	}
+	compressor := h.compressor.forPath(r.URL.Path).forSize(bodySize)
+	gz := compressor.writer(&buf)
 	defer r.Body.Close()
-	contentSize, err := io.Copy(gz, r.Body)
+	inBody, err := requestBody(r, h.metrics, pathTag)
+	if err != nil {
+		reqLogger.Warn().Err(err).Str("remote", remote).Msg("invalid request body")
+		writeError(w, "invalid gzip request body", http.StatusBadRequest)
+		return
+	}
+	src := reqBody.tee(inBody)
+	var validator *bulkValidator
+	if h.validateBulk {
+		validator = &bulkValidator{}
+		src = io.TeeReader(src, validator)
+	}
+	var docCounter *bulkDocCounter
+	if h.bulkDocs {
+		docCounter = &bulkDocCounter{}
+		src = io.TeeReader(src, docCounter)
+	}
+	contentSize, err := compressBody(h.metrics, pathTag, h.copyBuffers, gz, src)
 	if err != nil {
 		reqLogger.Error().Err(err).Msg("compressing body")
-		http.Error(w, "compressing body", http.StatusInternalServerError)
-		return
-	}
-	if err = gz.Close(); err != nil {
-		reqLogger.Error().Err(err).Msg("closing compressed buffer")
-		http.Error(w, "closing compressed buffer", http.StatusInternalServerError)
-		return
-	}
-
-	destURL := url.URL{}
-	var client *http.Client
-	if h.dest.EnableTLS {
-		destURL.Scheme = "https"
-		client = &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				DialContext: (&net.Dialer{
-					Timeout:       10 * time.Second,
-					KeepAlive:     3 * time.Second,
-					FallbackDelay: -1 * time.Millisecond,
-				}).DialContext,
-				TLSClientConfig:     h.dest.TLSConfig.Clone(),
-				TLSHandshakeTimeout: 10 * time.Second,
-				DisableKeepAlives:   true,
-				DisableCompression:  false,
-				MaxIdleConns:        1,
-				MaxIdleConnsPerHost: 0,
-			},
-			Timeout: 60 * time.Second,
+		writeError(w, "compressing body", http.StatusInternalServerError)
+		return
+	}
+	if err = validator.close(); err != nil {
+		_ = h.metrics.CounterIncrement("invalid_bulk", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+		reqLogger.Warn().Err(err).Str("remote", remote).Msg("invalid bulk request, rejecting")
+		writeError(w, "invalid bulk request, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	reqBody.log(reqLogger, "request body")
+	h.stats.bytesIn.Add(uint64(contentSize))
+
+	if contentSize == 0 {
+		_ = h.metrics.CounterIncrement("empty_body", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+		if h.rejectEmpty {
+			reqLogger.Warn().Str("remote", remote).Msg("empty request body, rejecting")
+			writeError(w, "empty request body", http.StatusBadRequest)
+			return
 		}
-	} else {
-		destURL.Scheme = "http"
-		client = &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				DialContext: (&net.Dialer{
-					Timeout:       10 * time.Second,
-					KeepAlive:     3 * time.Second,
-					FallbackDelay: -1 * time.Millisecond,
-				}).DialContext,
-				DisableKeepAlives:   true,
-				DisableCompression:  false,
-				MaxIdleConns:        1,
-				MaxIdleConnsPerHost: 0,
+		// forwarded as-is, some upstreams reject an empty gzip stream
+		buf.Reset()
+	}
+
+	if h.async != nil {
+		job := asyncJob{
+			reqID: reqID,
+			body:  buf.Bytes(),
+			entry: spool.Entry{
+				Created:     time.Now(),
+				Method:      method,
+				Path:        r.URL.Path,
+				ContentType: r.Header.Get("Content-Type"),
+				Username:    username,
+				Password:    password,
+				Remote:      remote,
+				Host:        r.Host,
+				Proto:       forwardedProto(r, h.trustedProxies),
+				Encoding:    compressor.encoding(),
 			},
-			Timeout: 60 * time.Second,
 		}
+		if !h.async.enqueue(job) {
+			reqLogger.Warn().Int("queue_depth", h.async.depth()).Msg("async queue full")
+			_ = h.metrics.CounterIncrement("async_queue_full", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+			writeError(w, "queue full", http.StatusServiceUnavailable)
+			return
+		}
+
+		destName := destinationName(&h.dest, h.dest.WriteDestination)
+		recordLogSize(h.metrics, h.accounts, pathTag, destName, username, reqTags, contentSize)
+		recordGzSize(h.metrics, pathTag, destName, reqTags, buf.Len())
+		recordBulkDocs(h.metrics, pathTag, docCounter)
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"queued":true}`))
+		if idemKey != "" {
+			h.idempotency.set(idemKey, http.StatusAccepted, w.Header().Get("Content-Type"), []byte(`{"queued":true}`))
+		}
+
+		handleDur := time.Since(handleStart)
+		requestEvent(r, reqLogger, h.slowRequest, handleDur).
+			Str("remote", remote).
+			Str("proto", r.Proto).
+			Str("handle_dur", handleDur.String()).
+			Int64("orig_size", contentSize).
+			Int("gz_size", buf.Len()).
+			Msg("request queued")
+		return
 	}
 
-	destURL.Host = net.JoinHostPort(h.dest.Host, h.dest.Port)
-	destURL.Path = r.URL.Path
+	destURL := destinationURL(&h.dest, h.dest.WriteDestination)
+	client, closeIdle := h.clients.forEndpoint(h.dest.WriteDestination)
+	defer closeIdle()
 
-	req, err := retryablehttp.NewRequestWithContext(r.Context(), method, destURL.String(), &buf)
+	destURL.Path = h.dest.TenantPrefixes[requestAccount(username, h.defaultAccount)] + r.URL.Path
+	setQueryParams(&destURL, h.dest.QueryParams)
+
+	var body interface{}
+	if buf.Len() > 0 {
+		body = &buf
+	}
+	ctx, cancel := upstreamContext(r, h.writeTimeout)
+	defer cancel()
+	var connAddr upstreamAddr
+	req, err := retryablehttp.NewRequestWithContext(traceConns(ctx, h.metrics, pathTag, &connAddr), method, destURL.String(), body)
 	if err != nil {
 		reqLogger.Error().Err(err).Msg("creating destination request")
-		http.Error(w, "creating destination request", http.StatusInternalServerError)
+		writeError(w, "creating destination request", http.StatusInternalServerError)
 		return
 	}
 
 	reqLogger = log.With().
-		Str("req_id", reqID.String()).
+		Str("req_id", reqID).
 		Str("url", req.URL.String()).
 		Str("method", req.Method).
 		Logger()
 
-	// pass along the basic auth
-	req.SetBasicAuth(username, password)
+	// pass along the basic auth (none for anonymous requests w/o an account)
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
 
 	req.Header.Set("X-Circonus-Auth-Token", h.dataToken)
 	req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
-	req.Header.Set("Content-Encoding", "gzip")
+	setContentEncoding(req.Header, compressor.encoding(), buf.Len())
 	// req.Header.Set("Accept-Encoding", "gzip")
-	req.Header.Set("Connection", "close")
+	if h.clients.forceClose {
+		req.Header.Set("Connection", "close")
+	}
 	req.Header.Set("User-Agent", release.NAME+"/"+release.Version)
 	req.Header.Set("X-Forwarded-For", remote)
+	if h.dest.AddForwardedHeaders {
+		setForwardedHeaders(req.Header, forwardedProto(r, h.trustedProxies), forwardedHost(r, h.trustedProxies))
+	}
+	if h.dest.ForwardClientCert {
+		setClientCertHeaders(req.Header, r)
+	}
+	setHeaders(req.Header, h.dest.CompatHeaders.Request)
+	if h.dest.PreserveHost {
+		req.Host = r.Host
+	}
+	h.shadow.mirror(req.Request, buf.Bytes(), reqID, pathTag)
 
 	var reqStart time.Time
 	retries := 0
 
-	retryClient := retryablehttp.NewClient()
-	retryClient.HTTPClient = client
-	retryClient.Logger = logger.LogWrapper{
-		Log:   reqLogger.With().Str("handler", "/_bulk").Str("component", "retryablehttp").Logger(),
-		Debug: h.debug,
-	}
-	retryClient.RetryWaitMin = 2 * time.Second
-	retryClient.RetryWaitMax = 10 * time.Second
-	retryClient.RetryMax = 7
+	retryClient := newRetryClient(client, h.retry, reqLogger, "/_bulk", h.debug)
 	retryClient.RequestLogHook = func(l retryablehttp.Logger, r *http.Request, attempt int) {
+		if h.debug {
+			logHeaders(reqLogger, "forwarded headers", r.Header)
+		}
 		if attempt > 0 {
 			reqStart = time.Now()
-			reqLogger.Info().Int("attempt", attempt).Msg("retrying")
+			retryEvent(reqLogger, h.dest.RetryLogLevel).Int("attempt", attempt).Msg("retrying")
 			retries++
+			h.stats.retries.Add(1)
 		}
 	}
 
 	retryClient.ResponseLogHook = func(l retryablehttp.Logger, r *http.Response) {
 		if r.StatusCode != http.StatusOK {
-			reqLogger.Warn().Int("status_code", r.StatusCode).Str("status", r.Status).Msg("non-200 response")
+			retryEvent(reqLogger, h.dest.RetryLogLevel).Int("status_code", r.StatusCode).Str("status", r.Status).Msg("non-200 response")
 		} else if r.StatusCode == http.StatusOK && retries > 0 {
 			reqLogger.Info().Int("retries", retries+1).Msg("succeeded")
 		}
 	}
 
-	retryClient.CheckRetry = func(ctx context.Context, resp *http.Response, origErr error) (bool, error) {
-		retry, rhErr := retryablehttp.ErrorPropagatedRetryPolicy(ctx, resp, origErr)
-		if retry && rhErr != nil {
-			reqLogger.Warn().Err(rhErr).Err(origErr).Msg("request error")
-		}
-
-		return retry, nil
-	}
-
-	defer retryClient.HTTPClient.CloseIdleConnections()
+	retryClient.CheckRetry = checkRetry(h.dest.NoRetryStatus, h.clients.retryErrors, h.clients.budget, h.metrics, pathTag, reqLogger, h.dest.RetryLogLevel)
+	limitRetryTime(retryClient, h.dest.RetryBudget, reqLogger)
 
 	reqStart = time.Now()
+	destName := destinationName(&h.dest, h.dest.WriteDestination)
 	resp, err := retryClient.Do(req) //nolint:contextcheck
+	if clientCancelled(r, h.metrics, reqLogger, pathTag, err) {
+		return
+	}
+	if err != nil && h.dest.Failover != nil && ctx.Err() == nil {
+		reqLogger.Warn().Err(err).Str("failover", h.dest.Failover.Host).Msg("destination request failed, trying failover")
+		_ = h.metrics.CounterIncrement("failover", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+		foClient, foCloseIdle := h.clients.get(true)
+		defer foCloseIdle()
+		retryClient.HTTPClient = foClient
+		reqStart = time.Now()
+		destName = h.dest.Failover.Name
+		resp, err = retryClient.Do(failoverRequest(req, h.dest.Failover)) //nolint:contextcheck
+	}
 	if resp != nil {
 		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			reqLogger.Warn().Int("status_code", resp.StatusCode).Str("status", resp.Status).Int("retries", retries).Msg("non-200 response")
+		}
+		recordRejected(h.metrics, pathTag, resp)
 	}
+	checkTLSError(h.metrics, reqLogger, pathTag, err)
 	if err != nil {
-		reqLogger.Error().Err(err).Msg("making destination request")
-		http.Error(w, "making destination request", http.StatusInternalServerError)
+		h.stats.upstreamErrors.Add(1)
+	}
+	if errors.Is(err, errDestinationNotAllowed) {
+		reqLogger.Error().Err(err).Msg("destination not in allowed_hosts, not forwarding")
+		writeError(w, "destination not allowed", http.StatusBadGateway)
+		return
+	}
+	if err != nil && h.spool != nil {
+		spoolErr := h.spool.Store(spool.Entry{
+			Created:     time.Now(),
+			Method:      method,
+			Path:        r.URL.Path,
+			ContentType: r.Header.Get("Content-Type"),
+			Username:    username,
+			Remote:      remote,
+			Host:        r.Host,
+			Proto:       forwardedProto(r, h.trustedProxies),
+			Encoding:    compressor.encoding(),
+		}, buf.Bytes())
+		if spoolErr == nil {
+			reqLogger.Warn().Err(err).Int("gz_size", buf.Len()).Msg("destination request failed, spooled")
+			_ = h.metrics.CounterIncrement("spooled", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte(`{"spooled":true}`))
+			if idemKey != "" {
+				h.idempotency.set(idemKey, http.StatusAccepted, w.Header().Get("Content-Type"), []byte(`{"spooled":true}`))
+			}
+			return
+		}
+		reqLogger.Error().Err(spoolErr).Msg("spooling request")
+		if errors.Is(spoolErr, spool.ErrFull) {
+			_ = h.metrics.CounterIncrement("spool_full", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+		}
+	}
+	if upstreamTimedOut(ctx, err) {
+		reqLogger.Error().Err(err).Msg("destination request timed out")
+		_ = h.metrics.CounterIncrement("upstream_timeout", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+		writeError(w, "destination request timed out", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		reqLogger.Error().Err(err).Str("upstream_addr", connAddr.String()).Msg("making destination request")
+		writeError(w, "making destination request", http.StatusInternalServerError)
 		return
 	}
 
-	tags := trapmetrics.Tags{
-		{Category: "units", Value: "bytes"},
-		{Category: "path", Value: r.URL.Path},
+	recordLogSize(h.metrics, h.accounts, pathTag, destName, username, reqTags, contentSize)
+	recordGzSize(h.metrics, pathTag, destName, reqTags, buf.Len())
+	recordBulkDocs(h.metrics, pathTag, docCounter)
+
+	respBody := newBodyCapture(h.debugBodies)
+	relayHeaders(w.Header(), resp)
+	setHeaders(w.Header(), h.dest.CompatHeaders.Response)
+	stripHeaders(w.Header(), h.stripHeaders)
+	// only successful responses are remembered, a failed request may be retried
+	var remembered *bytes.Buffer
+	dst := io.Writer(w)
+	if idemKey != "" && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		remembered = &bytes.Buffer{}
+		dst = io.MultiWriter(w, remembered)
 	}
-	_ = h.metrics.CounterIncrementByValue("log_size", tags, uint64(r.ContentLength))
-	_ = h.metrics.HistogramRecordValue("log_size_h", tags, float64(r.ContentLength))
-	tags = append(tags, trapmetrics.Tag{Category: "ingest_acct", Value: username})
-	_ = h.metrics.CounterIncrementByValue("log_size", tags, uint64(r.ContentLength))
-	_ = h.metrics.HistogramRecordValue("log_size_h", tags, float64(r.ContentLength))
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(resp.StatusCode)
-	responseSize, err := io.Copy(w, resp.Body)
+	if h.trailers {
+		declareTrailers(w.Header(), resp)
+	}
+	w.WriteHeader(remapStatus(h.statusRemap, resp.StatusCode))
+	responseSize, err := h.copyBuffers.copy(dst, respBody.tee(resp.Body))
+	h.stats.bytesOut.Add(uint64(responseSize))
+	recordRespBytes(h.metrics, pathTag, responseSize)
 	if err != nil {
 		reqLogger.Error().Err(err).Msg("reading/writing response body")
-		http.Error(w, "reading/writing response", http.StatusInternalServerError)
+		writeError(w, "reading/writing response", http.StatusInternalServerError)
 		return
 	}
+	if h.trailers {
+		relayTrailers(w.Header(), resp)
+	}
+	respBody.log(reqLogger, "response body")
+
+	if remembered != nil {
+		h.idempotency.set(idemKey, resp.StatusCode, w.Header().Get("Content-Type"), remembered.Bytes())
+	}
 
 	var ratio float64
-	if r.ContentLength > 0 {
+	if buf.Len() > 0 {
 		ratio = float64(contentSize) / float64(buf.Len())
 	}
 
-	reqLogger.Info().
+	handleDur := time.Since(handleStart)
+	requestEvent(r, reqLogger, h.slowRequest, handleDur).
 		Str("remote", remote).
 		Str("proto", r.Proto).
 		Int("upstream_resp_code", resp.StatusCode).
-		Str("handle_dur", time.Since(handleStart).String()).
+		Str("handle_dur", handleDur.String()).
 		Str("upstream_req_dur", time.Since(reqStart).String()).
 		Int64("orig_size", contentSize).
 		Int("gz_size", buf.Len()).
 		Str("ratio", fmt.Sprintf("%.2f", ratio)).
 		Int64("resp_size", responseSize).
+		Str("upstream_addr", connAddr.String()).
 		Msg("request processed")
 }
 
@@ -260,7 +502,7 @@ type clusterSettingsHandler struct {
 
 func (h clusterSettingsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, h.s.metrics, h.s.paths)
 		return
 	}
 
@@ -275,7 +517,7 @@ func (h templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPut, http.MethodHead, http.MethodGet:
 	default:
-		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, h.s.metrics, h.s.paths)
 		return
 	}
 
@@ -290,7 +532,7 @@ func (h otelv1apmservicemapHandler) ServeHTTP(w http.ResponseWriter, r *http.Req
 	switch r.Method {
 	case http.MethodPut, http.MethodHead, http.MethodGet:
 	default:
-		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, h.s.metrics, h.s.paths)
 		return
 	}
 
@@ -305,7 +547,7 @@ func (h ismPolicyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPut, http.MethodHead, http.MethodGet:
 	default:
-		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, h.s.metrics, h.s.paths)
 		return
 	}
 
@@ -320,7 +562,7 @@ func (h otelSpanHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPut, http.MethodHead, http.MethodGet:
 	default:
-		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, h.s.metrics, h.s.paths)
 		return
 	}
 
@@ -335,7 +577,7 @@ func (h otelSpanSearchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	switch r.Method {
 	case http.MethodPost:
 	default:
-		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, h.s.metrics, h.s.paths)
 		return
 	}
 
@@ -356,88 +598,120 @@ func (s *Server) genericRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reqID := uuid.New()
-	reqLogger := log.With().Str("req_id", reqID.String()).Logger()
+	reqID := requestID(r, s.cfg.Server.RequestIDHeader)
+	reqLogger := log.With().Str("req_id", reqID).Logger()
 	handleStart := time.Now()
+	pathTag := s.paths.tag(r.URL.Path)
+	reqTags := s.requestTags.tags(r, s.metrics, pathTag)
+
+	remote := clientIP(r, s.cfg.Server.TrustedNets)
+
+	if r.Method == http.MethodPut && matchPath(s.cfg.Server.StubProvisioningPaths, r.URL.Path) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_ = s.metrics.CounterIncrement("stubbed", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"acknowledged":true}`))
+
+		handleDur := time.Since(handleStart)
+		requestEvent(r, reqLogger, s.cfg.Server.SlowRequest, handleDur).
+			Str("remote", remote).
+			Str("proto", r.Proto).
+			Str("url", r.URL.String()).
+			Str("method", r.Method).
+			Str("handle_dur", handleDur.String()).
+			Msg("request stubbed, not forwarded")
+		return
+	}
 
-	remote := r.Header.Get("X-Forwarded-For")
-	if remote == "" {
-		remote = r.RemoteAddr
+	var key string
+	if s.cache != nil && r.Method == http.MethodGet {
+		key = cacheKey(username, password, r.URL.String())
+		if entry, ok := s.cache.get(key); ok {
+			_ = s.metrics.CounterIncrement("cache_hit", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+			if entry.contentType != "" {
+				w.Header().Set("Content-Type", entry.contentType)
+			}
+			setHeaders(w.Header(), s.cfg.Destination.CompatHeaders.Response)
+			stripHeaders(w.Header(), s.cfg.Server.StripResponseHeaders)
+			w.WriteHeader(remapStatus(s.cfg.Server.StatusRemap, http.StatusOK))
+			_, _ = w.Write(entry.body)
+			recordRespBytes(s.metrics, pathTag, int64(len(entry.body)))
+
+			handleDur := time.Since(handleStart)
+			requestEvent(r, reqLogger, s.cfg.Server.SlowRequest, handleDur).
+				Str("remote", remote).
+				Str("proto", r.Proto).
+				Str("url", r.URL.String()).
+				Str("method", r.Method).
+				Str("handle_dur", handleDur.String()).
+				Int("resp_size", len(entry.body)).
+				Msg("request served from cache")
+			return
+		}
+		_ = s.metrics.CounterIncrement("cache_miss", trapmetrics.Tags{{Category: "path", Value: pathTag}})
 	}
 
-	data, err := io.ReadAll(r.Body)
+	reqBody := newBodyCapture(s.debugBodies)
+	inBody, err := requestBody(r, s.metrics, pathTag)
 	if err != nil {
-		log.Fatal().Err(err).Msg("reading request body")
+		reqLogger.Warn().Err(err).Str("remote", remote).Msg("invalid request body")
+		writeError(w, "invalid gzip request body", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(reqBody.tee(inBody))
+	if err != nil {
+		reqLogger.Warn().Err(err).Str("remote", remote).Msg("reading request body")
+		writeError(w, "reading request body", http.StatusBadRequest)
+		return
+	}
+	reqBody.log(reqLogger, "request body")
+	s.stats.bytesIn.Add(uint64(len(data)))
+
+	hasBody := r.Method == http.MethodPut || r.Method == http.MethodPost
+	if hasBody && len(data) == 0 {
+		_ = s.metrics.CounterIncrement("empty_body", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+		if s.cfg.Server.EmptyBody == "reject" {
+			reqLogger.Warn().Str("remote", remote).Str("method", r.Method).Str("url", r.URL.String()).Msg("empty request body, rejecting")
+			writeError(w, "empty request body", http.StatusBadRequest)
+			return
+		}
+		// forwarded as-is, some upstreams reject an empty gzip stream
+		hasBody = false
 	}
-	log.Debug().Str("data", string(data)).Msg("request body")
 
 	var contentSize int64
 	var buf bytes.Buffer
-	if r.Method == http.MethodPut || r.Method == http.MethodPost {
-		gz := gzip.NewWriter(&buf)
+	compressor := s.compressor.forPath(r.URL.Path).forSize(int64(len(data)))
+	if hasBody {
+		gz := compressor.writer(&buf)
 		defer r.Body.Close()
-		sz, err := io.Copy(gz, bytes.NewBuffer(data))
+		sz, err := compressBody(s.metrics, pathTag, s.copyBuffers, gz, bytes.NewBuffer(data))
 		if err != nil {
-			s.serverError(w, fmt.Errorf("compressing body: %w", err))
-			return
-		}
-		if err = gz.Close(); err != nil {
-			s.serverError(w, fmt.Errorf("closing compressed buffer: %w", err))
+			s.serverError(w, err)
 			return
 		}
 		contentSize = sz
 	}
 
-	newURL := ""
-	var client *http.Client
-	if s.cfg.Destination.EnableTLS {
-		newURL = "https://"
-		client = &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				DialContext: (&net.Dialer{
-					Timeout:       10 * time.Second,
-					KeepAlive:     3 * time.Second,
-					FallbackDelay: -1 * time.Millisecond,
-				}).DialContext,
-				TLSClientConfig:     s.cfg.Destination.TLSConfig.Clone(),
-				TLSHandshakeTimeout: 10 * time.Second,
-				DisableKeepAlives:   true,
-				DisableCompression:  false,
-				MaxIdleConns:        1,
-				MaxIdleConnsPerHost: 0,
-			},
-			Timeout: 60 * time.Second,
-		}
-	} else {
-		newURL = "http://"
-		client = &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				DialContext: (&net.Dialer{
-					Timeout:       10 * time.Second,
-					KeepAlive:     3 * time.Second,
-					FallbackDelay: -1 * time.Millisecond,
-				}).DialContext,
-				DisableKeepAlives:   true,
-				DisableCompression:  false,
-				MaxIdleConns:        1,
-				MaxIdleConnsPerHost: 0,
-			},
-			Timeout: 60 * time.Second,
-		}
-	}
+	ep := endpointFor(&s.cfg.Destination, r)
+	destURL := destinationURL(&s.cfg.Destination, ep)
+	client, closeIdle := s.clients.forEndpoint(ep)
+	defer closeIdle()
 
-	newURL += net.JoinHostPort(s.cfg.Destination.Host, s.cfg.Destination.Port)
-	newURL += r.URL.String()
+	newURL := destURL.String() + s.cfg.Destination.TenantPrefixes[requestAccount(username, s.cfg.Circonus.DefaultAccount)] + r.URL.String()
 
+	upstreamCtx, cancel := upstreamContext(r, s.writeTimeout)
+	defer cancel()
 	var req *retryablehttp.Request
+	var connAddr upstreamAddr
 	{
 		var err error
-		if r.Method == http.MethodPut || r.Method == http.MethodPost {
-			req, err = retryablehttp.NewRequestWithContext(r.Context(), r.Method, newURL, &buf)
+		ctx := traceConns(upstreamCtx, s.metrics, pathTag, &connAddr)
+		if hasBody {
+			req, err = retryablehttp.NewRequestWithContext(ctx, r.Method, newURL, &buf)
 		} else {
-			req, err = retryablehttp.NewRequestWithContext(r.Context(), r.Method, newURL, nil)
+			req, err = retryablehttp.NewRequestWithContext(ctx, r.Method, newURL, nil)
 		}
 		if err != nil {
 			s.serverError(w, fmt.Errorf("creating destination request: %w", err))
@@ -446,142 +720,609 @@ func (s *Server) genericRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	reqLogger = log.With().
-		Str("req_id", reqID.String()).
+		Str("req_id", reqID).
 		Str("url", req.URL.String()).
 		Str("method", req.Method).
 		Logger()
 
-	// pass along the basic auth
-	req.SetBasicAuth(username, password)
+	// pass along the basic auth (none for anonymous requests w/o an account)
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
 
 	req.Header.Set("X-Circonus-Auth-Token", s.cfg.Circonus.APIKey)
-	if r.Method == http.MethodPut || r.Method == http.MethodPost {
+	if hasBody {
 		req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
-		req.Header.Set("Content-Encoding", "gzip")
+		setContentEncoding(req.Header, compressor.encoding(), buf.Len())
 		// req.Header.Set("Accept-Encoding", "gzip")
 	}
-	req.Header.Set("Connection", "close")
+	if s.clients.forceClose {
+		req.Header.Set("Connection", "close")
+	}
 	req.Header.Set("User-Agent", release.NAME+"/"+release.Version)
 	req.Header.Set("X-Forwarded-For", remote)
+	if s.cfg.Destination.AddForwardedHeaders {
+		setForwardedHeaders(req.Header, forwardedProto(r, s.cfg.Server.TrustedNets), forwardedHost(r, s.cfg.Server.TrustedNets))
+	}
+	if s.cfg.Destination.ForwardClientCert {
+		setClientCertHeaders(req.Header, r)
+	}
+	setHeaders(req.Header, s.cfg.Destination.CompatHeaders.Request)
+	if s.cfg.Destination.PreserveHost {
+		req.Host = r.Host
+	}
 
 	var reqStart time.Time
 	retries := 0
 
-	retryClient := retryablehttp.NewClient()
-	retryClient.HTTPClient = client
-	retryClient.Logger = logger.LogWrapper{
-		Log:   reqLogger.With().Str("handler", "genericRequest").Str("component", "retryablehttp").Logger(),
-		Debug: s.cfg.Debug,
-	}
-	retryClient.RetryWaitMin = 2 * time.Second
-	retryClient.RetryWaitMax = 10 * time.Second
-	retryClient.RetryMax = 7
+	retryClient := newRetryClient(client, s.cfg.Destination.Retry, reqLogger, "genericRequest", s.cfg.Debug)
 	retryClient.RequestLogHook = func(l retryablehttp.Logger, r *http.Request, attempt int) {
+		if s.cfg.Debug {
+			logHeaders(reqLogger, "forwarded headers", r.Header)
+		}
 		if attempt > 0 {
 			reqStart = time.Now()
-			reqLogger.Info().Int("attempt", attempt).Msg("retrying")
+			retryEvent(reqLogger, s.cfg.Destination.RetryLogLevel).Int("attempt", attempt).Msg("retrying")
 			retries++
+			s.stats.retries.Add(1)
 		}
 	}
 
 	retryClient.ResponseLogHook = func(l retryablehttp.Logger, r *http.Response) {
 		if r.StatusCode != http.StatusOK {
-			reqLogger.Warn().Int("status_code", r.StatusCode).Str("status", r.Status).Msg("non-200 response")
+			retryEvent(reqLogger, s.cfg.Destination.RetryLogLevel).Int("status_code", r.StatusCode).Str("status", r.Status).Msg("non-200 response")
 		} else if r.StatusCode == http.StatusOK && retries > 0 {
 			reqLogger.Info().Int("retries", retries+1).Msg("succeeded") // add one for first failed attempt
 		}
 	}
 
-	retryClient.CheckRetry = func(ctx context.Context, resp *http.Response, origErr error) (bool, error) {
-		retry, rhErr := retryablehttp.ErrorPropagatedRetryPolicy(ctx, resp, origErr)
-		if retry && rhErr != nil {
-			reqLogger.Warn().Err(rhErr).Err(origErr).Msg("request error")
-		}
-
-		return retry, nil
-	}
-
-	defer retryClient.HTTPClient.CloseIdleConnections()
+	retryClient.CheckRetry = checkRetry(s.cfg.Destination.NoRetryStatus, s.clients.retryErrors, s.clients.budget, s.metrics, pathTag, reqLogger, s.cfg.Destination.RetryLogLevel)
+	limitRetryTime(retryClient, s.cfg.Destination.RetryBudget, reqLogger)
 
 	reqStart = time.Now()
+	destName := destinationName(&s.cfg.Destination, ep)
 	resp, err := retryClient.Do(req) //nolint:contextcheck
+	if clientCancelled(r, s.metrics, reqLogger, pathTag, err) {
+		return
+	}
+	if err != nil && s.cfg.Destination.Failover != nil && upstreamCtx.Err() == nil {
+		reqLogger.Warn().Err(err).Str("failover", s.cfg.Destination.Failover.Host).Msg("destination request failed, trying failover")
+		_ = s.metrics.CounterIncrement("failover", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+		foClient, foCloseIdle := s.clients.get(true)
+		defer foCloseIdle()
+		retryClient.HTTPClient = foClient
+		reqStart = time.Now()
+		destName = s.cfg.Destination.Failover.Name
+		resp, err = retryClient.Do(failoverRequest(req, s.cfg.Destination.Failover)) //nolint:contextcheck
+	}
 	if resp != nil {
 		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			reqLogger.Warn().Int("status_code", resp.StatusCode).Str("status", resp.Status).Int("retries", retries).Msg("non-200 response")
+		}
+		recordRejected(s.metrics, pathTag, resp)
 	}
+	checkTLSError(s.metrics, reqLogger, pathTag, err)
 	if err != nil {
-		reqLogger.Error().Err(err).Msg("making destination request")
-		http.Error(w, "making destination request", http.StatusInternalServerError)
+		s.stats.upstreamErrors.Add(1)
+	}
+	if errors.Is(err, errDestinationNotAllowed) {
+		reqLogger.Error().Err(err).Msg("destination not in allowed_hosts, not forwarding")
+		writeError(w, "destination not allowed", http.StatusBadGateway)
 		return
 	}
-
-	tags := trapmetrics.Tags{
-		{Category: "units", Value: "bytes"},
-		{Category: "path", Value: r.URL.Path},
+	if upstreamTimedOut(upstreamCtx, err) {
+		reqLogger.Error().Err(err).Msg("destination request timed out")
+		_ = s.metrics.CounterIncrement("upstream_timeout", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+		writeError(w, "destination request timed out", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		reqLogger.Error().Err(err).Str("upstream_addr", connAddr.String()).Msg("making destination request")
+		writeError(w, "making destination request", http.StatusInternalServerError)
+		return
 	}
-	_ = s.metrics.CounterIncrementByValue("log_size", tags, uint64(r.ContentLength))
-	_ = s.metrics.HistogramRecordValue("log_size_h", tags, float64(r.ContentLength))
-	tags = append(tags, trapmetrics.Tag{Category: "ingest_acct", Value: username})
-	_ = s.metrics.CounterIncrementByValue("log_size", tags, uint64(r.ContentLength))
-	_ = s.metrics.HistogramRecordValue("log_size_h", tags, float64(r.ContentLength))
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	recordLogSize(s.metrics, s.accounts, pathTag, destName, username, reqTags, contentSize)
+	if hasBody {
+		recordGzSize(s.metrics, pathTag, destName, reqTags, buf.Len())
+	}
 
 	var ratio float64
-	if r.ContentLength > 0 {
+	if buf.Len() > 0 {
 		ratio = float64(contentSize) / float64(buf.Len())
 	}
 
+	respBody := newBodyCapture(s.debugBodies)
+
+	relayHeaders(w.Header(), resp)
+	setHeaders(w.Header(), s.cfg.Destination.CompatHeaders.Response)
+	stripHeaders(w.Header(), s.cfg.Server.StripResponseHeaders)
+
+	if s.cfg.Server.ForwardTrailers {
+		declareTrailers(w.Header(), resp)
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		w.WriteHeader(resp.StatusCode)
-		responseSize, err := io.Copy(w, resp.Body)
+		buffered, body, err := bufferResponse(respBody.tee(resp.Body), resp.ContentLength, s.cfg.Server.BufferResponses)
+		if err != nil {
+			s.serverError(w, fmt.Errorf("reading response body: %w", err))
+			return
+		}
+		if buffered != nil {
+			w.Header().Set("Content-Length", strconv.Itoa(len(buffered)))
+			if resp.Header.Get("Content-Encoding") == "" {
+				reqLogger.Warn().Int("status_code", resp.StatusCode).Str("body", redactBody(buffered)).Msg("non-200 response body")
+			}
+		}
+		w.WriteHeader(remapStatus(s.cfg.Server.StatusRemap, resp.StatusCode))
+		responseSize, err := s.copyBuffers.copy(w, body)
+		s.stats.bytesOut.Add(uint64(responseSize))
+		recordRespBytes(s.metrics, pathTag, responseSize)
 		if err != nil {
 			s.serverError(w, fmt.Errorf("reading/writing response body: %w", err))
 			return
 		}
+		if s.cfg.Server.ForwardTrailers {
+			relayTrailers(w.Header(), resp)
+		}
+		respBody.log(reqLogger, "response body")
 
-		reqLogger.Info().
+		handleDur := time.Since(handleStart)
+		requestEvent(r, reqLogger, s.cfg.Server.SlowRequest, handleDur).
 			Str("remote", remote).
 			Str("proto", r.Proto).
 			Int("resp_code", resp.StatusCode).
-			Str("handle_dur", time.Since(handleStart).String()).
+			Str("handle_dur", handleDur.String()).
 			Str("upstream_req_dur", time.Since(reqStart).String()).
 			Int64("orig_size", contentSize).
 			Int("gz_size", buf.Len()).
 			Str("ratio", fmt.Sprintf("%.2f", ratio)).
 			Int64("resp_size", responseSize).
+			Str("upstream_addr", connAddr.String()).
+			Bool("resp_buffered", buffered != nil).
 			Msg("request processed")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	responseSize, err := io.Copy(w, resp.Body)
+	var cached *bytes.Buffer
+	dst := io.Writer(w)
+	if key != "" {
+		cached = &bytes.Buffer{}
+		dst = io.MultiWriter(w, cached)
+	}
+
+	buffered, body, err := bufferResponse(respBody.tee(resp.Body), resp.ContentLength, s.cfg.Server.BufferResponses)
+	if err != nil {
+		s.serverError(w, fmt.Errorf("reading response body: %w", err))
+		return
+	}
+	if buffered != nil {
+		w.Header().Set("Content-Length", strconv.Itoa(len(buffered)))
+	}
+	// responses w/a content encoding are relayed as-is, when buffering
+	// (buffer_responses) only buffered responses are transformed
+	if t := s.transforms.lookup(r.URL.Path); t != nil && resp.Header.Get("Content-Encoding") == "" && (buffered != nil || s.cfg.Server.BufferResponses == 0) {
+		data := buffered
+		if data == nil {
+			data, err = io.ReadAll(body)
+			if err != nil {
+				s.serverError(w, fmt.Errorf("reading response body: %w", err))
+				return
+			}
+		}
+		if out, err := t.transform(data); err != nil {
+			reqLogger.Warn().Err(err).Msg("transforming response, relaying it unchanged")
+			_ = s.metrics.CounterIncrement("transform_errors", trapmetrics.Tags{{Category: "path", Value: pathTag}})
+		} else {
+			data = out
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		body = bytes.NewReader(data)
+	}
+
+	w.WriteHeader(remapStatus(s.cfg.Server.StatusRemap, http.StatusOK))
+	responseSize, err := s.copyBuffers.copy(dst, body)
+	s.stats.bytesOut.Add(uint64(responseSize))
+	recordRespBytes(s.metrics, pathTag, responseSize)
 	if err != nil {
 		s.serverError(w, fmt.Errorf("writing response body: %w", err))
 		return
 	}
+	if s.cfg.Server.ForwardTrailers {
+		relayTrailers(w.Header(), resp)
+	}
+	respBody.log(reqLogger, "response body")
 
-	reqLogger.Info().
+	if cached != nil {
+		s.cache.set(key, http.StatusOK, w.Header().Get("Content-Type"), cached.Bytes())
+	}
+
+	handleDur := time.Since(handleStart)
+	requestEvent(r, reqLogger, s.cfg.Server.SlowRequest, handleDur).
 		Str("remote", remote).
 		Str("proto", r.Proto).
 		Int("resp_code", resp.StatusCode).
-		Str("handle_dur", time.Since(handleStart).String()).
+		Str("handle_dur", handleDur.String()).
 		Str("upstream_req_dur", time.Since(reqStart).String()).
 		Int64("orig_size", contentSize).
 		Int("gz_size", buf.Len()).
 		Str("ratio", fmt.Sprintf("%.2f", ratio)).
 		Int64("resp_size", responseSize).
+		Str("upstream_addr", connAddr.String()).
+		Bool("resp_buffered", buffered != nil).
 		Msg("request processed")
 }
 
+// requestEvent returns the event for the per-request log line. With a slow
+// request threshold, requests exceeding it are logged as warnings (slow) and
+// the rest at debug, otherwise all requests are logged at info. Requests
+// logged in the combined format (access_log_format) are logged at debug,
+// unless slow. Requests which waited for a slot (max_concurrent_requests)
+// include the time waited, queue_wait_ms.
+func requestEvent(r *http.Request, l zerolog.Logger, threshold, dur time.Duration) *zerolog.Event {
+	var e *zerolog.Event
+	switch {
+	case threshold > 0 && dur > threshold:
+		e = l.Warn().Bool("slow", true)
+	case threshold > 0, accessLogged(r):
+		e = l.Debug()
+	default:
+		e = l.Info()
+	}
+	if wait, ok := r.Context().Value(queueWaitKey).(time.Duration); ok {
+		e = e.Float64("queue_wait_ms", float64(wait)/float64(time.Millisecond))
+	}
+	return e
+}
+
+// setForwardedHeaders tells the destination the scheme and host the client
+// used (add_forwarded_headers), e.g. for generating urls.
+func setForwardedHeaders(h http.Header, proto, host string) {
+	if proto != "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+	if host != "" {
+		h.Set("X-Forwarded-Host", host)
+	}
+}
+
+// maxRequestIDLen bounds inbound request ids, longer ids are replaced.
+const maxRequestIDLen = 128
+
+// requestID returns the id used to correlate the logs of a request, the
+// value of the configured inbound header (e.g. X-Request-ID, set by a proxy
+// in front of the exporter) when present, otherwise a new uuid.
+func requestID(r *http.Request, header string) string {
+	if header != "" {
+		if id := r.Header.Get(header); id != "" && len(id) <= maxRequestIDLen {
+			return id
+		}
+	}
+	return uuid.New().String()
+}
+
+// retryEvent returns the event for per-attempt retry logs, at the configured
+// retry_log_level. Only the outcome of a request (succeeded after retries,
+// a final non-200 response or failure) is logged at info or above.
+func retryEvent(l zerolog.Logger, level string) *zerolog.Event {
+	if level == "info" {
+		return l.Info()
+	}
+	return l.Debug()
+}
+
+// clientCancelled returns true, recording client_cancelled, if the request
+// failed because the client went away. There is no one to respond to, and
+// it is not a server error.
+func clientCancelled(r *http.Request, tm *trapmetrics.TrapMetrics, l zerolog.Logger, path string, err error) bool {
+	if err == nil || !errors.Is(r.Context().Err(), context.Canceled) {
+		return false
+	}
+	l.Warn().Err(err).Msg("client cancelled request")
+	_ = tm.CounterIncrement("client_cancelled", trapmetrics.Tags{{Category: "path", Value: path}})
+	return true
+}
+
+// matchPath returns true if the path matches one of the paths, either exactly
+// or, for a path ending in '/', by prefix.
+func matchPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayHeaders copies the content headers of the upstream response to the
+// client response, responses are not necessarily json (e.g. text, or an html
+// error page from a proxy) so json is only assumed when there is no
+// Content-Type. When net/http has decompressed the body, it removes the
+// Content-Encoding and the length is unknown, so the headers match the body
+// which is relayed.
+func relayHeaders(h http.Header, resp *http.Response) {
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		h.Set("Content-Type", ct)
+	} else {
+		h.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+		h.Set("Content-Encoding", ce)
+	}
+	if !resp.Uncompressed && resp.ContentLength >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+}
+
+// declareTrailers announces the destination response's trailers, their
+// values are relayed by relayTrailers once the body has been copied.
+func declareTrailers(h http.Header, resp *http.Response) {
+	for name := range resp.Trailer {
+		h.Add("Trailer", name)
+	}
+}
+
+// relayTrailers sets the destination response's trailers, resp.Trailer is
+// only complete once its body has been read.
+func relayTrailers(h http.Header, resp *http.Response) {
+	for name, values := range resp.Trailer {
+		for _, value := range values {
+			h.Add(name, value)
+		}
+	}
+}
+
+// setHeaders sets the configured headers on a request or response.
+func setHeaders(h http.Header, headers map[string]string) {
+	for name, value := range headers {
+		h.Set(name, value)
+	}
+}
+
+// remapStatus returns the status to respond with for a destination status,
+// per server.status_remap (e.g. 403 -> 401 so clients re-authenticate).
+func remapStatus(remap map[int]int, status int) int {
+	if to, ok := remap[status]; ok {
+		return to
+	}
+	return status
+}
+
+// stripHeaders removes the configured headers from a response before it is
+// written to the client. A nil value, rather than deleting the header, also
+// stops net/http adding a default (e.g. Date).
+func stripHeaders(h http.Header, names []string) {
+	for _, name := range names {
+		h[name] = nil
+	}
+}
+
+// recordGzSize records the compressed size of a forwarded body, with the
+// tags sent by the client (request_tags), if any.
+func recordGzSize(tm *trapmetrics.TrapMetrics, path, dest string, reqTags trapmetrics.Tags, size int) {
+	tags := trapmetrics.Tags{
+		{Category: "units", Value: "bytes"},
+		{Category: "path", Value: path},
+		{Category: "destination", Value: dest},
+	}
+	tags = append(tags, reqTags...)
+	_ = tm.HistogramRecordValue("gz_size_h", tags, float64(size))
+}
+
+// recordRespBytes records the bytes of a response body written to the
+// client, the egress counterpart of log_size.
+func recordRespBytes(tm *trapmetrics.TrapMetrics, path string, size int64) {
+	if size <= 0 {
+		return
+	}
+	_ = tm.CounterIncrementByValue("resp_bytes", trapmetrics.Tags{{Category: "path", Value: path}}, uint64(size))
+}
+
+// recordLogSize records the size of a request, overall and, when enabled
+// for it, for the account, with the tags sent by the client (request_tags),
+// if any.
+func recordLogSize(tm *trapmetrics.TrapMetrics, accounts accountMetrics, path, dest, username string, reqTags trapmetrics.Tags, size int64) {
+	tags := trapmetrics.Tags{
+		{Category: "units", Value: "bytes"},
+		{Category: "path", Value: path},
+		{Category: "destination", Value: dest},
+	}
+	tags = append(tags, reqTags...)
+	_ = tm.CounterIncrementByValue("log_size", tags, uint64(size))
+	_ = tm.HistogramRecordValue("log_size_h", tags, float64(size))
+	acct := accounts.tag(username)
+	if !accounts.enabled(acct, size) {
+		return
+	}
+	tags = append(tags, trapmetrics.Tag{Category: "ingest_acct", Value: acct})
+	_ = tm.CounterIncrementByValue("log_size", tags, uint64(size))
+	_ = tm.HistogramRecordValue("log_size_h", tags, float64(size))
+}
+
+// newRetryClient creates the retrying client used to forward requests.
+func newRetryClient(client *http.Client, retry config.Retry, l zerolog.Logger, handler string, debug bool) *retryablehttp.Client {
+	retryClient := retryablehttp.NewClient()
+	retryClient.HTTPClient = client
+	retryClient.Logger = logger.LogWrapper{
+		Log:   l.With().Str("handler", handler).Str("component", "retryablehttp").Logger(),
+		Debug: debug,
+	}
+	retryClient.RetryWaitMin = retry.WaitMin
+	retryClient.RetryWaitMax = retry.WaitMax
+	retryClient.RetryMax = *retry.Max
+
+	return retryClient
+}
+
+// failoverRequest returns a copy of the request, sharing the body so it can
+// be replayed, directed to the failover endpoint. A client Host which was
+// preserved (preserve_host) is kept.
+func failoverRequest(req *retryablehttp.Request, ep *config.Endpoint) *retryablehttp.Request {
+	u := *req.URL
+	u.Scheme = "http"
+	if ep.EnableTLS {
+		u.Scheme = "https"
+	}
+	u.Host = net.JoinHostPort(ep.Host, ep.Port)
+
+	foReq := req.WithContext(req.Context())
+	foReq.URL = &u
+	if req.Host == req.URL.Host {
+		foReq.Host = u.Host
+	}
+
+	return foReq
+}
+
+// checkRetry returns the retry policy for forwarded requests. Configured
+// status codes, errors of classes not in retry_errors (e.g. tls) and
+// destinations which are not allowed are not retried, nor is anything once
+// the retry budget is exhausted (retry_budget_exhausted). Attempt errors are
+// logged at the retry_log_level.
+func checkRetry(codes []int, retryErrors errorClasses, budget *retryBudget, tm *trapmetrics.TrapMetrics, path string, l zerolog.Logger, level string) retryablehttp.CheckRetry {
+	return func(ctx context.Context, resp *http.Response, origErr error) (bool, error) {
+		if noRetry(codes, resp) || errors.Is(origErr, errDestinationNotAllowed) {
+			return false, nil
+		}
+		retry, rhErr := retryablehttp.ErrorPropagatedRetryPolicy(ctx, resp, origErr)
+		if retry && origErr != nil && !retryErrors.retryable(origErr) {
+			retryEvent(l, level).Err(origErr).Str("error_class", errorClass(origErr)).Msg("request error, not retrying")
+			return false, nil
+		}
+		if retry && !budget.take() {
+			l.Warn().Err(origErr).Msg("retry budget exhausted, not retrying")
+			_ = tm.CounterIncrement("retry_budget_exhausted", trapmetrics.Tags{{Category: "path", Value: path}})
+			return false, nil
+		}
+		if retry && rhErr != nil {
+			retryEvent(l, level).Err(rhErr).Err(origErr).Msg("request error")
+		}
+
+		return retry, nil
+	}
+}
+
+// setQueryParams sets the configured query parameters on u, replacing any
+// of the same name already in the query.
+func setQueryParams(u *url.URL, params map[string]string) {
+	if len(params) == 0 {
+		return
+	}
+	q := u.Query()
+	for name, value := range params {
+		q.Set(name, value)
+	}
+	u.RawQuery = q.Encode()
+}
+
+// rejectedStatus are destination statuses rejecting the request itself,
+// a body too large (413) or malformed (400), which retrying can not fix.
+var rejectedStatus = map[int]bool{
+	http.StatusBadRequest:            true,
+	http.StatusRequestEntityTooLarge: true,
+}
+
+// recordRejected records a request rejected by the destination (400, 413)
+// in the rejected_upstream metric, by path and status.
+func recordRejected(tm *trapmetrics.TrapMetrics, path string, resp *http.Response) {
+	if resp == nil || !rejectedStatus[resp.StatusCode] {
+		return
+	}
+	_ = tm.CounterIncrement("rejected_upstream", trapmetrics.Tags{
+		{Category: "path", Value: path},
+		{Category: "status", Value: strconv.Itoa(resp.StatusCode)},
+	})
+}
+
+// noRetry returns true if the response status is one which has been
+// configured to be passed straight through to the client w/o retrying, or
+// rejects the request (400, 413), whatever the retry settings.
+func noRetry(codes []int, resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	if rejectedStatus[resp.StatusCode] {
+		return true
+	}
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// publicPath reports whether path is served w/o requiring basic auth, a path
+// matching both public_paths and protected_paths is protected.
+func (s *Server) publicPath(path string) bool {
+	return matchPath(s.cfg.Server.PublicPaths, path) && !matchPath(s.cfg.Server.ProtectedPaths, path)
+}
+
+// protectPaths requires basic auth for the paths of a route, which otherwise
+// does not require it, listed in protected_paths.
+func (s *Server) protectPaths(next http.Handler) http.Handler {
+	if len(s.cfg.Server.ProtectedPaths) == 0 {
+		return next
+	}
+	auth := s.verifyBasicAuth(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if matchPath(s.cfg.Server.ProtectedPaths, r.URL.Path) {
+			auth.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestAccount returns the account a request is made as, its basic auth
+// username or, w/o one, the default account.
+func requestAccount(username, defaultAccount string) string {
+	if username == "" {
+		return defaultAccount
+	}
+	return username
+}
+
 func (s *Server) verifyBasicAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// extract basic auth credentials
 		// we're not going to verify them, but they must be present so they can be
 		// passed upstream and ultimately to opensearch.
 		username, password, ok := r.BasicAuth()
+		if s.cfg.Server.ClientCertAccount {
+			// the account is identified by the (verified) client certificate,
+			// basic auth is optional and only its password is passed along
+			username, ok = clientCertAccount(r)
+		}
+		// requests w/o credentials are made as the default account (see
+		// account), which is not passed upstream as credentials
+		switch s.cfg.Server.AuthMode {
+		case "anonymous":
+			username, password, ok = "", "", true
+		case "optional":
+			if !ok {
+				username, password, ok = "", "", true
+			}
+		}
+		// public paths are served w/o credentials, unless (also) protected
+		public := false
+		if !ok && s.publicPath(r.URL.Path) {
+			username, password, ok = "", "", true
+			public = true
+		}
 		if !ok {
-			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			if *s.cfg.Server.AuthChallenge {
+				w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+			}
+			writeError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !public && !s.allowed.allowed(requestAccount(username, s.cfg.Circonus.DefaultAccount)) {
+			_ = s.metrics.CounterIncrement("account_denied", trapmetrics.Tags{{Category: "path", Value: s.paths.tag(r.URL.Path)}})
+			log.Warn().Str("account", requestAccount(username, s.cfg.Circonus.DefaultAccount)).Str("remote", clientIP(r, s.cfg.Server.TrustedNets)).Str("url", r.URL.String()).Msg("account not allowed")
+			writeError(w, "account not allowed", http.StatusForbidden)
 			return
 		}
 
@@ -0,0 +1,1105 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/go-trapmetrics"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+func TestLogSizeChunked(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	cfg := testConfig(t, up.Server, "")
+	ts := newTestServer(t, cfg)
+
+	doc := `{"index":{}}` + "\n" + `{"message":"chunked"}` + "\n"
+	template := `{"index_patterns":["logs-*"]}`
+	for path, body := range map[string]string{"/_bulk": doc, "/_template/logs": template} {
+		method := http.MethodPost
+		if path != "/_bulk" {
+			method = http.MethodPut
+		}
+		req, err := http.NewRequest(method, ts.url+path, chunked(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(testAccount, testToken)
+		resp, respBody := ts.do(t, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: response %d %s", path, resp.StatusCode, respBody)
+		}
+		if _, got := up.last(t); got != body {
+			t.Errorf("%s: forwarded body %q, want %q", path, got, body)
+		}
+
+		tags := sizeTags(ts.paths.tag(path), cfg.Destination.Name)
+		if n := counterValue(ts.metrics, "log_size", tags); n != int64(len(body)) {
+			t.Errorf("%s: log_size %d, want %d (bytes read)", path, n, len(body))
+		}
+		if h := histogram(ts.metrics, "log_size_h", tags); h == nil || h.Max() > float64(2*len(body)) {
+			t.Errorf("%s: log_size_h not the bytes read: %v", path, h)
+		}
+	}
+}
+
+func TestNoRetryStatus(t *testing.T) {
+	for name, tc := range map[string]struct {
+		noRetry  string
+		attempts int
+	}{
+		"retried":      {attempts: 3},
+		"not retried":  {noRetry: "  no_retry_status: [503]\n", attempts: 1},
+		"other status": {noRetry: "  no_retry_status: [502]\n", attempts: 3},
+	} {
+		t.Run(name, func(t *testing.T) {
+			up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"error":"unavailable"}`, http.StatusServiceUnavailable)
+			})
+			ts := newTestServer(t, testConfig(t, up.Server, "destination:\n"+tc.noRetry+
+				"  bulk_retry:\n    max: 2\n    wait_min: \"1ms\"\n    wait_max: \"1ms\"\n"))
+
+			resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"))
+			if up.received() != tc.attempts {
+				t.Errorf("%d attempts, want %d", up.received(), tc.attempts)
+			}
+			if tc.attempts == 1 && (resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "unavailable")) {
+				t.Errorf("response %d %s, want the destination's 503", resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestRejectedNotRetried(t *testing.T) {
+	for _, status := range []int{http.StatusRequestEntityTooLarge, http.StatusBadRequest} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"error":"rejected"}`, status)
+			})
+			ts := newTestServer(t, testConfig(t, up.Server, "destination:\n"+
+				"  bulk_retry:\n    max: 2\n    wait_min: \"1ms\"\n    wait_max: \"1ms\"\n"))
+
+			if !noRetry(nil, &http.Response{StatusCode: status}) {
+				t.Error("retried w/o no_retry_status")
+			}
+			resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"))
+			if up.received() != 1 {
+				t.Errorf("%d attempts, want 1", up.received())
+			}
+			if resp.StatusCode != status || !strings.Contains(string(body), "rejected") {
+				t.Errorf("response %d %s, want the destination's %d", resp.StatusCode, body, status)
+			}
+			tags := append(pathTags("/_bulk"), trapmetrics.Tag{Category: "status", Value: strconv.Itoa(status)})
+			if n := counterValue(ts.metrics, "rejected_upstream", tags); n != 1 {
+				t.Errorf("rejected_upstream %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestHealthFormat(t *testing.T) {
+	for _, format := range []string{"plain", "json"} {
+		t.Run(format, func(t *testing.T) {
+			up := newTestUpstream(t, nil)
+			ts := newTestServer(t, testConfig(t, up.Server, "server:\n  health_format: "+format+"\n"))
+			ts.stats.flushes.Add(2)
+
+			req, err := http.NewRequest(http.MethodGet, ts.url+"/health", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, body := ts.do(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("response %d %s", resp.StatusCode, body)
+			}
+			if up.received() != 0 {
+				t.Error("health check forwarded")
+			}
+
+			if format == "plain" {
+				if string(body) != "OK" {
+					t.Errorf("body %q, want OK", body)
+				}
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("content type %q", ct)
+			}
+			var health healthResponse
+			if err := json.Unmarshal(body, &health); err != nil {
+				t.Fatalf("decoding response: %s\n%s", err, body)
+			}
+			if health.Status != "ok" || health.Flushes != 2 || health.Uptime == "" {
+				t.Errorf("health %+v", health)
+			}
+		})
+	}
+}
+
+func TestFailover(t *testing.T) {
+	for name, status := range map[string]int{"destination fails": http.StatusServiceUnavailable, "destination ok": http.StatusOK} {
+		t.Run(name, func(t *testing.T) {
+			up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+				_, _ = w.Write([]byte(`{"from":"destination"}`))
+			})
+			fo := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"from":"failover"}`))
+			})
+			u, err := url.Parse(fo.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ts := newTestServer(t, testConfig(t, up.Server, fmt.Sprintf(`destination:
+  bulk_retry:
+    max: 1
+    wait_min: "1ms"
+    wait_max: "1ms"
+  failover:
+    host: %s
+    port: "%s"
+`, u.Hostname(), u.Port())))
+
+			doc := `{"index":{}}` + "\n{}\n"
+			resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("response %d %s", resp.StatusCode, body)
+			}
+			failover := counterValue(ts.metrics, "failover", pathTags("/_bulk"))
+			if status == http.StatusOK {
+				if fo.received() != 0 || failover != 0 || !strings.Contains(string(body), "destination") {
+					t.Errorf("failover used (%d requests, failover %d): %s", fo.received(), failover, body)
+				}
+				return
+			}
+			if up.received() != 2 {
+				t.Errorf("destination received %d requests, want 2 (retried)", up.received())
+			}
+			if _, got := fo.last(t); got != doc || failover != 1 || !strings.Contains(string(body), "failover") {
+				t.Errorf("failover body %q, failover %d, response %s", got, failover, body)
+			}
+		})
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, "server:\n  max_header_bytes: 1024\n"))
+
+	req := ts.request(t, http.MethodGet, "/logs/_search", "")
+	req.Header.Set("X-Small", strings.Repeat("a", 512))
+	if resp, body := ts.do(t, req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("headers under the limit: response %d %s", resp.StatusCode, body)
+	}
+
+	// the server allows some slack over the limit
+	req = ts.request(t, http.MethodGet, "/logs/_search", "")
+	req.Header.Set("X-Large", strings.Repeat("a", 16*1024))
+	if resp, body := ts.do(t, req); resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("oversized headers: response %d %s, want 431", resp.StatusCode, body)
+	}
+	if up.received() != 1 {
+		t.Errorf("upstream received %d requests, want 1", up.received())
+	}
+
+	// counted once the server is done with the connection
+	tags := trapmetrics.Tags{{Category: "reason", Value: "rejected"}}
+	deadline := time.Now().Add(2 * time.Second)
+	for counterValue(ts.metrics, "server_errors", tags) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := counterValue(ts.metrics, "server_errors", tags); n != 1 {
+		t.Errorf("server_errors rejected %d, want 1", n)
+	}
+}
+
+func TestStripResponseHeaders(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, `server:
+  strip_response_headers: [x-elastic-product, date]
+destination:
+  compat_headers:
+    response:
+      X-Elastic-Product: Elasticsearch
+      X-Kept: "yes"
+`))
+
+	for _, req := range []*http.Request{
+		ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"),
+		ts.request(t, http.MethodGet, "/logs/_search", ""),
+	} {
+		resp, body := ts.do(t, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: response %d %s", req.URL.Path, resp.StatusCode, body)
+		}
+		for _, name := range []string{"X-Elastic-Product", "Date"} {
+			if v := resp.Header.Values(name); len(v) != 0 {
+				t.Errorf("%s: stripped header %s sent: %v", req.URL.Path, name, v)
+			}
+		}
+		if resp.Header.Get("X-Kept") != "yes" {
+			t.Errorf("%s: other header removed: %v", req.URL.Path, resp.Header)
+		}
+	}
+}
+
+func TestCompatHeaders(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, `destination:
+  compat_headers:
+    request:
+      Accept: "application/vnd.elasticsearch+json; compatible-with=7"
+    response:
+      X-Elastic-Product: Elasticsearch
+`))
+
+	for _, req := range []*http.Request{
+		ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"),
+		ts.request(t, http.MethodGet, "/logs/_search", ""),
+	} {
+		resp, body := ts.do(t, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: response %d %s", req.URL.Path, resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("X-Elastic-Product"); got != "Elasticsearch" {
+			t.Errorf("%s: response header %q", req.URL.Path, got)
+		}
+		if r, _ := up.last(t); r.Header.Get("Accept") != "application/vnd.elasticsearch+json; compatible-with=7" {
+			t.Errorf("%s: forwarded accept %q", req.URL.Path, r.Header.Get("Accept"))
+		}
+	}
+}
+
+func TestStubProvisioningPaths(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, `server:
+  stub_provisioning_paths:
+    - /_index_template/
+    - /_opendistro/_ism/policies/raw-span-policy
+`))
+
+	for _, path := range []string{"/_index_template/otel-v1-apm-span", "/_opendistro/_ism/policies/raw-span-policy"} {
+		resp, body := ts.do(t, ts.request(t, http.MethodPut, path, `{"template":{}}`))
+		if resp.StatusCode != http.StatusOK || string(body) != `{"acknowledged":true}` {
+			t.Errorf("%s: response %d %s", path, resp.StatusCode, body)
+		}
+		if n := counterValue(ts.metrics, "stubbed", pathTags(ts.paths.tag(path))); n != 1 {
+			t.Errorf("%s: stubbed %d, want 1", path, n)
+		}
+	}
+	if up.received() != 0 {
+		t.Fatalf("stubbed requests forwarded: %d", up.received())
+	}
+
+	// only PUTs, to the listed paths, are stubbed
+	ts.do(t, ts.request(t, http.MethodGet, "/_index_template/otel-v1-apm-span", ""))
+	ts.do(t, ts.request(t, http.MethodPut, "/_template/logs", `{"template":{}}`))
+	if up.received() != 2 {
+		t.Errorf("upstream received %d requests, want 2", up.received())
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	stubbed := []string{"/_index_template/", "/_opendistro/_ism/policies/raw-span-policy"}
+	for path, want := range map[string]bool{
+		"/_index_template/logs":                            true,
+		"/_opendistro/_ism/policies/raw-span-policy":       true,
+		"/_opendistro/_ism/policies/raw-span-policy-other": false,
+		"/_index_template":                                 false,
+		"/_template/logs":                                  false,
+	} {
+		if got := matchPath(stubbed, path); got != want {
+			t.Errorf("%s: matched %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestClientCancelled(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	upstreamDone := make(chan struct{}, 1)
+	release := make(chan struct{})
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			upstreamDone <- struct{}{}
+		case <-release:
+		}
+	})
+	defer close(release)
+	ts := newTestServer(t, testConfig(t, up.Server, ""))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n").WithContext(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errc <- err
+	}()
+
+	<-arrived
+	cancel()
+	if err := <-errc; err == nil {
+		t.Fatal("cancelled request succeeded")
+	}
+	select {
+	case <-upstreamDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request not cancelled")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for counterValue(ts.metrics, "client_cancelled", pathTags("/_bulk")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := counterValue(ts.metrics, "client_cancelled", pathTags("/_bulk")); n != 1 {
+		t.Errorf("client_cancelled %d, want 1", n)
+	}
+	if up.received() != 1 {
+		t.Errorf("upstream received %d requests, want 1 (not retried)", up.received())
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	for _, mode := range []string{"forward", "reject"} {
+		t.Run(mode, func(t *testing.T) {
+			up := newTestUpstream(t, nil)
+			ts := newTestServer(t, testConfig(t, up.Server, "server:\n  empty_body: "+mode+"\n"))
+
+			for _, tc := range []struct{ method, path string }{
+				{http.MethodPost, "/_bulk"},
+				{http.MethodPut, "/_template/logs"},
+			} {
+				before := up.received()
+				resp, body := ts.do(t, ts.request(t, tc.method, tc.path, ""))
+				if n := counterValue(ts.metrics, "empty_body", pathTags(tc.path)); n != 1 {
+					t.Errorf("%s: empty_body %d, want 1", tc.path, n)
+				}
+				if mode == "reject" {
+					if resp.StatusCode != http.StatusBadRequest || up.received() != before {
+						t.Errorf("%s: response %d %s, forwarded %v", tc.path, resp.StatusCode, body, up.received() != before)
+					}
+					continue
+				}
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("%s: response %d %s", tc.path, resp.StatusCode, body)
+				}
+				// an empty body, not an empty gzip stream or a chunked body
+				r, got := up.last(t)
+				if got != "" || r.ContentLength != 0 || len(r.TransferEncoding) != 0 || r.Header.Get("Content-Encoding") != "" {
+					t.Errorf("%s: forwarded body %q, length %d, transfer encoding %v, content encoding %q",
+						tc.path, got, r.ContentLength, r.TransferEncoding, r.Header.Get("Content-Encoding"))
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamErrorRelayed(t *testing.T) {
+	page := "<html><body>400 Bad Request</body></html>"
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		// e.g. an error page from a proxy in front of the destination
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusBadRequest)
+		zw := gzip.NewWriter(w)
+		_, _ = zw.Write([]byte(page))
+		_ = zw.Close()
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, ""))
+
+	for _, req := range []*http.Request{
+		ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"),
+		ts.request(t, http.MethodGet, "/logs/_search", ""),
+	} {
+		resp, body := ts.do(t, req)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: response %d, want 400", req.URL.Path, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/html" {
+			t.Errorf("%s: content type %q, want text/html", req.URL.Path, ct)
+		}
+		if string(body) != page {
+			t.Errorf("%s: body %q, want the (decoded) error page", req.URL.Path, body)
+		}
+	}
+}
+
+func TestTextResponseContentType(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_cat/indices" {
+			w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			_, _ = w.Write([]byte("green open logs 1 1\n"))
+			return
+		}
+		// no content type (not sniffed), json is assumed
+		w.Header()["Content-Type"] = nil
+		_, _ = w.Write([]byte(`{}`))
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, ""))
+
+	resp, body := ts.do(t, ts.request(t, http.MethodGet, "/_cat/indices", ""))
+	if resp.StatusCode != http.StatusOK || string(body) != "green open logs 1 1\n" {
+		t.Fatalf("response %d %q", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; charset=UTF-8" {
+		t.Errorf("content type %q, want the upstream's text/plain", ct)
+	}
+
+	resp, _ = ts.do(t, ts.request(t, http.MethodGet, "/logs", ""))
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("w/o an upstream content type: %q, want json", ct)
+	}
+}
+
+func TestSlowRequestLogged(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(150 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte(`{}`))
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, "server:\n  slow_request_threshold: 100ms\n"))
+	logs := captureLog(t)
+
+	for _, path := range []string{"/fast", "/slow"} {
+		if resp, body := ts.do(t, ts.request(t, http.MethodGet, path, "")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: response %d %s", path, resp.StatusCode, body)
+		}
+	}
+
+	var slow []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry struct {
+			Level string `json:"level"`
+			URL   string `json:"url"`
+			Slow  bool   `json:"slow"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.URL == "" {
+			continue
+		}
+		if entry.Slow {
+			if entry.Level != "warn" {
+				t.Errorf("slow request logged at %s, want warn", entry.Level)
+			}
+			slow = append(slow, strings.TrimPrefix(entry.URL, up.URL))
+		}
+	}
+	if strings.Join(slow, ",") != "/slow" {
+		t.Errorf("slow requests logged %v, want [/slow]\n%s", slow, logs)
+	}
+}
+
+func TestPreserveHost(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		t.Run(fmt.Sprintf("preserve_host %v", preserve), func(t *testing.T) {
+			up := newTestUpstream(t, nil)
+			ts := newTestServer(t, testConfig(t, up.Server, fmt.Sprintf("destination:\n  preserve_host: %v\n", preserve)))
+			want := strings.TrimPrefix(up.URL, "http://")
+			if preserve {
+				want = "logs.example.com"
+			}
+
+			for _, req := range []*http.Request{
+				ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"),
+				ts.request(t, http.MethodGet, "/logs/_search", ""),
+			} {
+				req.Host = "logs.example.com"
+				if resp, body := ts.do(t, req); resp.StatusCode != http.StatusOK {
+					t.Fatalf("%s: response %d %s", req.URL.Path, resp.StatusCode, body)
+				}
+				if r, _ := up.last(t); r.Host != want {
+					t.Errorf("%s: forwarded host %q, want %q", req.URL.Path, r.Host, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	n := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"took":%d,"errors":false}`, n)
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, `server:
+  idempotency:
+    enabled: true
+`))
+
+	bulk := func(key string) (int, string) {
+		t.Helper()
+		req := ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n")
+		req.Header.Set("Idempotency-Key", key)
+		resp, body := ts.do(t, req)
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("key %s: content type %q", key, ct)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	status, first := bulk("k1")
+	if status != http.StatusOK || first != `{"took":1,"errors":false}` {
+		t.Fatalf("first request: response %d %s", status, first)
+	}
+	if up.received() != 1 {
+		t.Fatalf("upstream received %d requests, want 1", up.received())
+	}
+
+	status, dup := bulk("k1")
+	if status != http.StatusOK || dup != first {
+		t.Errorf("duplicate: response %d %s, want %s", status, dup, first)
+	}
+	if up.received() != 1 {
+		t.Errorf("duplicate forwarded, upstream received %d requests", up.received())
+	}
+	if v := counterValue(ts.metrics, "idempotent_replay", pathTags("/_bulk")); v != 1 {
+		t.Errorf("idempotent_replay %d, want 1", v)
+	}
+
+	// another key is a different request
+	if status, body := bulk("k2"); status != http.StatusOK || body != `{"took":2,"errors":false}` {
+		t.Errorf("other key: response %d %s", status, body)
+	}
+	if up.received() != 2 {
+		t.Errorf("upstream received %d requests, want 2", up.received())
+	}
+}
+
+func TestTenantPrefixes(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, `destination:
+  tenant_prefixes:
+    acct-a: tenant-a
+    acct-b: /tenant-b/
+`))
+
+	tests := []struct {
+		account, path, want string
+	}{
+		{"acct-a", "/_bulk", "/tenant-a/_bulk"},
+		{"acct-b", "/_bulk", "/tenant-b/_bulk"},
+		{"acct-a", "/logs/_search", "/tenant-a/logs/_search"},
+		{"acct-b", "/logs/_search", "/tenant-b/logs/_search"},
+		{"acct-c", "/_bulk", "/_bulk"},
+	}
+
+	for _, tt := range tests {
+		var req *http.Request
+		if tt.path == "/_bulk" {
+			req = ts.request(t, http.MethodPost, tt.path, `{"index":{}}`+"\n{}\n")
+		} else {
+			req = ts.request(t, http.MethodGet, tt.path, "")
+		}
+		req.SetBasicAuth(tt.account, testToken)
+		resp, body := ts.do(t, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s: response %d %s", tt.account, tt.path, resp.StatusCode, body)
+		}
+		if r, _ := up.last(t); r.URL.Path != tt.want {
+			t.Errorf("%s %s: forwarded to %s, want %s", tt.account, tt.path, r.URL.Path, tt.want)
+		}
+	}
+}
+
+func TestGzSizeHistogram(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	cfg := testConfig(t, up.Server, "")
+	ts := newTestServer(t, cfg)
+
+	doc := strings.Repeat(`{"index":{}}`+"\n"+`{"message":"compressible"}`+"\n", 200)
+	resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("response %d %s", resp.StatusCode, body)
+	}
+	r, _ := up.last(t)
+	if r.Header.Get("Content-Encoding") != "gzip" || r.ContentLength <= 0 {
+		t.Fatalf("forwarded body not gzip w/a length: %v %d", r.Header, r.ContentLength)
+	}
+
+	tags := sizeTags(ts.paths.tag("/_bulk"), cfg.Destination.Name)
+	h := histogram(ts.metrics, "gz_size_h", tags)
+	if h == nil || h.Count() != 1 {
+		t.Fatalf("gz_size_h not recorded once: %v", h)
+	}
+	// histogram bins are approximate, within 10% of the compressed size
+	compressed := float64(r.ContentLength)
+	if mean := h.ApproxMean(); mean < compressed*0.9 || mean > compressed*1.1 {
+		t.Errorf("gz_size_h %.0f, want the compressed size %.0f (uncompressed %d)", mean, compressed, len(doc))
+	}
+}
+
+func TestStatusRemap(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/_bulk" {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			_, _ = w.Write([]byte(`{"error":"too large"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"no such index"}`))
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, `server:
+  status_remap:
+    413: 400
+`))
+
+	tests := []struct {
+		req        *http.Request
+		wantStatus int
+		wantBody   string
+	}{
+		{ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"), http.StatusBadRequest, `{"error":"too large"}`},
+		{ts.request(t, http.MethodGet, "/logs/_search", ""), http.StatusNotFound, `{"error":"no such index"}`},
+	}
+
+	for _, tt := range tests {
+		resp, body := ts.do(t, tt.req)
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.req.URL.Path, resp.StatusCode, tt.wantStatus)
+		}
+		if string(body) != tt.wantBody {
+			t.Errorf("%s: body %s, want %s", tt.req.URL.Path, body, tt.wantBody)
+		}
+	}
+}
+
+func TestHandlerTimeouts(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(300 * time.Millisecond):
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, `server:
+  handler_timeouts:
+    /_bulk: 100ms
+    /_template/: 5s
+`))
+
+	// the bulk route times out, answered by the timeout handler (503) or the
+	// handler seeing its cancelled destination request (504)
+	start := time.Now()
+	resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"))
+	if resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("/_bulk: response %d %s, want a timeout", resp.StatusCode, body)
+	}
+	if d := time.Since(start); d >= 300*time.Millisecond {
+		t.Errorf("/_bulk: answered after %s, want the 100ms timeout", d)
+	}
+
+	// the template route waits for the destination
+	resp, body = ts.do(t, ts.request(t, http.MethodPut, "/_template/logs", `{"index_patterns":["logs-*"]}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/_template/logs: response %d %s, want 200", resp.StatusCode, body)
+	}
+}
+
+func TestBulkRetryMax(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"unavailable"}`, http.StatusServiceUnavailable)
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, `destination:
+  bulk_retry:
+    max: 1
+    wait_min: 1ms
+    wait_max: 5ms
+  retry:
+    max: 3
+    wait_min: 1ms
+    wait_max: 5ms
+`))
+
+	tests := []struct {
+		req          *http.Request
+		wantAttempts int
+	}{
+		{ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"), 2},
+		{ts.request(t, http.MethodGet, "/logs/_search", ""), 4},
+	}
+
+	for _, tt := range tests {
+		before := up.received()
+		resp, body := ts.do(t, tt.req)
+		if resp.StatusCode < http.StatusInternalServerError {
+			t.Errorf("%s: response %d %s, want a failure", tt.req.URL.Path, resp.StatusCode, body)
+		}
+		if n := up.received() - before; n != tt.wantAttempts {
+			t.Errorf("%s: %d attempts, want %d", tt.req.URL.Path, n, tt.wantAttempts)
+		}
+	}
+}
+
+func TestBulkQueryParams(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, `destination:
+  query_params:
+    pipeline: logs-ingest
+    refresh: "false"
+`))
+
+	resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk?refresh=true", `{"index":{}}`+"\n{}\n"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("response %d %s", resp.StatusCode, body)
+	}
+	r, _ := up.last(t)
+	q := r.URL.Query()
+	if q.Get("pipeline") != "logs-ingest" {
+		t.Errorf("pipeline %q, want logs-ingest (query %s)", q.Get("pipeline"), r.URL.RawQuery)
+	}
+	if v := q["refresh"]; len(v) != 1 || v[0] != "false" {
+		t.Errorf("refresh %v, want the configured [false] (query %s)", v, r.URL.RawQuery)
+	}
+
+	// generic requests are forwarded w/o them
+	resp, body = ts.do(t, ts.request(t, http.MethodGet, "/logs/_search", ""))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("search: response %d %s", resp.StatusCode, body)
+	}
+	if r, _ := up.last(t); r.URL.RawQuery != "" {
+		t.Errorf("search: query %q, want none", r.URL.RawQuery)
+	}
+}
+
+func TestAuthMode(t *testing.T) {
+	tests := []struct {
+		mode      string
+		creds     bool
+		challenge string // auth_challenge, empty for the default
+		wantCode  int
+		wantUser  string // forwarded basic auth, none for the default account
+		wantPass  string
+		wantPath  string // forwarded path, the default account's tenant prefix applies
+	}{
+		{"require", true, "", http.StatusOK, testAccount, testToken, "/_bulk"},
+		{"require", false, "", http.StatusUnauthorized, "", "", ""},
+		{"require", false, "false", http.StatusUnauthorized, "", "", ""},
+		{"optional", true, "", http.StatusOK, testAccount, testToken, "/_bulk"},
+		{"optional", false, "", http.StatusOK, "", "", "/fallback/_bulk"},
+		{"anonymous", true, "", http.StatusOK, "", "", "/fallback/_bulk"},
+		{"anonymous", false, "", http.StatusOK, "", "", "/fallback/_bulk"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s creds %v challenge %q", tt.mode, tt.creds, tt.challenge), func(t *testing.T) {
+			up := newTestUpstream(t, nil)
+			doc := "circonus:\n  default_account: fallback\nserver:\n  auth_mode: " + tt.mode + "\n"
+			if tt.challenge != "" {
+				doc += "  auth_challenge: " + tt.challenge + "\n"
+			}
+			doc += "destination:\n  tenant_prefixes:\n    fallback: fallback\n"
+			ts := newTestServer(t, testConfig(t, up.Server, doc))
+
+			req := ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n")
+			if !tt.creds {
+				req.Header.Del("Authorization")
+			}
+			resp, body := ts.do(t, req)
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("response %d %s, want %d", resp.StatusCode, body, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusUnauthorized {
+				wantChallenge := tt.challenge != "false"
+				if got := resp.Header.Get("WWW-Authenticate") != ""; got != wantChallenge {
+					t.Errorf("challenge sent %v, want %v", got, wantChallenge)
+				}
+				if up.received() != 0 {
+					t.Error("unauthorized request forwarded")
+				}
+				return
+			}
+			r, _ := up.last(t)
+			user, pass, ok := r.BasicAuth()
+			if user != tt.wantUser || pass != tt.wantPass || ok != (tt.wantUser != "") {
+				t.Errorf("forwarded as %q/%q (basic auth %v), want %q/%q", user, pass, ok, tt.wantUser, tt.wantPass)
+			}
+			if r.URL.Path != tt.wantPath {
+				t.Errorf("forwarded to %s, want %s", r.URL.Path, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestPublicPaths(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, `circonus:
+  default_account: fallback
+server:
+  public_paths: [/_cluster/health, /_cat/]
+  protected_paths: [/_cat/indices, /health]
+`))
+
+	tests := []struct {
+		path     string
+		creds    bool
+		wantCode int
+		forward  bool
+		wantUser string // forwarded basic auth, none w/o credentials
+	}{
+		{"/_cluster/health", false, http.StatusOK, true, ""},
+		{"/_cluster/health", true, http.StatusOK, true, testAccount},
+		{"/_cat/nodes", false, http.StatusOK, true, ""},
+		{"/_cat/indices", false, http.StatusUnauthorized, false, ""},
+		{"/logs/_search", false, http.StatusUnauthorized, false, ""},
+		{"/health", false, http.StatusUnauthorized, false, ""},
+		{"/health", true, http.StatusOK, false, ""},
+	}
+	for _, tt := range tests {
+		before := up.received()
+		req := ts.request(t, http.MethodGet, tt.path, "")
+		if !tt.creds {
+			req.Header.Del("Authorization")
+		}
+		resp, body := ts.do(t, req)
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("%s creds %v: response %d %s, want %d", tt.path, tt.creds, resp.StatusCode, body, tt.wantCode)
+			continue
+		}
+		if !tt.forward {
+			if up.received() != before {
+				t.Errorf("%s creds %v: forwarded", tt.path, tt.creds)
+			}
+			continue
+		}
+		r, _ := up.last(t)
+		if user, _, _ := r.BasicAuth(); r.URL.Path != tt.path || user != tt.wantUser {
+			t.Errorf("%s creds %v: forwarded %s as %q, want %q", tt.path, tt.creds, r.URL.Path, user, tt.wantUser)
+		}
+	}
+}
+
+func TestForwardTrailers(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+		w.Header().Set("X-Checksum", "abc123")
+	})
+
+	for _, forward := range []bool{true, false} {
+		t.Run(fmt.Sprintf("forward_trailers %v", forward), func(t *testing.T) {
+			ts := newTestServer(t, testConfig(t, up.Server, fmt.Sprintf("server:\n  forward_trailers: %v\n", forward)))
+
+			for _, req := range []*http.Request{
+				ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"),
+				ts.request(t, http.MethodGet, "/logs/_search", ""),
+			} {
+				resp, body := ts.do(t, req)
+				if resp.StatusCode != http.StatusOK || string(body) != `{}` {
+					t.Fatalf("%s: response %d %s", req.URL.Path, resp.StatusCode, body)
+				}
+				want := ""
+				if forward {
+					want = "abc123"
+				}
+				if got := resp.Trailer.Get("X-Checksum"); got != want {
+					t.Errorf("%s: trailer %q, want %q", req.URL.Path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryLogLevel(t *testing.T) {
+	// the level the exporter runs at w/o --debug
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	defer zerolog.SetGlobalLevel(level)
+
+	tests := []struct {
+		retryLogLevel string // empty for the default
+		wantAttempts  int    // per-attempt lines, retrying and non-200 response
+	}{
+		{"", 0},
+		{"info", 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("retry_log_level %q", tt.retryLogLevel), func(t *testing.T) {
+			n := 0
+			up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if n++; n <= 2 {
+					http.Error(w, `{"error":"unavailable"}`, http.StatusServiceUnavailable)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{}`))
+			})
+			doc := "destination:\n  bulk_retry:\n    wait_min: 1ms\n    wait_max: 5ms\n"
+			if tt.retryLogLevel != "" {
+				doc += "  retry_log_level: " + tt.retryLogLevel + "\n"
+			}
+			ts := newTestServer(t, testConfig(t, up.Server, doc))
+			logs := captureLog(t)
+
+			resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("response %d %s", resp.StatusCode, body)
+			}
+
+			messages := make(map[string]int)
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				var entry struct {
+					Message string `json:"message"`
+				}
+				if err := json.Unmarshal([]byte(line), &entry); err == nil {
+					messages[entry.Message]++
+				}
+			}
+			if got := messages["retrying"] + messages["non-200 response"]; got != tt.wantAttempts {
+				t.Errorf("%d per-attempt logs, want %d: %v", got, tt.wantAttempts, messages)
+			}
+			// the outcome is logged regardless
+			if messages["succeeded"] != 1 {
+				t.Errorf("outcome not logged: %v", messages)
+			}
+		})
+	}
+}
+
+func TestDestinationTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int // of the (primary) destination
+		named    bool
+		wantDest string
+	}{
+		{"destination", http.StatusOK, true, "primary"},
+		{"failover", http.StatusServiceUnavailable, true, "secondary"},
+		{"default name", http.StatusOK, false, "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(`{}`))
+			})
+			fo := newTestUpstream(t, nil)
+			u, err := url.Parse(fo.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc := fmt.Sprintf(`destination:
+  bulk_retry:
+    max: 0
+  failover:
+    host: %s
+    port: "%s"
+`, u.Hostname(), u.Port())
+			if tt.named {
+				doc += "    name: secondary\n  name: primary\n"
+			}
+			ts := newTestServer(t, testConfig(t, up.Server, doc))
+
+			doc = `{"index":{}}` + "\n{}\n"
+			if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc)); resp.StatusCode != http.StatusOK {
+				t.Fatalf("response %d %s", resp.StatusCode, body)
+			}
+			tags := sizeTags(ts.paths.tag("/_bulk"), tt.wantDest)
+			if n := counterValue(ts.metrics, "log_size", tags); n != int64(len(doc)) {
+				t.Errorf("log_size tagged destination:%s %d, want %d", tt.wantDest, n, len(doc))
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name, header, inbound string
+		want                  string // empty for a generated uuid
+	}{
+		{"inbound present", "X-Request-ID", "proxy-id-1", "proxy-id-1"},
+		{"inbound absent", "X-Request-ID", "", ""},
+		{"not configured", "", "proxy-id-1", ""},
+		{"too long", "X-Request-ID", strings.Repeat("x", maxRequestIDLen+1), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, "http://localhost/_bulk", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.inbound != "" {
+				r.Header.Set("X-Request-ID", tt.inbound)
+			}
+			got := requestID(r, tt.header)
+			if tt.want != "" {
+				if got != tt.want {
+					t.Errorf("id %q, want %q", got, tt.want)
+				}
+				return
+			}
+			if _, err := uuid.Parse(got); err != nil {
+				t.Errorf("id %q, want a generated uuid", got)
+			}
+		})
+	}
+
+	// the id is on the request's logs
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, "server:\n  request_id_header: X-Request-ID\n"))
+	logs := captureLog(t)
+	req := ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n")
+	req.Header.Set("X-Request-ID", "proxy-id-2")
+	if resp, body := ts.do(t, req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("response %d %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(logs.String(), `"req_id":"proxy-id-2"`) {
+		t.Errorf("inbound id not logged:\n%s", logs)
+	}
+}
+
+func TestRespBytes(t *testing.T) {
+	bulkResp := `{"took":1,"errors":false,"items":[{"index":{"status":201}}]}`
+	searchResp := `{"hits":{"total":{"value":0},"hits":[]}}`
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/_bulk" {
+			_, _ = w.Write([]byte(bulkResp))
+			return
+		}
+		_, _ = w.Write([]byte(searchResp))
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, ""))
+
+	for i := 0; i < 2; i++ {
+		for _, req := range []*http.Request{
+			ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"),
+			ts.request(t, http.MethodGet, "/logs/_search", ""),
+		} {
+			if resp, body := ts.do(t, req); resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s: response %d %s", req.URL.Path, resp.StatusCode, body)
+			}
+		}
+	}
+
+	for path, want := range map[string]int{"/_bulk": 2 * len(bulkResp), "/logs/_search": 2 * len(searchResp)} {
+		if n := counterValue(ts.metrics, "resp_bytes", pathTags(ts.paths.tag(path))); n != int64(want) {
+			t.Errorf("%s: resp_bytes %d, want %d", path, n, want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listen binds the server's listener. With reusePort, SO_REUSEPORT is set so
+// multiple processes can bind the same address (the kernel balances new
+// connections between them). A backlog > 0 replaces the system default
+// (somaxconn) length of the queue of pending connections.
+func listen(ctx context.Context, addr string, reusePort bool, backlog int) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("setting SO_REUSEPORT: %w", sockErr)
+			}
+			return nil
+		}
+	}
+
+	ln, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if backlog > 0 {
+		if err := setBacklog(ln, backlog); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	return ln, nil
+}
+
+// setBacklog sets the length of the listener's queue of pending connections,
+// listen(2) on a listening socket updates its backlog.
+func setBacklog(ln net.Listener, backlog int) error {
+	tcpLn, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	rc, err := tcpLn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("setting listen backlog: %w", err)
+	}
+	var listenErr error
+	err = rc.Control(func(fd uintptr) {
+		listenErr = unix.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return fmt.Errorf("setting listen backlog: %w", err)
+	}
+	if listenErr != nil {
+		return fmt.Errorf("setting listen backlog: %w", listenErr)
+	}
+	return nil
+}
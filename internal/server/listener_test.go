@@ -0,0 +1,37 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+//go:build linux || freebsd || darwin
+
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	first, err := listen(context.Background(), "127.0.0.1:0", true, 0)
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer first.Close()
+	addr := first.Addr().String()
+
+	// e.g. a second exporter process started on the same port
+	second, err := listen(context.Background(), addr, true, 16)
+	if err != nil {
+		t.Fatalf("second listen on %s with reuseport: %s", addr, err)
+	}
+	defer second.Close()
+	if second.Addr().String() != addr {
+		t.Errorf("second listener on %s, want %s", second.Addr(), addr)
+	}
+
+	if ln, err := listen(context.Background(), addr, false, 0); err == nil {
+		ln.Close()
+		t.Errorf("listen on %s w/o reuseport succeeded", addr)
+	}
+}
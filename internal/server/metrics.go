@@ -6,27 +6,313 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/circonus-labs/go-apiclient"
 	"github.com/circonus-labs/go-trapcheck"
 	"github.com/circonus-labs/go-trapmetrics"
 	"github.com/circonus/c3-exporter/internal/config"
+	"github.com/rs/zerolog/log"
 )
 
-func initMetrics(cfg config.Circonus) (*trapmetrics.TrapMetrics, error) {
+func initMetrics(cfg config.Circonus) (*trapmetrics.TrapMetrics, *trapcheck.TrapCheck, error) {
 	client, err := apiclient.New(&apiclient.Config{TokenKey: cfg.APIKey, URL: cfg.APIURL})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	checkCfg := &trapcheck.Config{
+		Client:          client,
+		SubmissionURL:   cfg.SubmissionURL,
+		SubmitTLSConfig: cfg.SubmitTLSConfig,
+	}
+	tags := staticTags(cfg.StaticTags)
+	if cfg.BrokerCID != "" || len(tags) > 0 {
+		checkCfg.CheckConfig = &apiclient.CheckBundle{}
+		if cfg.BrokerCID != "" {
+			checkCfg.CheckConfig.Brokers = []string{cfg.BrokerCID}
+		}
+		for _, tag := range tags {
+			checkCfg.CheckConfig.Tags = append(checkCfg.CheckConfig.Tags, tag.Category+":"+tag.Value)
+		}
+	}
+
+	if cfg.SubmissionURL != "" {
+		// w/o a check, the check config is taken as the check bundle, its
+		// uuid is used for the result of each submission
+		if checkCfg.CheckConfig == nil {
+			checkCfg.CheckConfig = &apiclient.CheckBundle{}
+		}
+		checkCfg.CheckConfig.CheckUUIDs = []string{submissionCheckUUID(cfg.SubmissionURL)}
+	}
+
+	check, err := trapcheck.New(checkCfg)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	check, err := trapcheck.New(&trapcheck.Config{Client: client})
+	trap, err := trapmetrics.New(&trapmetrics.Config{Trap: check, GlobalTags: tags})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	trap, err := trapmetrics.New(&trapmetrics.Config{Trap: check})
+	return trap, check, nil
+}
+
+// submissionCheckUUID returns the check uuid of an httptrap submission url
+// (.../module/httptrap/<uuid>/<secret>), "n/a" for other urls.
+func submissionCheckUUID(submissionURL string) string {
+	u, err := url.Parse(submissionURL)
 	if err != nil {
-		return nil, err
+		return "n/a"
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i, segment := range segments {
+		if segment == "httptrap" && i+1 < len(segments) && segments[i+1] != "" {
+			return segments[i+1]
+		}
 	}
+	return "n/a"
+}
 
-	return trap, nil
+// staticTags returns the static tags (e.g. pod and node), added to every
+// metric, sorted by category.
+func staticTags(static map[string]string) trapmetrics.Tags {
+	categories := make([]string, 0, len(static))
+	for category := range static {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	tags := make(trapmetrics.Tags, 0, len(categories))
+	for _, category := range categories {
+		tags = append(tags, trapmetrics.Tag{Category: category, Value: static[category]})
+	}
+	return tags
+}
+
+// errNoMetrics is the error (not exported by trapmetrics) from JSONMetrics
+// when no metrics have been recorded since the last flush.
+const errNoMetrics = "no valid metrics found"
+
+// flushSet flushes a metric set to its check, returning the metrics (httptrap
+// json) flushed. Taking the metrics resets them, so they are returned to be
+// exported (otlp) and kept (admin /metrics) even when sending them fails. They
+// are sent with the check itself, tm.FlushRawJSON would append any metrics
+// recorded since the snapshot to them.
+func flushSet(ctx context.Context, tm *trapmetrics.TrapMetrics, check *trapcheck.TrapCheck) (*trapmetrics.Result, []byte, error) {
+	start := time.Now()
+	data, err := tm.JSONMetrics()
+	if err != nil {
+		if err.Error() == errNoMetrics {
+			// nothing recorded, nothing to flush
+			return &trapmetrics.Result{Error: "no metrics to send"}, nil, nil
+		}
+		return nil, nil, fmt.Errorf("encoding metrics: %w", err)
+	}
+	encodeDur := time.Since(start)
+
+	submitStart := time.Now()
+	r, err := check.SendMetrics(ctx, *bytes.NewBuffer(data))
+	if err != nil {
+		return nil, data, fmt.Errorf("submitting metrics to broker: %w", err)
+	}
+	return &trapmetrics.Result{
+		CheckUUID:       r.CheckUUID,
+		Error:           r.Error,
+		SubmitUUID:      r.SubmitUUID,
+		Stats:           r.Stats,
+		Filtered:        r.Filtered,
+		EncodeDuration:  encodeDur,
+		SubmitDuration:  r.SubmitDuration,
+		LastReqDuration: r.LastReqDuration,
+		FlushDuration:   encodeDur + time.Since(submitStart),
+		BytesSent:       r.BytesSent,
+		BytesSentGzip:   r.BytesSentGzip,
+	}, data, nil
+}
+
+// preflightCheck pulls a fresh copy of the check bundle from the API so that
+// the check is known to exist before the server starts accepting requests.
+// Returns the check uuid.
+func preflightCheck(check *trapcheck.TrapCheck) (string, error) {
+	bundle, err := check.RefreshCheckBundle()
+	if err != nil {
+		return "", fmt.Errorf("preflight check: %w", err)
+	}
+	if len(bundle.CheckUUIDs) == 0 {
+		return "", fmt.Errorf("preflight check: no check uuid found in bundle (%s)", bundle.CID)
+	}
+
+	log.Info().
+		Str("cid", bundle.CID).
+		Str("check_uuid", bundle.CheckUUIDs[0]).
+		Bool("created", check.IsNewCheckBundle()).
+		Msg("preflight check")
+
+	return bundle.CheckUUIDs[0], nil
+}
+
+// recordRuntimeMetrics sets gauges for the go runtime, it is called before
+// each flush so the values reflect the state at submission time.
+func recordRuntimeMetrics(tm *trapmetrics.TrapMetrics) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	tags := trapmetrics.Tags{{Category: "source", Value: "runtime"}}
+	_ = tm.GaugeSet("goroutines", tags, runtime.NumGoroutine(), nil)
+	_ = tm.GaugeSet("heap_alloc", tags, ms.HeapAlloc, nil)
+	_ = tm.GaugeSet("heap_inuse", tags, ms.HeapInuse, nil)
+	_ = tm.GaugeSet("heap_objects", tags, ms.HeapObjects, nil)
+	_ = tm.GaugeSet("sys", tags, ms.Sys, nil)
+	_ = tm.GaugeSet("gc_runs", tags, ms.NumGC, nil)
+	_ = tm.GaugeSet("gc_pause_total_ns", tags, ms.PauseTotalNs, nil)
+	_ = tm.GaugeSet("gc_pause_last_ns", tags, ms.PauseNs[(ms.NumGC+255)%256], nil)
+}
+
+// accountMetrics decides which accounts have per-account (ingest_acct)
+// metrics recorded. With no accounts and no minimum, all accounts do.
+type accountMetrics struct {
+	accounts       map[string]bool
+	defaultAccount string
+	minBytes       int64
+}
+
+func newAccountMetrics(cfg config.AccountMetrics, defaultAccount string) accountMetrics {
+	a := accountMetrics{minBytes: cfg.MinBytes, defaultAccount: defaultAccount}
+	if len(cfg.Accounts) > 0 {
+		a.accounts = make(map[string]bool, len(cfg.Accounts))
+		for _, acct := range cfg.Accounts {
+			a.accounts[a.tag(acct)] = true
+		}
+	}
+	return a
+}
+
+// tag returns the ingest_acct tag value for a username, trimmed and lower
+// cased, the default account for blank usernames (e.g. anonymous requests).
+func (a accountMetrics) tag(username string) string {
+	if acct := strings.ToLower(strings.TrimSpace(username)); acct != "" {
+		return acct
+	}
+	return a.defaultAccount
+}
+
+// enabled returns true if per-account metrics should be recorded for a
+// request from the account (tag) of size bytes.
+func (a accountMetrics) enabled(username string, size int64) bool {
+	if a.accounts == nil && a.minBytes == 0 {
+		return true
+	}
+	if a.accounts[username] {
+		return true
+	}
+	return a.minBytes > 0 && size >= a.minBytes
+}
+
+// checkMetrics are the metrics sent to a check.
+type checkMetrics struct {
+	tm    *trapmetrics.TrapMetrics
+	check *trapcheck.TrapCheck
+}
+
+// flushMetrics flushes the metric sets (one per check), at most concurrency
+// at a time, logging the result of each and, for more than one, the totals.
+// Each flush is counted in flushStats, which keeps the metrics flushed (admin
+// /metrics), and in the set's metric_flush* metrics, and aborted if it takes
+// longer than timeout. With an otlp exporter, the metrics are then pushed to
+// the collector, with the exporter's own timeout, so an unresponsive
+// collector does not take from the time allowed for the submission to
+// circonus.
+func flushMetrics(ctx context.Context, sets []checkMetrics, concurrency int, timeout time.Duration, otlp *otlpExporter, flushStats *serverStats) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	start := time.Now()
+	results := make([]*trapmetrics.Result, len(sets))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, set := range sets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, set checkMetrics) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			flushCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			r, data, err := flushSet(flushCtx, set.tm, set.check)
+			switch {
+			case err != nil && ctx.Err() == nil && errors.Is(flushCtx.Err(), context.DeadlineExceeded):
+				log.Warn().Err(err).Str("timeout", timeout.String()).Msg("flushing circonus metrics timed out")
+			case err != nil:
+				log.Warn().Err(err).Msg("flushing circonus metrics")
+			}
+			recordFlush(set.tm, flushStats, r, err)
+			if data != nil {
+				flushStats.lastMetrics.Store(&flushedMetrics{Metrics: data, Time: time.Now()})
+			}
+			if otlp != nil && data != nil {
+				if err := otlp.export(ctx, data); err != nil {
+					log.Warn().Err(err).Msg("exporting otlp metrics")
+				}
+			}
+			results[i] = r
+		}(i, set)
+	}
+	wg.Wait()
+
+	var stats uint64
+	var bytes int
+	for _, r := range results {
+		if r == nil {
+			continue
+		}
+		stats += r.Stats
+		bytes += r.BytesSent
+		log.Debug().
+			Str("check_uuid", r.CheckUUID).
+			Str("submit_uuid", r.SubmitUUID).
+			Str("error", r.Error).
+			Uint64("filtered", r.Filtered).
+			Uint64("stats", r.Stats).
+			Int("bytes", r.BytesSent).
+			Str("encode_dur", r.EncodeDuration.String()).
+			Str("submit_dur", r.SubmitDuration.String()).
+			Str("last_req_dur", r.LastReqDuration.String()).
+			Str("flush_dur", r.FlushDuration.String()).
+			Msg("flushed metrics")
+	}
+
+	if len(sets) > 1 {
+		log.Debug().
+			Int("checks", len(sets)).
+			Uint64("stats", stats).
+			Int("bytes", bytes).
+			Str("flush_dur", time.Since(start).String()).
+			Msg("flushed all metrics")
+	}
+}
+
+// recordFlush counts the flush of a set in the in-process stats and the set
+// itself, the latter are sent with the set's next flush.
+func recordFlush(tm *trapmetrics.TrapMetrics, stats *serverStats, r *trapmetrics.Result, err error) {
+	_ = tm.CounterIncrement("metric_flushes", nil)
+	if stats.recordFlush(r, err) {
+		_ = tm.CounterIncrement("metric_flush_failures", nil)
+	}
+	if r != nil {
+		_ = tm.CounterIncrementByValue("metric_flush_bytes", nil, uint64(r.BytesSent))
+	}
 }
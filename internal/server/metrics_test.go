@@ -0,0 +1,431 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/go-trapmetrics"
+	"github.com/circonus/c3-exporter/internal/config"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestInitMetricsSubmissionURL(t *testing.T) {
+	broker := newTestBroker(t)
+	for name, static := range map[string]map[string]string{
+		"no check config": nil,
+		"static tags":     {"pod": "c3e-0"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tm, _, err := initMetrics(config.Circonus{
+				APIKey:        testToken,
+				APIURL:        broker.URL,
+				SubmissionURL: broker.submissionURL(),
+				StaticTags:    static,
+			})
+			if err != nil {
+				t.Fatalf("init metrics: %s", err)
+			}
+			before := len(broker.submitted())
+			_ = tm.CounterIncrement("requests", nil)
+
+			result, err := tm.Flush(context.Background())
+			if err != nil {
+				t.Fatalf("flush: %s", err)
+			}
+			if result.CheckUUID != testCheckUUID {
+				t.Errorf("check uuid %q, want %q", result.CheckUUID, testCheckUUID)
+			}
+			submitted := broker.submitted()
+			if len(submitted) != before+1 {
+				t.Fatalf("%d submissions, want %d", len(submitted), before+1)
+			}
+			if !strings.Contains(string(submitted[len(submitted)-1]), "requests") {
+				t.Errorf("metric not submitted to the submission url: %s", submitted[len(submitted)-1])
+			}
+		})
+	}
+}
+
+func TestFlushMetrics(t *testing.T) {
+	broker := newTestBroker(t)
+	tm, check, err := initMetrics(config.Circonus{APIKey: testToken, APIURL: broker.URL, SubmissionURL: broker.submissionURL()})
+	if err != nil {
+		t.Fatalf("init metrics: %s", err)
+	}
+	stats := &serverStats{}
+
+	_ = tm.CounterIncrement("requests", nil)
+	flushMetrics(context.Background(), []checkMetrics{{tm, check}}, 1, 5*time.Second, nil, stats)
+	if n := len(broker.submitted()); n != 1 {
+		t.Fatalf("%d submissions, want 1", n)
+	}
+	if stats.flushes.Load() != 1 || stats.flushFailures.Load() != 0 || stats.flushBytes.Load() == 0 {
+		t.Errorf("flush stats %d flushes, %d failures (%v), %d bytes", stats.flushes.Load(), stats.flushFailures.Load(), stats.lastFlushError.Load(), stats.flushBytes.Load())
+	}
+	if n := counterValue(tm, "metric_flushes", nil); n != 1 {
+		t.Errorf("metric_flushes %d, want 1", n)
+	}
+}
+
+func TestFlushMetricsConcurrency(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	tests := []struct {
+		concurrency int
+		min, max    time.Duration // time taken to flush both checks
+	}{
+		{1, 2 * delay, 10 * delay},
+		{2, delay, 2 * delay},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("concurrency %d", tt.concurrency), func(t *testing.T) {
+			var sets []checkMetrics
+			var brokers []*testBroker
+			for i := 0; i < 2; i++ {
+				broker := newTestBroker(t)
+				broker.onSubmit = func() { time.Sleep(delay) }
+				tm, check, err := initMetrics(config.Circonus{APIKey: testToken, APIURL: broker.URL, SubmissionURL: broker.submissionURL()})
+				if err != nil {
+					t.Fatalf("init metrics: %s", err)
+				}
+				_ = tm.CounterIncrement("requests", nil)
+				sets = append(sets, checkMetrics{tm, check})
+				brokers = append(brokers, broker)
+			}
+			stats := &serverStats{}
+
+			start := time.Now()
+			flushMetrics(context.Background(), sets, tt.concurrency, 5*time.Second, nil, stats)
+			if d := time.Since(start); d < tt.min || d >= tt.max {
+				t.Errorf("flushed in %s, want [%s, %s)", d, tt.min, tt.max)
+			}
+			for i, broker := range brokers {
+				if n := len(broker.submitted()); n != 1 {
+					t.Errorf("check %d: %d submissions, want 1", i, n)
+				}
+			}
+			if n := stats.flushes.Load(); n != 2 {
+				t.Errorf("%d flushes, want 2", n)
+			}
+		})
+	}
+}
+
+func TestFlushMetricsError(t *testing.T) {
+	logs := captureLog(t)
+	// the broker rejects the submission, it is not retried
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/module/httptrap/") {
+			_, _ = w.Write([]byte(`[]`))
+			return
+		}
+		http.Error(w, "unparsable", http.StatusNotAcceptable)
+	}))
+	defer broker.Close()
+	tm, check, err := initMetrics(config.Circonus{APIKey: testToken, APIURL: broker.URL, SubmissionURL: broker.URL + "/module/httptrap/" + testCheckUUID + "/secret"})
+	if err != nil {
+		t.Fatalf("init metrics: %s", err)
+	}
+	stats := &serverStats{}
+
+	_ = tm.CounterIncrement("requests", nil)
+	r, _, err := flushSet(context.Background(), tm, check)
+	if err == nil || r != nil {
+		t.Fatalf("flush result %v, err %v; want an error w/o a result", r, err)
+	}
+
+	_ = tm.CounterIncrement("requests", nil)
+	flushMetrics(context.Background(), []checkMetrics{{tm, check}}, 1, 5*time.Second, nil, stats)
+	if stats.flushes.Load() != 1 || stats.flushFailures.Load() != 1 || stats.lastFlushError.Load() == nil {
+		t.Errorf("flush stats %d flushes, %d failures (%v)", stats.flushes.Load(), stats.flushFailures.Load(), stats.lastFlushError.Load())
+	}
+	if n := counterValue(tm, "metric_flush_failures", nil); n != 1 {
+		t.Errorf("metric_flush_failures %d, want 1", n)
+	}
+	if !strings.Contains(logs.String(), "flushing circonus metrics") {
+		t.Errorf("flush error not logged:\n%s", logs)
+	}
+}
+
+func TestFlushMetricsTimeout(t *testing.T) {
+	logs := captureLog(t)
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer hung.Close()
+	defer close(release)
+	tm, check, err := initMetrics(config.Circonus{APIKey: testToken, APIURL: hung.URL, SubmissionURL: hung.URL + "/module/httptrap/" + testCheckUUID + "/secret"})
+	if err != nil {
+		t.Fatalf("init metrics: %s", err)
+	}
+	stats := &serverStats{}
+
+	_ = tm.CounterIncrement("requests", nil)
+	start := time.Now()
+	flushMetrics(context.Background(), []checkMetrics{{tm, check}}, 1, 200*time.Millisecond, nil, stats)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("flush returned after %s, want at the flush timeout", d)
+	}
+	if stats.flushFailures.Load() != 1 || stats.lastFlushError.Load() == nil {
+		t.Errorf("flush failure not recorded: %d failures", stats.flushFailures.Load())
+	}
+	if !strings.Contains(logs.String(), "flushing circonus metrics timed out") {
+		t.Errorf("timeout not logged:\n%s", logs)
+	}
+}
+
+func TestSubmissionCheckUUID(t *testing.T) {
+	tests := map[string]string{
+		"https://broker:43191/module/httptrap/" + testCheckUUID + "/secret": testCheckUUID,
+		"http://127.0.0.1:2609/write/c3e":                                   "n/a",
+		"http://agent/module/httptrap/":                                     "n/a",
+	}
+	for submissionURL, want := range tests {
+		if got := submissionCheckUUID(submissionURL); got != want {
+			t.Errorf("submissionCheckUUID(%s) = %q, want %q", submissionURL, got, want)
+		}
+	}
+}
+
+func TestPreflightCheckUUID(t *testing.T) {
+	broker := newTestBroker(t)
+	bundle := fmt.Sprintf(`{"_cid":"/check_bundle/1234","_check_uuids":[%q],"_checks":["/check/1234"],"brokers":["/broker/1"],`+
+		`"config":{"submission_url":%q},"status":"active","type":"httptrap","target":"c3-exporter"}`,
+		testCheckUUID, broker.submissionURL())
+	var fetched atomic.Int32
+	broker.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/check_bundle/1234"):
+			fetched.Add(1)
+			_, _ = w.Write([]byte(bundle))
+		case strings.HasSuffix(r.URL.Path, "/check_bundle"):
+			_, _ = w.Write([]byte("[" + bundle + "]"))
+		default:
+			_, _ = w.Write([]byte(`[]`))
+		}
+	}
+
+	cfg := testConfig(t, nil, "destination:\n  host: localhost\ncirconus:\n  preflight: true\n")
+	cfg.Circonus.APIURL = broker.URL
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new server: %s", err)
+	}
+	// the bundle is refreshed from the api before the server is started
+	if fetched.Load() == 0 {
+		t.Error("check bundle not fetched by the preflight")
+	}
+	if s.checkUUID != testCheckUUID {
+		t.Errorf("check uuid %q, want %q", s.checkUUID, testCheckUUID)
+	}
+}
+
+func TestRecordRuntimeMetrics(t *testing.T) {
+	broker := newTestBroker(t)
+	tm, check, err := initMetrics(config.Circonus{APIKey: testToken, APIURL: broker.URL, SubmissionURL: broker.submissionURL()})
+	if err != nil {
+		t.Fatalf("init metrics: %s", err)
+	}
+
+	recordRuntimeMetrics(tm)
+	tags := trapmetrics.Tags{{Category: "source", Value: "runtime"}}
+	for _, name := range []string{"goroutines", "heap_alloc", "heap_inuse", "heap_objects", "sys", "gc_runs", "gc_pause_total_ns", "gc_pause_last_ns"} {
+		if gaugeValue(tm, name, tags) == nil {
+			t.Errorf("%s not recorded", name)
+		}
+	}
+	if n, _ := gaugeValue(tm, "goroutines", tags).(int); n <= 0 {
+		t.Errorf("goroutines %v", gaugeValue(tm, "goroutines", tags))
+	}
+
+	flushMetrics(context.Background(), []checkMetrics{{tm, check}}, 1, 5*time.Second, nil, &serverStats{})
+	submitted := broker.submitted()
+	if len(submitted) != 1 || !strings.Contains(string(submitted[0]), "goroutines|ST[") {
+		t.Errorf("runtime gauges not submitted: %s", submitted)
+	}
+}
+
+func TestAccountMetricsEnabled(t *testing.T) {
+	tests := map[string]struct {
+		cfg  config.AccountMetrics
+		user string
+		size int64
+		want bool
+	}{
+		"all accounts":          {user: "other", want: true},
+		"listed":                {cfg: config.AccountMetrics{Accounts: []string{"Acct"}}, user: " ACCT ", want: true},
+		"not listed":            {cfg: config.AccountMetrics{Accounts: []string{"acct"}}, user: "other"},
+		"not listed, large":     {cfg: config.AccountMetrics{Accounts: []string{"acct"}, MinBytes: 100}, user: "other", size: 100, want: true},
+		"under min bytes":       {cfg: config.AccountMetrics{MinBytes: 100}, user: "other", size: 99},
+		"anonymous, default":    {cfg: config.AccountMetrics{Accounts: []string{"default"}}, want: true},
+		"anonymous, not listed": {cfg: config.AccountMetrics{Accounts: []string{"acct"}}},
+	}
+	for name, tc := range tests {
+		a := newAccountMetrics(tc.cfg, "default")
+		if got := a.enabled(a.tag(tc.user), tc.size); got != tc.want {
+			t.Errorf("%s: enabled %v, want %v", name, got, tc.want)
+		}
+	}
+}
+
+func TestAccountMetricsNotListed(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	cfg := testConfig(t, up.Server, "circonus:\n  account_metrics:\n    accounts: [acct]\n")
+	ts := newTestServer(t, cfg)
+
+	doc := `{"index":{}}` + "\n{}\n"
+	for _, user := range []string{testAccount, "other"} {
+		req := ts.request(t, http.MethodPost, "/_bulk", doc)
+		req.SetBasicAuth(user, testToken)
+		if resp, body := ts.do(t, req); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: response %d %s", user, resp.StatusCode, body)
+		}
+	}
+
+	tags := sizeTags("/_bulk", cfg.Destination.Name)
+	if n := counterValue(ts.metrics, "log_size", tags); n != int64(2*len(doc)) {
+		t.Errorf("log_size %d, want %d (all accounts)", n, 2*len(doc))
+	}
+	for user, want := range map[string]int64{testAccount: int64(len(doc)), "other": 0} {
+		acctTags := append(append(trapmetrics.Tags{}, tags...), trapmetrics.Tag{Category: "ingest_acct", Value: user})
+		if n := counterValue(ts.metrics, "log_size", acctTags); n != want {
+			t.Errorf("%s: log_size %d, want %d", user, n, want)
+		}
+	}
+}
+
+func TestAccountMetricsDefaultAccount(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	cfg := testConfig(t, up.Server, "circonus:\n  default_account: unknown\n")
+	ts := newTestServer(t, cfg)
+
+	doc := `{"index":{}}` + "\n{}\n"
+	for _, user := range []string{"", "  ", " Acct"} {
+		req := ts.request(t, http.MethodPost, "/_bulk", doc)
+		req.SetBasicAuth(user, testToken)
+		if resp, body := ts.do(t, req); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%q: response %d %s", user, resp.StatusCode, body)
+		}
+	}
+
+	tags := sizeTags("/_bulk", cfg.Destination.Name)
+	for acct, want := range map[string]int64{"unknown": int64(2 * len(doc)), testAccount: int64(len(doc)), "": 0} {
+		acctTags := append(append(trapmetrics.Tags{}, tags...), trapmetrics.Tag{Category: "ingest_acct", Value: acct})
+		if n := counterValue(ts.metrics, "log_size", acctTags); n != want {
+			t.Errorf("%q: log_size %d, want %d", acct, n, want)
+		}
+	}
+}
+
+func TestStaticTags(t *testing.T) {
+	broker := newTestBroker(t)
+	tm, _, err := initMetrics(config.Circonus{
+		APIKey:        testToken,
+		APIURL:        broker.URL,
+		SubmissionURL: broker.submissionURL(),
+		StaticTags:    map[string]string{"pod": "c3e-0", "node": "node-1"},
+	})
+	if err != nil {
+		t.Fatalf("init metrics: %s", err)
+	}
+	_ = tm.CounterIncrement("requests", pathTags("/_bulk"))
+	_ = tm.GaugeSet("async_queue_depth", nil, 1, nil)
+	if _, err := tm.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %s", err)
+	}
+
+	submitted := broker.submitted()
+	if len(submitted) != 1 {
+		t.Fatalf("%d submissions, want 1", len(submitted))
+	}
+	var metrics map[string]json.RawMessage
+	if err := json.Unmarshal(submitted[0], &metrics); err != nil {
+		t.Fatalf("submission not a json object: %s\n%s", err, submitted[0])
+	}
+	found := make(map[string]bool)
+	for streamName := range metrics {
+		name, attrs := otlpName(streamName)
+		found[name] = true
+		for category, want := range map[string]string{"pod": "c3e-0", "node": "node-1"} {
+			if v, ok := attrs.Value(attribute.Key(category)); !ok || v.AsString() != want {
+				t.Errorf("%s: %s tag %q, want %q", streamName, category, v.AsString(), want)
+			}
+		}
+	}
+	if !found["requests"] || !found["async_queue_depth"] {
+		t.Errorf("metrics missing from the submission: %s", submitted[0])
+	}
+}
+
+func TestFlushSkippedWhileFlushing(t *testing.T) {
+	ts := newTestServer(t, testConfig(t, nil, "destination:\n  host: localhost\n"))
+	entered := make(chan struct{}, 4)
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock()
+	ts.broker.mu.Lock()
+	ts.broker.onSubmit = func() {
+		entered <- struct{}{}
+		<-release
+	}
+	ts.broker.mu.Unlock()
+
+	_ = ts.metrics.CounterIncrement("requests", nil)
+	ts.flush(context.Background())
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush not submitted after 5s")
+	}
+
+	// the first flush is blocked in the submission
+	ts.flush(context.Background())
+	ts.flush(context.Background())
+	if n := ts.stats.flushSkipped.Load(); n != 2 {
+		t.Errorf("flushes skipped %d, want 2", n)
+	}
+	if n := counterValue(ts.metrics, "flush_skipped", nil); n != 2 {
+		t.Errorf("flush_skipped %d, want 2", n)
+	}
+	if n := len(ts.broker.submitted()); n != 1 {
+		t.Errorf("%d submissions while flushing, want 1", n)
+	}
+
+	// once complete, the next interval flushes
+	unblock()
+	deadline := time.Now().Add(5 * time.Second)
+	for ts.flushing.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("flush not complete after 5s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.flush(context.Background())
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush after the slow flush not submitted after 5s")
+	}
+	if n := ts.stats.flushSkipped.Load(); n != 2 {
+		t.Errorf("flushes skipped %d, want 2", n)
+	}
+}
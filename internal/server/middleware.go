@@ -0,0 +1,32 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/circonus-labs/go-trapmetrics"
+)
+
+// countRequests increments the requests_total counter, by path and method,
+// for every request received, and counts it as served for its connection.
+func (s *Server) countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served(r)
+		s.stats.requests.Add(1)
+		_ = s.metrics.CounterIncrement("requests_total", methodTags(s.paths, r))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// methodTags are the path (normalized) and method tags for a request.
+func methodTags(paths pathTagger, r *http.Request) trapmetrics.Tags {
+	return trapmetrics.Tags{
+		{Category: "path", Value: paths.tag(r.URL.Path)},
+		{Category: "method", Value: r.Method},
+	}
+}
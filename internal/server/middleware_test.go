@@ -0,0 +1,63 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/circonus-labs/go-trapmetrics"
+)
+
+func TestCountRequestsByPath(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, ""))
+
+	doc := `{"index":{}}` + "\n{}\n"
+	for i := 0; i < 2; i++ {
+		ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc))
+	}
+	ts.do(t, ts.request(t, http.MethodGet, "/logs/_search", ""))
+
+	for _, tc := range []struct {
+		path, method string
+		want         int64
+	}{
+		{"/_bulk", http.MethodPost, 2},
+		{"/logs/_search", http.MethodGet, 1},
+		{"/logs/_search", http.MethodPost, 0},
+	} {
+		tags := trapmetrics.Tags{{Category: "path", Value: tc.path}, {Category: "method", Value: tc.method}}
+		if n := counterValue(ts.metrics, "requests_total", tags); n != tc.want {
+			t.Errorf("requests_total %s %s: %d, want %d", tc.method, tc.path, n, tc.want)
+		}
+	}
+	if n := ts.stats.requests.Load(); n != 3 {
+		t.Errorf("stats requests %d, want 3", n)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, ""))
+
+	for path, status := range map[string]int{
+		"/_cluster/settings": http.StatusMethodNotAllowed,
+		"/logs":              http.StatusNotFound, // forwarded paths only allow GET and HEAD
+	} {
+		resp, body := ts.do(t, ts.request(t, http.MethodDelete, path, ""))
+		if resp.StatusCode != status {
+			t.Errorf("%s: response %d %s, want %d", path, resp.StatusCode, body, status)
+		}
+		tags := trapmetrics.Tags{{Category: "path", Value: path}, {Category: "method", Value: http.MethodDelete}}
+		if n := counterValue(ts.metrics, "method_not_allowed", tags); n != 1 {
+			t.Errorf("%s: method_not_allowed %d, want 1", path, n)
+		}
+	}
+	if up.received() != 0 {
+		t.Errorf("disallowed methods forwarded: %d", up.received())
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/circonus/c3-exporter/internal/config"
+	"github.com/circonus/c3-exporter/internal/release"
+	"github.com/openhistogram/circonusllhist"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// quantiles reported for histograms, which are exported as otlp summaries
+var otlpQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// otlpExportTimeout bounds each export, including the exporter's retries.
+var otlpExportTimeout = 30 * time.Second
+
+// otlpExporter pushes the exporter's metrics to an OpenTelemetry collector
+// with the OpenTelemetry SDK's OTLP/HTTP exporter (protobuf, retries). Each
+// flush, the snapshot of the metrics submitted to circonus (httptrap json) is
+// converted to the SDK's metric data: counters to delta sums, gauges to gauges
+// and histograms to summaries.
+type otlpExporter struct {
+	last     time.Time // end of the previous export, start of counter deltas
+	exporter *otlpmetrichttp.Exporter
+	resource *resource.Resource
+	mu       sync.Mutex
+}
+
+func newOTLPExporter(ctx context.Context, cfg config.OTLP) (*otlpExporter, error) {
+	if cfg.Endpoint == "" {
+		return nil, nil
+	}
+	exporter, err := otlpmetrichttp.New(ctx,
+		otlpmetrichttp.WithEndpointURL(cfg.Endpoint),
+		otlpmetrichttp.WithHeaders(cfg.Headers),
+		otlpmetrichttp.WithTimeout(otlpExportTimeout),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating otlp exporter: %w", err)
+	}
+	return &otlpExporter{
+		last:     time.Now(),
+		exporter: exporter,
+		resource: resource.NewSchemaless(
+			attribute.String("service.name", release.NAME),
+			attribute.String("service.version", release.Version),
+		),
+	}, nil
+}
+
+// export converts the snapshot data and sends it to the collector, taking
+// at most otlpExportTimeout.
+func (e *otlpExporter) export(ctx context.Context, data []byte) error {
+	e.mu.Lock()
+	now := time.Now()
+	metrics, err := otlpMetrics(data, e.last, now)
+	if err == nil {
+		e.last = now
+	}
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	rm := &metricdata.ResourceMetrics{
+		Resource: e.resource,
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: release.NAME, Version: release.Version},
+			Metrics: metrics,
+		}},
+	}
+	ctx, cancel := context.WithTimeout(ctx, otlpExportTimeout)
+	defer cancel()
+	if err := e.exporter.Export(ctx, rm); err != nil {
+		return fmt.Errorf("exporting otlp metrics: %w", err)
+	}
+	return nil
+}
+
+// shutdown flushes and closes the exporter.
+func (e *otlpExporter) shutdown(ctx context.Context) error {
+	return e.exporter.Shutdown(ctx)
+}
+
+// trapSample is a metric in the httptrap json format, values are numbers or
+// (most) strings, histograms base64 encoded.
+type trapSample struct {
+	Type  string          `json:"_type"`
+	Value json.RawMessage `json:"_value"`
+	TS    uint64          `json:"_ts"`
+}
+
+func (s trapSample) value() string {
+	return strings.Trim(string(s.Value), `"`)
+}
+
+// otlpMetrics converts httptrap json metrics, recorded between start and end,
+// to otlp metric data. Streams of a metric (by tags) are the data points of
+// one otlp metric, per kind (e.g. counters and gauges of the same name are
+// separate metrics).
+func otlpMetrics(data []byte, start, end time.Time) ([]metricdata.Metrics, error) {
+	var samples map[string]trapSample
+	if err := json.Unmarshal(data, &samples); err != nil {
+		return nil, fmt.Errorf("parsing metrics: %w", err)
+	}
+
+	names := make([]string, 0, len(samples))
+	for name := range samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var metrics []metricdata.Metrics
+	index := make(map[string]int)
+	add := func(name, kind string, data metricdata.Aggregation) {
+		key := name + "\x00" + kind
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(metrics)
+			metrics = append(metrics, metricdata.Metrics{Name: name, Data: data})
+			return
+		}
+		metrics[i].Data = mergeAggregation(metrics[i].Data, data)
+	}
+
+	for _, streamName := range names {
+		sample := samples[streamName]
+		name, attrs := otlpName(streamName)
+
+		switch sample.Type {
+		case "h", "H":
+			point, err := otlpSummaryPoint(sample.value())
+			if err != nil {
+				return nil, fmt.Errorf("metric %s: %w", streamName, err)
+			}
+			point.Attributes = attrs
+			point.StartTime = start
+			point.Time = end
+			add(name, "summary", metricdata.Summary{DataPoints: []metricdata.SummaryDataPoint{point}})
+		case "n":
+			v, err := strconv.ParseFloat(sample.value(), 64)
+			if err != nil {
+				return nil, fmt.Errorf("metric %s: %w", streamName, err)
+			}
+			point := metricdata.DataPoint[float64]{Attributes: attrs, Time: end, Value: v}
+			// gauges are set w/o a timestamp, counters carry the flush time
+			if sample.TS == 0 {
+				add(name, "gauge_float", metricdata.Gauge[float64]{DataPoints: []metricdata.DataPoint[float64]{point}})
+				continue
+			}
+			point.StartTime = start
+			add(name, "sum_float", metricdata.Sum[float64]{
+				DataPoints:  []metricdata.DataPoint[float64]{point},
+				Temporality: metricdata.DeltaTemporality,
+				IsMonotonic: true,
+			})
+		case "i", "I", "l", "L":
+			v, err := strconv.ParseInt(sample.value(), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("metric %s: %w", streamName, err)
+			}
+			point := metricdata.DataPoint[int64]{Attributes: attrs, Time: end, Value: v}
+			if sample.TS == 0 {
+				add(name, "gauge_int", metricdata.Gauge[int64]{DataPoints: []metricdata.DataPoint[int64]{point}})
+				continue
+			}
+			point.StartTime = start
+			add(name, "sum_int", metricdata.Sum[int64]{
+				DataPoints:  []metricdata.DataPoint[int64]{point},
+				Temporality: metricdata.DeltaTemporality,
+				IsMonotonic: true,
+			})
+		default:
+			// text metrics have no otlp equivalent
+		}
+	}
+
+	return metrics, nil
+}
+
+// mergeAggregation appends the data points of b to a, both of the same kind.
+func mergeAggregation(a, b metricdata.Aggregation) metricdata.Aggregation {
+	switch a := a.(type) {
+	case metricdata.Summary:
+		a.DataPoints = append(a.DataPoints, b.(metricdata.Summary).DataPoints...)
+		return a
+	case metricdata.Gauge[float64]:
+		a.DataPoints = append(a.DataPoints, b.(metricdata.Gauge[float64]).DataPoints...)
+		return a
+	case metricdata.Gauge[int64]:
+		a.DataPoints = append(a.DataPoints, b.(metricdata.Gauge[int64]).DataPoints...)
+		return a
+	case metricdata.Sum[float64]:
+		a.DataPoints = append(a.DataPoints, b.(metricdata.Sum[float64]).DataPoints...)
+		return a
+	case metricdata.Sum[int64]:
+		a.DataPoints = append(a.DataPoints, b.(metricdata.Sum[int64]).DataPoints...)
+		return a
+	}
+	return a
+}
+
+// otlpName splits a stream tagged metric name (name|ST[b"cat":b"val",...])
+// into the name and attributes.
+func otlpName(streamName string) (string, attribute.Set) {
+	name, tags, ok := strings.Cut(streamName, "|ST[")
+	if !ok {
+		return name, *attribute.EmptySet()
+	}
+	tags = strings.TrimSuffix(tags, "]")
+
+	var attrs []attribute.KeyValue
+	for _, tag := range strings.Split(tags, ",") {
+		cat, val, _ := strings.Cut(tag, ":")
+		attrs = append(attrs, attribute.String(decodeTag(cat), decodeTag(val)))
+	}
+	return name, attribute.NewSet(attrs...)
+}
+
+// decodeTag decodes a base64 encoded (b"...") tag category or value.
+func decodeTag(s string) string {
+	if !strings.HasPrefix(s, `b"`) || !strings.HasSuffix(s, `"`) || len(s) < 3 {
+		return s
+	}
+	data, err := base64.StdEncoding.DecodeString(s[2 : len(s)-1])
+	if err != nil {
+		return s
+	}
+	return string(data)
+}
+
+// otlpSummaryPoint summarizes a base64 encoded histogram.
+func otlpSummaryPoint(value string) (metricdata.SummaryDataPoint, error) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return metricdata.SummaryDataPoint{}, fmt.Errorf("decoding histogram: %w", err)
+	}
+	h, err := circonusllhist.Deserialize(bytes.NewReader(data))
+	if err != nil {
+		return metricdata.SummaryDataPoint{}, fmt.Errorf("deserializing histogram: %w", err)
+	}
+	values, err := h.ApproxQuantile(otlpQuantiles)
+	if err != nil {
+		return metricdata.SummaryDataPoint{}, fmt.Errorf("histogram quantiles: %w", err)
+	}
+
+	point := metricdata.SummaryDataPoint{
+		Count: h.Count(),
+		Sum:   h.ApproxSum(),
+	}
+	for i, q := range otlpQuantiles {
+		point.QuantileValues = append(point.QuantileValues, metricdata.QuantileValue{Quantile: q, Value: values[i]})
+	}
+	return point, nil
+}
@@ -0,0 +1,338 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/circonus/c3-exporter/internal/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// testCollector is a stub OTLP/HTTP receiver, the export requests it received
+// are kept.
+type testCollector struct {
+	*httptest.Server
+	onExport func() // called for each export request, nil for none
+	requests []*colmetricpb.ExportMetricsServiceRequest
+	headers  []http.Header
+	mu       sync.Mutex
+}
+
+func newTestCollector(t *testing.T) *testCollector {
+	t.Helper()
+	c := &testCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req colmetricpb.ExportMetricsServiceRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if c.onExport != nil {
+			c.onExport()
+		}
+		c.mu.Lock()
+		c.requests = append(c.requests, &req)
+		c.headers = append(c.headers, r.Header.Clone())
+		c.mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		resp, _ := proto.Marshal(&colmetricpb.ExportMetricsServiceResponse{})
+		_, _ = w.Write(resp)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// metrics returns the metrics of the export requests received, by name.
+func (c *testCollector) metrics() map[string]*metricpb.Metric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	metrics := make(map[string]*metricpb.Metric)
+	for _, req := range c.requests {
+		for _, rm := range req.GetResourceMetrics() {
+			for _, sm := range rm.GetScopeMetrics() {
+				for _, m := range sm.GetMetrics() {
+					metrics[m.GetName()] = m
+				}
+			}
+		}
+	}
+	return metrics
+}
+
+func TestOTLPExportedWithFlush(t *testing.T) {
+	collector := newTestCollector(t)
+	broker := newTestBroker(t)
+
+	tm, check, err := initMetrics(config.Circonus{APIKey: testToken, APIURL: broker.URL, SubmissionURL: broker.submissionURL()})
+	if err != nil {
+		t.Fatalf("init metrics: %s", err)
+	}
+	otlp, err := newOTLPExporter(context.Background(), config.OTLP{
+		Endpoint: collector.URL + "/v1/metrics",
+		Headers:  map[string]string{"Authorization": "Bearer otlp"},
+	})
+	if err != nil {
+		t.Fatalf("new otlp exporter: %s", err)
+	}
+	defer func() { _ = otlp.shutdown(context.Background()) }()
+
+	_ = tm.CounterIncrementByValue("requests", pathTags("/_bulk"), 3)
+	_ = tm.CounterIncrement("requests", pathTags("/other"))
+	_ = tm.GaugeSet("async_queue_depth", nil, 5, nil)
+	_ = tm.HistogramRecordValue("latency_ms", pathTags("/_bulk"), 10)
+	_ = tm.HistogramRecordValue("latency_ms", pathTags("/_bulk"), 20)
+	_ = tm.TextSet("version", nil, "v1", nil)
+
+	flushMetrics(context.Background(), []checkMetrics{{tm, check}}, 1, 5*time.Second, otlp, &serverStats{})
+
+	if n := len(broker.submitted()); n != 1 {
+		t.Errorf("%d circonus submissions, want 1", n)
+	}
+	collector.mu.Lock()
+	if len(collector.requests) != 1 {
+		t.Fatalf("%d otlp export requests, want 1", len(collector.requests))
+	}
+	if got := collector.headers[0].Get("Authorization"); got != "Bearer otlp" {
+		t.Errorf("authorization header %q", got)
+	}
+	resource := collector.requests[0].GetResourceMetrics()[0].GetResource()
+	collector.mu.Unlock()
+	serviceName := ""
+	for _, attr := range resource.GetAttributes() {
+		if attr.GetKey() == "service.name" {
+			serviceName = attr.GetValue().GetStringValue()
+		}
+	}
+	if serviceName == "" {
+		t.Error("no service.name resource attribute")
+	}
+
+	metrics := collector.metrics()
+	if _, ok := metrics["version"]; ok {
+		t.Error("text metric exported")
+	}
+
+	requests := metrics["requests"].GetSum()
+	if requests == nil {
+		t.Fatalf("requests not exported as a sum: %v", metrics["requests"])
+	}
+	if !requests.GetIsMonotonic() || requests.GetAggregationTemporality() != metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA {
+		t.Errorf("requests not a monotonic delta sum: %v", requests)
+	}
+	byPath := make(map[string]int64)
+	for _, point := range requests.GetDataPoints() {
+		for _, attr := range point.GetAttributes() {
+			if attr.GetKey() == "path" {
+				byPath[attr.GetValue().GetStringValue()] = point.GetAsInt()
+			}
+		}
+	}
+	if byPath["/_bulk"] != 3 || byPath["/other"] != 1 {
+		t.Errorf("requests by path %v, want /_bulk 3 and /other 1", byPath)
+	}
+
+	depth := metrics["async_queue_depth"].GetGauge()
+	if depth == nil || len(depth.GetDataPoints()) != 1 || depth.GetDataPoints()[0].GetAsInt() != 5 {
+		t.Errorf("async_queue_depth not exported as a gauge of 5: %v", metrics["async_queue_depth"])
+	}
+
+	latency := metrics["latency_ms"].GetSummary()
+	if latency == nil || len(latency.GetDataPoints()) != 1 {
+		t.Fatalf("latency_ms not exported as a summary: %v", metrics["latency_ms"])
+	}
+	point := latency.GetDataPoints()[0]
+	if point.GetCount() != 2 {
+		t.Errorf("latency_ms count %d, want 2", point.GetCount())
+	}
+	if len(point.GetQuantileValues()) != len(otlpQuantiles) {
+		t.Errorf("latency_ms has %d quantiles, want %d", len(point.GetQuantileValues()), len(otlpQuantiles))
+	}
+}
+
+func TestOTLPFlushRecordedDuringExport(t *testing.T) {
+	collector := newTestCollector(t)
+	broker := newTestBroker(t)
+
+	tm, check, err := initMetrics(config.Circonus{APIKey: testToken, APIURL: broker.URL, SubmissionURL: broker.submissionURL()})
+	if err != nil {
+		t.Fatalf("init metrics: %s", err)
+	}
+	otlp, err := newOTLPExporter(context.Background(), config.OTLP{Endpoint: collector.URL + "/v1/metrics"})
+	if err != nil {
+		t.Fatalf("new otlp exporter: %s", err)
+	}
+	defer func() { _ = otlp.shutdown(context.Background()) }()
+
+	// e.g. a request handled while the metrics are exported
+	collector.onExport = func() { _ = tm.CounterIncrement("late", nil) }
+	_ = tm.CounterIncrement("requests", nil)
+	flushMetrics(context.Background(), []checkMetrics{{tm, check}}, 1, 5*time.Second, otlp, &serverStats{})
+	collector.onExport = nil
+	flushMetrics(context.Background(), []checkMetrics{{tm, check}}, 1, 5*time.Second, otlp, &serverStats{})
+
+	submitted := broker.submitted()
+	if len(submitted) != 2 {
+		t.Fatalf("%d submissions, want 2", len(submitted))
+	}
+	var first, second map[string]json.RawMessage
+	if err := json.Unmarshal(submitted[0], &first); err != nil {
+		t.Fatalf("first submission not a json object: %s\n%s", err, submitted[0])
+	}
+	if err := json.Unmarshal(submitted[1], &second); err != nil {
+		t.Fatalf("second submission not a json object: %s\n%s", err, submitted[1])
+	}
+	if _, ok := first["requests"]; !ok {
+		t.Errorf("requests not in the first submission: %s", submitted[0])
+	}
+	if _, ok := first["late"]; ok {
+		t.Errorf("metric recorded after the snapshot in the first submission: %s", submitted[0])
+	}
+	if _, ok := second["late"]; !ok {
+		t.Errorf("metric recorded during the export not in the next submission: %s", submitted[1])
+	}
+}
+
+func TestOTLPHungCollector(t *testing.T) {
+	orig := otlpExportTimeout
+	otlpExportTimeout = 300 * time.Millisecond
+	t.Cleanup(func() { otlpExportTimeout = orig })
+
+	logs := captureLog(t)
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer hung.Close()
+	defer close(release)
+	broker := newTestBroker(t)
+
+	tm, check, err := initMetrics(config.Circonus{APIKey: testToken, APIURL: broker.URL, SubmissionURL: broker.submissionURL()})
+	if err != nil {
+		t.Fatalf("init metrics: %s", err)
+	}
+	otlp, err := newOTLPExporter(context.Background(), config.OTLP{Endpoint: hung.URL + "/v1/metrics"})
+	if err != nil {
+		t.Fatalf("new otlp exporter: %s", err)
+	}
+	defer func() { _ = otlp.shutdown(context.Background()) }()
+	stats := &serverStats{}
+
+	// the export, with its own timeout, does not use up the flush timeout
+	_ = tm.CounterIncrement("requests", nil)
+	flushMetrics(context.Background(), []checkMetrics{{tm, check}}, 1, 200*time.Millisecond, otlp, stats)
+	if n := len(broker.submitted()); n != 1 {
+		t.Errorf("%d circonus submissions, want 1", n)
+	}
+	if stats.flushes.Load() != 1 || stats.flushFailures.Load() != 0 {
+		t.Errorf("flush stats %d flushes, %d failures (%v), want 1 successful flush", stats.flushes.Load(), stats.flushFailures.Load(), stats.lastFlushError.Load())
+	}
+	if !strings.Contains(logs.String(), "exporting otlp metrics") {
+		t.Errorf("export failure not logged:\n%s", logs)
+	}
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	end := start.Add(time.Minute)
+	data := []byte(`{
+	"requests|ST[b\"cGF0aA==\":b\"L19idWxr\"]": {"_type": "L", "_value": 7, "_ts": 1700000060000},
+	"requests|ST[b\"cGF0aA==\":b\"L290aGVy\"]": {"_type": "L", "_value": 2, "_ts": 1700000060000},
+	"requests": {"_type": "L", "_value": 4},
+	"ratio": {"_type": "n", "_value": 0.5},
+	"version": {"_type": "s", "_value": "v1"}
+}`)
+
+	metrics, err := otlpMetrics(data, start, end)
+	if err != nil {
+		t.Fatalf("converting metrics: %s", err)
+	}
+
+	// sorted by stream name, counters and gauges of a name are separate
+	want := []metricdata.Metrics{
+		{Name: "ratio", Data: metricdata.Gauge[float64]{DataPoints: []metricdata.DataPoint[float64]{
+			{Attributes: *attribute.EmptySet(), Time: end, Value: 0.5},
+		}}},
+		{Name: "requests", Data: metricdata.Gauge[int64]{DataPoints: []metricdata.DataPoint[int64]{
+			{Attributes: *attribute.EmptySet(), Time: end, Value: 4},
+		}}},
+		{Name: "requests", Data: metricdata.Sum[int64]{
+			DataPoints: []metricdata.DataPoint[int64]{
+				{Attributes: attribute.NewSet(attribute.String("path", "/_bulk")), StartTime: start, Time: end, Value: 7},
+				{Attributes: attribute.NewSet(attribute.String("path", "/other")), StartTime: start, Time: end, Value: 2},
+			},
+			Temporality: metricdata.DeltaTemporality,
+			IsMonotonic: true,
+		}},
+	}
+	if len(metrics) != len(want) {
+		t.Fatalf("%d metrics, want %d: %+v", len(metrics), len(want), metrics)
+	}
+	for i := range want {
+		if metrics[i].Name != want[i].Name {
+			t.Errorf("metric %d name %q, want %q", i, metrics[i].Name, want[i].Name)
+			continue
+		}
+		if !equalAggregation(metrics[i].Data, want[i].Data) {
+			t.Errorf("metric %d (%s) data\n%+v\nwant\n%+v", i, want[i].Name, metrics[i].Data, want[i].Data)
+		}
+	}
+
+	if _, err := otlpMetrics([]byte(`{"bad": {"_type": "L", "_value": "x", "_ts": 1}}`), start, end); err == nil {
+		t.Error("invalid counter value accepted")
+	}
+}
+
+func equalAggregation(a, b metricdata.Aggregation) bool {
+	switch a := a.(type) {
+	case metricdata.Gauge[float64]:
+		b, ok := b.(metricdata.Gauge[float64])
+		return ok && equalPoints(a.DataPoints, b.DataPoints)
+	case metricdata.Gauge[int64]:
+		b, ok := b.(metricdata.Gauge[int64])
+		return ok && equalPoints(a.DataPoints, b.DataPoints)
+	case metricdata.Sum[int64]:
+		b, ok := b.(metricdata.Sum[int64])
+		return ok && a.Temporality == b.Temporality && a.IsMonotonic == b.IsMonotonic && equalPoints(a.DataPoints, b.DataPoints)
+	}
+	return false
+}
+
+func equalPoints[N int64 | float64](a, b []metricdata.DataPoint[N]) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Attributes.Equals(&b[i].Attributes) || !a[i].StartTime.Equal(b[i].StartTime) || !a[i].Time.Equal(b[i].Time) || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,19 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import "github.com/circonus/c3-exporter/internal/config"
+
+// pathTagger normalizes request paths for use as metric tags, so that e.g.
+// rolling indices or document ids do not each create new series.
+type pathTagger []config.PathTagRule
+
+func (p pathTagger) tag(path string) string {
+	for _, rule := range p {
+		path = rule.Regexp.ReplaceAllString(path, rule.Replacement)
+	}
+	return path
+}
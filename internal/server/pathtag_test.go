@@ -0,0 +1,48 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/circonus-labs/go-trapmetrics"
+)
+
+func TestPathTag(t *testing.T) {
+	paths := pathTagger(testConfig(t, nil, "destination:\n  host: localhost\n").Server.PathTagRules)
+	for path, want := range map[string]string{
+		"/otel-v1-apm-span-000123":                        "/otel-v1-apm-span-{n}",
+		"/otel-v1-apm-span-000124":                        "/otel-v1-apm-span-{n}",
+		"/logs-2024.01.15/_doc/42":                        "/logs-{n}.{n}.{n}/_doc/{n}",
+		"/logs/_doc/0b3f5e8a-1c2d-4e5f-8a9b-0c1d2e3f4a5b": "/logs/_doc/{uuid}",
+		"/_bulk":    "/_bulk",
+		"/v1/index": "/v1/index",
+	} {
+		if got := paths.tag(path); got != want {
+			t.Errorf("%s: tag %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestPathTagCardinality(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, ""))
+
+	for _, path := range []string{"/otel-v1-apm-span-000123", "/otel-v1-apm-span-000124"} {
+		if resp, body := ts.do(t, ts.request(t, http.MethodGet, path, "")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: response %d %s", path, resp.StatusCode, body)
+		}
+	}
+	tags := trapmetrics.Tags{{Category: "path", Value: "/otel-v1-apm-span-{n}"}, {Category: "method", Value: http.MethodGet}}
+	if n := counterValue(ts.metrics, "requests_total", tags); n != 2 {
+		t.Errorf("requests_total for the normalized path %d, want 2", n)
+	}
+	tags[0].Value = "/otel-v1-apm-span-000123"
+	if n := counterValue(ts.metrics, "requests_total", tags); n != 0 {
+		t.Errorf("requests_total for the raw path %d, want 0", n)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/circonus-labs/go-trapmetrics"
+	"github.com/circonus/c3-exporter/internal/config"
+)
+
+// maxRequestTagLen bounds the values of tags sent by clients, longer values
+// are rejected.
+const maxRequestTagLen = 64
+
+// requestTagger parses the tags clients send in a header (request_tags),
+// keeping those in the allowed categories, which are added to the
+// log_size, log_size_h and gz_size_h metrics of the request.
+type requestTagger struct {
+	categories map[string]bool
+	header     string
+}
+
+func newRequestTagger(cfg config.RequestTags) requestTagger {
+	if len(cfg.Categories) == 0 {
+		return requestTagger{}
+	}
+	t := requestTagger{
+		categories: make(map[string]bool, len(cfg.Categories)),
+		header:     cfg.Header,
+	}
+	for _, category := range cfg.Categories {
+		t.categories[category] = true
+	}
+	return t
+}
+
+// tags returns the allowed tags of r, at most one per category (the first).
+// Tags in other categories, or malformed, are dropped and counted in the
+// request_tag_rejected metric.
+func (t requestTagger) tags(r *http.Request, tm *trapmetrics.TrapMetrics, path string) trapmetrics.Tags {
+	if t.categories == nil {
+		return nil
+	}
+	value := strings.Join(r.Header.Values(t.header), ",")
+	if value == "" {
+		return nil
+	}
+
+	var tags trapmetrics.Tags
+	seen := make(map[string]bool)
+	rejected := 0
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		category, val, ok := strings.Cut(tag, ":")
+		category, val = strings.TrimSpace(category), strings.TrimSpace(val)
+		if !ok || !t.categories[category] || val == "" || len(val) > maxRequestTagLen || seen[category] {
+			rejected++
+			continue
+		}
+		seen[category] = true
+		tags = append(tags, trapmetrics.Tag{Category: category, Value: val})
+	}
+	if rejected > 0 {
+		_ = tm.CounterIncrementByValue("request_tag_rejected", trapmetrics.Tags{{Category: "path", Value: path}}, uint64(rejected))
+	}
+	return tags
+}
@@ -0,0 +1,79 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/circonus-labs/go-trapmetrics"
+	"github.com/circonus/c3-exporter/internal/config"
+)
+
+func TestRequestTagger(t *testing.T) {
+	ts := newTestServer(t, testConfig(t, nil, "destination:\n  host: localhost\n"))
+	tagger := newRequestTagger(config.RequestTags{Header: "X-C3E-Tags", Categories: []string{"env", "team"}})
+
+	tests := []struct {
+		name     string
+		headers  []string
+		want     trapmetrics.Tags
+		rejected int64
+	}{
+		{name: "none"},
+		{name: "allowed", headers: []string{"env:prod, team:search"}, want: trapmetrics.Tags{{Category: "env", Value: "prod"}, {Category: "team", Value: "search"}}},
+		{name: "multiple headers", headers: []string{"env:prod", "team:search"}, want: trapmetrics.Tags{{Category: "env", Value: "prod"}, {Category: "team", Value: "search"}}},
+		{name: "disallowed category", headers: []string{"env:prod,host:web-1"}, want: trapmetrics.Tags{{Category: "env", Value: "prod"}}, rejected: 1},
+		{name: "reserved category", headers: []string{"path:/spoofed"}, rejected: 1},
+		{name: "first of a category", headers: []string{"env:prod,env:dev"}, want: trapmetrics.Tags{{Category: "env", Value: "prod"}}, rejected: 1},
+		{name: "malformed", headers: []string{"env,team:," + "env:" + strings.Repeat("x", maxRequestTagLen+1)}, rejected: 3},
+	}
+	rejected := int64(0)
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/_bulk", nil)
+		for _, h := range tt.headers {
+			r.Header.Add("X-C3E-Tags", h)
+		}
+		if got := tagger.tags(r, ts.metrics, "/_bulk"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: tags %v, want %v", tt.name, got, tt.want)
+		}
+		rejected += tt.rejected
+		if n := counterValue(ts.metrics, "request_tag_rejected", pathTags("/_bulk")); n != rejected {
+			t.Errorf("%s: request_tag_rejected %d, want %d", tt.name, n, rejected)
+		}
+	}
+
+	// w/o categories, request tags are disabled
+	r := httptest.NewRequest(http.MethodPost, "/_bulk", nil)
+	r.Header.Set("X-C3E-Tags", "env:prod")
+	if got := newRequestTagger(config.RequestTags{Header: "X-C3E-Tags"}).tags(r, ts.metrics, "/_bulk"); got != nil {
+		t.Errorf("tags %v w/o categories", got)
+	}
+}
+
+func TestRequestTagsRecorded(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	cfg := testConfig(t, up.Server, "server:\n  request_tags:\n    categories: [env]\n")
+	ts := newTestServer(t, cfg)
+
+	doc := `{"index":{}}` + "\n{}\n"
+	req := ts.request(t, http.MethodPost, "/_bulk", doc)
+	req.Header.Set("X-C3E-Tags", "env:prod,team:search")
+	if resp, body := ts.do(t, req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("response %d %s", resp.StatusCode, body)
+	}
+
+	tags := append(sizeTags("/_bulk", cfg.Destination.Name), trapmetrics.Tag{Category: "env", Value: "prod"})
+	if n := counterValue(ts.metrics, "log_size", tags); n != int64(len(doc)) {
+		t.Errorf("log_size w/the env tag %d, want %d", n, len(doc))
+	}
+	if n := counterValue(ts.metrics, "request_tag_rejected", pathTags("/_bulk")); n != 1 {
+		t.Errorf("request_tag_rejected %d, want 1 (team)", n)
+	}
+}
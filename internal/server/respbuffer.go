@@ -0,0 +1,31 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"io"
+)
+
+// bufferResponse reads a destination response body of at most limit bytes
+// (buffer_responses) into memory, so it can be logged or transformed before
+// it is relayed. Larger bodies, by their content length or once more than
+// limit bytes have been read, are streamed and data is nil. Either way rest
+// reads the whole body (including anything already read). A limit of 0
+// streams all bodies.
+func bufferResponse(body io.Reader, size int64, limit int) (data []byte, rest io.Reader, err error) {
+	if limit <= 0 || size > int64(limit) {
+		return nil, body, nil
+	}
+	data, err = io.ReadAll(io.LimitReader(body, int64(limit)+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) > limit {
+		return nil, io.MultiReader(bytes.NewReader(data), body), nil
+	}
+	return data, bytes.NewReader(data), nil
+}
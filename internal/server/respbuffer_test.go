@@ -0,0 +1,89 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBufferResponse(t *testing.T) {
+	small := `{"acknowledged":true}`
+	large := strings.Repeat("x", 100)
+	tests := []struct {
+		name     string
+		body     string
+		size     int64
+		limit    int
+		buffered bool
+	}{
+		{"small", small, int64(len(small)), 64, true},
+		{"small, unknown size", small, -1, 64, true},
+		{"at the limit", large[:64], -1, 64, true},
+		{"large", large, int64(len(large)), 64, false},
+		{"large, unknown size", large, -1, 64, false},
+		{"no limit", small, int64(len(small)), 0, false},
+	}
+	for _, tt := range tests {
+		data, rest, err := bufferResponse(strings.NewReader(tt.body), tt.size, tt.limit)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if (data != nil) != tt.buffered {
+			t.Errorf("%s: buffered %v, want %v", tt.name, data != nil, tt.buffered)
+		}
+		if tt.buffered && string(data) != tt.body {
+			t.Errorf("%s: buffered %q, want %q", tt.name, data, tt.body)
+		}
+		if got, err := io.ReadAll(rest); err != nil || string(got) != tt.body {
+			t.Errorf("%s: rest %q (%v), want the whole body", tt.name, got, err)
+		}
+	}
+}
+
+func TestBufferResponses(t *testing.T) {
+	small := `{"acknowledged":true}`
+	large := `{"hits":"` + strings.Repeat("x", 8192) + `"}`
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// w/o a content length, the size is only known once read
+		body := small
+		if r.URL.Path == "/logs/_search" {
+			body = large
+		}
+		_, _ = io.WriteString(w, body[:1])
+		w.(http.Flusher).Flush()
+		_, _ = io.WriteString(w, body[1:])
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, "server:\n  buffer_responses: 256\n"))
+
+	tests := []struct {
+		path     string
+		body     string
+		buffered bool
+	}{
+		{"/_cluster/health", small, true},
+		{"/logs/_search", large, false},
+	}
+	for _, tt := range tests {
+		logs := captureLog(t)
+		resp, body := ts.do(t, ts.request(t, http.MethodGet, tt.path, ""))
+		if resp.StatusCode != http.StatusOK || string(body) != tt.body {
+			t.Fatalf("%s: response %d %s", tt.path, resp.StatusCode, body)
+		}
+		if !strings.Contains(logs.String(), `"resp_buffered":`+strconv.FormatBool(tt.buffered)) {
+			t.Errorf("%s: resp_buffered not %v:\n%s", tt.path, tt.buffered, logs)
+		}
+		// streamed, the response is sent as it is read
+		if !tt.buffered && resp.ContentLength != -1 {
+			t.Errorf("%s: content length %d, want it streamed w/o one", tt.path, resp.ContentLength)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		accept []string
+		want   bool
+	}{
+		{nil, false},
+		{[]string{"gzip"}, true},
+		{[]string{"br, GZIP;q=0.5"}, true},
+		{[]string{"identity", "*"}, true},
+		{[]string{"gzip;q=0"}, false},
+		{[]string{"deflate, br"}, false},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Accept-Encoding": tt.accept}
+		if got := acceptsGzip(h); got != tt.want {
+			t.Errorf("%q: accepts gzip %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestResponseGzip(t *testing.T) {
+	ts := newTestServer(t, testConfig(t, nil, "destination:\n  host: localhost\nserver:\n  response_gzip: true\n"))
+
+	// set explicitly, the client does not decompress the response
+	for accept, encoding := range map[string]string{"identity": "", "gzip": "gzip"} {
+		// no credentials, the exporter's own 401 error response
+		req := ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n")
+		req.Header.Del("Authorization")
+		req.Header.Set("Accept-Encoding", accept)
+		resp, body := ts.do(t, req)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%q: response %d %s, want 401", accept, resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("Content-Encoding"); got != encoding {
+			t.Errorf("%q: content encoding %q, want %q", accept, got, encoding)
+		}
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("response not gzipped: %s", err)
+			}
+			if body, err = io.ReadAll(zr); err != nil {
+				t.Fatalf("decompressing response: %s", err)
+			}
+		}
+		if !strings.Contains(string(body), "Unauthorized") {
+			t.Errorf("%q: response %s, want the error", accept, body)
+		}
+	}
+}
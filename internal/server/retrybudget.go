@@ -0,0 +1,94 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/rs/zerolog"
+)
+
+// retryBudget is a token bucket limiting the retries made across all
+// requests, so retries cannot multiply the load on a struggling destination.
+// A nil budget is unlimited.
+type retryBudget struct {
+	last   time.Time
+	rate   float64
+	burst  float64
+	tokens float64
+	mu     sync.Mutex
+}
+
+func newRetryBudget(rate float64, burst int) *retryBudget {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &retryBudget{
+		last:   time.Now(),
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// take returns true, using a token, if a retry is within the budget.
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// limitRetryTime bounds the total time a request waits between retries to
+// budget (0 is unlimited), once it is spent the request is not retried. The
+// wait which would exceed the budget is shortened. It wraps the client's
+// CheckRetry, so is applied after CheckRetry is set.
+func limitRetryTime(c *retryablehttp.Client, budget time.Duration, l zerolog.Logger) {
+	if budget <= 0 {
+		return
+	}
+
+	var waited time.Duration
+	backoff := c.Backoff
+	c.Backoff = func(min, max time.Duration, attempt int, resp *http.Response) time.Duration {
+		wait := backoff(min, max, attempt, resp)
+		if remaining := budget - waited; wait > remaining {
+			wait = remaining
+		}
+		waited += wait
+		return wait
+	}
+
+	checkRetry := c.CheckRetry
+	c.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		retry, checkErr := checkRetry(ctx, resp, err)
+		if retry && waited >= budget {
+			l.Warn().Str("waited", waited.String()).Msg("retry time budget spent, not retrying")
+			return false, checkErr
+		}
+		return retry, checkErr
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/rs/zerolog"
+)
+
+func TestRetryBudgetTake(t *testing.T) {
+	if b := newRetryBudget(0, 10); b != nil || !b.take() {
+		t.Error("no rate is not unlimited")
+	}
+
+	b := newRetryBudget(10, 2)
+	if !b.take() || !b.take() {
+		t.Fatal("burst not available")
+	}
+	if b.take() {
+		t.Error("retry over the burst allowed")
+	}
+	// refilled at rate, 10/s
+	b.last = b.last.Add(-150 * time.Millisecond)
+	if !b.take() {
+		t.Error("budget not refilled")
+	}
+	if b.take() {
+		t.Error("refilled over the elapsed time")
+	}
+}
+
+func TestRetryBudgetConcurrentFailures(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"unavailable"}`, http.StatusServiceUnavailable)
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, `destination:
+  retry_rate: 0.001
+  retry_burst: 2
+  bulk_retry:
+    max: 3
+    wait_min: "1ms"
+    wait_max: "1ms"
+`))
+
+	const requests = 4
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		req := ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.DefaultClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// each request is attempted, only the burst is retried
+	if n := up.received(); n != requests+2 {
+		t.Errorf("upstream received %d requests, want %d", n, requests+2)
+	}
+	if n := counterValue(ts.metrics, "retry_budget_exhausted", pathTags("/_bulk")); n != requests {
+		t.Errorf("retry_budget_exhausted %d, want %d", n, requests)
+	}
+}
+
+func TestLimitRetryTime(t *testing.T) {
+	var attempts atomic.Int32
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+
+	tests := []struct {
+		name         string
+		budget       time.Duration
+		wantAttempts int32
+	}{
+		// waits of 20ms, 40ms and 80ms, the last shortened to the 40ms left
+		{"budget", 100 * time.Millisecond, 4},
+		{"unlimited", 0, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts.Store(0)
+			c := retryablehttp.NewClient()
+			c.Logger = nil
+			c.RetryMax = 5
+			c.RetryWaitMin = 20 * time.Millisecond
+			c.RetryWaitMax = time.Second
+			limitRetryTime(c, tt.budget, zerolog.Nop())
+
+			start := time.Now()
+			resp, err := c.Get(up.URL + "/_bulk")
+			elapsed := time.Since(start)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", got, tt.wantAttempts)
+			}
+			if tt.budget > 0 && elapsed > tt.budget+time.Second {
+				t.Errorf("retried for %s, budget %s", elapsed, tt.budget)
+			}
+		})
+	}
+}
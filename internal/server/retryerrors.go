@@ -0,0 +1,59 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// errorClasses are the classes of request errors (see errorClass) which
+// are retried, retry_errors.
+type errorClasses map[string]bool
+
+func newErrorClasses(classes []string) errorClasses {
+	c := make(errorClasses, len(classes))
+	for _, class := range classes {
+		c[class] = true
+	}
+	return c
+}
+
+// retryable returns true if a request error of its class is retried.
+func (c errorClasses) retryable(err error) bool {
+	return c[errorClass(err)]
+}
+
+// errorClass classifies a request error: timeout, refused, reset (incl.
+// connections closed w/o a response), dns, tls (handshake and certificate
+// verification failures) or other.
+func errorClass(err error) string {
+	var (
+		netErr net.Error
+		dnsErr *net.DNSError
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return "reset"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case isTLSError(err):
+		return "tls"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRetryErrors(t *testing.T) {
+	// a port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+	tlsUp := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	tlsUp.Config.ErrorLog = log.New(io.Discard, "", 0) // handshake errors
+	tlsUp.StartTLS()
+	defer tlsUp.Close()
+	plainUp := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer plainUp.Close()
+
+	requestErr := func(url string) error {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the test servers' certificate is not trusted
+		resp, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("%s: no request error", url)
+		}
+		return err
+	}
+	tests := []struct {
+		name  string
+		err   error
+		class string
+	}{
+		{"refused", requestErr("http://" + closedAddr), "refused"},
+		{"unknown authority", requestErr(tlsUp.URL), "tls"},
+		{"plain http server", requestErr(strings.Replace(plainUp.URL, "http:", "https:", 1)), "tls"},
+	}
+
+	defaults := []string{"refused", "reset", "timeout", "dns", "other"}
+	for _, classes := range [][]string{defaults, append(defaults, "tls")} {
+		retryTLS := len(classes) > len(defaults)
+		check := checkRetry(nil, newErrorClasses(classes), nil, nil, "/_bulk", zerolog.Nop(), "debug")
+		for _, tt := range tests {
+			if class := errorClass(tt.err); class != tt.class {
+				t.Errorf("%s: class %q, want %q (%s)", tt.name, class, tt.class, tt.err)
+			}
+			retry, err := check(context.Background(), nil, tt.err)
+			if err != nil {
+				t.Errorf("%s: check retry: %s", tt.name, err)
+			}
+			want := tt.class == "refused" || retryTLS
+			if retry != want {
+				t.Errorf("%s, retry_errors %v: retry %v, want %v", tt.name, classes, retry, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/circonus/c3-exporter/internal/config"
+)
+
+// readEndpoints are the (last) path elements of POST requests which read
+// rather than write, e.g. /otel-v1-apm-span/_search.
+var readEndpoints = map[string]bool{
+	"_search":   true,
+	"_msearch":  true,
+	"_count":    true,
+	"_mget":     true,
+	"_validate": true,
+}
+
+// isRead reports whether r reads (GET/HEAD, or a search) rather than writes.
+func isRead(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		for _, elem := range strings.Split(strings.Trim(r.URL.Path, "/"), "/") {
+			if readEndpoints[elem] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// endpointFor returns the endpoint (read_destination or write_destination)
+// r is forwarded to, nil for the destination.
+func endpointFor(dest *config.Destination, r *http.Request) *config.Endpoint {
+	if isRead(r) {
+		return dest.ReadDestination
+	}
+	return dest.WriteDestination
+}
+
+// destinationURL returns the scheme and host requests are forwarded to, the
+// endpoint's or, when nil, the destination's.
+func destinationURL(dest *config.Destination, ep *config.Endpoint) url.URL {
+	host, port, enableTLS := dest.Host, dest.Port, dest.EnableTLS
+	if ep != nil {
+		host, port, enableTLS = ep.Host, ep.Port, ep.EnableTLS
+	}
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(host, port)}
+	if enableTLS {
+		u.Scheme = "https"
+	}
+	return u
+}
+
+// destinationName returns the destination metric tag of the endpoint or,
+// when nil, the destination.
+func destinationName(dest *config.Destination, ep *config.Endpoint) string {
+	if ep != nil {
+		return ep.Name
+	}
+	return dest.Name
+}
@@ -0,0 +1,125 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestIsRead(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{http.MethodGet, "/logs/_doc/1", true},
+		{http.MethodHead, "/logs", true},
+		{http.MethodPost, "/otel-v1-apm-span/_search", true},
+		{http.MethodPost, "/_msearch", true},
+		{http.MethodPost, "/logs/_count", true},
+		{http.MethodPost, "/_bulk", false},
+		{http.MethodPost, "/logs/_doc", false},
+		{http.MethodPut, "/_template/logs", false},
+		{http.MethodDelete, "/logs", false},
+	}
+	for _, tt := range tests {
+		if got := isRead(httptest.NewRequest(tt.method, tt.path, nil)); got != tt.want {
+			t.Errorf("%s %s: read %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestReadWriteDestinations(t *testing.T) {
+	dest := newTestUpstream(t, nil)
+	reads := newTestUpstream(t, nil)
+	writes := newTestUpstream(t, nil)
+
+	doc := `{"index":{}}` + "\n{}\n"
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		read   bool
+	}{
+		{http.MethodPost, "/_bulk", doc, false},
+		{http.MethodPost, "/otel-v1-apm-span/_bulk", doc, false},
+		{http.MethodGet, "/logs/_search", "", true},
+		{http.MethodPost, "/otel-v1-apm-span/_search", `{"query":{"match_all":{}}}`, true},
+	}
+	names := map[*testUpstream]string{dest: "destination", reads: "read_destination", writes: "write_destination"}
+
+	for _, split := range []struct {
+		name         string
+		yaml         string
+		reads, write *testUpstream
+	}{
+		{"read and write", "destination:\n  read_destination:\n" + endpointYAML(t, reads.Server, "    ") + "  write_destination:\n" + endpointYAML(t, writes.Server, "    "), reads, writes},
+		{"read only", "destination:\n  read_destination:\n" + endpointYAML(t, reads.Server, "    "), reads, dest},
+	} {
+		t.Run(split.name, func(t *testing.T) {
+			ts := newTestServer(t, testConfig(t, dest.Server, split.yaml))
+			for _, tt := range tests {
+				want := split.write
+				if tt.read {
+					want = split.reads
+				}
+				counts := map[*testUpstream]int{dest: dest.received(), reads: reads.received(), writes: writes.received()}
+				resp, body := ts.do(t, ts.request(t, tt.method, tt.path, tt.body))
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("%s %s: response %d %s", tt.method, tt.path, resp.StatusCode, body)
+				}
+				for up, before := range counts {
+					wantN := before
+					if up == want {
+						wantN++
+					}
+					if up.received() != wantN {
+						t.Errorf("%s %s: %s received %d requests, want %d", tt.method, tt.path, names[up], up.received()-before, wantN-before)
+					}
+				}
+				if r, _ := want.last(t); r.URL.Path != tt.path {
+					t.Errorf("%s %s: forwarded %s", tt.method, tt.path, r.URL.Path)
+				}
+			}
+		})
+	}
+}
+
+func TestReloadReadWriteDestinationCA(t *testing.T) {
+	dest := newTestUpstream(t, nil)
+	for _, forceClose := range []bool{false, true} {
+		writes, writesCA, _ := newTLSUpstream(t)
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		if err := os.WriteFile(caFile, selfSignedCert(t), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		ts := newTestServer(t, testConfig(t, dest.Server, "destination:\n  force_close: "+strconv.FormatBool(forceClose)+"\n  write_destination:\n"+
+			endpointYAML(t, writes, "    ")+"    enable_tls: true\n    ca_file: "+caFile+"\n"))
+		doc := `{"index":{}}` + "\n{}\n"
+
+		// the write destination's certificate is not signed by the ca
+		if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc)); resp.StatusCode == http.StatusOK {
+			t.Fatalf("force_close %t: response %d %s, want the certificate rejected", forceClose, resp.StatusCode, body)
+		}
+
+		ca, err := os.ReadFile(writesCA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		ts.Reload()
+		if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc)); resp.StatusCode != http.StatusOK {
+			t.Errorf("force_close %t: after reload: response %d %s", forceClose, resp.StatusCode, body)
+		}
+	}
+}
@@ -7,20 +7,53 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	stdlog "log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
+	"github.com/circonus-labs/go-trapcheck"
 	"github.com/circonus-labs/go-trapmetrics"
 	"github.com/circonus/c3-exporter/internal/config"
+	"github.com/circonus/c3-exporter/internal/spool"
 	"github.com/rs/zerolog/log"
 )
 
 type Server struct {
 	srv             *http.Server
+	admin           *http.Server
 	cfg             *config.Config
 	idleConnsClosed chan struct{}
+	ready           chan struct{}
 	metrics         *trapmetrics.TrapMetrics
+	check           *trapcheck.TrapCheck
+	spool           *spool.Spooler
+	async           *asyncQueue
+	shadow          *shadowForwarder
+	clients         *destClients
+	cache           *responseCache
+	idempotency     *responseCache
+	compression     *compressionTuner
+	compressor      bodyCompressor
+	otlp            *otlpExporter
+	allowed         *allowedAccounts
+	copyBuffers     *copyBuffers
+	limiter         *clientLimiter
+	slots           chan struct{}
+	paths           pathTagger
+	transforms      responseTransforms
+	accounts        accountMetrics
+	requestTags     requestTagger
+	cert            *serverCert
+	stats           *serverStats
+	flushing        atomic.Bool
+	started         time.Time
+	writeTimeout    time.Duration
+	checkUUID       string
+	debugBodies     int
 	tls             bool
 }
 
@@ -49,41 +82,182 @@ func New(cfg *config.Config) (*Server, error) {
 
 	s := &Server{
 		cfg:             cfg,
+		started:         time.Now(),
+		writeTimeout:    writeTimeout,
 		tls:             cfg.Server.CertFile != "" && cfg.Server.KeyFile != "",
 		idleConnsClosed: make(chan struct{}),
+		ready:           make(chan struct{}),
+		clients:         newDestClients(&cfg.Destination),
+		paths:           pathTagger(cfg.Server.PathTagRules),
+		transforms:      newResponseTransforms(cfg.Server.ResponseTransforms),
+		accounts:        newAccountMetrics(cfg.Circonus.AccountMetrics, cfg.Circonus.DefaultAccount),
+		requestTags:     newRequestTagger(cfg.Server.RequestTags),
+		stats:           &serverStats{},
+		copyBuffers:     newCopyBuffers(cfg.Server.CopyBufferSize),
+		limiter:         newClientLimiter(cfg.Server.MaxConnsPerIP),
+	}
+
+	if cfg.Server.MaxConcurrentRequests > 0 {
+		s.slots = make(chan struct{}, cfg.Server.MaxConcurrentRequests)
+	}
+
+	// request/response bodies are only logged when running with debug
+	if cfg.Debug {
+		s.debugBodies = cfg.Server.DebugBodies
 	}
 
 	// create the check for tracking
-	metrics, err := initMetrics(cfg.Circonus)
+	metrics, check, err := initMetrics(cfg.Circonus)
 	if err != nil {
 		return nil, err
 	}
 
 	s.metrics = metrics
+	s.check = check
+
+	switch {
+	case cfg.Circonus.Preflight && cfg.Circonus.SubmissionURL != "":
+		log.Warn().Str("submission_url", cfg.Circonus.SubmissionURL).Msg("preflight not applicable with explicit submission url, skipping")
+	case cfg.Circonus.Preflight:
+		checkUUID, err := preflightCheck(check)
+		if err != nil {
+			return nil, err
+		}
+		s.checkUUID = checkUUID
+	}
+
+	if cfg.Server.Spool.Enabled {
+		sp, err := spool.New(cfg.Server.Spool.Dir, cfg.Server.Spool.MaxSize, cfg.Server.Spool.RetryInterval, s.sendSpooled)
+		if err != nil {
+			return nil, err
+		}
+		s.spool = sp
+	}
+
+	if cfg.Server.Cache.Enabled {
+		s.cache = newResponseCache(cfg.Server.Cache.TTL, cfg.Server.Cache.MaxEntries)
+	}
+
+	otlp, err := newOTLPExporter(context.Background(), cfg.Metrics.OTLP)
+	if err != nil {
+		return nil, err
+	}
+	s.otlp = otlp
+
+	if cfg.Server.AllowedAccountsFile != "" {
+		allowed, err := newAllowedAccounts(cfg.Server.AllowedAccountsFile)
+		if err != nil {
+			return nil, err
+		}
+		s.allowed = allowed
+	}
+
+	if cfg.Destination.AdaptiveCompression {
+		s.compression = newCompressionTuner()
+	}
+	s.compressor = bodyCompressor{
+		tuner:    s.compression,
+		algo:     cfg.Destination.CompressionAlgo,
+		minBytes: int64(cfg.Destination.CompressMinBytes),
+		paths:    cfg.Destination.CompressPaths,
+		noPaths:  cfg.Destination.NoCompressPaths,
+	}
+
+	if cfg.Server.Idempotency.Enabled {
+		s.idempotency = newResponseCache(cfg.Server.Idempotency.TTL, cfg.Server.Idempotency.MaxEntries)
+	}
+
+	s.shadow = newShadowForwarder(cfg.Destination.Shadow, s.clients, metrics)
+
+	if cfg.Server.Async.Enabled {
+		s.async = newAsyncQueue(s, cfg.Server.Async.Workers, cfg.Server.Async.QueueSize)
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/", s.verifyBasicAuth(genericHandler{s: s}))
-	mux.Handle("/health", healthHandler{})
-	mux.Handle("/_bulk", s.verifyBasicAuth(http.TimeoutHandler(bulkHandler{
-		dest:      cfg.Destination,
-		dataToken: cfg.Circonus.APIKey,
-		metrics:   metrics,
-		debug:     cfg.Debug,
-	}, handlerTimeout, "Handler timeout")))
-	mux.Handle("/otel-v1-apm-span/_bulk", s.verifyBasicAuth(http.TimeoutHandler(bulkHandler{
-		dest:      cfg.Destination,
-		dataToken: cfg.Circonus.APIKey,
-		metrics:   metrics,
-		debug:     cfg.Debug,
-	}, handlerTimeout, "Handler timeout")))
-	mux.Handle("/_cluster/settings", s.verifyBasicAuth(clusterSettingsHandler{s: s}))
-	mux.Handle("/otel-v1-apm-service-map", s.verifyBasicAuth(otelv1apmservicemapHandler{s: s}))
-	mux.Handle("/_template/", s.verifyBasicAuth(templateHandler{s: s}))
-	mux.Handle("/_component_template/", s.verifyBasicAuth(templateHandler{s: s}))
-	mux.Handle("/_index_template/", s.verifyBasicAuth(templateHandler{s: s}))
-	mux.Handle("/_opendistro/_ism/policies/raw-span-policy", s.verifyBasicAuth(ismPolicyHandler{s: s}))
-	mux.Handle("/otel-v1-apm-span-000001", s.verifyBasicAuth(otelSpanHandler{s: s}))
-	mux.Handle("/otel-v1-apm-span/_search", s.verifyBasicAuth(otelSpanSearchHandler{s: s}))
+	// disabled routes (and paths under them) respond 404
+	for _, route := range cfg.Server.DisabledRoutes {
+		mux.Handle(route, disabledRouteHandler{s: s})
+	}
+	handle := func(pattern string, handler http.Handler) {
+		if matchPath(cfg.Server.DisabledRoutes, pattern) {
+			log.Info().Str("route", pattern).Msg("route disabled")
+			return
+		}
+		mux.Handle(pattern, handler)
+	}
+	handle("/", s.verifyBasicAuth(s.withTimeout("/", genericHandler{s: s}, 0)))
+	handle("/health", s.protectPaths(healthHandler{started: s.started, stats: s.stats, format: cfg.Server.HealthFormat}))
+	handle("/_bulk", s.verifyBasicAuth(s.withTimeout("/_bulk", bulkHandler{
+		dest:           cfg.Destination,
+		dataToken:      cfg.Circonus.APIKey,
+		defaultAccount: cfg.Circonus.DefaultAccount,
+		metrics:        metrics,
+		spool:          s.spool,
+		async:          s.async,
+		shadow:         s.shadow,
+		clients:        s.clients,
+		idempotency:    s.idempotency,
+		stripHeaders:   cfg.Server.StripResponseHeaders,
+		statusRemap:    cfg.Server.StatusRemap,
+		retry:          cfg.Destination.BulkRetry,
+		compressor:     s.compressor,
+		copyBuffers:    s.copyBuffers,
+		stats:          s.stats,
+		rejectEmpty:    cfg.Server.EmptyBody == "reject",
+		validateBulk:   cfg.Server.ValidateBulk,
+		trailers:       cfg.Server.ForwardTrailers,
+		requestID:      cfg.Server.RequestIDHeader,
+		bulkDocs:       cfg.Server.BulkDocs,
+		paths:          s.paths,
+		accounts:       s.accounts,
+		requestTags:    s.requestTags,
+		trustedProxies: cfg.Server.TrustedNets,
+		slowRequest:    cfg.Server.SlowRequest,
+		writeTimeout:   writeTimeout,
+		debugBodies:    s.debugBodies,
+		debug:          cfg.Debug,
+	}, handlerTimeout)))
+	handle("/otel-v1-apm-span/_bulk", s.verifyBasicAuth(s.withTimeout("/otel-v1-apm-span/_bulk", bulkHandler{
+		dest:           cfg.Destination,
+		dataToken:      cfg.Circonus.APIKey,
+		defaultAccount: cfg.Circonus.DefaultAccount,
+		metrics:        metrics,
+		spool:          s.spool,
+		async:          s.async,
+		shadow:         s.shadow,
+		clients:        s.clients,
+		idempotency:    s.idempotency,
+		stripHeaders:   cfg.Server.StripResponseHeaders,
+		statusRemap:    cfg.Server.StatusRemap,
+		retry:          cfg.Destination.BulkRetry,
+		compressor:     s.compressor,
+		copyBuffers:    s.copyBuffers,
+		stats:          s.stats,
+		rejectEmpty:    cfg.Server.EmptyBody == "reject",
+		validateBulk:   cfg.Server.ValidateBulk,
+		trailers:       cfg.Server.ForwardTrailers,
+		requestID:      cfg.Server.RequestIDHeader,
+		bulkDocs:       cfg.Server.BulkDocs,
+		paths:          s.paths,
+		accounts:       s.accounts,
+		requestTags:    s.requestTags,
+		trustedProxies: cfg.Server.TrustedNets,
+		slowRequest:    cfg.Server.SlowRequest,
+		writeTimeout:   writeTimeout,
+		debugBodies:    s.debugBodies,
+		debug:          cfg.Debug,
+	}, handlerTimeout)))
+	if cfg.Server.StatsEndpoint {
+		handle("/stats", s.verifyBasicAuth(statsHandler{s: s}))
+	}
+	handle("/_cluster/settings", s.verifyBasicAuth(s.withTimeout("/_cluster/settings", clusterSettingsHandler{s: s}, 0)))
+	handle("/otel-v1-apm-service-map", s.verifyBasicAuth(s.withTimeout("/otel-v1-apm-service-map", otelv1apmservicemapHandler{s: s}, 0)))
+	handle("/_template/", s.verifyBasicAuth(s.withTimeout("/_template/", templateHandler{s: s}, 0)))
+	handle("/_component_template/", s.verifyBasicAuth(s.withTimeout("/_component_template/", templateHandler{s: s}, 0)))
+	handle("/_index_template/", s.verifyBasicAuth(s.withTimeout("/_index_template/", templateHandler{s: s}, 0)))
+	handle("/_opendistro/_ism/policies/raw-span-policy", s.verifyBasicAuth(s.withTimeout("/_opendistro/_ism/policies/raw-span-policy", ismPolicyHandler{s: s}, 0)))
+	handle("/otel-v1-apm-span-000001", s.verifyBasicAuth(s.withTimeout("/otel-v1-apm-span-000001", otelSpanHandler{s: s}, 0)))
+	handle("/otel-v1-apm-span/_search", s.verifyBasicAuth(s.withTimeout("/otel-v1-apm-span/_search", otelSpanSearchHandler{s: s}, 0)))
 
 	s.srv = &http.Server{
 		Addr:              cfg.Server.Address,
@@ -91,12 +265,65 @@ func New(cfg *config.Config) (*Server, error) {
 		WriteTimeout:      writeTimeout,
 		IdleTimeout:       idleTimeout,
 		ReadHeaderTimeout: readHeaderTimeout,
-		Handler:           mux,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+		Handler:           s.countRequests(s.accessLog(s.limitClients(s.limitRequests(s.gzipResponses(mux))))),
+		ErrorLog:          stdlog.New(serverErrorLog{tm: metrics}, "", 0),
+	}
+	conns := &connTracker{tm: metrics}
+	s.srv.ConnContext = conns.connContext
+	s.srv.ConnState = conns.connState
+	if cfg.Server.DisableKeepAlives {
+		// e.g. so load balancers spread requests rather than connections
+		s.srv.SetKeepAlivesEnabled(false)
+	}
+
+	if cfg.Server.ClientCAFile != "" {
+		tlsConfig, err := clientCertTLSConfig(cfg.Server.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		s.srv.TLSConfig = tlsConfig
+	}
+
+	if s.tls {
+		// the certificate is loaded here, rather than by ServeTLS, so it can
+		// be reloaded and its expiry checked
+		cert, err := newServerCert(cfg.Server.CertFile, cfg.Server.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.cert = cert
+		if s.srv.TLSConfig == nil {
+			s.srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		s.srv.TLSConfig.GetCertificate = cert.getCertificate
+	}
+
+	if cfg.Server.AdminAddress != "" {
+		s.admin = s.newAdminServer(readTimeout, writeTimeout, idleTimeout, readHeaderTimeout)
 	}
 
 	return s, nil
 }
 
+// Ready is closed once Start has bound the listener and requests are accepted.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// withTimeout wraps a route's handler in a timeout, the route's entry in
+// server.handler_timeouts or, if there is none, def (0 is no timeout).
+func (s *Server) withTimeout(pattern string, h http.Handler, def time.Duration) http.Handler {
+	timeout := def
+	if d, ok := s.cfg.Server.RouteTimeouts[pattern]; ok {
+		timeout = d
+	}
+	if timeout <= 0 {
+		return h
+	}
+	return http.TimeoutHandler(h, timeout, "Handler timeout")
+}
+
 func (s *Server) Start(ctx context.Context) error {
 
 	if done(ctx) {
@@ -110,36 +337,64 @@ func (s *Server) Start(ctx context.Context) error {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				r, err := s.metrics.Flush(ctx)
-				if err != nil {
-					log.Warn().Err(err).Msg("flushing circonus metrics")
-				}
-				log.Debug().
-					Str("check_uuid", r.CheckUUID).
-					Str("submit_uuid", r.SubmitUUID).
-					Str("error", r.Error).
-					Uint64("filtered", r.Filtered).
-					Uint64("stats", r.Stats).
-					Int("bytes", r.BytesSent).
-					Str("encode_dur", r.EncodeDuration.String()).
-					Str("submit_dur", r.SubmitDuration.String()).
-					Str("last_req_dur", r.LastReqDuration.String()).
-					Str("flush_dur", r.FlushDuration.String()).
-					Msg("flushed metrics")
+				s.flush(ctx)
 			}
 		}
 	}(ctx)
 
-	if s.cfg.Server.CertFile != "" && s.cfg.Server.KeyFile != "" {
-		log.Info().Str("listen", s.srv.Addr).Msg("starting TLS server")
-		if err := s.srv.ListenAndServeTLS(s.cfg.Server.CertFile, s.cfg.Server.KeyFile); err != nil {
+	if s.spool != nil {
+		go s.spool.Run(ctx)
+	}
+
+	if s.compression != nil {
+		go s.compression.run(ctx, 5*time.Second)
+	}
+
+	if s.allowed != nil {
+		go s.allowed.watch(ctx, s.cfg.Server.AllowedAccountsReload)
+	}
+
+	if s.async != nil {
+		s.async.start(ctx)
+	}
+
+	if s.cert != nil && s.cfg.Server.CertExpiryWarning > 0 {
+		go s.watchCertExpiry(ctx)
+	}
+
+	if s.admin != nil {
+		go func() {
+			log.Info().Str("listen", s.admin.Addr).Msg("starting admin server")
+			if err := s.admin.ListenAndServe(); err != nil {
+				if !errors.Is(err, http.ErrServerClosed) {
+					log.Error().Err(err).Msg("admin listen and serve")
+				}
+			}
+		}()
+	}
+
+	// the listener is only bound once New has completed (metrics and check
+	// initialized), so a connection accepted is one which can be served
+	addr := s.srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := listen(ctx, addr, s.cfg.Server.ReusePort, s.cfg.Server.ListenBacklog)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	close(s.ready)
+
+	if s.tls {
+		log.Info().Str("listen", ln.Addr().String()).Str("check_uuid", s.checkUUID).Msg("startup complete, starting TLS server")
+		if err := s.srv.ServeTLS(ln, "", ""); err != nil {
 			if !errors.Is(err, http.ErrServerClosed) {
 				log.Error().Err(err).Msg("listen and serve tls")
 			}
 		}
 	} else {
-		log.Info().Str("listen", s.srv.Addr).Msg("starting server")
-		if err := s.srv.ListenAndServe(); err != nil {
+		log.Info().Str("listen", ln.Addr().String()).Str("check_uuid", s.checkUUID).Msg("startup complete, starting server")
+		if err := s.srv.Serve(ln); err != nil {
 			if !errors.Is(err, http.ErrServerClosed) {
 				log.Error().Err(err).Msg("listen and serve")
 			}
@@ -151,6 +406,63 @@ func (s *Server) Start(ctx context.Context) error {
 	return nil
 }
 
+// flush records the metrics sampled at flush time and flushes the metrics in
+// the background. A flush still in progress (e.g. a slow broker) is not
+// overlapped, this interval's flush is skipped.
+func (s *Server) flush(ctx context.Context) {
+	if !s.flushing.CompareAndSwap(false, true) {
+		s.stats.flushSkipped.Add(1)
+		_ = s.metrics.CounterIncrement("flush_skipped", nil)
+		log.Warn().Msg("flush in progress, skipping flush")
+		return
+	}
+	go func() {
+		defer s.flushing.Store(false)
+		if s.cfg.Circonus.RuntimeMetrics {
+			recordRuntimeMetrics(s.metrics)
+		}
+		if s.async != nil {
+			_ = s.metrics.GaugeSet("async_queue_depth", nil, s.async.depth(), nil)
+		}
+		if s.compression != nil {
+			_ = s.metrics.GaugeSet("gzip_level", nil, s.compression.level.Load(), nil)
+		}
+		flushMetrics(ctx, []checkMetrics{{s.metrics, s.check}}, s.cfg.Circonus.FlushConcurrency, s.cfg.Circonus.FlushTimeout, s.otlp, s.stats)
+	}()
+}
+
+// Reload re-reads the server certificate and the destination tls ca files
+// (e.g. after rotation) and swaps them into use w/o disrupting requests in
+// flight.
+func (s *Server) Reload() {
+	if s.cert != nil {
+		if err := s.cert.reload(); err != nil {
+			log.Error().Err(err).Msg("reloading server certificate, continuing with current certificate")
+		} else {
+			log.Info().Time("not_after", s.cert.notAfter()).Msg("reloaded server certificate")
+		}
+		s.checkCertExpiry()
+	}
+
+	if !s.clients.tlsEnabled() {
+		return
+	}
+	if err := s.clients.reloadTLS(); err != nil {
+		log.Error().Err(err).Msg("reloading destination tls config, continuing with current config")
+		return
+	}
+	log.Info().Msg("reloaded destination tls config")
+}
+
+// ReloadAccounts re-reads the allowed accounts file, if there is one, w/o
+// touching listeners or the destination.
+func (s *Server) ReloadAccounts() {
+	if s.allowed == nil {
+		return
+	}
+	s.allowed.logReload(true)
+}
+
 func (s *Server) Stop(ctx context.Context) error {
 	log.Info().Msg("shutting down server")
 
@@ -160,6 +472,22 @@ func (s *Server) Stop(ctx context.Context) error {
 		log.Error().Err(err).Msg("server shutdown")
 	}
 
+	if s.async != nil {
+		s.async.stop(toctx)
+	}
+
+	if s.admin != nil {
+		if err := s.admin.Shutdown(toctx); err != nil {
+			log.Error().Err(err).Msg("admin server shutdown")
+		}
+	}
+
+	if s.otlp != nil {
+		if err := s.otlp.shutdown(toctx); err != nil {
+			log.Error().Err(err).Msg("otlp exporter shutdown")
+		}
+	}
+
 	close(s.idleConnsClosed)
 
 	// if no error, check the ctx and return that error
@@ -0,0 +1,492 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/go-trapmetrics"
+	"github.com/circonus/c3-exporter/internal/config"
+	"github.com/openhistogram/circonusllhist"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	testCheckUUID = "11111111-2222-3333-4444-555555555555"
+	testAccount   = "acct"
+	testToken     = "c3e-test-token"
+)
+
+// testBroker is a stub of the circonus api and of a broker's httptrap
+// submission endpoint, the metrics submitted are kept.
+type testBroker struct {
+	*httptest.Server
+	handler     http.HandlerFunc // api requests, nil responds with no objects
+	onSubmit    func()           // called for each submission, nil for none
+	submissions [][]byte
+	mu          sync.Mutex
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	b := &testBroker{}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/module/httptrap/") {
+			var body io.Reader = r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				body = zr
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			b.mu.Lock()
+			b.submissions = append(b.submissions, data)
+			onSubmit := b.onSubmit
+			b.mu.Unlock()
+			if onSubmit != nil {
+				onSubmit()
+			}
+			_, _ = w.Write([]byte(`{"stats":1}`))
+			return
+		}
+		if b.handler != nil {
+			b.handler(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *testBroker) submissionURL() string {
+	return b.URL + "/module/httptrap/" + testCheckUUID + "/secret"
+}
+
+// submitted returns the metrics (httptrap json) submitted so far.
+func (b *testBroker) submitted() [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]byte(nil), b.submissions...)
+}
+
+// endpointYAML returns the host and port of upstream as endpoint yaml,
+// indented by indent.
+func endpointYAML(t *testing.T, upstream *httptest.Server, indent string) string {
+	t.Helper()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return indent + "host: " + host + "\n" + indent + "port: \"" + port + "\"\n"
+}
+
+// testConfig loads a (strict) config from doc, yaml w/o the version. The
+// destination host and port of upstream (if not nil) and a circonus api key
+// are added to the destination and circonus sections.
+func testConfig(t *testing.T, upstream *httptest.Server, doc string) *config.Config {
+	t.Helper()
+	if upstream != nil {
+		doc = addYAML(doc, "destination", endpointYAML(t, upstream, "  "))
+	}
+	doc = addYAML(doc, "circonus", "  api_key: "+testToken+"\n")
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("version: 1\n"+doc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(file, true)
+	if err != nil {
+		t.Fatalf("loading config: %s", err)
+	}
+	return cfg
+}
+
+// addYAML adds lines to the top level section of doc, the section is added
+// if doc does not have it.
+func addYAML(doc, section, lines string) string {
+	key := section + ":\n"
+	if strings.HasPrefix(doc, key) {
+		return key + lines + doc[len(key):]
+	}
+	if i := strings.Index(doc, "\n"+key); i >= 0 {
+		i += len(key) + 1
+		return doc[:i] + lines + doc[i:]
+	}
+	if doc != "" && !strings.HasSuffix(doc, "\n") {
+		doc += "\n"
+	}
+	return doc + key + lines
+}
+
+// testServer is a Server, with a stub circonus broker, serving on an httptest
+// listener.
+type testServer struct {
+	*Server
+	broker *testBroker
+	url    string
+}
+
+// newTestServer creates the server for cfg and starts its (data) listener,
+// the background workers (e.g. spool, async queue) are not started.
+func newTestServer(t *testing.T, cfg *config.Config) *testServer {
+	t.Helper()
+	broker := newTestBroker(t)
+	cfg.Circonus.APIURL = broker.URL
+	cfg.Circonus.SubmissionURL = broker.submissionURL()
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new server: %s", err)
+	}
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = s.srv
+	if s.tls {
+		ts.TLS = s.srv.TLSConfig
+		ts.StartTLS()
+	} else {
+		ts.Start()
+	}
+	t.Cleanup(ts.Close)
+
+	return &testServer{Server: s, broker: broker, url: ts.URL}
+}
+
+// request returns a request to the server, with the test account's basic
+// auth credentials.
+func (ts *testServer) request(t *testing.T, method, path, body string) *http.Request {
+	t.Helper()
+	var rdr io.Reader
+	if body != "" {
+		rdr = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, ts.url+path, rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(testAccount, testToken)
+	return req
+}
+
+// do sends req, returning the response and its body.
+func (ts *testServer) do(t *testing.T, req *http.Request) (*http.Response, []byte) {
+	t.Helper()
+	return doRequest(t, http.DefaultClient, req)
+}
+
+func doRequest(t *testing.T, client *http.Client, req *http.Request) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %s", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response: %s", err)
+	}
+	return resp, body
+}
+
+// testUpstream is a destination stub, the requests it received are kept
+// (with their bodies, decompressed).
+type testUpstream struct {
+	*httptest.Server
+	requests []*http.Request
+	bodies   []string
+	mu       sync.Mutex
+}
+
+// newTestUpstream starts a destination stub, responding with handler (nil
+// responds 200 with an empty json object).
+func newTestUpstream(t *testing.T, handler http.HandlerFunc) *testUpstream {
+	t.Helper()
+	u := &testUpstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		u.mu.Lock()
+		u.requests = append(u.requests, r.Clone(r.Context()))
+		u.bodies = append(u.bodies, string(body))
+		u.mu.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if handler != nil {
+			handler(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+// received returns the number of requests received.
+func (u *testUpstream) received() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.requests)
+}
+
+// last returns the last request received and its body.
+func (u *testUpstream) last(t *testing.T) (*http.Request, string) {
+	t.Helper()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.requests) == 0 {
+		t.Fatal("no requests received by upstream")
+	}
+	return u.requests[len(u.requests)-1], u.bodies[len(u.bodies)-1]
+}
+
+// readBody reads the, gzip decompressed, body of r.
+func readBody(r *http.Request) ([]byte, error) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = zr
+	}
+	return io.ReadAll(body)
+}
+
+// syncBuffer is a log destination safe for use by handlers and the test.
+type syncBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends the (global) log to a buffer for the rest of the test.
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	orig := log.Logger
+	log.Logger = zerolog.New(buf).Level(zerolog.DebugLevel)
+	t.Cleanup(func() { log.Logger = orig })
+	return buf
+}
+
+// counterValue returns the value of a counter, 0 if it has not been recorded.
+func counterValue(tm *trapmetrics.TrapMetrics, name string, tags trapmetrics.Tags) int64 {
+	m, err := tm.CounterFetch(name, tags)
+	if err != nil {
+		return 0
+	}
+	v, _ := m.Samples[0].(int64)
+	return v
+}
+
+// histogramCount returns the number of samples in a histogram, 0 if it has
+// not been recorded.
+func histogramCount(tm *trapmetrics.TrapMetrics, name string, tags trapmetrics.Tags) uint64 {
+	h := histogram(tm, name, tags)
+	if h == nil {
+		return 0
+	}
+	return h.Count()
+}
+
+func histogram(tm *trapmetrics.TrapMetrics, name string, tags trapmetrics.Tags) *circonusllhist.Histogram {
+	m, err := tm.HistogramFetch(name, tags)
+	if err != nil {
+		return nil
+	}
+	h, _ := m.Samples[0].(*circonusllhist.Histogram)
+	return h
+}
+
+// gaugeValue returns the (last set) value of a gauge, nil if it has not been
+// recorded.
+func gaugeValue(tm *trapmetrics.TrapMetrics, name string, tags trapmetrics.Tags) interface{} {
+	m, err := tm.GaugeFetch(name, tags)
+	if err != nil {
+		return nil
+	}
+	for _, v := range m.Samples {
+		return v
+	}
+	return nil
+}
+
+// chunked returns a body sent w/o a Content-Length.
+func chunked(body string) io.Reader {
+	return io.NopCloser(strings.NewReader(body))
+}
+
+// sizeTags are the log_size tags of a request to path, handled by dest.
+func sizeTags(path, dest string) trapmetrics.Tags {
+	return trapmetrics.Tags{
+		{Category: "units", Value: "bytes"},
+		{Category: "path", Value: path},
+		{Category: "destination", Value: dest},
+	}
+}
+
+func pathTags(path string) trapmetrics.Tags {
+	return trapmetrics.Tags{{Category: "path", Value: path}}
+}
+
+func TestStartListensWhenReady(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	up := newTestUpstream(t, nil)
+	cfg := testConfig(t, up.Server, "server:\n  listen_address: \""+addr+"\"\n")
+	broker := newTestBroker(t)
+	cfg.Circonus.APIURL = broker.URL
+	cfg.Circonus.SubmissionURL = broker.submissionURL()
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new server: %s", err)
+	}
+
+	// initialized, but not started, connections are refused
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("connection accepted before start")
+	}
+	select {
+	case <-s.Ready():
+		t.Fatal("ready before start")
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan error, 1)
+	go func() { started <- s.Start(ctx) }()
+	select {
+	case <-s.Ready():
+	case err := <-started:
+		t.Fatalf("start: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not ready after 5s")
+	}
+
+	ts := &testServer{Server: s, broker: broker, url: "http://" + addr}
+	resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("response %d %s once ready", resp.StatusCode, body)
+	}
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Errorf("stop: %s", err)
+	}
+	if err := <-started; err != nil {
+		t.Errorf("start: %s", err)
+	}
+}
+
+func TestDisabledRoutes(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, "server:\n  disabled_routes: [/otel-v1-apm-span/]\n"))
+
+	doc := `{"index":{}}` + "\n{}\n"
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/otel-v1-apm-span/_bulk", http.StatusNotFound},
+		{"/otel-v1-apm-span/_search", http.StatusNotFound},
+		{"/_bulk", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := ts.request(t, http.MethodPost, tt.path, doc)
+		resp, body := ts.do(t, req)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: response %d %s, want %d", tt.path, resp.StatusCode, body, tt.status)
+		}
+		disabled := int64(0)
+		if tt.status == http.StatusNotFound {
+			disabled = 1
+		}
+		if n := counterValue(ts.metrics, "route_disabled", methodTags(ts.paths, req)); n != disabled {
+			t.Errorf("%s: route_disabled %d, want %d", tt.path, n, disabled)
+		}
+	}
+	if _, got := up.last(t); up.received() != 1 || got != doc {
+		t.Errorf("upstream received %d requests (last %q), want the enabled route's", up.received(), got)
+	}
+}
+
+func TestDisableKeepAlives(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable_keepalives %v", disabled), func(t *testing.T) {
+			up := newTestUpstream(t, nil)
+			ts := newTestServer(t, testConfig(t, up.Server, fmt.Sprintf("server:\n  disable_keepalives: %v\n", disabled)))
+			client := &http.Client{Transport: &http.Transport{}}
+			defer client.CloseIdleConnections()
+
+			var reused []bool
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) }}
+			for i := 0; i < 2; i++ {
+				req := ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n")
+				req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+				resp, body := doRequest(t, client, req)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("response %d %s", resp.StatusCode, body)
+				}
+				if resp.Close != disabled {
+					t.Errorf("request %d: connection closed %v, want %v", i, resp.Close, disabled)
+				}
+			}
+			if len(reused) != 2 || reused[1] == disabled {
+				t.Errorf("connections reused %v, want the second reused %v", reused, !disabled)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// certExpiryCheckInterval is how often the server certificate's expiry is
+// checked, in addition to at startup and on reload.
+const certExpiryCheckInterval = time.Hour
+
+// serverCert is the listener certificate, loaded from cert_file/key_file and
+// swapped on reload so a rotated certificate is used for new connections.
+type serverCert struct {
+	cert     atomic.Pointer[tls.Certificate]
+	certFile string
+	keyFile  string
+}
+
+func newServerCert(certFile, keyFile string) (*serverCert, error) {
+	c := &serverCert{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload re-reads the certificate and key, the current certificate is kept
+// if they cannot be loaded.
+func (c *serverCert) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading server certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("parsing server certificate: %w", err)
+		}
+		cert.Leaf = leaf
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *serverCert) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+func (c *serverCert) notAfter() time.Time {
+	return c.cert.Load().Leaf.NotAfter
+}
+
+// checkCertExpiry sets the server_cert_expiry_seconds and server_cert_expiring
+// gauges and warns when the server certificate expires within
+// server.cert_expiry_warning.
+func (s *Server) checkCertExpiry() {
+	if s.cert == nil || s.cfg.Server.CertExpiryWarning <= 0 {
+		return
+	}
+	notAfter := s.cert.notAfter()
+	remaining := time.Until(notAfter)
+	expiring := 0
+	if remaining < s.cfg.Server.CertExpiryWarning {
+		expiring = 1
+		log.Warn().
+			Str("cert_file", s.cert.certFile).
+			Time("not_after", notAfter).
+			Str("remaining", remaining.Truncate(time.Second).String()).
+			Msg("server certificate expires soon")
+	}
+	_ = s.metrics.GaugeSet("server_cert_expiry_seconds", nil, int64(remaining.Seconds()), nil)
+	_ = s.metrics.GaugeSet("server_cert_expiring", nil, expiring, nil)
+}
+
+// watchCertExpiry checks the server certificate's expiry at start and then
+// periodically until ctx is done.
+func (s *Server) watchCertExpiry(ctx context.Context) {
+	s.checkCertExpiry()
+	ticker := time.NewTicker(certExpiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkCertExpiry()
+		}
+	}
+}
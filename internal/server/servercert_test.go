@@ -0,0 +1,51 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCertExpiryWarning(t *testing.T) {
+	// the test certificate expires in an hour
+	_, _, certFile, keyFile := newTestServerCert(t)
+	tests := []struct {
+		warning  string // cert_expiry_warning, empty for the default (720h)
+		expiring bool
+	}{
+		{"", true},
+		{"2h", true},
+		{"30m", false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("warning %q", tt.warning), func(t *testing.T) {
+			doc := "destination:\n  host: localhost\nserver:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n"
+			if tt.warning != "" {
+				doc += "  cert_expiry_warning: " + tt.warning + "\n"
+			}
+			ts := newTestServer(t, testConfig(t, nil, doc))
+			logs := captureLog(t)
+
+			ts.checkCertExpiry()
+			if got := strings.Contains(logs.String(), "server certificate expires soon"); got != tt.expiring {
+				t.Errorf("warned %v, want %v:\n%s", got, tt.expiring, logs)
+			}
+			want := 0
+			if tt.expiring {
+				want = 1
+			}
+			if got, ok := gaugeValue(ts.metrics, "server_cert_expiring", nil).(int); !ok || got != want {
+				t.Errorf("server_cert_expiring %v, want %d", gaugeValue(ts.metrics, "server_cert_expiring", nil), want)
+			}
+			remaining, _ := gaugeValue(ts.metrics, "server_cert_expiry_seconds", nil).(int64)
+			if remaining <= 0 || remaining > 3600 {
+				t.Errorf("server_cert_expiry_seconds %d, want (0, 3600]", remaining)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/circonus-labs/go-trapmetrics"
+	"github.com/rs/zerolog/log"
+)
+
+// connRequests counts, for a connection, the requests read by the http
+// server (active) and those which reached the handlers (served). Requests
+// the server rejects itself (e.g. malformed request line, headers over
+// max_header_bytes) are read but never served.
+type connRequests struct {
+	active atomic.Int64
+	served atomic.Int64
+}
+
+// connTracker records, in the server_errors metric, requests rejected by the
+// http server before reaching the handlers, which otherwise go unnoticed.
+type connTracker struct {
+	tm    *trapmetrics.TrapMetrics
+	conns sync.Map // net.Conn -> *connRequests
+}
+
+// connContext adds the connection's request counts to its context, so the
+// handlers can count the requests they serve.
+func (t *connTracker) connContext(ctx context.Context, c net.Conn) context.Context {
+	cr := &connRequests{}
+	t.conns.Store(c, cr)
+	return context.WithValue(ctx, connRequestsKey, cr)
+}
+
+func (t *connTracker) connState(c net.Conn, state http.ConnState) {
+	v, ok := t.conns.Load(c)
+	if !ok {
+		return
+	}
+	cr := v.(*connRequests)
+
+	switch state { //nolint:exhaustive
+	case http.StateActive:
+		cr.active.Add(1)
+	case http.StateIdle:
+		t.check(c, cr)
+	case http.StateClosed, http.StateHijacked:
+		t.check(c, cr)
+		t.conns.Delete(c)
+	}
+}
+
+// check records the requests read since the last check which did not reach
+// the handlers.
+func (t *connTracker) check(c net.Conn, cr *connRequests) {
+	active := cr.active.Load()
+	rejected := active - cr.served.Load()
+	if rejected <= 0 {
+		return
+	}
+	cr.served.Store(active)
+	_ = t.tm.CounterIncrementByValue("server_errors", trapmetrics.Tags{{Category: "reason", Value: "rejected"}}, uint64(rejected))
+	log.Warn().Str("remote", c.RemoteAddr().String()).Msg("request rejected by http server (malformed, headers too large or timed out)")
+}
+
+// served counts a request reaching the handlers.
+func served(r *http.Request) {
+	if cr, ok := r.Context().Value(connRequestsKey).(*connRequests); ok {
+		cr.served.Add(1)
+	}
+}
+
+// serverErrorLog routes the http server's error log (e.g. tls handshake
+// errors) to the logger, recording each in the server_errors metric.
+type serverErrorLog struct {
+	tm *trapmetrics.TrapMetrics
+}
+
+func (l serverErrorLog) Write(p []byte) (int, error) {
+	_ = l.tm.CounterIncrement("server_errors", trapmetrics.Tags{{Category: "reason", Value: "error_log"}})
+	log.Warn().Str("component", "http_server").Msg(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
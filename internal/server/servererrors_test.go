@@ -0,0 +1,79 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/go-trapmetrics"
+)
+
+func TestMalformedRequestCounted(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, ""))
+	logs := captureLog(t)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("NOT A REQUEST LINE\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("reading response: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("response %d, want 400", resp.StatusCode)
+	}
+
+	// counted once the server is done with the connection
+	tags := trapmetrics.Tags{{Category: "reason", Value: "rejected"}}
+	deadline := time.Now().Add(2 * time.Second)
+	for counterValue(ts.metrics, "server_errors", tags) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := counterValue(ts.metrics, "server_errors", tags); n != 1 {
+		t.Errorf("server_errors rejected %d, want 1", n)
+	}
+	if !strings.Contains(logs.String(), "request rejected by http server") {
+		t.Errorf("rejection not logged:\n%s", logs)
+	}
+	if up.received() != 0 {
+		t.Errorf("upstream received %d requests", up.received())
+	}
+
+	// a well formed request is not counted
+	if resp, body := ts.do(t, ts.request(t, http.MethodGet, "/logs/_search", "")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("response %d %s", resp.StatusCode, body)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := counterValue(ts.metrics, "server_errors", tags); n != 1 {
+		t.Errorf("server_errors rejected %d after a served request, want 1", n)
+	}
+}
+
+func TestServerErrorLog(t *testing.T) {
+	ts := newTestServer(t, testConfig(t, nil, "destination:\n  host: localhost\n"))
+	logs := captureLog(t)
+
+	ts.srv.ErrorLog.Printf("http: TLS handshake error from 10.0.0.1:1234: EOF")
+
+	if n := counterValue(ts.metrics, "server_errors", trapmetrics.Tags{{Category: "reason", Value: "error_log"}}); n != 1 {
+		t.Errorf("server_errors error_log %d, want 1", n)
+	}
+	if !strings.Contains(logs.String(), `"message":"http: TLS handshake error from 10.0.0.1:1234: EOF"`) {
+		t.Errorf("error not logged:\n%s", logs)
+	}
+}
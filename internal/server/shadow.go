@@ -0,0 +1,108 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/circonus-labs/go-trapmetrics"
+	"github.com/circonus/c3-exporter/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// shadowMaxInFlight bounds the copies being sent to the shadow at once,
+	// copies beyond it are dropped (shadow_dropped) rather than queued
+	shadowMaxInFlight = 64
+	shadowTimeout     = 60 * time.Second
+)
+
+// shadowForwarder sends copies of _bulk writes to a shadow destination (e.g.
+// a cluster being migrated to) in the background. It is best-effort, copies
+// are not retried and the client gets the destination's response regardless
+// of the shadow's.
+type shadowForwarder struct {
+	client *http.Client
+	ep     *config.Endpoint
+	tm     *trapmetrics.TrapMetrics
+	sem    chan struct{}
+}
+
+func newShadowForwarder(ep *config.Endpoint, clients *destClients, tm *trapmetrics.TrapMetrics) *shadowForwarder {
+	if ep == nil {
+		return nil
+	}
+	return &shadowForwarder{
+		client: clients.newClient(ep.TLSConfig, true),
+		ep:     ep,
+		tm:     tm,
+		sem:    make(chan struct{}, shadowMaxInFlight),
+	}
+}
+
+// mirror sends a copy of req, as prepared for the destination, with body to
+// the shadow. It does not wait for the shadow, nil sends nothing.
+func (s *shadowForwarder) mirror(req *http.Request, body []byte, reqID, pathTag string) {
+	if s == nil {
+		return
+	}
+	tags := trapmetrics.Tags{{Category: "path", Value: pathTag}}
+	select {
+	case s.sem <- struct{}{}:
+	default:
+		_ = s.tm.CounterIncrement("shadow_dropped", tags)
+		return
+	}
+
+	u := *req.URL
+	u.Scheme = "http"
+	if s.ep.EnableTLS {
+		u.Scheme = "https"
+	}
+	u.Host = net.JoinHostPort(s.ep.Host, s.ep.Port)
+	host := req.Host
+	if host == req.URL.Host {
+		host = u.Host
+	}
+	header := req.Header.Clone()
+
+	go func() {
+		defer func() { <-s.sem }()
+		l := log.With().Str("req_id", reqID).Str("shadow", s.ep.Name).Logger()
+
+		// not tied to the client request, which may complete first
+		ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+		defer cancel()
+		shadowReq, err := http.NewRequestWithContext(ctx, req.Method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			l.Debug().Err(err).Msg("creating shadow request")
+			_ = s.tm.CounterIncrement("shadow_failure", tags)
+			return
+		}
+		shadowReq.Header = header
+		shadowReq.Host = host
+
+		resp, err := s.client.Do(shadowReq)
+		if err != nil {
+			l.Debug().Err(err).Msg("shadow request failed")
+			_ = s.tm.CounterIncrement("shadow_failure", tags)
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			l.Debug().Int("status_code", resp.StatusCode).Msg("shadow request non-2xx response")
+			_ = s.tm.CounterIncrement("shadow_failure", tags)
+			return
+		}
+		_ = s.tm.CounterIncrement("shadow_success", tags)
+	}()
+}
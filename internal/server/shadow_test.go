@@ -0,0 +1,59 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShadow(t *testing.T) {
+	primary := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"errors":false,"items":[]}`))
+	})
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock()
+	shadow := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.Error(w, `{"error":"shadow"}`, http.StatusServiceUnavailable)
+	})
+	ts := newTestServer(t, testConfig(t, primary.Server, "destination:\n  shadow:\n"+endpointYAML(t, shadow.Server, "    ")))
+
+	// the client gets the primary's response w/o waiting for the shadow
+	doc := `{"index":{}}` + "\n" + `{"message":"mirrored"}` + "\n"
+	resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc))
+	if resp.StatusCode != http.StatusOK || string(body) != `{"errors":false,"items":[]}` {
+		t.Fatalf("response %d %s, want the primary's", resp.StatusCode, body)
+	}
+	if _, got := primary.last(t); got != doc {
+		t.Errorf("primary body %q, want %q", got, doc)
+	}
+	unblock()
+
+	tags := pathTags("/_bulk")
+	deadline := time.Now().Add(5 * time.Second)
+	for counterValue(ts.metrics, "shadow_failure", tags) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("shadow received %d requests, shadow_failure not counted", shadow.received())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r, got := shadow.last(t)
+	if got != doc {
+		t.Errorf("shadow body %q, want %q", got, doc)
+	}
+	if user, pass, _ := r.BasicAuth(); user != testAccount || pass != testToken {
+		t.Errorf("shadow credentials %q/%q, want %q/%q", user, pass, testAccount, testToken)
+	}
+	if primary.received() != 1 || shadow.received() != 1 {
+		t.Errorf("primary received %d, shadow %d requests, want 1 each", primary.received(), shadow.received())
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/circonus/c3-exporter/internal/config"
+)
+
+// sigV4Headers are the request headers covered by the signature (in addition
+// to the host and content length).
+var sigV4Headers = []string{"Content-Type", "Content-Encoding", "X-Amz-Content-Sha256"}
+
+// sigV4Signer signs requests forwarded to AWS managed OpenSearch. Signing is
+// done by the destination transports, so each attempt (retries, failover)
+// is signed for the host and body actually sent.
+type sigV4Signer struct {
+	signer  *v4.Signer
+	creds   func(context.Context) (aws.Credentials, error)
+	region  string
+	service string
+}
+
+func newSigV4Signer(cfg *config.AWSSigV4) *sigV4Signer {
+	if cfg == nil {
+		return nil
+	}
+	s := &sigV4Signer{
+		signer:  v4.NewSigner(),
+		region:  cfg.Region,
+		service: cfg.Service,
+	}
+	if cfg.Credentials == "static" {
+		creds := aws.Credentials{
+			AccessKeyID:     cfg.AccessKeyID,
+			SecretAccessKey: cfg.SecretAccessKey,
+			SessionToken:    cfg.SessionToken,
+			Source:          "config",
+		}
+		s.creds = func(context.Context) (aws.Credentials, error) { return creds, nil }
+	} else {
+		s.creds = envCredentials
+	}
+	return s
+}
+
+// envCredentials reads the credentials from the environment for each request,
+// so rotated (e.g. injected session) credentials are picked up.
+func envCredentials(context.Context) (aws.Credentials, error) {
+	creds := aws.Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Source:          "environment",
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return aws.Credentials{}, fmt.Errorf("aws credentials, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY not set")
+	}
+	return creds, nil
+}
+
+// transport wraps next, signing each request, nil signs nothing.
+func (s *sigV4Signer) transport(next http.RoundTripper) http.RoundTripper {
+	if s == nil {
+		return next
+	}
+	return sigV4Transport{next: next, signer: s}
+}
+
+type sigV4Transport struct {
+	next   http.RoundTripper
+	signer *sigV4Signer
+}
+
+func (t sigV4Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	req := r.Clone(r.Context())
+
+	// the signature covers the (compressed) body as sent
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		data, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading body to sign: %w", err)
+		}
+		body = data
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+
+	creds, err := t.signer.creds(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	// only headers which are not changed on the way (e.g. hop-by-hop,
+	// X-Forwarded-For appended to by load balancers) are signed, the
+	// signature replaces basic auth
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signed := req.Clone(req.Context())
+	signed.Header = make(http.Header)
+	for _, name := range sigV4Headers {
+		if v := req.Header.Values(name); len(v) > 0 {
+			signed.Header[name] = v
+		}
+	}
+	if err := t.signer.signer.SignHTTP(req.Context(), creds, signed, payloadHash, t.signer.service, t.signer.region, time.Now()); err != nil {
+		return nil, fmt.Errorf("signing request: %w", err)
+	}
+	for _, name := range []string{"Authorization", "X-Amz-Date", "X-Amz-Security-Token"} {
+		req.Header.Del(name)
+		if v := signed.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// CloseIdleConnections lets the client close the wrapped transport's idle
+// connections.
+func (t sigV4Transport) CloseIdleConnections() {
+	if ci, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+func TestSigV4Signed(t *testing.T) {
+	var (
+		got     *http.Request
+		gotBody []byte
+		mu      sync.Mutex
+	)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got, gotBody = r.Clone(context.Background()), body
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer up.Close()
+
+	for _, enabled := range []bool{true, false} {
+		doc := ""
+		if enabled {
+			doc = `destination:
+  aws_sigv4:
+    region: us-east-1
+    credentials: static
+    access_key_id: AKIDEXAMPLE
+    secret_access_key: secret
+    session_token: session
+`
+		}
+		ts := newTestServer(t, testConfig(t, up, doc))
+		resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", `{"index":{}}`+"\n{}\n"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("sigv4 %v: response %d %s", enabled, resp.StatusCode, body)
+		}
+
+		mu.Lock()
+		r, rawBody := got, gotBody
+		mu.Unlock()
+		if !enabled {
+			if r.Header.Get("X-Amz-Date") != "" || strings.HasPrefix(r.Header.Get("Authorization"), "AWS4") {
+				t.Errorf("sigv4 disabled: request signed: %v", r.Header)
+			}
+			if user, _, ok := r.BasicAuth(); !ok || user != testAccount {
+				t.Errorf("sigv4 disabled: basic auth not forwarded: %v", r.Header)
+			}
+			continue
+		}
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/us-east-1/es/aws4_request") {
+			t.Fatalf("authorization %q, want a sigv4 signature", auth)
+		}
+		if r.Header.Get("X-Amz-Security-Token") != "session" {
+			t.Errorf("security token %q", r.Header.Get("X-Amz-Security-Token"))
+		}
+		sum := sha256.Sum256(rawBody)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			t.Errorf("content sha256 %s, not the body as sent", r.Header.Get("X-Amz-Content-Sha256"))
+		}
+
+		// the signature is valid for the request as received
+		date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+		if err != nil {
+			t.Fatalf("x-amz-date: %s", err)
+		}
+		check, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), bytes.NewReader(rawBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range sigV4Headers {
+			if v := r.Header.Values(name); len(v) > 0 {
+				check.Header[name] = v
+			}
+		}
+		creds := aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", SessionToken: "session"}
+		if err := v4.NewSigner().SignHTTP(context.Background(), creds, check, hex.EncodeToString(sum[:]), "es", "us-east-1", date); err != nil {
+			t.Fatal(err)
+		}
+		if want := check.Header.Get("Authorization"); auth != want {
+			t.Errorf("signature\n%s\nwant\n%s", auth, want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/circonus-labs/go-trapmetrics"
+	"github.com/circonus/c3-exporter/internal/release"
+	"github.com/circonus/c3-exporter/internal/spool"
+	"github.com/rs/zerolog/log"
+)
+
+// sendSpooled re-sends a spooled request to the destination. Upstream
+// server errors leave the entry in the spool, other non-200 responses
+// are logged and the entry is dropped as re-sending will not help. Entries
+// rejected as unauthorized (401, 403) are counted as spool_auth_rejected.
+func (s *Server) sendSpooled(ctx context.Context, e *spool.Entry, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, backgroundTimeout)
+	defer cancel()
+
+	req, err := s.entryRequest(ctx, e, body)
+	if err != nil {
+		return fmt.Errorf("creating spooled request: %w", err)
+	}
+
+	client, closeIdle := s.clients.forEndpoint(s.cfg.Destination.WriteDestination)
+	defer closeIdle()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending spooled request: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	tags := trapmetrics.Tags{{Category: "path", Value: s.paths.tag(e.Path)}}
+
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("sending spooled request: %s", resp.Status)
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		// spooled entries have no password, a destination which checks it
+		// rejects them however often they are re-sent
+		log.Warn().
+			Str("path", e.Path).
+			Str("username", e.Username).
+			Str("created", e.Created.String()).
+			Int("status_code", resp.StatusCode).
+			Msg("spooled request rejected by destination, not authorized w/o the client's password, dropping")
+		_ = s.metrics.CounterIncrement("spool_auth_rejected", tags)
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Warn().
+			Str("path", e.Path).
+			Str("created", e.Created.String()).
+			Int("status_code", resp.StatusCode).
+			Msg("spooled request rejected by destination, dropping")
+		_ = s.metrics.CounterIncrement("spool_rejected", tags)
+		recordRejected(s.metrics, s.paths.tag(e.Path), resp)
+		return nil
+	}
+
+	_ = s.metrics.CounterIncrement("spool_sent", tags)
+
+	return nil
+}
+
+// entryRequest creates a request to the destination for a body which was
+// not forwarded when it was received (spooled or queued). Spooled entries
+// have no password, they are sent as the account with the exporter's own
+// credentials (auth token, sigv4).
+func (s *Server) entryRequest(ctx context.Context, e *spool.Entry, body []byte) (*http.Request, error) {
+	dest := s.cfg.Destination
+
+	destURL := destinationURL(&dest, dest.WriteDestination)
+	destURL.Path = dest.TenantPrefixes[requestAccount(e.Username, s.cfg.Circonus.DefaultAccount)] + e.Path
+	setQueryParams(&destURL, dest.QueryParams)
+
+	ctx = traceConns(ctx, s.metrics, s.paths.tag(e.Path), nil)
+	req, err := http.NewRequestWithContext(ctx, e.Method, destURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Username != "" || e.Password != "" {
+		req.SetBasicAuth(e.Username, e.Password)
+	}
+	req.Header.Set("X-Circonus-Auth-Token", s.cfg.Circonus.APIKey)
+	req.Header.Set("Content-Type", e.ContentType)
+	encoding := e.Encoding
+	if encoding == "" {
+		encoding = "gzip" // spooled before the encoding was recorded
+	}
+	setContentEncoding(req.Header, encoding, len(body))
+	if s.clients.forceClose {
+		req.Header.Set("Connection", "close")
+	}
+	req.Header.Set("User-Agent", release.NAME+"/"+release.Version)
+	req.Header.Set("X-Forwarded-For", e.Remote)
+	if s.cfg.Destination.AddForwardedHeaders {
+		setForwardedHeaders(req.Header, e.Proto, e.Host)
+	}
+	setHeaders(req.Header, s.cfg.Destination.CompatHeaders.Request)
+	if s.cfg.Destination.PreserveHost && e.Host != "" {
+		req.Host = e.Host
+	}
+
+	return req, nil
+}
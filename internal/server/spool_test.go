@@ -0,0 +1,148 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBulkSpooledUntilUpstreamRecovers(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"errors":false}`))
+	})
+	dir := t.TempDir()
+	cfg := testConfig(t, up.Server, `
+server:
+  spool:
+    enabled: true
+    dir: `+dir+`
+destination:
+  bulk_retry:
+    max: 0
+    wait_min: "1ms"
+    wait_max: "1ms"
+`)
+	ts := newTestServer(t, cfg)
+
+	doc := `{"index":{}}` + "\n" + `{"message":"spooled"}` + "\n"
+	resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc))
+	if resp.StatusCode != http.StatusAccepted || string(body) != `{"spooled":true}` {
+		t.Fatalf("response %d %s, want 202 spooled", resp.StatusCode, body)
+	}
+	if n := counterValue(ts.metrics, "spooled", pathTags("/_bulk")); n != 1 {
+		t.Errorf("spooled %d, want 1", n)
+	}
+
+	// the client's password is not written to disk
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("spool files %v (%v)", files, err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), testToken) {
+			t.Errorf("password written to spool file %s", file)
+		}
+	}
+
+	// still down, the entry stays
+	if n, err := ts.spool.Drain(context.Background()); err == nil || n != 0 {
+		t.Fatalf("drain while down: sent %d, err %v", n, err)
+	}
+
+	down.Store(false)
+	received := up.received()
+	if n, err := ts.spool.Drain(context.Background()); err != nil || n != 1 {
+		t.Fatalf("drain: sent %d, err %v", n, err)
+	}
+	if up.received() != received+1 {
+		t.Fatalf("upstream received %d requests, want %d", up.received(), received+1)
+	}
+	req, got := up.last(t)
+	if got != doc {
+		t.Errorf("spooled body %q, want %q", got, doc)
+	}
+	user, pass, _ := req.BasicAuth()
+	if user != testAccount || pass != "" {
+		t.Errorf("spooled request sent as %q/%q, want the account w/o a password", user, pass)
+	}
+	if req.Header.Get("X-Circonus-Auth-Token") != testToken {
+		t.Errorf("spooled request auth token %q", req.Header.Get("X-Circonus-Auth-Token"))
+	}
+	if n := counterValue(ts.metrics, "spool_sent", pathTags("/_bulk")); n != 1 {
+		t.Errorf("spool_sent %d, want 1", n)
+	}
+	if ts.spool.Size() != 0 {
+		t.Errorf("spool size %d after drain, want 0", ts.spool.Size())
+	}
+}
+
+func TestSpooledAuthRejected(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if _, pass, _ := r.BasicAuth(); pass == "" {
+			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"errors":false}`))
+	})
+	cfg := testConfig(t, up.Server, `
+server:
+  spool:
+    enabled: true
+    dir: `+t.TempDir()+`
+destination:
+  bulk_retry:
+    max: 0
+    wait_min: "1ms"
+    wait_max: "1ms"
+`)
+	ts := newTestServer(t, cfg)
+	logs := captureLog(t)
+
+	doc := `{"index":{}}` + "\n" + `{"message":"spooled"}` + "\n"
+	if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc)); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("response %d %s, want 202 spooled", resp.StatusCode, body)
+	}
+
+	// re-sent w/o the password, rejected and dropped rather than re-sent
+	down.Store(false)
+	if _, err := ts.spool.Drain(context.Background()); err != nil {
+		t.Fatalf("drain: %s", err)
+	}
+	if ts.spool.Size() != 0 {
+		t.Errorf("spool size %d after drain, want 0", ts.spool.Size())
+	}
+	if n := counterValue(ts.metrics, "spool_auth_rejected", pathTags("/_bulk")); n != 1 {
+		t.Errorf("spool_auth_rejected %d, want 1", n)
+	}
+	if n := counterValue(ts.metrics, "spool_sent", pathTags("/_bulk")); n != 0 {
+		t.Errorf("spool_sent %d, want 0", n)
+	}
+	if !strings.Contains(logs.String(), "not authorized w/o the client's password") {
+		t.Errorf("rejection not logged:\n%s", logs)
+	}
+}
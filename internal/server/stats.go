@@ -0,0 +1,116 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/circonus-labs/go-trapmetrics"
+)
+
+// serverStats are in-process counters, since start, served by /stats.
+type serverStats struct {
+	requests       atomic.Uint64
+	bytesIn        atomic.Uint64
+	bytesOut       atomic.Uint64
+	upstreamErrors atomic.Uint64
+	retries        atomic.Uint64
+	flushes        atomic.Uint64
+	flushFailures  atomic.Uint64
+	flushBytes     atomic.Uint64
+	flushSkipped   atomic.Uint64
+	lastFlushError atomic.Pointer[flushError]
+	lastMetrics    atomic.Pointer[flushedMetrics]
+}
+
+// flushError is the last error flushing metrics to circonus.
+type flushError struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// flushedMetrics are the metrics (httptrap json) sent with the last flush,
+// metrics are reset when flushed so the last flush is what can be shown.
+type flushedMetrics struct {
+	Time    time.Time       `json:"time"`
+	Metrics json.RawMessage `json:"metrics"`
+}
+
+// recordFlush counts a flush of a metrics set, a flush failed when it returned
+// an error or the broker reported one, and reports whether it failed.
+func (s *serverStats) recordFlush(r *trapmetrics.Result, err error) bool {
+	s.flushes.Add(1)
+	if r != nil {
+		s.flushBytes.Add(uint64(r.BytesSent))
+	}
+	switch {
+	case err != nil:
+	case r == nil:
+		err = fmt.Errorf("no flush result")
+	case r.Error == "none", r.Error == "no metrics to send":
+		// submitted, or nothing recorded to submit
+		return false
+	case r.Error != "":
+		err = fmt.Errorf("%s", r.Error)
+	default:
+		return false
+	}
+	s.flushFailures.Add(1)
+	s.lastFlushError.Store(&flushError{Error: err.Error(), Time: time.Now()})
+	return true
+}
+
+type statsResponse struct {
+	Uptime         string      `json:"uptime"`
+	UptimeSeconds  float64     `json:"uptime_seconds"`
+	Requests       uint64      `json:"requests"`
+	BytesIn        uint64      `json:"bytes_in"`
+	BytesOut       uint64      `json:"bytes_out"`
+	UpstreamErrors uint64      `json:"upstream_errors"`
+	Retries        uint64      `json:"retries"`
+	Flushes        uint64      `json:"flushes"`
+	FlushFailures  uint64      `json:"flush_failures"`
+	FlushBytes     uint64      `json:"flush_bytes"`
+	FlushSkipped   uint64      `json:"flush_skipped"`
+	LastFlushError *flushError `json:"last_flush_error,omitempty"`
+}
+
+type statsHandler struct {
+	s *Server
+}
+
+func (h statsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, h.s.metrics, h.s.paths)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(h.s.stats.response(h.s.started))
+}
+
+// response returns the stats since started.
+func (s *serverStats) response(started time.Time) statsResponse {
+	uptime := time.Since(started)
+	return statsResponse{
+		Uptime:         uptime.Round(time.Second).String(),
+		UptimeSeconds:  uptime.Seconds(),
+		Requests:       s.requests.Load(),
+		BytesIn:        s.bytesIn.Load(),
+		BytesOut:       s.bytesOut.Load(),
+		UpstreamErrors: s.upstreamErrors.Load(),
+		Retries:        s.retries.Load(),
+		Flushes:        s.flushes.Load(),
+		FlushFailures:  s.flushFailures.Load(),
+		FlushBytes:     s.flushBytes.Load(),
+		FlushSkipped:   s.flushSkipped.Load(),
+		LastFlushError: s.lastFlushError.Load(),
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/circonus-labs/go-trapmetrics"
+)
+
+func TestRecordFlush(t *testing.T) {
+	tests := []struct {
+		result *trapmetrics.Result
+		err    error
+		name   string
+		failed bool
+	}{
+		{name: "success", result: &trapmetrics.Result{Error: "none", BytesSent: 10}},
+		{name: "no error reported", result: &trapmetrics.Result{BytesSent: 10}},
+		{name: "nothing to send", result: &trapmetrics.Result{Error: "no metrics to send"}},
+		{name: "broker error", result: &trapmetrics.Result{Error: "bad metrics"}, failed: true},
+		{name: "flush error", err: errors.New("broker unreachable"), failed: true},
+		{name: "no result", failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := &serverStats{}
+			if failed := stats.recordFlush(tt.result, tt.err); failed != tt.failed {
+				t.Errorf("failed %t, want %t", failed, tt.failed)
+			}
+			if stats.flushes.Load() != 1 {
+				t.Errorf("flushes %d, want 1", stats.flushes.Load())
+			}
+			if tt.failed && (stats.flushFailures.Load() != 1 || stats.lastFlushError.Load() == nil) {
+				t.Error("failure not recorded")
+			}
+			if !tt.failed && (stats.flushFailures.Load() != 0 || stats.lastFlushError.Load() != nil) {
+				t.Errorf("success recorded as a failure: %v", stats.lastFlushError.Load())
+			}
+		})
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	up := newTestUpstream(t, nil)
+	ts := newTestServer(t, testConfig(t, up.Server, "server:\n  stats_endpoint: true\n"))
+
+	doc := `{"index":{}}` + "\n" + `{"message":"hello"}` + "\n"
+	for i := 0; i < 2; i++ {
+		if resp, body := ts.do(t, ts.request(t, http.MethodPost, "/_bulk", doc)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("response %d %s", resp.StatusCode, body)
+		}
+	}
+	ts.do(t, ts.request(t, http.MethodGet, "/logs/_search", ""))
+
+	req := ts.request(t, http.MethodGet, "/stats", "")
+	req.Header.Del("Authorization")
+	if resp, _ := ts.do(t, req); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("w/o credentials: response %d, want 401", resp.StatusCode)
+	}
+
+	resp, body := ts.do(t, ts.request(t, http.MethodGet, "/stats", ""))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("response %d %s", resp.StatusCode, body)
+	}
+	var stats statsResponse
+	if err := json.Unmarshal(body, &stats); err != nil {
+		t.Fatalf("decoding stats: %s\n%s", err, body)
+	}
+	// the stats requests are counted too
+	if stats.Requests != 5 {
+		t.Errorf("requests %d, want 5", stats.Requests)
+	}
+	if stats.BytesIn != uint64(2*len(doc)) {
+		t.Errorf("bytes_in %d, want %d", stats.BytesIn, 2*len(doc))
+	}
+	if stats.BytesOut == 0 || stats.UpstreamErrors != 0 || stats.Retries != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+	if up.received() != 3 {
+		t.Errorf("upstream received %d requests, want 3", up.received())
+	}
+}
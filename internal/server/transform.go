@@ -0,0 +1,100 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/circonus/c3-exporter/internal/config"
+)
+
+// responseTransformer rewrites the body of a successful response before it
+// is returned to the client, an error relays the response unchanged.
+type responseTransformer interface {
+	transform(body []byte) ([]byte, error)
+}
+
+type pathTransformer struct {
+	transformer responseTransformer
+	path        string
+}
+
+// responseTransforms are the transformers by path, the first matching the
+// request path is applied.
+type responseTransforms []pathTransformer
+
+func newResponseTransforms(cfg []config.ResponseTransform) responseTransforms {
+	var transforms responseTransforms
+	for _, t := range cfg {
+		transforms = append(transforms, pathTransformer{
+			path:        t.Path,
+			transformer: newFieldStripper(t.StripFields),
+		})
+	}
+	return transforms
+}
+
+// lookup returns the transformer for path, nil if there is none.
+func (t responseTransforms) lookup(path string) responseTransformer {
+	for _, pt := range t {
+		if matchPath([]string{pt.path}, path) {
+			return pt.transformer
+		}
+	}
+	return nil
+}
+
+// fieldStripper removes fields, dotted paths, from json responses, e.g. large
+// fields of search hits (hits.hits._source.events). Arrays along a path are
+// descended into, so the field is removed from each element.
+type fieldStripper [][]string
+
+func newFieldStripper(fields []string) fieldStripper {
+	f := make(fieldStripper, 0, len(fields))
+	for _, field := range fields {
+		f = append(f, strings.Split(field, "."))
+	}
+	return f
+}
+
+func (f fieldStripper) transform(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber() // numbers are relayed as-is, not as float64
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	for _, path := range f {
+		stripField(doc, path)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, fmt.Errorf("encoding response: %w", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func stripField(v interface{}, path []string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+			return
+		}
+		if child, ok := v[path[0]]; ok {
+			stripField(child, path[1:])
+		}
+	case []interface{}:
+		for _, e := range v {
+			stripField(e, path)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFieldStripper(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+		body   string
+		want   string
+	}{
+		{
+			name:   "nested in arrays",
+			fields: []string{"hits.hits._source.events"},
+			body:   `{"hits":{"hits":[{"_source":{"traceId":"a","events":[1]}},{"_source":{"traceId":"b"}}]}}`,
+			want:   `{"hits":{"hits":[{"_source":{"traceId":"a"}},{"_source":{"traceId":"b"}}]}}`,
+		},
+		{
+			name:   "top level, missing field",
+			fields: []string{"took", "aggregations.missing"},
+			body:   `{"took":5,"timed_out":false}`,
+			want:   `{"timed_out":false}`,
+		},
+		{
+			name:   "numbers and html kept as-is",
+			fields: []string{"x"},
+			body:   `{"n":12345678901234567890,"s":"<a&b>","x":1}`,
+			want:   `{"n":12345678901234567890,"s":"<a&b>"}`,
+		},
+	}
+	for _, tt := range tests {
+		got, err := newFieldStripper(tt.fields).transform([]byte(tt.body))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := newFieldStripper([]string{"x"}).transform([]byte("not json")); err == nil {
+		t.Error("invalid json transformed")
+	}
+}
+
+func TestResponseTransforms(t *testing.T) {
+	search := `{"took":3,"hits":{"hits":[{"_id":"1","_source":{"traceId":"t1","events":[{"name":"e"}]}}]}}`
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(search))
+	})
+	ts := newTestServer(t, testConfig(t, up.Server, `server:
+  response_transforms:
+    - path: /otel-v1-apm-span/_search
+      strip_fields: [hits.hits._source.events]
+`))
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodPost, "/otel-v1-apm-span/_search", `{"hits":{"hits":[{"_id":"1","_source":{"traceId":"t1"}}]},"took":3}`},
+		{http.MethodGet, "/logs/_search", search},
+	}
+	for _, tt := range tests {
+		resp, body := ts.do(t, ts.request(t, tt.method, tt.path, `{"query":{"match_all":{}}}`))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: response %d %s", tt.path, resp.StatusCode, body)
+		}
+		if string(body) != tt.want {
+			t.Errorf("%s: response %s, want %s", tt.path, body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+// Package spool persists request bodies which could not be forwarded so
+// they can be re-sent once the destination recovers.
+package spool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	metaExt = ".json"
+	bodyExt = ".gz"
+)
+
+// ErrFull is returned by Store when adding the entry would exceed the max size.
+var ErrFull = errors.New("spool full")
+
+// Entry is the metadata needed to re-send a spooled (compressed) body. The
+// client's password is never written to the spool, it is only kept for
+// entries held in memory (e.g. the async queue).
+type Entry struct {
+	Created     time.Time `json:"created"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	ContentType string    `json:"content_type"`
+	Username    string    `json:"username"`
+	Password    string    `json:"-"`
+	Remote      string    `json:"remote"`
+	Host        string    `json:"host,omitempty"`
+	Proto       string    `json:"proto,omitempty"`    // scheme the client used, http|https
+	Encoding    string    `json:"encoding,omitempty"` // content encoding of the body, empty is gzip
+}
+
+// SendFunc re-sends a spooled entry, an error leaves the entry in the spool.
+type SendFunc func(ctx context.Context, e *Entry, body []byte) error
+
+type Spooler struct {
+	send     SendFunc
+	dir      string
+	maxSize  int64
+	interval time.Duration
+	size     int64
+	mu       sync.Mutex
+}
+
+// New creates a spooler for dir, creating the directory if needed and
+// accounting for any entries already present.
+func New(dir string, maxSize int64, interval time.Duration, send SendFunc) (*Spooler, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("invalid spool dir (empty)")
+	}
+	if send == nil {
+		return nil, fmt.Errorf("invalid send func (nil)")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating spool dir: %w", err)
+	}
+
+	s := &Spooler{
+		send:     send,
+		dir:      dir,
+		maxSize:  maxSize,
+		interval: interval,
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading spool dir: %w", err)
+	}
+	for _, de := range entries {
+		if info, err := de.Info(); err == nil && info.Mode().IsRegular() {
+			s.size += info.Size()
+		}
+	}
+
+	return s, nil
+}
+
+// Store persists the entry and body. The body is written first so that the
+// presence of the metadata file indicates a complete entry.
+func (s *Spooler) Store(e Entry, body []byte) error {
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding spool entry: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	need := int64(len(meta) + len(body))
+	if s.maxSize > 0 && s.size+need > s.maxSize {
+		return ErrFull
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + uuid.NewString()
+	bodyFile := filepath.Join(s.dir, id+bodyExt)
+	if err := os.WriteFile(bodyFile, body, 0o600); err != nil {
+		return fmt.Errorf("writing spool body: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(s.dir, id+metaExt), meta, 0o600); err != nil {
+		_ = os.Remove(bodyFile)
+		return fmt.Errorf("writing spool entry: %w", err)
+	}
+
+	s.size += need
+
+	return nil
+}
+
+// Size returns the current size, in bytes, of the spool.
+func (s *Spooler) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Run drains the spool every interval until the context is done.
+func (s *Spooler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sent, err := s.Drain(ctx)
+			if err != nil {
+				log.Warn().Err(err).Int("sent", sent).Msg("draining spool")
+			} else if sent > 0 {
+				log.Info().Int("sent", sent).Msg("drained spool")
+			}
+		}
+	}
+}
+
+// Drain re-sends spooled entries, oldest first, stopping at the first
+// failure (the destination is likely still unavailable). Returns the
+// number of entries sent.
+func (s *Spooler) Drain(ctx context.Context) (int, error) {
+	ids, err := s.list()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+
+		e, body, err := s.load(id)
+		if err != nil {
+			log.Warn().Err(err).Str("id", id).Msg("removing unreadable spool entry")
+			s.remove(id)
+			continue
+		}
+
+		if err := s.send(ctx, e, body); err != nil {
+			return sent, err
+		}
+
+		s.remove(id)
+		sent++
+	}
+
+	return sent, nil
+}
+
+// list returns the ids of complete entries, oldest first.
+func (s *Spooler) list() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading spool dir: %w", err)
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, de := range entries {
+		if name := de.Name(); strings.HasSuffix(name, metaExt) {
+			ids = append(ids, strings.TrimSuffix(name, metaExt))
+		}
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (s *Spooler) load(id string) (*Entry, []byte, error) {
+	meta, err := os.ReadFile(filepath.Join(s.dir, id+metaExt))
+	if err != nil {
+		return nil, nil, err
+	}
+	var e Entry
+	if err := json.Unmarshal(meta, &e); err != nil {
+		return nil, nil, err
+	}
+
+	body, err := os.ReadFile(filepath.Join(s.dir, id+bodyExt))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &e, body, nil
+}
+
+func (s *Spooler) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ext := range []string{metaExt, bodyExt} {
+		fn := filepath.Join(s.dir, id+ext)
+		if info, err := os.Stat(fn); err == nil {
+			s.size -= info.Size()
+		}
+		if err := os.Remove(fn); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn().Err(err).Str("file", fn).Msg("removing spool file")
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright © 2022 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package spool
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreDrain(t *testing.T) {
+	dir := t.TempDir()
+	var sent []string
+	failing := true
+	s, err := New(dir, 0, time.Hour, func(_ context.Context, e *Entry, body []byte) error {
+		if failing {
+			return errors.New("destination unavailable")
+		}
+		sent = append(sent, e.Path+" "+string(body))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+
+	for _, path := range []string{"/_bulk", "/otel-v1-apm-span/_bulk"} {
+		if err := s.Store(Entry{Created: time.Now(), Method: "POST", Path: path, Username: "acct", Password: "secret"}, []byte("body")); err != nil {
+			t.Fatalf("store: %s", err)
+		}
+	}
+	if s.Size() == 0 {
+		t.Error("size not updated on store")
+	}
+
+	// failures leave the entries in the spool
+	n, err := s.Drain(context.Background())
+	if err == nil || n != 0 {
+		t.Fatalf("drain with failing send: sent %d, err %v", n, err)
+	}
+	if ids, _ := s.list(); len(ids) != 2 {
+		t.Fatalf("%d entries left after failed drain, want 2", len(ids))
+	}
+
+	// recovered, entries are sent oldest first and removed
+	failing = false
+	n, err = s.Drain(context.Background())
+	if err != nil || n != 2 {
+		t.Fatalf("drain: sent %d, err %v", n, err)
+	}
+	want := []string{"/_bulk body", "/otel-v1-apm-span/_bulk body"}
+	if strings.Join(sent, ",") != strings.Join(want, ",") {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+	if s.Size() != 0 {
+		t.Errorf("size %d after drain, want 0", s.Size())
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d files left after drain", len(files))
+	}
+}
+
+func TestStoreOmitsPassword(t *testing.T) {
+	dir := t.TempDir()
+	var got *Entry
+	s, err := New(dir, 0, time.Hour, func(_ context.Context, e *Entry, _ []byte) error {
+		got = e
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	if err := s.Store(Entry{Method: "POST", Path: "/_bulk", Username: "acct", Password: "s3cr3t"}, []byte("body")); err != nil {
+		t.Fatalf("store: %s", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+metaExt))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("spool entries %v (%v)", files, err)
+	}
+	meta, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(meta), "s3cr3t") || strings.Contains(string(meta), "password") {
+		t.Errorf("password written to the spool: %s", meta)
+	}
+
+	if _, err := s.Drain(context.Background()); err != nil {
+		t.Fatalf("drain: %s", err)
+	}
+	if got == nil || got.Username != "acct" || got.Password != "" {
+		t.Errorf("spooled entry %+v, want the username w/o a password", got)
+	}
+}
+
+func TestStoreFull(t *testing.T) {
+	s, err := New(t.TempDir(), 1024, time.Hour, func(context.Context, *Entry, []byte) error { return nil })
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	if err := s.Store(Entry{Path: "/_bulk"}, make([]byte, 10)); err != nil {
+		t.Fatalf("store: %s", err)
+	}
+	if err := s.Store(Entry{Path: "/_bulk"}, make([]byte, 1024)); !errors.Is(err, ErrFull) {
+		t.Errorf("store over max size: %v, want ErrFull", err)
+	}
+}
+
+func TestNewAccountsExisting(t *testing.T) {
+	dir := t.TempDir()
+	send := func(context.Context, *Entry, []byte) error { return nil }
+	s, err := New(dir, 0, time.Hour, send)
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	if err := s.Store(Entry{Path: "/_bulk"}, []byte("body")); err != nil {
+		t.Fatalf("store: %s", err)
+	}
+
+	// e.g. after a restart, the entries already spooled count
+	s2, err := New(dir, 0, time.Hour, send)
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	if s2.Size() != s.Size() {
+		t.Errorf("size %d, want %d", s2.Size(), s.Size())
+	}
+	if n, err := s2.Drain(context.Background()); err != nil || n != 1 {
+		t.Errorf("drain: sent %d, err %v", n, err)
+	}
+}